@@ -0,0 +1,379 @@
+//go:build !wasip1
+
+package main
+
+/*
+#include <stdint.h>
+
+// Layout descriptor, version 1. The caller allocates the descriptor, the
+// column buffers and the error buffer; Go only writes into them.
+typedef struct {
+	uint32_t version;
+	uint32_t header_size;    // sizeof(gaia_layout)
+	uint32_t column_size;    // sizeof(gaia_column)
+	uint32_t column_count;
+	uint32_t capacity;       // rows each column buffer holds
+	uint32_t rows;           // set by gaia_reader_next
+	uint32_t error_capacity;
+	uint32_t reserved;
+	char* error;             // NUL-terminated message on failure
+	uint64_t reserved2;
+	// followed by column_count gaia_column entries
+} gaia_layout;
+
+typedef struct {
+	uint32_t kind;           // 1 = float64, 2 = int64
+	uint32_t reserved;
+	void* values;            // capacity * 8 bytes
+	uint8_t* nulls;          // (capacity + 7) / 8 bytes, bit set = null
+	uint64_t reserved2;
+} gaia_column;
+*/
+import "C"
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// Bump whenever gaia_layout or gaia_column change.
+const layoutVersion = 1
+
+// Column kinds in gaia_column.kind.
+const (
+	kindFloat64 = 1
+	kindInt64   = 2
+)
+
+// Integer columns; other numeric columns are Float64.
+var integerColumns = map[string]bool{
+	"source_id":   true,
+	"solution_id": true,
+}
+
+// batchReader reads a Gaia CSV straight into the caller's buffers.
+type batchReader struct {
+	mu      sync.Mutex
+	file    *os.File
+	gz      *gzip.Reader
+	lines   *bufio.Reader
+	layout  *C.gaia_layout
+	columns []C.gaia_column
+	indices []int
+	fields  [][]byte
+	buffer  []byte
+	line    int
+}
+
+var (
+	batchReadersMu sync.Mutex
+	batchReaders   = map[int64]*batchReader{}
+	nextBatchID    int64
+)
+
+// gaia_layout_version is the layout version this library was built for.
+//
+//export gaia_layout_version
+func gaia_layout_version() C.uint32_t {
+	return layoutVersion
+}
+
+// gaia_reader_open checks the layout, opens a gzipped or plain Gaia CSV and
+// reads its header. It returns a handle, or -1 with the error written to
+// the layout's error buffer.
+//
+// The layout and every buffer it points to must stay allocated and
+// unmoved until gaia_reader_close. Go never frees or keeps them after
+// that.
+//
+//export gaia_reader_open
+func gaia_reader_open(path, columnsJSON *C.char, layout *C.gaia_layout) C.int64_t {
+	if layout == nil {
+		return -1
+	}
+
+	reader, err := openBatchReader(C.GoString(path), C.GoString(columnsJSON), layout)
+	if err != nil {
+		writeError(layout, err)
+		return -1
+	}
+
+	batchReadersMu.Lock()
+	defer batchReadersMu.Unlock()
+	nextBatchID++
+	batchReaders[nextBatchID] = reader
+	return C.int64_t(nextBatchID)
+}
+
+// gaia_reader_next fills the column buffers with up to capacity rows and
+// sets layout.rows. It returns the row count, 0 at the end of the file or
+// -1 with the error in the layout's error buffer.
+//
+// The caller must not touch the buffers while this runs. The first rows
+// values of each buffer are then valid until the next call.
+//
+//export gaia_reader_next
+func gaia_reader_next(handle C.int64_t) C.int32_t {
+	batchReadersMu.Lock()
+	reader, ok := batchReaders[int64(handle)]
+	batchReadersMu.Unlock()
+	if !ok {
+		return -1
+	}
+
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+
+	rows, err := reader.next()
+	reader.layout.rows = C.uint32_t(rows)
+	if err != nil {
+		writeError(reader.layout, err)
+		return -1
+	}
+	return C.int32_t(rows)
+}
+
+// gaia_reader_close closes the file. The caller's buffers may be freed
+// once it returns.
+//
+//export gaia_reader_close
+func gaia_reader_close(handle C.int64_t) {
+	batchReadersMu.Lock()
+	reader, ok := batchReaders[int64(handle)]
+	delete(batchReaders, int64(handle))
+	batchReadersMu.Unlock()
+	if !ok {
+		return
+	}
+
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+	if reader.gz != nil {
+		reader.gz.Close()
+	}
+	reader.file.Close()
+}
+
+func openBatchReader(
+	path string,
+	columnsJSON string,
+	layout *C.gaia_layout,
+) (*batchReader, error) {
+	var names []string
+	if err := json.Unmarshal([]byte(columnsJSON), &names); err != nil {
+		return nil, fmt.Errorf("invalid columns: %w", err)
+	}
+
+	columns, err := checkLayout(layout, names)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &batchReader{file: file, layout: layout, columns: columns}
+	source := bufio.NewReaderSize(file, 1<<16)
+	if start, _ := source.Peek(2); len(start) == 2 &&
+		start[0] == 0x1f && start[1] == 0x8b {
+		if reader.gz, err = gzip.NewReader(source); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt gzip stream: %w", err)
+		}
+		reader.lines = bufio.NewReaderSize(reader.gz, 1<<20)
+	} else {
+		reader.lines = source
+	}
+
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			file.Close()
+			if errors.Is(err, io.EOF) {
+				err = errors.New("no header row")
+			}
+			return nil, err
+		}
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		reader.indices, err = columnIndices(splitFields(nil, line), names)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return reader, nil
+	}
+}
+
+// checkLayout makes sure the caller's descriptor is one this library
+// understands and matches the requested columns.
+func checkLayout(layout *C.gaia_layout, names []string) ([]C.gaia_column, error) {
+	if layout.version != layoutVersion {
+		return nil, fmt.Errorf(
+			"layout version %d is not supported (library uses %d)",
+			layout.version, layoutVersion,
+		)
+	}
+	if layout.header_size != C.sizeof_gaia_layout ||
+		layout.column_size != C.sizeof_gaia_column {
+		return nil, fmt.Errorf(
+			"layout sizes %d/%d do not match the library's %d/%d",
+			layout.header_size, layout.column_size,
+			C.sizeof_gaia_layout, C.sizeof_gaia_column,
+		)
+	}
+	if int(layout.column_count) != len(names) {
+		return nil, fmt.Errorf(
+			"layout has %d columns but %d were requested",
+			layout.column_count, len(names),
+		)
+	}
+	if layout.capacity == 0 {
+		return nil, errors.New("layout capacity is 0")
+	}
+
+	columns := unsafe.Slice(
+		(*C.gaia_column)(unsafe.Add(unsafe.Pointer(layout), C.sizeof_gaia_layout)),
+		len(names),
+	)
+	for i, name := range names {
+		want := C.uint32_t(kindFloat64)
+		if stringColumns[name] {
+			if !integerColumns[name] {
+				return nil, fmt.Errorf("text column %q is not supported", name)
+			}
+			want = kindInt64
+		}
+		if columns[i].kind != want {
+			return nil, fmt.Errorf(
+				"column %q has kind %d, expected %d", name, columns[i].kind, want,
+			)
+		}
+		if columns[i].values == nil || columns[i].nulls == nil {
+			return nil, fmt.Errorf("column %q has no buffers", name)
+		}
+	}
+	return columns, nil
+}
+
+func (r *batchReader) next() (int, error) {
+	capacity := int(r.layout.capacity)
+	rows := 0
+
+	for rows < capacity {
+		line, err := r.readLine()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return rows, err
+		}
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		r.fields = splitFields(r.fields[:0], line)
+		for i, index := range r.indices {
+			if index >= len(r.fields) {
+				return rows, fmt.Errorf("line %d: expected %d fields, got %d",
+					r.line, index+1, len(r.fields))
+			}
+			r.store(i, rows, r.fields[index])
+		}
+		rows++
+	}
+
+	return rows, nil
+}
+
+// store writes one value into the caller's buffers.
+func (r *batchReader) store(column, row int, value []byte) {
+	info := &r.columns[column]
+	null := isNull(value)
+
+	if info.kind == kindInt64 {
+		values := unsafe.Slice((*int64)(info.values), r.layout.capacity)
+		var number int64
+		if !null {
+			var err error
+			number, err = strconv.ParseInt(unsafe.String(&value[0], len(value)), 10, 64)
+			null = err != nil
+		}
+		values[row] = number
+	} else {
+		values := unsafe.Slice((*float64)(info.values), r.layout.capacity)
+		var number float64
+		if !null {
+			number, null = parseNumber(value)
+		}
+		values[row] = number
+	}
+
+	nulls := unsafe.Slice((*byte)(unsafe.Pointer(info.nulls)), (r.layout.capacity+7)/8)
+	if null {
+		nulls[row/8] |= 1 << (row % 8)
+	} else {
+		nulls[row/8] &^= 1 << (row % 8)
+	}
+}
+
+// readLine returns the next line without its line ending. Quoted fields
+// may span lines. The slice is only valid until the next call.
+func (r *batchReader) readLine() ([]byte, error) {
+	r.buffer = r.buffer[:0]
+	for {
+		chunk, err := r.lines.ReadSlice('\n')
+		partial := errors.Is(err, bufio.ErrBufferFull) ||
+			(errors.Is(err, io.EOF) && len(chunk)+len(r.buffer) > 0)
+		if err != nil && !partial {
+			if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("corrupt gzip stream: %w", err)
+			}
+			return nil, err
+		}
+
+		// Usually the whole line is in the reader's buffer and needs no copy
+		if err == nil && len(r.buffer) == 0 && !openQuote(chunk) {
+			r.line++
+			return trimLine(chunk), nil
+		}
+
+		r.buffer = append(r.buffer, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) || (err == nil && openQuote(r.buffer)) {
+			continue
+		}
+		r.line++
+		return trimLine(r.buffer), nil
+	}
+}
+
+// openQuote reports whether a quoted field continues past the line.
+func openQuote(line []byte) bool {
+	return bytes.Count(line, []byte{'"'})%2 == 1
+}
+
+func trimLine(line []byte) []byte {
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+}
+
+// writeError copies a message into the caller's error buffer.
+func writeError(layout *C.gaia_layout, err error) {
+	if layout.error == nil || layout.error_capacity == 0 {
+		return
+	}
+	buffer := unsafe.Slice((*byte)(unsafe.Pointer(layout.error)), layout.error_capacity)
+	n := copy(buffer[:len(buffer)-1], err.Error())
+	buffer[n] = 0
+}
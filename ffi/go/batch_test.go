@@ -0,0 +1,246 @@
+//go:build !wasip1
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// Offsets in gaia_layout and gaia_column, as src/ffi/go.ts writes them.
+const (
+	headerSize   = 48
+	columnSize   = 32
+	errorSize    = 256
+	offsetError  = 32
+	offsetValues = 8
+	offsetNulls  = 16
+)
+
+// testLayout is a layout descriptor and its buffers in Go memory.
+type testLayout struct {
+	memory []uint64
+	values [][]uint64
+	nulls  [][]byte
+	errors []byte
+}
+
+func newTestLayout(kinds []uint32, capacity int) *testLayout {
+	l := &testLayout{
+		memory: make([]uint64, (headerSize+columnSize*len(kinds))/8),
+		errors: make([]byte, errorSize),
+	}
+	base := unsafe.Pointer(&l.memory[0])
+	header := unsafe.Slice((*uint32)(base), 8)
+	copy(header, []uint32{layoutVersion, headerSize, columnSize, uint32(len(kinds)), uint32(capacity), 0, errorSize, 0})
+	*(*unsafe.Pointer)(unsafe.Add(base, offsetError)) = unsafe.Pointer(&l.errors[0])
+
+	for i, kind := range kinds {
+		column := unsafe.Add(base, headerSize+columnSize*i)
+		values := make([]uint64, capacity)
+		nulls := make([]byte, (capacity+7)/8)
+		l.values = append(l.values, values)
+		l.nulls = append(l.nulls, nulls)
+		*(*uint32)(column) = kind
+		*(*unsafe.Pointer)(unsafe.Add(column, offsetValues)) = unsafe.Pointer(&values[0])
+		*(*unsafe.Pointer)(unsafe.Add(column, offsetNulls)) = unsafe.Pointer(&nulls[0])
+	}
+	return l
+}
+
+// header returns the descriptor's uint32 fields for tests to change.
+func (l *testLayout) header() []uint32 {
+	return unsafe.Slice((*uint32)(unsafe.Pointer(&l.memory[0])), 8)
+}
+
+// open calls openBatchReader with the layout. The descriptor's C type is
+// inferred from openBatchReader, since a test file cannot import "C".
+func (l *testLayout) open(path string, columns []string) (*batchReader, error) {
+	names, _ := json.Marshal(columns)
+	return openWithLayout(openBatchReader, path, string(names), unsafe.Pointer(&l.memory[0]))
+}
+
+func openWithLayout[L any](
+	open func(string, string, *L) (*batchReader, error),
+	path, columns string,
+	layout unsafe.Pointer,
+) (*batchReader, error) {
+	return open(path, columns, (*L)(layout))
+}
+
+func (l *testLayout) float(column, row int) float64 {
+	return math.Float64frombits(l.values[column][row])
+}
+
+func (l *testLayout) null(column, row int) bool {
+	return l.nulls[column][row/8]&(1<<(row%8)) != 0
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// row is one row as the batch reader stores it: source_id, then ra,
+// has_xp_continuous and parallax with nil for null.
+type row struct {
+	id     int64
+	values [3]any
+}
+
+func readRows(t *testing.T, path string, capacity int) ([]row, []int) {
+	t.Helper()
+	layout := newTestLayout([]uint32{kindInt64, kindFloat64, kindFloat64, kindFloat64}, capacity)
+	reader, err := layout.open(path, []string{"source_id", "ra", "has_xp_continuous", "parallax"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.file.Close()
+
+	var rows []row
+	var sizes []int
+	for {
+		n, err := reader.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return rows, sizes
+		}
+		sizes = append(sizes, n)
+		for i := range n {
+			r := row{id: int64(layout.values[0][i])}
+			for column := 1; column < 4; column++ {
+				if !layout.null(column, i) {
+					r.values[column-1] = layout.float(column, i)
+				}
+			}
+			rows = append(rows, r)
+		}
+	}
+}
+
+func TestBatchReaderPlainAndGzip(t *testing.T) {
+	want := []row{
+		{1, [3]any{10.5, 1.0, 0.25}},
+		{2, [3]any{-0.5, 0.0, nil}},
+		{3, [3]any{0.001, 0.0, nil}},
+		{4, [3]any{359.99, 1.0, -1.5}},
+	}
+	for name, data := range map[string][]byte{
+		"sample.csv":    []byte(sample),
+		"sample.csv.gz": gzipped(t, sample),
+	} {
+		path := writeFile(t, name, data)
+		for _, capacity := range []int{1, 3, 4, 100} {
+			rows, sizes := readRows(t, path, capacity)
+			if !reflect.DeepEqual(rows, want) {
+				t.Errorf("%s, capacity %d: got %v, want %v", name, capacity, rows, want)
+			}
+			if len(sizes) != (4+capacity-1)/capacity {
+				t.Errorf("%s, capacity %d: got batches %v", name, capacity, sizes)
+			}
+		}
+	}
+}
+
+// A null in one batch must not leave its bit set for the next batch's row
+// in the same position.
+func TestBatchReaderClearsNulls(t *testing.T) {
+	path := writeFile(t, "nulls.csv", []byte("source_id,parallax\n1,\n2,3\n,4\n"))
+	layout := newTestLayout([]uint32{kindInt64, kindFloat64}, 1)
+	reader, err := layout.open(path, []string{"source_id", "parallax"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.file.Close()
+
+	var nulls [][2]bool
+	for {
+		n, err := reader.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		nulls = append(nulls, [2]bool{layout.null(0, 0), layout.null(1, 0)})
+	}
+	want := [][2]bool{{false, true}, {false, false}, {true, false}}
+	if !reflect.DeepEqual(nulls, want) {
+		t.Errorf("got nulls %v, want %v", nulls, want)
+	}
+}
+
+// Lines longer than the plain reader's 64 KiB buffer are put together
+// from several reads.
+func TestBatchReaderLongLine(t *testing.T) {
+	long := strings.Repeat("x", 100_000)
+	path := writeFile(t, "long.csv", []byte(
+		"source_id,designation,ra\n1,\""+long+"\n"+long+"\",5\n2,short,6\n",
+	))
+	layout := newTestLayout([]uint32{kindInt64, kindFloat64}, 10)
+	reader, err := layout.open(path, []string{"source_id", "ra"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.file.Close()
+
+	n, err := reader.next()
+	if err != nil || n != 2 {
+		t.Fatalf("got %d rows, %v", n, err)
+	}
+	if layout.float(1, 0) != 5 || layout.float(1, 1) != 6 {
+		t.Errorf("got ra %v, %v", layout.float(1, 0), layout.float(1, 1))
+	}
+}
+
+func TestBatchReaderErrors(t *testing.T) {
+	plain := writeFile(t, "sample.csv", []byte(sample))
+	corrupt := gzipped(t, sample)
+	corrupt[len(corrupt)-6] ^= 0xff
+
+	tests := []struct {
+		name    string
+		path    string
+		columns []string
+		kinds   []uint32
+		change  func(header []uint32)
+		want    string
+	}{
+		{"text column", plain, []string{"designation"}, []uint32{kindInt64}, nil, `text column "designation" is not supported`},
+		{"wrong kind", plain, []string{"source_id"}, []uint32{kindFloat64}, nil, `column "source_id" has kind 1, expected 2`},
+		{"old version", plain, []string{"ra"}, []uint32{kindFloat64}, func(h []uint32) { h[0] = 0 }, "layout version 0 is not supported"},
+		{"wrong size", plain, []string{"ra"}, []uint32{kindFloat64}, func(h []uint32) { h[1] = 40 }, "layout sizes 40/32"},
+		{"column count", plain, []string{"ra", "dec"}, []uint32{kindFloat64}, nil, "layout has 1 columns but 2 were requested"},
+		{"no capacity", plain, []string{"ra"}, []uint32{kindFloat64}, func(h []uint32) { h[4] = 0 }, "layout capacity is 0"},
+		{"missing column", plain, []string{"pmra"}, []uint32{kindFloat64}, nil, `column "pmra" is not in the file`},
+		{"no header", writeFile(t, "empty.csv", []byte("# nothing\n")), []string{"ra"}, []uint32{kindFloat64}, nil, "no header row"},
+		{"corrupt gzip", writeFile(t, "corrupt.csv.gz", corrupt), []string{"ra"}, []uint32{kindFloat64}, nil, "corrupt gzip stream"},
+		{"short row", writeFile(t, "short.csv", []byte("source_id,ra\n1,2\n3\n")), []string{"ra"}, []uint32{kindFloat64}, nil, "line 3: expected 2 fields, got 1"},
+	}
+	for _, test := range tests {
+		layout := newTestLayout(test.kinds, 10)
+		if test.change != nil {
+			test.change(layout.header())
+		}
+		reader, err := layout.open(test.path, test.columns)
+		if err == nil {
+			_, err = reader.next()
+			reader.file.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
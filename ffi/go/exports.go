@@ -0,0 +1,92 @@
+//go:build !wasip1
+
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"unsafe"
+)
+
+// ingest_file parses, filters and inserts one gzipped Gaia CSV file and
+// returns a JSON Summary. The string must be released with free_string.
+//
+//export ingest_file
+func ingest_file(dbPath, filePath, configJSON *C.char) *C.char {
+	var config Config
+	var summary Summary
+
+	err := json.Unmarshal([]byte(C.GoString(configJSON)), &config)
+	if err == nil {
+		summary, err = ingest(C.GoString(dbPath), C.GoString(filePath), config)
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	return jsonString(summary)
+}
+
+// ingest_xmatch_file inserts the links of one gzipped 2MASS best-neighbour
+// file and returns a JSON Summary. The string must be released with
+// free_string.
+//
+//export ingest_xmatch_file
+func ingest_xmatch_file(dbPath, filePath *C.char, batchSize C.int) *C.char {
+	summary, err := ingestXmatch(
+		C.GoString(dbPath),
+		C.GoString(filePath),
+		int(batchSize),
+	)
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	return jsonString(summary)
+}
+
+// query_json runs one read-only SQL statement, with the astronomy
+// functions registered, and returns a JSON QueryResult of up to maxRows
+// rows. The string must be released with free_string.
+//
+//export query_json
+func query_json(dbPath, query *C.char, maxRows C.int) *C.char {
+	result, err := runQuery(C.GoString(dbPath), C.GoString(query), int(maxRows))
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return jsonString(result)
+}
+
+// exec_sql runs statements that change the database and returns a JSON
+// ExecResult with their duration. The string must be released with
+// free_string.
+//
+//export exec_sql
+func exec_sql(dbPath, statements *C.char) *C.char {
+	result, err := runExec(C.GoString(dbPath), C.GoString(statements))
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return jsonString(result)
+}
+
+// jsonString encodes v as a C string for the caller to free.
+func jsonString(v any) *C.char {
+	result, _ := json.Marshal(v)
+	return C.CString(string(result))
+}
+
+//export free_string
+func free_string(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// Required for -buildmode=c-shared
+func main() {}
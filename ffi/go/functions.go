@@ -0,0 +1,281 @@
+//go:build !wasip1
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// functionsDriver is the sqlite3 driver with the astronomy functions
+// registered on every connection.
+const functionsDriver = "sqlite3_gaia"
+
+// sqlFunction is a pure function of its arguments, so SQLite may evaluate
+// it once per statement for constant arguments.
+type sqlFunction struct {
+	name string
+	impl any
+}
+
+// Arguments are taken as any so integers, reals and numeric text all work
+// (go-sqlite3 only accepts REAL for a float64 argument), and a NULL
+// argument gives NULL.
+var sqlFunctions = []sqlFunction{
+	{"ang_sep", angSepFunc},
+	{"in_cone", inConeFunc},
+	{"healpix", healpixFunc},
+	{"healpix_from_source_id", healpixFromSourceIDFunc},
+	{"flux_to_mag", fluxToMagFunc},
+}
+
+// connectHooks run on each new connection after the functions are
+// registered; search.go adds its table-valued functions here.
+var connectHooks []func(conn *sqlite3.SQLiteConn) error
+
+func init() {
+	sql.Register(functionsDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, function := range sqlFunctions {
+				if err := conn.RegisterFunc(function.name, function.impl, true); err != nil {
+					return fmt.Errorf("registering %s: %w", function.name, err)
+				}
+			}
+			for _, hook := range connectHooks {
+				if err := hook(conn); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// Default Gaia DR3 zeropoints, matching DEFAULT_CONFIG.zeropoints.
+var bandZeropoints = map[string]float64{
+	"g":  25.6873668671,
+	"bp": 25.3385422158,
+	"rp": 24.7478955012,
+}
+
+// sourceIDLevel is the HEALPix level encoded in Gaia source_ids.
+const sourceIDLevel = 12
+
+// ang_sep(ra1, dec1, ra2, dec2): angular separation in degrees.
+func angSepFunc(ra1, dec1, ra2, dec2 any) (any, error) {
+	values, ok, err := sqlFloats(ra1, dec1, ra2, dec2)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return angularSeparation(values[0], values[1], values[2], values[3]), nil
+}
+
+// in_cone(ra, dec, ra0, dec0, radius): whether a position is within
+// radius degrees of (ra0, dec0).
+func inConeFunc(ra, dec, ra0, dec0, radius any) (any, error) {
+	values, ok, err := sqlFloats(ra, dec, ra0, dec0, radius)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return angularSeparation(values[0], values[1], values[2], values[3]) <= values[4], nil
+}
+
+// healpix(level, ra, dec): nested pixel index containing a position.
+func healpixFunc(level, ra, dec any) (any, error) {
+	values, ok, err := sqlFloats(level, ra, dec)
+	if !ok || err != nil {
+		return nil, err
+	}
+	l, err := healpixLevel(values[0], 29)
+	if err != nil {
+		return nil, err
+	}
+	return angToPix(l, values[1], values[2]), nil
+}
+
+// healpix_from_source_id(source_id, level): HEALPix pixel of a Gaia source
+// at level 0-12, from its source_id.
+func healpixFromSourceIDFunc(sourceID, level any) (any, error) {
+	if isSQLNull(sourceID) || isSQLNull(level) {
+		return nil, nil
+	}
+	var id int64
+	switch v := sourceID.(type) {
+	case int64:
+		id = v
+	case string:
+		parsed, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("healpix_from_source_id: invalid source_id %q", v)
+		}
+		id = parsed
+	default:
+		return nil, fmt.Errorf("healpix_from_source_id: source_id must be an integer")
+	}
+	l, ok, err := sqlFloat(level)
+	if !ok || err != nil {
+		return nil, err
+	}
+	lvl, err := healpixLevel(l, sourceIDLevel)
+	if err != nil {
+		return nil, err
+	}
+	return id >> (35 + 2*(sourceIDLevel-lvl)), nil
+}
+
+// flux_to_mag(flux, band): Vega magnitude of a flux in e-/s, for band g,
+// bp or rp; NULL unless the flux is positive.
+func fluxToMagFunc(flux, band any) (any, error) {
+	if isSQLNull(flux) || isSQLNull(band) {
+		return nil, nil
+	}
+	name, ok := band.(string)
+	if !ok {
+		return nil, fmt.Errorf("flux_to_mag: band must be 'g', 'bp' or 'rp'")
+	}
+	zeropoint, ok := bandZeropoints[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("flux_to_mag: unknown band %q, must be 'g', 'bp' or 'rp'", name)
+	}
+	f, ok, err := sqlFloat(flux)
+	if !ok || err != nil || f <= 0 {
+		return nil, err
+	}
+	return zeropoint - 2.5*math.Log10(f), nil
+}
+
+// isSQLNull reports whether an argument is NULL, which go-sqlite3 passes as
+// a nil []byte.
+func isSQLNull(value any) bool {
+	bytes, ok := value.([]byte)
+	return value == nil || (ok && bytes == nil)
+}
+
+// sqlFloat converts an SQL argument to a float64; ok is false for NULL.
+func sqlFloat(value any) (f float64, ok bool, err error) {
+	if isSQLNull(value) {
+		return 0, false, nil
+	}
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true, nil
+	case float64:
+		return v, true, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("%q is not a number", v)
+		}
+		return f, true, nil
+	default:
+		return 0, false, fmt.Errorf("argument must be a number")
+	}
+}
+
+// sqlFloats converts several arguments; ok is false if any is NULL.
+func sqlFloats(values ...any) ([]float64, bool, error) {
+	result := make([]float64, len(values))
+	for i, value := range values {
+		f, ok, err := sqlFloat(value)
+		if !ok || err != nil {
+			return nil, false, err
+		}
+		result[i] = f
+	}
+	return result, true, nil
+}
+
+func healpixLevel(level float64, max int) (int, error) {
+	if level != math.Trunc(level) || level < 0 || level > float64(max) {
+		return 0, fmt.Errorf("invalid HEALPix level %v, must be 0-%d", level, max)
+	}
+	return int(level), nil
+}
+
+// angularSeparation is the Vincenty formula, stable at small and large
+// separations, in degrees.
+func angularSeparation(ra1, dec1, ra2, dec2 float64) float64 {
+	const deg = math.Pi / 180
+	dRa := (ra2 - ra1) * deg
+	sin1, cos1 := math.Sincos(dec1 * deg)
+	sin2, cos2 := math.Sincos(dec2 * deg)
+	sinRa, cosRa := math.Sincos(dRa)
+
+	num := math.Hypot(cos2*sinRa, cos1*sin2-sin1*cos2*cosRa)
+	den := sin1*sin2 + cos1*cos2*cosRa
+	return math.Atan2(num, den) / deg
+}
+
+// angToPix is the nested pixel index containing a position, as in
+// src/healpix.ts.
+func angToPix(level int, ra, dec float64) int64 {
+	nside := int64(1) << level
+	z := math.Sin(dec * math.Pi / 180)
+	za := math.Abs(z)
+	// Longitude in units of 90°, in [0, 4)
+	tt := math.Mod(math.Mod(math.Mod(ra, 360)+360, 360)/90, 4)
+
+	var face, ix, iy int64
+	if za <= 2.0/3 {
+		// Equatorial region
+		temp1 := float64(nside) * (0.5 + tt)
+		temp2 := float64(nside) * z * 0.75
+		jp := int64(math.Floor(temp1 - temp2))
+		jm := int64(math.Floor(temp1 + temp2))
+		ifp := floorDiv(jp, nside)
+		ifm := floorDiv(jm, nside)
+
+		switch {
+		case ifp == ifm:
+			face = ifp | 4
+		case ifp < ifm:
+			face = ifp
+		default:
+			face = ifm + 8
+		}
+		ix = jm & (nside - 1)
+		iy = nside - (jp & (nside - 1)) - 1
+	} else {
+		// Polar caps
+		ntt := min(3, int64(math.Floor(tt)))
+		tp := tt - float64(ntt)
+		tmp := float64(nside) * math.Sqrt(3*(1-za))
+		jp := min(nside-1, int64(math.Floor(tp*tmp)))
+		jm := min(nside-1, int64(math.Floor((1-tp)*tmp)))
+
+		if z >= 0 {
+			face = ntt
+			ix = nside - jm - 1
+			iy = nside - jp - 1
+		} else {
+			face = ntt + 8
+			ix = jp
+			iy = jm
+		}
+	}
+
+	return face*nside*nside + interleave(ix, iy)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// interleave puts the bits of x in the even positions and y in the odd.
+func interleave(x, y int64) int64 {
+	var result int64
+	for bit := 0; bit < 30; bit++ {
+		result |= ((x >> bit) & 1) << (2 * bit)
+		result |= ((y >> bit) & 1) << (2*bit + 1)
+	}
+	return result
+}
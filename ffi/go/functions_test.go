@@ -0,0 +1,228 @@
+//go:build !wasip1
+
+package main
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"testing"
+)
+
+// openFunctions opens an in-memory database with the astronomy functions.
+func openFunctions(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(functionsDriver, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// queryValue runs a one-value SELECT.
+func queryValue(t *testing.T, db *sql.DB, query string, args ...any) (any, error) {
+	t.Helper()
+	var value any
+	err := db.QueryRow(query, args...).Scan(&value)
+	return value, err
+}
+
+func TestAngSep(t *testing.T) {
+	db := openFunctions(t)
+	tests := []struct {
+		name  string
+		query string
+		want  float64
+	}{
+		{"same position", "SELECT ang_sep(10, 20, 10, 20)", 0},
+		{"quarter of the equator", "SELECT ang_sep(0, 0, 90, 0)", 90},
+		{"pole to pole", "SELECT ang_sep(0, 90, 0, -90)", 180},
+		{"across RA 0", "SELECT ang_sep(359.5, 0, 0.5, 0)", 1},
+		{"across the pole", "SELECT ang_sep(0, 89.9, 180, 89.9)", 0.2},
+		{"one arcsecond", "SELECT ang_sep(56.75, 24.12, 56.75, 24.12 + 1.0 / 3600)", 1.0 / 3600},
+		{"numeric text", "SELECT ang_sep('0', '0', '90', '0')", 90},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := queryValue(t, db, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := value.(float64)
+			if !ok || math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("got %v, want %v", value, test.want)
+			}
+		})
+	}
+}
+
+func TestInCone(t *testing.T) {
+	db := openFunctions(t)
+	tests := []struct {
+		query string
+		want  int64
+	}{
+		{"SELECT in_cone(56.75, 24.12, 56.75, 24.12, 0)", 1},
+		{"SELECT in_cone(56.75, 24.5, 56.75, 24.12, 0.5)", 1},
+		{"SELECT in_cone(56.75, 24.7, 56.75, 24.12, 0.5)", 0},
+		// Within 0.5° across RA 0
+		{"SELECT in_cone(359.8, 0, 0.1, 0, 0.5)", 1},
+		{"SELECT in_cone(0, -90, 180, -89.5, 0.6)", 1},
+		{"SELECT in_cone(0, -90, 180, -89.5, 0.4)", 0},
+	}
+	for _, test := range tests {
+		value, err := queryValue(t, db, test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if value != test.want {
+			t.Errorf("%s: got %v, want %v", test.query, value, test.want)
+		}
+	}
+}
+
+// Outputs of angToPix in src/healpix.ts
+var healpixCases = []struct {
+	level   int
+	ra, dec float64
+	pixel   int64
+}{
+	{0, 0, 0, 4},
+	{0, 45, 89, 0},
+	{0, 300, -89, 11},
+	{1, 10, 10, 19},
+	{4, 56.75, 24.12, 28},
+	{6, -10, 30, 20394},
+	{6, 350, 30, 20394},
+	{8, 266.417, -29.008, 461282},
+	{8, 359.999, 0.5, 311299},
+	{12, 83.822, -5.391, 87816852},
+	{12, 0, 90, 16777215},
+	{12, 180, -90, 167772160},
+	{12, 123.4, 41.8, 26825983},
+	{12, 201.3, -41.9, 178608663},
+	{13, 56.75, 24.12, 7593298},
+	{13, 0.0001, -0.0001, 285212671},
+	{13, 90, 41.81, 402653183},
+	{13, 270, -41.82, 782936744},
+}
+
+func TestHealpixMatchesTypeScript(t *testing.T) {
+	db := openFunctions(t)
+	for _, test := range healpixCases {
+		if got := angToPix(test.level, test.ra, test.dec); got != test.pixel {
+			t.Errorf("angToPix(%d, %v, %v) = %d, want %d", test.level, test.ra, test.dec, got, test.pixel)
+		}
+		value, err := queryValue(t, db, "SELECT healpix(?, ?, ?)", test.level, test.ra, test.dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != test.pixel {
+			t.Errorf("healpix(%d, %v, %v) = %v, want %d", test.level, test.ra, test.dec, value, test.pixel)
+		}
+	}
+}
+
+func TestHealpixFromSourceID(t *testing.T) {
+	db := openFunctions(t)
+	tests := []struct {
+		query string
+		want  int64
+	}{
+		{"SELECT healpix_from_source_id(4295806720, 12)", 0},
+		{"SELECT healpix_from_source_id(6917528997577384320, 12)", 201326591},
+		{"SELECT healpix_from_source_id(6917528997577384320, 0)", 11},
+		{"SELECT healpix_from_source_id(66529975427235712, 8)", 7563},
+		// source_id is stored as text
+		{"SELECT healpix_from_source_id('66529975427235712', 8)", 7563},
+		{"SELECT healpix_from_source_id(66529975427235712, '8')", 7563},
+	}
+	for _, test := range tests {
+		value, err := queryValue(t, db, test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if value != test.want {
+			t.Errorf("%s: got %v, want %v", test.query, value, test.want)
+		}
+	}
+}
+
+func TestFluxToMag(t *testing.T) {
+	db := openFunctions(t)
+	tests := []struct {
+		query string
+		want  float64
+	}{
+		{"SELECT flux_to_mag(1, 'g')", 25.6873668671},
+		{"SELECT flux_to_mag(100, 'G')", 25.6873668671 - 5},
+		{"SELECT flux_to_mag(1000, 'bp')", 25.3385422158 - 7.5},
+		{"SELECT flux_to_mag('10', 'rp')", 24.7478955012 - 2.5},
+	}
+	for _, test := range tests {
+		value, err := queryValue(t, db, test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		got, ok := value.(float64)
+		if !ok || math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", test.query, value, test.want)
+		}
+	}
+}
+
+func TestFunctionsReturnNullForNullArguments(t *testing.T) {
+	db := openFunctions(t)
+	queries := []string{
+		"SELECT ang_sep(NULL, 0, 0, 0)",
+		"SELECT ang_sep(0, 0, 0, NULL)",
+		"SELECT in_cone(0, 0, 0, 0, NULL)",
+		"SELECT healpix(NULL, 0, 0)",
+		"SELECT healpix(8, NULL, 0)",
+		"SELECT healpix_from_source_id(NULL, 12)",
+		"SELECT healpix_from_source_id(4295806720, NULL)",
+		"SELECT flux_to_mag(NULL, 'g')",
+		"SELECT flux_to_mag(100, NULL)",
+		// Magnitudes need a positive flux
+		"SELECT flux_to_mag(0, 'g')",
+		"SELECT flux_to_mag(-5, 'g')",
+	}
+	for _, query := range queries {
+		value, err := queryValue(t, db, query)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+		} else if value != nil {
+			t.Errorf("%s: got %v, want NULL", query, value)
+		}
+	}
+}
+
+func TestFunctionsRejectInvalidArguments(t *testing.T) {
+	db := openFunctions(t)
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT ang_sep('north', 0, 0, 0)", `"north" is not a number`},
+		{"SELECT in_cone(0, 0, 0, 0, x'00')", "argument must be a number"},
+		{"SELECT healpix(30, 0, 0)", "invalid HEALPix level 30"},
+		{"SELECT healpix(-1, 0, 0)", "invalid HEALPix level -1"},
+		{"SELECT healpix(2.5, 0, 0)", "invalid HEALPix level 2.5"},
+		{"SELECT healpix_from_source_id(4295806720, 13)", "must be 0-12"},
+		{"SELECT healpix_from_source_id('gaia', 12)", `invalid source_id "gaia"`},
+		{"SELECT healpix_from_source_id(1.5, 12)", "source_id must be an integer"},
+		{"SELECT flux_to_mag(100, 'v')", `unknown band "v"`},
+		{"SELECT flux_to_mag(100, 1)", "band must be"},
+		{"SELECT ang_sep(0, 0, 0)", "wrong number of arguments"},
+	}
+	for _, test := range tests {
+		_, err := queryValue(t, db, test.query)
+		if err == nil {
+			t.Errorf("%s: no error", test.query)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q does not mention %q", test.query, err, test.want)
+		}
+	}
+}
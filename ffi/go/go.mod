@@ -0,0 +1,5 @@
+module github.com/okcoker/gaiaoffline-ts/ffi/go
+
+go 1.24
+
+require github.com/mattn/go-sqlite3 v1.14.32
@@ -0,0 +1,380 @@
+//go:build !wasip1
+
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Config mirrors the options the TypeScript ingest path reads from CLIConfig.
+type Config struct {
+	// Columns are the stored Gaia columns, in table order.
+	Columns []string `json:"columns"`
+	// DerivePM appends the total proper motion as a trailing `pm` column.
+	DerivePM bool `json:"derive_pm"`
+	// MagnitudeLimit drops sources with G at or fainter than this.
+	MagnitudeLimit float64 `json:"magnitude_limit"`
+	// Zeropoint converts phot_g_mean_flux to G.
+	Zeropoint float64 `json:"zeropoint"`
+	// BatchSize is the number of rows inserted per transaction.
+	BatchSize int `json:"batch_size"`
+}
+
+// Summary is returned to Deno as JSON.
+type Summary struct {
+	RowsRead     int64  `json:"rows_read"`
+	RowsKept     int64  `json:"rows_kept"`
+	RowsInserted int64  `json:"rows_inserted"`
+	DurationMs   int64  `json:"duration_ms"`
+	Stages       Stages `json:"stages"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Stages is the time spent in each part of an ingest, in milliseconds.
+type Stages struct {
+	// Gzip is reading and decompressing the file.
+	Gzip float64 `json:"gzip_ms"`
+	// CSV is splitting the text into fields: the rest of the time spent
+	// reading rows.
+	CSV float64 `json:"csv_ms"`
+	// Parse is filtering and converting fields to values, estimated from a
+	// sample of rows.
+	Parse float64 `json:"parse_ms"`
+	// SQLite is inserting, including waiting for the write lock.
+	SQLite float64 `json:"sqlite_ms"`
+}
+
+// timedReader adds the time spent in Read to spent.
+type timedReader struct {
+	reader io.Reader
+	spent  *time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.reader.Read(p)
+	*t.spent += time.Since(start)
+	return n, err
+}
+
+// parseSampleEvery is how often a row's parsing is timed. Reading the clock
+// costs about as much as parsing a short row, so the parse stage is scaled
+// up from one row in this many and the CSV stage is what remains.
+const parseSampleEvery = 64
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Parsing runs in parallel across calls, but SQLite takes one writer at a
+// time, so inserts into the same database are serialised here rather than
+// left to busy retries.
+var (
+	writeLocksMu sync.Mutex
+	writeLocks   = map[string]*sync.Mutex{}
+)
+
+func writeLock(dbPath string) *sync.Mutex {
+	writeLocksMu.Lock()
+	defer writeLocksMu.Unlock()
+	lock, ok := writeLocks[dbPath]
+	if !ok {
+		lock = &sync.Mutex{}
+		writeLocks[dbPath] = lock
+	}
+	return lock
+}
+
+// ingest parses a gzipped Gaia CSV, keeps sources brighter than the
+// magnitude limit and inserts them into gaiadr3 with INSERT OR IGNORE, so
+// re-ingesting a partly loaded file is safe.
+func ingest(dbPath, filePath string, config Config) (summary Summary, err error) {
+	start := time.Now()
+
+	if len(config.Columns) == 0 {
+		return summary, errors.New("config.columns is empty")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100000
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return summary, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return summary, fmt.Errorf("corrupt gzip stream: %w", err)
+	}
+	defer gz.Close()
+
+	var (
+		gzipTime, sqliteTime time.Duration
+		// loopTime covers reading, parsing and inserting every row
+		loopTime, sampledParse time.Duration
+		sampledRows            int64
+	)
+	defer func() {
+		var parseTime time.Duration
+		if sampledRows > 0 {
+			parseTime = time.Duration(float64(sampledParse) *
+				float64(summary.RowsRead) / float64(sampledRows))
+		}
+		csvTime := max(loopTime-gzipTime-sqliteTime-parseTime, 0)
+		summary.Stages = Stages{
+			Gzip:   milliseconds(gzipTime),
+			CSV:    milliseconds(csvTime),
+			Parse:  milliseconds(parseTime),
+			SQLite: milliseconds(sqliteTime),
+		}
+	}()
+
+	reader := csv.NewReader(&timedReader{reader: gz, spent: &gzipTime})
+	reader.Comment = '#'
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return summary, fmt.Errorf("reading header: %w", err)
+	}
+
+	position := make(map[string]int, len(header))
+	for i, name := range header {
+		position[name] = i
+	}
+
+	indices := make([]int, len(config.Columns))
+	for i, column := range config.Columns {
+		index, ok := position[column]
+		if !ok {
+			return summary, fmt.Errorf("column %q is not in the file", column)
+		}
+		indices[i] = index
+	}
+
+	fluxIndex, ok := position["phot_g_mean_flux"]
+	if !ok {
+		return summary, errors.New("column \"phot_g_mean_flux\" is not in the file")
+	}
+	pmraIndex, hasPmra := position["pmra"]
+	pmdecIndex, hasPmdec := position["pmdec"]
+	derivePM := config.DerivePM && hasPmra && hasPmdec
+
+	// Brighter than the limit means flux above this
+	minFlux := math.Pow(10, (config.Zeropoint-config.MagnitudeLimit)/2.5)
+
+	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=60000")
+	if err != nil {
+		return summary, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if err := checkSchemaVersion(db); err != nil {
+		return summary, err
+	}
+
+	columns := append([]string{}, config.Columns...)
+	if config.DerivePM {
+		columns = append(columns, "pm")
+	}
+	query := fmt.Sprintf(
+		"INSERT OR IGNORE INTO gaiadr3 (%s) VALUES (%s)",
+		strings.Join(columns, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "),
+	)
+
+	batch := make([][]any, 0, config.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		start := time.Now()
+		inserted, err := insertBatch(db, dbPath, query, batch)
+		sqliteTime += time.Since(start)
+		summary.RowsInserted += inserted
+		batch = batch[:0]
+		return err
+	}
+
+	// parse filters a record and converts the kept fields, returning nil for
+	// rows at or fainter than the limit
+	parse := func(record []string) []any {
+		flux, err := strconv.ParseFloat(record[fluxIndex], 64)
+		if err != nil || flux <= 0 || flux <= minFlux {
+			return nil
+		}
+
+		values := make([]any, 0, len(columns))
+		for i, index := range indices {
+			values = append(values, convert(config.Columns[i], record[index]))
+		}
+		if config.DerivePM {
+			var pm any
+			if derivePM {
+				pm = properMotion(record[pmraIndex], record[pmdecIndex])
+			}
+			values = append(values, pm)
+		}
+		return values
+	}
+
+	loopStart := time.Now()
+	defer func() { loopTime = time.Since(loopStart) }()
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return summary, fmt.Errorf("corrupt gzip stream: %w", err)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("line %d: %w", summary.RowsRead+2, err)
+		}
+		summary.RowsRead++
+
+		var values []any
+		if summary.RowsRead%parseSampleEvery == 1 {
+			parseStart := time.Now()
+			values = parse(record)
+			sampledParse += time.Since(parseStart)
+			sampledRows++
+		} else {
+			values = parse(record)
+		}
+		if values == nil {
+			continue
+		}
+		summary.RowsKept++
+
+		batch = append(batch, values)
+		if len(batch) >= config.BatchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return summary, err
+	}
+
+	summary.DurationMs = time.Since(start).Milliseconds()
+	return summary, nil
+}
+
+// schemaVersion is the newest catalogue schema this library can write to.
+// Keep it in step with SCHEMA_VERSION in src/migrations.ts.
+const schemaVersion = 4
+
+// checkSchemaVersion refuses databases migrated by a newer gaiaoffline,
+// whose tables this library may no longer match. Databases from before
+// schema_version existed are version 0.
+func checkSchemaVersion(db *sql.DB) error {
+	var tables int
+	err := db.QueryRow(
+		"SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'",
+	).Scan(&tables)
+	if err != nil || tables == 0 {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow(
+		"SELECT COALESCE(MAX(version), 0) FROM schema_version",
+	).Scan(&version); err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf(
+			"database schema version %d is newer than this library supports (%d); rebuild libgaia_ingest",
+			version, schemaVersion,
+		)
+	}
+	return nil
+}
+
+func insertBatch(
+	db *sql.DB,
+	dbPath string,
+	query string,
+	rows [][]any,
+) (int64, error) {
+	lock := writeLock(dbPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var inserted int64
+	for _, values := range rows {
+		result, err := stmt.Exec(values...)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		changed, _ := result.RowsAffected()
+		inserted += changed
+	}
+
+	return inserted, tx.Commit()
+}
+
+// convert matches the TypeScript parser and the reader: empty and "null"
+// fields become NULL in every column, text columns keep their text,
+// booleans become 0/1, numbers become REAL and anything else stays text.
+func convert(column, value string) any {
+	if value == "" || strings.EqualFold(value, "null") {
+		return nil
+	}
+	if stringColumns[column] {
+		return value
+	}
+	switch strings.ToLower(value) {
+	case "true":
+		return 1
+	case "false":
+		return 0
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number
+	}
+	return value
+}
+
+// properMotion is the total proper motion, or NULL if either component is
+// missing.
+func properMotion(pmra, pmdec string) any {
+	ra, errRA := strconv.ParseFloat(pmra, 64)
+	dec, errDec := strconv.ParseFloat(pmdec, 64)
+	if errRA != nil || errDec != nil {
+		return nil
+	}
+	return math.Sqrt(ra*ra + dec*dec)
+}
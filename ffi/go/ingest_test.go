@@ -0,0 +1,33 @@
+//go:build !wasip1
+
+package main
+
+import "testing"
+
+// The values src/utils.ts stores for the same fields, so the content hash
+// of a database does not depend on which path ingested it.
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		column, value string
+		want          any
+	}{
+		{"parallax", "1.25", 1.25},
+		{"parallax", "-3e-2", -0.03},
+		{"parallax", "", nil},
+		{"parallax", "null", nil},
+		{"parallax", "NULL", nil},
+		{"has_xp_continuous", "True", 1},
+		{"has_xp_continuous", "false", 0},
+		{"parallax", "n/a", "n/a"},
+		{"source_id", "4295806720", "4295806720"},
+		{"designation", "Gaia DR3 4295806720", "Gaia DR3 4295806720"},
+		{"phot_variable_flag", "NOT_AVAILABLE", "NOT_AVAILABLE"},
+		{"phot_variable_flag", "", nil},
+		{"libname_gspphot", "null", nil},
+	}
+	for _, test := range tests {
+		if got := convert(test.column, test.value); got != test.want {
+			t.Errorf("convert(%q, %q) = %#v, want %#v", test.column, test.value, got, test.want)
+		}
+	}
+}
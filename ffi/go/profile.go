@@ -0,0 +1,180 @@
+//go:build !wasip1
+
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"time"
+)
+
+// ProfileConfig chooses which profiles to collect while the library runs.
+// Empty fields are skipped.
+type ProfileConfig struct {
+	// CPUProfile is a file for a pprof CPU profile.
+	CPUProfile string `json:"cpuprofile"`
+	// MemProfile is a file for a heap profile, written when profiling stops.
+	MemProfile string `json:"memprofile"`
+	// Trace is a file for an execution trace (go tool trace).
+	Trace string `json:"trace"`
+	// Pprof is an address to serve /debug/pprof/ on, e.g. "localhost:6060".
+	Pprof string `json:"pprof"`
+}
+
+var profiling struct {
+	sync.Mutex
+	active bool
+	config ProfileConfig
+	cpu    *os.File
+	trace  *os.File
+	server *http.Server
+}
+
+// startProfiling begins collecting the configured profiles, returning the
+// address the pprof listener is on, if any.
+func startProfiling(config ProfileConfig) (string, error) {
+	profiling.Lock()
+	defer profiling.Unlock()
+
+	if profiling.active {
+		return "", errors.New("profiling is already running")
+	}
+
+	if config.CPUProfile != "" {
+		file, err := os.Create(config.CPUProfile)
+		if err != nil {
+			return "", err
+		}
+		if err := pprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return "", err
+		}
+		profiling.cpu = file
+	}
+
+	if config.Trace != "" {
+		file, err := os.Create(config.Trace)
+		if err == nil {
+			err = trace.Start(file)
+		}
+		if err != nil {
+			if file != nil {
+				file.Close()
+			}
+			stopFiles()
+			return "", err
+		}
+		profiling.trace = file
+	}
+
+	address := ""
+	if config.Pprof != "" {
+		listener, err := net.Listen("tcp", config.Pprof)
+		if err != nil {
+			stopFiles()
+			return "", fmt.Errorf("pprof listener: %w", err)
+		}
+		// net/http/pprof registers its handlers on the default mux
+		profiling.server = &http.Server{Handler: http.DefaultServeMux}
+		go profiling.server.Serve(listener)
+		address = listener.Addr().String()
+	}
+
+	profiling.active = true
+	profiling.config = config
+	return address, nil
+}
+
+// stopProfiling finishes the CPU profile and trace, writes the heap profile
+// and closes the pprof listener.
+func stopProfiling() error {
+	profiling.Lock()
+	defer profiling.Unlock()
+
+	if !profiling.active {
+		return nil
+	}
+	profiling.active = false
+
+	var errs []error
+	if profiling.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		errs = append(errs, profiling.server.Shutdown(ctx))
+		cancel()
+		profiling.server = nil
+	}
+
+	errs = append(errs, stopFiles())
+
+	if path := profiling.config.MemProfile; path != "" {
+		file, err := os.Create(path)
+		if err == nil {
+			// Up-to-date statistics
+			runtime.GC()
+			err = pprof.WriteHeapProfile(file)
+			errs = append(errs, file.Close())
+		}
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// stopFiles stops the CPU profile and trace if they are running.
+func stopFiles() error {
+	var errs []error
+	if profiling.cpu != nil {
+		pprof.StopCPUProfile()
+		errs = append(errs, profiling.cpu.Close())
+		profiling.cpu = nil
+	}
+	if profiling.trace != nil {
+		trace.Stop()
+		errs = append(errs, profiling.trace.Close())
+		profiling.trace = nil
+	}
+	return errors.Join(errs...)
+}
+
+// profile_start starts profiling with a JSON ProfileConfig. Returns
+// {"pprof": address} or {"error": message}; release it with free_string.
+//
+//export profile_start
+func profile_start(configJSON *C.char) *C.char {
+	var config ProfileConfig
+	err := json.Unmarshal([]byte(C.GoString(configJSON)), &config)
+	address := ""
+	if err == nil {
+		address, err = startProfiling(config)
+	}
+	if err != nil {
+		return jsonString(map[string]string{"error": err.Error()})
+	}
+	return jsonString(map[string]string{"pprof": address})
+}
+
+// profile_stop stops profiling and writes the heap profile. Returns {} or
+// {"error": message}; release it with free_string.
+//
+//export profile_stop
+func profile_stop() *C.char {
+	if err := stopProfiling(); err != nil {
+		return jsonString(map[string]string{"error": err.Error()})
+	}
+	return jsonString(map[string]string{})
+}
@@ -0,0 +1,114 @@
+//go:build !wasip1
+
+package main
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+// QueryResult is the outcome of a query, returned to Deno as JSON.
+type QueryResult struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+	// Truncated is set when rows beyond maxRows were left unread.
+	Truncated  bool   `json:"truncated"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// runQuery runs one read-only statement with the astronomy functions of
+// functions.go, returning up to maxRows rows (all when maxRows <= 0).
+// Integers are returned as JSON numbers, so ids beyond 2^53 should be
+// selected as text with CAST(source_id AS TEXT).
+func runQuery(dbPath, query string, maxRows int) (result QueryResult, err error) {
+	start := time.Now()
+	result.Columns, result.Rows = []string{}, [][]any{}
+
+	db, err := sql.Open(functionsDriver, dbPath+"?_busy_timeout=60000&_query_only=1")
+	if err != nil {
+		return result, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if err := checkSchemaVersion(db); err != nil {
+		return result, err
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	result.Columns, err = rows.Columns()
+	if err != nil {
+		return result, err
+	}
+
+	for rows.Next() {
+		if maxRows > 0 && len(result.Rows) >= maxRows {
+			result.Truncated = true
+			break
+		}
+		values := make([]any, len(result.Columns))
+		pointers := make([]any, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return result, err
+		}
+		for i, value := range values {
+			switch v := value.(type) {
+			case []byte:
+				values[i] = string(v)
+			case float64:
+				// JSON has no NaN or Infinity
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					values[i] = nil
+				}
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// ExecResult is the outcome of a statement run for its effect, returned to
+// Deno as JSON.
+type ExecResult struct {
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// runExec runs statements that change the database, such as CREATE INDEX,
+// which can take minutes on a full catalogue. The caller is free to report
+// progress meanwhile since the FFI call does not block Deno.
+func runExec(dbPath, statements string) (result ExecResult, err error) {
+	start := time.Now()
+
+	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=60000")
+	if err != nil {
+		return result, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if err := checkSchemaVersion(db); err != nil {
+		return result, err
+	}
+	if _, err := db.Exec(statements); err != nil {
+		return result, err
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
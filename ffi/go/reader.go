@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unsafe"
+)
+
+// Text columns; everything else is numeric.
+var stringColumns = map[string]bool{
+	"source_id":          true,
+	"solution_id":        true,
+	"designation":        true,
+	"phot_variable_flag": true,
+	"libname_gspphot":    true,
+}
+
+// Batch holds parsed rows column by column, in the order the columns were
+// requested. Numeric columns are in Numbers and text columns in Text; the
+// other slice is nil for that column. Null marks missing values.
+type Batch struct {
+	Rows    int
+	Numbers [][]float64
+	Text    [][]string
+	Null    [][]bool
+}
+
+// Reader parses a Gaia CSV incrementally: Write gzip or plain CSV bytes to
+// it in pieces of any size and take projected, typed batches with Next as
+// rows complete. Gzip is detected from the first bytes.
+type Reader struct {
+	columns   []string
+	text      []bool
+	indices   []int
+	batchSize int
+
+	sniffed  bool
+	inflater *inflater
+	pending  []byte
+	header   bool
+	line     int
+	fields   [][]byte
+	current  *Batch
+	ready    []*Batch
+	finished bool
+	err      error
+}
+
+// NewReader returns a Reader producing batches of up to batchSize rows of
+// the given columns.
+func NewReader(columns []string, batchSize int) (*Reader, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("no columns requested")
+	}
+	if batchSize <= 0 {
+		batchSize = 100000
+	}
+
+	text := make([]bool, len(columns))
+	for i, column := range columns {
+		text[i] = stringColumns[column]
+	}
+
+	return &Reader{columns: columns, text: text, batchSize: batchSize}, nil
+}
+
+// Write feeds the next bytes of the file. The bytes are consumed before
+// Write returns, so the caller may reuse the slice.
+func (r *Reader) Write(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.finished {
+		return 0, errors.New("write after close")
+	}
+
+	if !r.sniffed {
+		if len(r.pending)+len(p) < 2 {
+			r.pending = append(r.pending, p...)
+			return len(p), nil
+		}
+		r.sniffed = true
+		start := append(r.pending, p...)
+		r.pending = nil
+		if start[0] == 0x1f && start[1] == 0x8b {
+			r.inflater = newInflater(r.parse)
+		}
+		p = start
+	}
+
+	if r.inflater != nil {
+		r.err = r.inflater.write(p)
+	} else {
+		r.err = r.parse(p)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return len(p), nil
+}
+
+// Close marks the end of the input and flushes the last rows.
+func (r *Reader) Close() error {
+	if r.err != nil || r.finished {
+		return r.err
+	}
+	r.finished = true
+
+	if r.inflater != nil {
+		r.err = r.inflater.close()
+	}
+	// The last line may have no newline
+	if r.err == nil && len(r.pending) > 0 {
+		r.err = r.parseLine(r.pending)
+		r.pending = nil
+	}
+	if r.err == nil && !r.header {
+		r.err = errors.New("no header row")
+	}
+	if r.err == nil && r.current != nil && r.current.Rows > 0 {
+		r.ready = append(r.ready, r.current)
+		r.current = nil
+	}
+	return r.err
+}
+
+// Next returns the oldest complete batch, or nil if none is ready.
+func (r *Reader) Next() *Batch {
+	if len(r.ready) == 0 {
+		return nil
+	}
+	batch := r.ready[0]
+	r.ready[0] = nil
+	r.ready = r.ready[1:]
+	return batch
+}
+
+// parse consumes CSV text, keeping any incomplete last line for later.
+func (r *Reader) parse(p []byte) error {
+	data := p
+	if len(r.pending) > 0 {
+		data = append(r.pending, p...)
+	}
+
+	start := 0
+	quoted := false
+	for i, c := range data {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '\n':
+			if quoted {
+				continue
+			}
+			if err := r.parseLine(data[start:i]); err != nil {
+				return err
+			}
+			start = i + 1
+		}
+	}
+
+	// Copy, since p belongs to the caller
+	r.pending = append(r.pending[:0:0], data[start:]...)
+	return nil
+}
+
+func (r *Reader) parseLine(line []byte) error {
+	r.line++
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	if len(line) == 0 || line[0] == '#' {
+		return nil
+	}
+
+	r.fields = splitFields(r.fields[:0], line)
+
+	if !r.header {
+		r.header = true
+		indices, err := columnIndices(r.fields, r.columns)
+		r.indices = indices
+		return err
+	}
+
+	if r.current == nil {
+		r.current = r.newBatch()
+	}
+	batch := r.current
+
+	for i, index := range r.indices {
+		if index >= len(r.fields) {
+			return fmt.Errorf("line %d: expected %d fields, got %d",
+				r.line, index+1, len(r.fields))
+		}
+		value := r.fields[index]
+		null := isNull(value)
+		batch.Null[i] = append(batch.Null[i], null)
+
+		if r.text[i] {
+			batch.Text[i] = append(batch.Text[i], string(value))
+			continue
+		}
+
+		var number float64
+		if !null {
+			number, null = parseNumber(value)
+			batch.Null[i][batch.Rows] = null
+		}
+		batch.Numbers[i] = append(batch.Numbers[i], number)
+	}
+
+	batch.Rows++
+	if batch.Rows >= r.batchSize {
+		r.ready = append(r.ready, batch)
+		r.current = nil
+	}
+	return nil
+}
+
+func (r *Reader) newBatch() *Batch {
+	batch := &Batch{
+		Numbers: make([][]float64, len(r.columns)),
+		Text:    make([][]string, len(r.columns)),
+		Null:    make([][]bool, len(r.columns)),
+	}
+	for i, text := range r.text {
+		if text {
+			batch.Text[i] = make([]string, 0, r.batchSize)
+		} else {
+			batch.Numbers[i] = make([]float64, 0, r.batchSize)
+		}
+		batch.Null[i] = make([]bool, 0, r.batchSize)
+	}
+	return batch
+}
+
+// columnIndices finds each column in the header row.
+func columnIndices(header [][]byte, columns []string) ([]int, error) {
+	position := make(map[string]int, len(header))
+	for i, name := range header {
+		position[string(name)] = i
+	}
+
+	indices := make([]int, len(columns))
+	for i, column := range columns {
+		index, ok := position[column]
+		if !ok {
+			return nil, fmt.Errorf("column %q is not in the file", column)
+		}
+		indices[i] = index
+	}
+	return indices, nil
+}
+
+func isNull(value []byte) bool {
+	return len(value) == 0 || bytes.EqualFold(value, []byte("null"))
+}
+
+// parseNumber reads a numeric field; booleans become 1 and 0. Anything
+// else is reported as null.
+func parseNumber(value []byte) (float64, bool) {
+	// Only borrowed for the call, so skip the copy
+	text := unsafe.String(&value[0], len(value))
+	switch text {
+	case "true", "True", "TRUE":
+		return 1, false
+	case "false", "False", "FALSE":
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, true
+	}
+	return number, false
+}
+
+// splitFields splits one CSV line, handling quoted fields and doubled
+// quotes. Unquoted fields point into line.
+func splitFields(fields [][]byte, line []byte) [][]byte {
+	for {
+		if len(line) > 0 && line[0] == '"' {
+			var field []byte
+			i := 1
+			for i < len(line) {
+				if line[i] == '"' {
+					if i+1 < len(line) && line[i+1] == '"' {
+						field = append(field, '"')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				field = append(field, line[i])
+				i++
+			}
+			fields = append(fields, field)
+			line = line[i:]
+			if comma := bytes.IndexByte(line, ','); comma >= 0 {
+				line = line[comma+1:]
+				continue
+			}
+			return fields
+		}
+
+		comma := bytes.IndexByte(line, ',')
+		if comma < 0 {
+			return append(fields, line)
+		}
+		fields = append(fields, line[:comma])
+		line = line[comma+1:]
+	}
+}
+
+// inflater decompresses gzip input that arrives in pieces. gzip.Reader
+// pulls its input, so it runs in its own goroutine and asks for each piece
+// in turn. write returns once the piece has been used up and its output
+// parsed, so the goroutine never runs at the same time as the caller.
+type inflater struct {
+	input  chan []byte
+	hungry chan struct{}
+	done   chan error
+	ended  bool
+	err    error
+}
+
+func newInflater(output func([]byte) error) *inflater {
+	f := &inflater{
+		input:  make(chan []byte),
+		hungry: make(chan struct{}),
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		zr, err := gzip.NewReader(&feed{inflater: f})
+		if err == nil {
+			_, err = io.Copy(writerFunc(output), zr)
+		}
+		if err != nil && !errors.Is(err, errOutput) {
+			err = fmt.Errorf("corrupt gzip stream: %w", err)
+		}
+		f.done <- err
+	}()
+
+	// Wait for the first request for input
+	<-f.hungry
+	return f
+}
+
+func (f *inflater) write(p []byte) error {
+	if f.ended {
+		// Bytes after the end of the stream are ignored
+		return f.err
+	}
+
+	f.input <- p
+	select {
+	case <-f.hungry:
+		return nil
+	case err := <-f.done:
+		f.ended, f.err = true, err
+		return err
+	}
+}
+
+func (f *inflater) close() error {
+	if f.ended {
+		return f.err
+	}
+	f.ended = true
+	close(f.input)
+	f.err = <-f.done
+	return f.err
+}
+
+// feed is the gzip.Reader's source, handing over one piece at a time.
+type feed struct {
+	inflater *inflater
+	piece    []byte
+}
+
+func (f *feed) Read(p []byte) (int, error) {
+	for len(f.piece) == 0 {
+		f.inflater.hungry <- struct{}{}
+		piece, ok := <-f.inflater.input
+		if !ok {
+			return 0, io.EOF
+		}
+		f.piece = piece
+	}
+	n := copy(p, f.piece)
+	f.piece = f.piece[n:]
+	return n, nil
+}
+
+// errOutput wraps errors from parsing the decompressed text, which are
+// not gzip errors.
+var errOutput = errors.New("output")
+
+type writerFunc func([]byte) error
+
+func (w writerFunc) Write(p []byte) (int, error) {
+	if err := w(p); err != nil {
+		return 0, fmt.Errorf("%w: %w", errOutput, err)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sample has comments, CRLF endings, quoted fields with commas, doubled
+// quotes and a newline, null and empty values, booleans and no final
+// newline.
+const sample = "# Gaia DR3\r\n" +
+	"source_id,ra,designation,has_xp_continuous,parallax,phot_variable_flag\r\n" +
+	"1,10.5,\"Gaia DR3 1\",True,0.25,NOT_AVAILABLE\r\n" +
+	"# a comment between rows\n" +
+	"2,-0.5,\"Gaia, \"\"DR3\"\" 2\",false,null,\n" +
+	"3,1e-3,\"two\nlines\",FALSE,,VARIABLE\n" +
+	"4,359.99,Gaia DR3 4,true,-1.5,null"
+
+var sampleColumns = []string{"source_id", "ra", "designation", "has_xp_continuous", "parallax", "phot_variable_flag"}
+
+func gzipped(t *testing.T, text string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	zw := gzip.NewWriter(&buffer)
+	if _, err := zw.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// readAll feeds data to a Reader in pieces of the given size and returns
+// every batch.
+func readAll(t *testing.T, columns []string, batchSize int, data []byte, piece int) ([]*Batch, error) {
+	t.Helper()
+	reader, err := NewReader(columns, batchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches []*Batch
+	for len(data) > 0 {
+		n := min(piece, len(data))
+		if _, err := reader.Write(data[:n]); err != nil {
+			return batches, err
+		}
+		data = data[n:]
+		for batch := reader.Next(); batch != nil; batch = reader.Next() {
+			batches = append(batches, batch)
+		}
+	}
+	if err := reader.Close(); err != nil {
+		return batches, err
+	}
+	for batch := reader.Next(); batch != nil; batch = reader.Next() {
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+func TestReaderParsesFields(t *testing.T) {
+	batches, err := readAll(t, sampleColumns, 100, []byte(sample), len(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 || batches[0].Rows != 4 {
+		t.Fatalf("got %d batches, want one of 4 rows", len(batches))
+	}
+	batch := batches[0]
+
+	wantText := map[int][]string{
+		0: {"1", "2", "3", "4"},
+		2: {"Gaia DR3 1", `Gaia, "DR3" 2`, "two\nlines", "Gaia DR3 4"},
+		5: {"NOT_AVAILABLE", "", "VARIABLE", "null"},
+	}
+	for column, want := range wantText {
+		if !reflect.DeepEqual(batch.Text[column], want) {
+			t.Errorf("%s: got %q, want %q", sampleColumns[column], batch.Text[column], want)
+		}
+		if batch.Numbers[column] != nil {
+			t.Errorf("%s: text column has numbers", sampleColumns[column])
+		}
+	}
+	wantNumbers := map[int][]float64{
+		1: {10.5, -0.5, 0.001, 359.99},
+		3: {1, 0, 0, 1},
+		4: {0.25, 0, 0, -1.5},
+	}
+	for column, want := range wantNumbers {
+		if !reflect.DeepEqual(batch.Numbers[column], want) {
+			t.Errorf("%s: got %v, want %v", sampleColumns[column], batch.Numbers[column], want)
+		}
+	}
+	wantNull := map[int][]bool{
+		4: {false, true, true, false},
+		5: {false, true, false, true},
+		3: {false, false, false, false},
+	}
+	for column, want := range wantNull {
+		if !reflect.DeepEqual(batch.Null[column], want) {
+			t.Errorf("%s nulls: got %v, want %v", sampleColumns[column], batch.Null[column], want)
+		}
+	}
+}
+
+func TestReaderNumbers(t *testing.T) {
+	tests := []struct {
+		field string
+		want  float64
+		null  bool
+	}{
+		{"42", 42, false},
+		{"-3.5e2", -350, false},
+		{"TRUE", 1, false},
+		{"False", 0, false},
+		{"NULL", 0, true},
+		{"", 0, true},
+		{"n/a", 0, true},
+		{"NaN", math.NaN(), false},
+	}
+	for _, test := range tests {
+		// A second column keeps the empty field from being an empty line
+		batches, err := readAll(t, []string{"parallax"}, 10, []byte("parallax,ra\n"+test.field+",1\n"), 64)
+		if err != nil {
+			t.Fatalf("%q: %v", test.field, err)
+		}
+		got, null := batches[0].Numbers[0][0], batches[0].Null[0][0]
+		same := got == test.want || (math.IsNaN(got) && math.IsNaN(test.want))
+		if !same || null != test.null {
+			t.Errorf("%q: got %v (null %v), want %v (null %v)", test.field, got, null, test.want, test.null)
+		}
+	}
+}
+
+// Whatever the pieces the input arrives in, and whether or not it is
+// gzipped, the batches are the same.
+func TestReaderGzipAndPiecesMatchPlain(t *testing.T) {
+	want, err := readAll(t, sampleColumns, 3, []byte(sample), len(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := gzipped(t, sample)
+	for _, piece := range []int{1, 2, 7, 64, 1 << 16} {
+		for name, data := range map[string][]byte{"plain": []byte(sample), "gzip": compressed} {
+			got, err := readAll(t, sampleColumns, 3, data, piece)
+			if err != nil {
+				t.Fatalf("%s in pieces of %d: %v", name, piece, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s in pieces of %d: batches differ", name, piece)
+			}
+		}
+	}
+}
+
+func TestReaderBatchBoundaries(t *testing.T) {
+	csv := func(rows int) string {
+		var text strings.Builder
+		text.WriteString("source_id,ra\n")
+		for i := range rows {
+			text.WriteString(strings.Repeat("9", i+1) + ",1\n")
+		}
+		return text.String()
+	}
+	tests := []struct {
+		rows, batchSize int
+		want            []int
+	}{
+		{5, 2, []int{2, 2, 1}},
+		{4, 2, []int{2, 2}},
+		{1, 1, []int{1}},
+		{3, 100, []int{3}},
+		{0, 2, nil},
+	}
+	for _, test := range tests {
+		batches, err := readAll(t, []string{"source_id"}, test.batchSize, []byte(csv(test.rows)), 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sizes []int
+		var ids []string
+		for _, batch := range batches {
+			sizes = append(sizes, batch.Rows)
+			ids = append(ids, batch.Text[0]...)
+		}
+		if !reflect.DeepEqual(sizes, test.want) {
+			t.Errorf("%d rows in batches of %d: got %v, want %v", test.rows, test.batchSize, sizes, test.want)
+		}
+		if len(ids) != test.rows || (test.rows > 0 && ids[test.rows-1] != strings.Repeat("9", test.rows)) {
+			t.Errorf("%d rows in batches of %d: got ids %v", test.rows, test.batchSize, ids)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	corrupt := gzipped(t, sample)
+	corrupt[len(corrupt)-6] ^= 0xff // Damage the CRC
+
+	tests := []struct {
+		name    string
+		columns []string
+		data    []byte
+		want    string
+	}{
+		{"missing column", []string{"pmra"}, []byte("source_id,ra\n1,2\n"), `column "pmra" is not in the file`},
+		{"short row", []string{"ra"}, []byte("source_id,ra\n1,2\n3\n"), "line 3: expected 2 fields, got 1"},
+		{"no header", []string{"ra"}, []byte("# only a comment\n"), "no header row"},
+		{"corrupt gzip", sampleColumns, corrupt, "corrupt gzip stream"},
+		{"truncated gzip", sampleColumns, gzipped(t, sample)[:40], "corrupt gzip stream"},
+	}
+	for _, test := range tests {
+		_, err := readAll(t, test.columns, 10, test.data, 16)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.want)
+		}
+	}
+
+	if _, err := NewReader(nil, 10); err == nil {
+		t.Error("NewReader accepted no columns")
+	}
+}
@@ -0,0 +1,415 @@
+//go:build sqlite_vtable && !wasip1
+
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The cone, box and nearest table-valued functions: a search's arguments
+// are hidden columns, so `FROM cone(56.75, 24.12, 0.5)` is a scan of the
+// search's results, and joins on source_id work as with any table. Each
+// search reads gaiadr3 through a bounding box on ra and dec, so it uses the
+// idx_ra_dec index, then checks the exact distance in Go.
+//
+// go-sqlite3 only includes virtual tables with the sqlite_vtable build
+// tag, which the Makefile sets.
+
+// Columns of every search, before its arguments.
+const (
+	columnSourceID = iota
+	columnRA
+	columnDec
+	// columnSeparation is from the search's centre, in arcseconds.
+	columnSeparation
+	firstArgument
+)
+
+type searchKind int
+
+const (
+	coneSearch searchKind = iota
+	boxSearch
+	nearestSearch
+)
+
+// searchModule is an eponymous-only module: it exists on every connection
+// under its own name and cannot be created with CREATE VIRTUAL TABLE.
+type searchModule struct {
+	name      string
+	kind      searchKind
+	arguments []string
+}
+
+var searchModules = []*searchModule{
+	{"cone", coneSearch, []string{"ra0", "dec0", "radius"}},
+	{"box", boxSearch, []string{"ra_min", "ra_max", "dec_min", "dec_max"}},
+	{"nearest", nearestSearch, []string{"ra0", "dec0", "count"}},
+}
+
+func init() {
+	connectHooks = append(connectHooks, registerSearchModules)
+}
+
+func registerSearchModules(conn *sqlite3.SQLiteConn) error {
+	for _, module := range searchModules {
+		if err := conn.CreateModule(module.name, module); err != nil {
+			return fmt.Errorf("registering %s: %w", module.name, err)
+		}
+	}
+	return nil
+}
+
+func (m *searchModule) EponymousOnlyModule() {}
+
+func (m *searchModule) Create(conn *sqlite3.SQLiteConn, args []string) (sqlite3.VTab, error) {
+	return m.Connect(conn, args)
+}
+
+func (m *searchModule) Connect(conn *sqlite3.SQLiteConn, args []string) (sqlite3.VTab, error) {
+	schema := "CREATE TABLE x(source_id, ra REAL, dec REAL, separation REAL"
+	for _, argument := range m.arguments {
+		schema += ", " + argument + " HIDDEN"
+	}
+	if err := conn.DeclareVTab(schema + ")"); err != nil {
+		return nil, err
+	}
+	return &searchTable{module: m, conn: conn}, nil
+}
+
+func (m *searchModule) DestroyModule() {}
+
+type searchTable struct {
+	module *searchModule
+	conn   *sqlite3.SQLiteConn
+}
+
+// BestIndex takes each argument from an equality constraint on its hidden
+// column. IdxStr lists the arguments in the order Filter receives them.
+func (t *searchTable) BestIndex(constraints []sqlite3.InfoConstraint, orderBys []sqlite3.InfoOrderBy) (*sqlite3.IndexResult, error) {
+	used := make([]bool, len(constraints))
+	seen := make(map[int]bool)
+	var order []string
+	for i, constraint := range constraints {
+		argument := constraint.Column - firstArgument
+		if argument < 0 || !constraint.Usable || constraint.Op != sqlite3.OpEQ || seen[argument] {
+			continue
+		}
+		used[i] = true
+		seen[argument] = true
+		order = append(order, strconv.Itoa(argument))
+	}
+
+	result := &sqlite3.IndexResult{
+		Used:          used,
+		IdxStr:        strings.Join(order, ","),
+		EstimatedCost: 1000,
+		EstimatedRows: 1000,
+	}
+	if len(seen) < len(t.module.arguments) {
+		// Only chosen when there is no other plan; Filter then reports the
+		// missing arguments
+		result.EstimatedCost = 1e18
+		return result, nil
+	}
+	// nearest returns rows closest first
+	if t.module.kind == nearestSearch && len(orderBys) == 1 &&
+		orderBys[0].Column == columnSeparation && !orderBys[0].Desc {
+		result.AlreadyOrdered = true
+	}
+	return result, nil
+}
+
+func (t *searchTable) Open() (sqlite3.VTabCursor, error) {
+	return &searchCursor{table: t}, nil
+}
+
+func (t *searchTable) Disconnect() error { return nil }
+
+func (t *searchTable) Destroy() error { return nil }
+
+// searchRow is one result of a search.
+type searchRow struct {
+	sourceID   driver.Value
+	ra, dec    float64
+	separation float64
+}
+
+type searchCursor struct {
+	table *searchTable
+	// Streamed rows of a cone or box search
+	rows   driver.Rows
+	accept func(row *searchRow) bool
+	// Every row of a nearest search, closest first
+	sorted []searchRow
+	row    searchRow
+	rowid  int64
+	eof    bool
+}
+
+func (c *searchCursor) Filter(_ int, idxStr string, values []any) error {
+	c.closeRows()
+	c.sorted, c.rowid, c.eof = nil, 0, false
+
+	module := c.table.module
+	arguments := make([]float64, len(module.arguments))
+	given := make([]bool, len(module.arguments))
+	if idxStr != "" {
+		for i, position := range strings.Split(idxStr, ",") {
+			argument, _ := strconv.Atoi(position)
+			value, ok, err := sqlFloat(values[i])
+			if err != nil {
+				return fmt.Errorf("%s: %w", module.arguments[argument], err)
+			}
+			if !ok {
+				// A NULL argument matches nothing
+				c.eof = true
+				return nil
+			}
+			arguments[argument], given[argument] = value, true
+		}
+	}
+	for i, ok := range given {
+		if !ok {
+			return fmt.Errorf("missing argument %s; call as %s(%s)",
+				module.arguments[i], module.name, strings.Join(module.arguments, ", "))
+		}
+	}
+
+	var err error
+	switch module.kind {
+	case coneSearch:
+		err = c.startCone(arguments[0], arguments[1], arguments[2])
+	case boxSearch:
+		err = c.startBox(arguments[0], arguments[1], arguments[2], arguments[3])
+	case nearestSearch:
+		err = c.startNearest(arguments[0], arguments[1], arguments[2])
+	}
+	if err != nil {
+		return err
+	}
+	return c.Next()
+}
+
+func (c *searchCursor) startCone(ra, dec, radius float64) error {
+	if radius < 0 {
+		return errors.New("cone: radius must not be negative")
+	}
+	where, args := coneClause(ra, dec, radius)
+	c.accept = func(row *searchRow) bool {
+		row.separation = angularSeparation(ra, dec, row.ra, row.dec) * 3600
+		return row.separation <= radius*3600
+	}
+	return c.query(where, args)
+}
+
+func (c *searchCursor) startBox(raMin, raMax, decMin, decMax float64) error {
+	if decMin > decMax {
+		return errors.New("box: dec_min must not exceed dec_max")
+	}
+	where := "dec BETWEEN ? AND ?"
+	args := []driver.Value{decMin, decMax}
+	raCentre := normaliseRA(raMin + normaliseRA(raMax-raMin)/2)
+	if raMax-raMin >= 360 {
+		raCentre = 180
+	} else {
+		raMin, raMax = normaliseRA(raMin), normaliseRA(raMax)
+		if raMin > raMax {
+			// Wraps through RA 0
+			where += " AND (ra BETWEEN ? AND 360 OR ra BETWEEN 0 AND ?)"
+		} else {
+			where += " AND ra BETWEEN ? AND ?"
+		}
+		args = append(args, raMin, raMax)
+	}
+	decCentre := (decMin + decMax) / 2
+	c.accept = func(row *searchRow) bool {
+		row.separation = angularSeparation(raCentre, decCentre, row.ra, row.dec) * 3600
+		return true
+	}
+	return c.query(where, args)
+}
+
+// startNearest searches cones of growing radius until there are count
+// stars, as GaiaDatabase.nearest does, and keeps the closest.
+func (c *searchCursor) startNearest(ra, dec, count float64) error {
+	if count < 0 || count != math.Trunc(count) {
+		return errors.New("nearest: count must be a whole number")
+	}
+	if count == 0 {
+		c.eof = true
+		return nil
+	}
+
+	for radius := 0.05; ; radius = min(radius*4, 180) {
+		c.sorted = nil
+		if err := c.startCone(ra, dec, radius); err != nil {
+			return err
+		}
+		for {
+			more, err := c.read()
+			if err != nil {
+				return err
+			}
+			if !more {
+				break
+			}
+			c.sorted = append(c.sorted, c.row)
+		}
+		if len(c.sorted) >= int(count) || radius >= 180 {
+			break
+		}
+	}
+
+	sort.SliceStable(c.sorted, func(i, j int) bool {
+		return c.sorted[i].separation < c.sorted[j].separation
+	})
+	if len(c.sorted) > int(count) {
+		c.sorted = c.sorted[:int(count)]
+	}
+	return nil
+}
+
+func (c *searchCursor) query(where string, args []driver.Value) error {
+	c.closeRows()
+	rows, err := c.table.conn.Query("SELECT source_id, ra, dec FROM gaiadr3 WHERE "+where, args)
+	if err != nil {
+		return err
+	}
+	c.rows = rows
+	return nil
+}
+
+// read moves to the next accepted row of the query, returning false at its
+// end.
+func (c *searchCursor) read() (bool, error) {
+	values := make([]driver.Value, 3)
+	for c.rows != nil {
+		err := c.rows.Next(values)
+		if errors.Is(err, io.EOF) {
+			c.closeRows()
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		ra, raOK, _ := sqlFloat(values[1])
+		dec, decOK, _ := sqlFloat(values[2])
+		if !raOK || !decOK {
+			continue
+		}
+		c.row = searchRow{sourceID: values[0], ra: ra, dec: dec}
+		if c.accept(&c.row) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *searchCursor) Next() error {
+	if c.eof {
+		return nil
+	}
+	c.rowid++
+	if c.table.module.kind == nearestSearch {
+		if int(c.rowid) > len(c.sorted) {
+			c.eof = true
+		} else {
+			c.row = c.sorted[c.rowid-1]
+		}
+		return nil
+	}
+	more, err := c.read()
+	c.eof = !more
+	return err
+}
+
+func (c *searchCursor) EOF() bool { return c.eof }
+
+func (c *searchCursor) Column(ctx *sqlite3.SQLiteContext, column int) error {
+	switch column {
+	case columnSourceID:
+		switch id := c.row.sourceID.(type) {
+		case int64:
+			ctx.ResultInt64(id)
+		case string:
+			ctx.ResultText(id)
+		case []byte:
+			ctx.ResultText(string(id))
+		default:
+			ctx.ResultNull()
+		}
+	case columnRA:
+		ctx.ResultDouble(c.row.ra)
+	case columnDec:
+		ctx.ResultDouble(c.row.dec)
+	case columnSeparation:
+		ctx.ResultDouble(c.row.separation)
+	default:
+		// Arguments are only used as constraints
+		ctx.ResultNull()
+	}
+	return nil
+}
+
+func (c *searchCursor) Rowid() (int64, error) { return c.rowid, nil }
+
+func (c *searchCursor) Close() error {
+	c.closeRows()
+	return nil
+}
+
+func (c *searchCursor) closeRows() {
+	if c.rows != nil {
+		c.rows.Close()
+		c.rows = nil
+	}
+}
+
+// coneClause is a bounding box on ra and dec around a cone, as in
+// buildRegionClause in src/database.ts; rows inside it still need the
+// exact distance check.
+func coneClause(ra, dec, radius float64) (string, []driver.Value) {
+	decMin := max(dec-radius, -90)
+	decMax := min(dec+radius, 90)
+	where := "dec BETWEEN ? AND ?"
+	args := []driver.Value{decMin, decMax}
+
+	// When the cone touches a pole it spans every RA
+	sinRatio := math.Sin(radius*math.Pi/180) / math.Cos(dec*math.Pi/180)
+	if decMin > -90 && decMax < 90 && sinRatio < 1 {
+		deltaRA := math.Asin(sinRatio) * 180 / math.Pi
+		raMin := normaliseRA(ra - deltaRA)
+		raMax := normaliseRA(ra + deltaRA)
+		if raMin > raMax {
+			where += " AND (ra BETWEEN ? AND 360 OR ra BETWEEN 0 AND ?)"
+		} else {
+			where += " AND ra BETWEEN ? AND ?"
+		}
+		args = append(args, raMin, raMax)
+	}
+	return where, args
+}
+
+// normaliseRA maps ra to [0, 360). Adding 360 only to negative angles
+// keeps those already in range exact, so a bound equals a stored RA.
+func normaliseRA(ra float64) float64 {
+	ra = math.Mod(ra, 360)
+	if ra < 0 {
+		ra += 360
+	}
+	if ra == 360 {
+		// A tiny negative angle
+		ra = 0
+	}
+	return ra
+}
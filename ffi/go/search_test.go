@@ -0,0 +1,378 @@
+//go:build sqlite_vtable && !wasip1
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+type star struct {
+	id      string
+	ra, dec float64
+}
+
+// openSearch opens an in-memory gaiadr3 with a star every 2.5° and a few
+// near RA 0 and the poles.
+func openSearch(t *testing.T) (*sql.DB, []star) {
+	t.Helper()
+	db := openFunctions(t)
+	if _, err := db.Exec("CREATE TABLE gaiadr3 (source_id TEXT PRIMARY KEY, ra REAL, dec REAL)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE INDEX idx_ra_dec ON gaiadr3(ra, dec)"); err != nil {
+		t.Fatal(err)
+	}
+
+	var stars []star
+	for ra := 0.0; ra < 360; ra += 2.5 {
+		for dec := -88.75; dec < 90; dec += 2.5 {
+			stars = append(stars, star{ra: ra, dec: dec})
+		}
+	}
+	stars = append(stars,
+		star{ra: 359.9, dec: 0.05}, star{ra: 0.1, dec: -0.05},
+		star{ra: 90, dec: 89.9}, star{ra: 270, dec: 89.8},
+		star{ra: 45, dec: -89.95}, star{ra: 200, dec: -89.7},
+	)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range stars {
+		stars[i].id = fmt.Sprint(i + 1)
+		if _, err := tx.Exec("INSERT INTO gaiadr3 VALUES (?, ?, ?)", stars[i].id, stars[i].ra, stars[i].dec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return db, stars
+}
+
+// queryIDs runs a search and returns its source_ids, sorted.
+func queryIDs(t *testing.T, db *sql.DB, query string, args ...any) []string {
+	t.Helper()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// within returns the sorted ids of the stars that keep returns true for.
+func within(stars []star, keep func(s star) bool) []string {
+	var ids []string
+	for _, s := range stars {
+		if keep(s) {
+			ids = append(ids, s.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestConeMatchesBruteForce(t *testing.T) {
+	db, stars := openSearch(t)
+	tests := []struct {
+		name            string
+		ra, dec, radius float64
+	}{
+		{"equator", 56.75, 24.12, 4},
+		{"across RA 0", 0, 0, 3},
+		{"across RA 0 from below", 359.5, 10, 5},
+		{"centre past RA 360", 361, 0, 3},
+		{"touching the north pole", 10, 88, 3},
+		{"around the south pole", 0, -90, 2},
+		{"wide enough for a pole", 123, 80, 12},
+		{"zero radius", 0.1, -0.05, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := queryIDs(t, db, "SELECT source_id FROM cone(?, ?, ?)", test.ra, test.dec, test.radius)
+			want := within(stars, func(s star) bool {
+				return angularSeparation(test.ra, test.dec, s.ra, s.dec) <= test.radius
+			})
+			if len(want) == 0 {
+				t.Fatal("no stars in the cone; the test is not checking anything")
+			}
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("got %d stars %v, want %d %v", len(got), got, len(want), want)
+			}
+		})
+	}
+}
+
+func TestConeSeparation(t *testing.T) {
+	db, _ := openSearch(t)
+	var id string
+	var separation float64
+	err := db.QueryRow("SELECT source_id, separation FROM cone(0, 0, 0.2) WHERE source_id = (SELECT source_id FROM gaiadr3 WHERE ra = 359.9)").
+		Scan(&id, &separation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := angularSeparation(0, 0, 359.9, 0.05) * 3600
+	if separation < want-1e-6 || separation > want+1e-6 {
+		t.Errorf("separation %v arcsec, want %v", separation, want)
+	}
+}
+
+func TestConeClause(t *testing.T) {
+	tests := []struct {
+		name            string
+		ra, dec, radius float64
+		where           string
+		args            int
+	}{
+		{"inside", 180, 0, 1, "dec BETWEEN ? AND ? AND ra BETWEEN ? AND ?", 4},
+		{"across RA 0", 0.5, 0, 1, "dec BETWEEN ? AND ? AND (ra BETWEEN ? AND 360 OR ra BETWEEN 0 AND ?)", 4},
+		{"touching a pole", 0, 89.5, 1, "dec BETWEEN ? AND ?", 2},
+		{"spanning every RA", 0, 60, 40, "dec BETWEEN ? AND ?", 2},
+	}
+	for _, test := range tests {
+		where, args := coneClause(test.ra, test.dec, test.radius)
+		if where != test.where || len(args) != test.args {
+			t.Errorf("%s: got %q with %d args, want %q with %d", test.name, where, len(args), test.where, test.args)
+		}
+	}
+	if _, args := coneClause(0, 89.5, 1); args[1] != 90.0 {
+		t.Errorf("dec range not clamped at the pole: %v", args)
+	}
+}
+
+func TestBox(t *testing.T) {
+	db, stars := openSearch(t)
+	tests := []struct {
+		name                         string
+		raMin, raMax, decMin, decMax float64
+		keep                         func(s star) bool
+	}{
+		{"inside", 10, 20, -5, 5, func(s star) bool {
+			return s.ra >= 10 && s.ra <= 20 && s.dec >= -5 && s.dec <= 5
+		}},
+		{"across RA 0", 355, 5, -3, 3, func(s star) bool {
+			return (s.ra >= 355 || s.ra <= 5) && s.dec >= -3 && s.dec <= 3
+		}},
+		{"negative RA", -5, 5, -3, 3, func(s star) bool {
+			return (s.ra >= 355 || s.ra <= 5) && s.dec >= -3 && s.dec <= 3
+		}},
+		{"every RA", 0, 360, 85, 90, func(s star) bool {
+			return s.dec >= 85
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := queryIDs(t, db, "SELECT source_id FROM box(?, ?, ?, ?)", test.raMin, test.raMax, test.decMin, test.decMax)
+			want := within(stars, test.keep)
+			if len(want) == 0 {
+				t.Fatal("no stars in the box; the test is not checking anything")
+			}
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("got %d stars %v, want %d %v", len(got), got, len(want), want)
+			}
+		})
+	}
+}
+
+func TestNearest(t *testing.T) {
+	db, stars := openSearch(t)
+	for _, count := range []int{1, 5, 40} {
+		rows, err := db.Query("SELECT source_id, separation FROM nearest(0.05, 0, ?) ORDER BY separation", count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		var separations []float64
+		for rows.Next() {
+			var id string
+			var separation float64
+			if err := rows.Scan(&id, &separation); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+			separations = append(separations, separation)
+		}
+		rows.Close()
+
+		sorted := append([]star(nil), stars...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return angularSeparation(0.05, 0, sorted[i].ra, sorted[i].dec) <
+				angularSeparation(0.05, 0, sorted[j].ra, sorted[j].dec)
+		})
+		if len(ids) != count {
+			t.Fatalf("nearest %d: got %d rows", count, len(ids))
+		}
+		for i := range ids {
+			if ids[i] != sorted[i].id {
+				t.Errorf("nearest %d: row %d is %s, want %s", count, i, ids[i], sorted[i].id)
+			}
+			if i > 0 && separations[i] < separations[i-1] {
+				t.Errorf("nearest %d: not closest first at row %d", count, i)
+			}
+		}
+	}
+
+	if ids := queryIDs(t, db, "SELECT source_id FROM nearest(0, 0, 0)"); len(ids) != 0 {
+		t.Errorf("count 0 gave %v", ids)
+	}
+	// More than the catalogue holds gives the whole catalogue
+	if ids := queryIDs(t, db, "SELECT source_id FROM nearest(0, 0, ?)", len(stars)+10); len(ids) != len(stars) {
+		t.Errorf("got %d of %d stars", len(ids), len(stars))
+	}
+}
+
+func TestNearestIsAlreadyOrdered(t *testing.T) {
+	nearest := &searchTable{module: searchModules[2]}
+	cone := &searchTable{module: searchModules[0]}
+	constraints := []sqlite3.InfoConstraint{
+		{Column: firstArgument, Op: sqlite3.OpEQ, Usable: true},
+		{Column: firstArgument + 1, Op: sqlite3.OpEQ, Usable: true},
+		{Column: firstArgument + 2, Op: sqlite3.OpEQ, Usable: true},
+	}
+	tests := []struct {
+		name     string
+		table    *searchTable
+		orderBys []sqlite3.InfoOrderBy
+		want     bool
+	}{
+		{"nearest by separation", nearest, []sqlite3.InfoOrderBy{{Column: columnSeparation}}, true},
+		{"nearest by separation descending", nearest, []sqlite3.InfoOrderBy{{Column: columnSeparation, Desc: true}}, false},
+		{"nearest by ra", nearest, []sqlite3.InfoOrderBy{{Column: columnRA}}, false},
+		{"nearest by separation then ra", nearest, []sqlite3.InfoOrderBy{{Column: columnSeparation}, {Column: columnRA}}, false},
+		{"cone by separation", cone, []sqlite3.InfoOrderBy{{Column: columnSeparation}}, false},
+	}
+	for _, test := range tests {
+		result, err := test.table.BestIndex(constraints, test.orderBys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.AlreadyOrdered != test.want {
+			t.Errorf("%s: AlreadyOrdered = %v, want %v", test.name, result.AlreadyOrdered, test.want)
+		}
+	}
+
+	// SQLite then skips its own sort
+	db, _ := openSearch(t)
+	rows, err := db.Query("EXPLAIN QUERY PLAN SELECT * FROM nearest(0, 0, 5) ORDER BY separation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(detail, "ORDER BY") {
+			t.Errorf("plan sorts the rows: %s", detail)
+		}
+	}
+}
+
+func TestBestIndexArguments(t *testing.T) {
+	cone := &searchTable{module: searchModules[0]}
+	// Arguments in any order; IdxStr records which is which
+	result, err := cone.BestIndex([]sqlite3.InfoConstraint{
+		{Column: firstArgument + 2, Op: sqlite3.OpEQ, Usable: true},
+		{Column: columnRA, Op: sqlite3.OpGT, Usable: true},
+		{Column: firstArgument, Op: sqlite3.OpEQ, Usable: true},
+		{Column: firstArgument + 1, Op: sqlite3.OpEQ, Usable: true},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.IdxStr != "2,0,1" || !result.Used[0] || result.Used[1] || result.EstimatedCost != 1000 {
+		t.Errorf("got %+v", result)
+	}
+
+	// Unusable and missing arguments make the plan a last resort
+	result, err = cone.BestIndex([]sqlite3.InfoConstraint{
+		{Column: firstArgument, Op: sqlite3.OpEQ, Usable: true},
+		{Column: firstArgument + 1, Op: sqlite3.OpEQ, Usable: false},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.EstimatedCost != 1e18 {
+		t.Errorf("missing arguments cost %v", result.EstimatedCost)
+	}
+}
+
+func TestSearchArguments(t *testing.T) {
+	db, _ := openSearch(t)
+	errors := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM cone(0, 0)", "missing argument radius; call as cone(ra0, dec0, radius)"},
+		{"SELECT * FROM cone WHERE ra0 = 0 AND radius = 1", "missing argument dec0"},
+		{"SELECT * FROM box(0, 10, 0)", "missing argument dec_max"},
+		{"SELECT * FROM nearest(0, 0)", "missing argument count"},
+		{"SELECT * FROM cone('north', 0, 1)", `ra0: "north" is not a number`},
+		{"SELECT * FROM cone(0, 0, -1)", "radius must not be negative"},
+		{"SELECT * FROM box(0, 10, 5, -5)", "dec_min must not exceed dec_max"},
+		{"SELECT * FROM nearest(0, 0, 1.5)", "count must be a whole number"},
+		{"SELECT * FROM nearest(0, 0, -1)", "count must be a whole number"},
+	}
+	for _, test := range errors {
+		_, err := db.Exec(test.query)
+		if err == nil {
+			rows, queryErr := db.Query(test.query)
+			if queryErr == nil {
+				for rows.Next() {
+				}
+				queryErr = rows.Err()
+				rows.Close()
+			}
+			err = queryErr
+		}
+		if err == nil {
+			t.Errorf("%s: no error", test.query)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q does not mention %q", test.query, err, test.want)
+		}
+	}
+
+	// A NULL argument matches nothing
+	for _, query := range []string{
+		"SELECT source_id FROM cone(NULL, 0, 5)",
+		"SELECT source_id FROM box(0, 10, NULL, 5)",
+		"SELECT source_id FROM nearest(0, 0, NULL)",
+	} {
+		if ids := queryIDs(t, db, query); len(ids) != 0 {
+			t.Errorf("%s: got %v", query, ids)
+		}
+	}
+
+	// Arguments from another table, as in a join
+	if _, err := db.Exec("CREATE TABLE targets (ra REAL, dec REAL)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO targets VALUES (10, 10), (200, -30)"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := queryIDs(t, db, "SELECT n.source_id FROM targets t, nearest(t.ra, t.dec, 2) n"); len(ids) != 4 {
+		t.Errorf("join gave %v", ids)
+	}
+}
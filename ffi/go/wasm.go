@@ -0,0 +1,207 @@
+//go:build wasip1
+
+package main
+
+import (
+	"encoding/json"
+	"unsafe"
+)
+
+// The WebAssembly build of Reader. The host writes config and input bytes
+// into the scratch buffer from alloc, feeds them to a reader and copies
+// each batch's columns out of linear memory. Pointers into a batch are
+// valid until the next call on that reader.
+
+type wasmReader struct {
+	reader  *Reader
+	batch   *Batch
+	offsets [][]uint32
+	text    [][]byte
+}
+
+var (
+	readers    = map[int32]*wasmReader{}
+	nextHandle int32
+	scratch    []byte
+	lastError  []byte
+)
+
+// Required for -buildmode=c-shared
+func main() {}
+
+func pointer[T any](values []T) uint32 {
+	if len(values) == 0 {
+		return 0
+	}
+	return uint32(uintptr(unsafe.Pointer(&values[0])))
+}
+
+func fail(err error) int32 {
+	lastError = []byte(err.Error())
+	return -1
+}
+
+// alloc returns a buffer of at least size bytes for the host to write into.
+//
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	if uint32(cap(scratch)) < size {
+		scratch = make([]byte, size)
+	}
+	scratch = scratch[:cap(scratch)]
+	return pointer(scratch)
+}
+
+// reader_new creates a reader from the JSON config in the scratch buffer,
+// {"columns": [...], "batch_size": 100000}, returning its handle.
+//
+//go:wasmexport reader_new
+func readerNew(configLength uint32) int32 {
+	var config struct {
+		Columns   []string `json:"columns"`
+		BatchSize int      `json:"batch_size"`
+	}
+	if err := json.Unmarshal(scratch[:configLength], &config); err != nil {
+		return fail(err)
+	}
+
+	reader, err := NewReader(config.Columns, config.BatchSize)
+	if err != nil {
+		return fail(err)
+	}
+
+	nextHandle++
+	readers[nextHandle] = &wasmReader{reader: reader}
+	return nextHandle
+}
+
+// reader_write feeds length bytes from the scratch buffer, returning the
+// number of batches ready.
+//
+//go:wasmexport reader_write
+func readerWrite(handle int32, length uint32) int32 {
+	r, ok := readers[handle]
+	if !ok {
+		return -1
+	}
+	if _, err := r.reader.Write(scratch[:length]); err != nil {
+		return fail(err)
+	}
+	return int32(len(r.reader.ready))
+}
+
+// reader_close ends the input, returning the number of batches ready.
+//
+//go:wasmexport reader_close
+func readerClose(handle int32) int32 {
+	r, ok := readers[handle]
+	if !ok {
+		return -1
+	}
+	if err := r.reader.Close(); err != nil {
+		return fail(err)
+	}
+	return int32(len(r.reader.ready))
+}
+
+// reader_next moves to the next ready batch, returning its row count, or 0
+// if there is none.
+//
+//go:wasmexport reader_next
+func readerNext(handle int32) int32 {
+	r, ok := readers[handle]
+	if !ok {
+		return -1
+	}
+
+	r.batch = r.reader.Next()
+	if r.batch == nil {
+		return 0
+	}
+
+	// Text is laid out as offsets into one byte array
+	columns := len(r.batch.Null)
+	r.offsets = make([][]uint32, columns)
+	r.text = make([][]byte, columns)
+	for i, values := range r.batch.Text {
+		if values == nil {
+			continue
+		}
+		offsets := make([]uint32, 0, len(values)+1)
+		var text []byte
+		for _, value := range values {
+			offsets = append(offsets, uint32(len(text)))
+			text = append(text, value...)
+		}
+		r.offsets[i] = append(offsets, uint32(len(text)))
+		r.text[i] = text
+	}
+
+	return int32(r.batch.Rows)
+}
+
+// batchColumn finds the reader of a handle whose current batch has the
+// column; the caller gets 0 otherwise, as for an unknown handle.
+func batchColumn(handle int32, column int32) (*wasmReader, bool) {
+	r, ok := readers[handle]
+	if !ok || r.batch == nil || column < 0 || int(column) >= len(r.batch.Null) {
+		return nil, false
+	}
+	return r, true
+}
+
+// reader_column returns the current batch's Float64 values for a numeric
+// column, or its Uint32 text offsets (rows + 1) for a text column.
+//
+//go:wasmexport reader_column
+func readerColumn(handle int32, column int32) uint32 {
+	r, ok := batchColumn(handle, column)
+	if !ok {
+		return 0
+	}
+	if r.offsets[column] != nil {
+		return pointer(r.offsets[column])
+	}
+	return pointer(r.batch.Numbers[column])
+}
+
+// reader_text returns the UTF-8 bytes of a text column in the current
+// batch.
+//
+//go:wasmexport reader_text
+func readerText(handle int32, column int32) uint32 {
+	r, ok := batchColumn(handle, column)
+	if !ok {
+		return 0
+	}
+	return pointer(r.text[column])
+}
+
+// reader_nulls returns one byte per row of a column, 1 where it is null.
+//
+//go:wasmexport reader_nulls
+func readerNulls(handle int32, column int32) uint32 {
+	r, ok := batchColumn(handle, column)
+	if !ok {
+		return 0
+	}
+	// A bool is one byte, 0 or 1
+	return pointer(r.batch.Null[column])
+}
+
+//go:wasmexport reader_free
+func readerFree(handle int32) {
+	delete(readers, handle)
+}
+
+// error_message returns the last error; its length is error_length.
+//
+//go:wasmexport error_message
+func errorMessage() uint32 {
+	return pointer(lastError)
+}
+
+//go:wasmexport error_length
+func errorLength() uint32 {
+	return uint32(len(lastError))
+}
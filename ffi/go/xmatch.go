@@ -0,0 +1,154 @@
+//go:build !wasip1
+
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// xmatchColumns are read from a tmass_psc_xsc_best_neighbour file, in the
+// order they are inserted into tmass_xmatch.
+var xmatchColumns = []string{
+	"source_id",
+	"original_ext_source_id",
+	"angular_distance",
+	"number_of_neighbours",
+	"number_of_mates",
+}
+
+// Keeps only links whose Gaia source was ingested. Links already present
+// get the match statistics, for databases crossmatched before they were
+// kept.
+const xmatchQuery = `INSERT INTO tmass_xmatch (gaiadr3_source_id, tmass_source_id, angular_distance, number_of_neighbours, number_of_mates)
+SELECT ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM gaiadr3 WHERE source_id = ?)
+ON CONFLICT (gaiadr3_source_id) DO UPDATE SET
+	angular_distance = excluded.angular_distance,
+	number_of_neighbours = excluded.number_of_neighbours,
+	number_of_mates = excluded.number_of_mates`
+
+// ingestXmatch parses a gzipped 2MASS best-neighbour CSV and inserts the
+// full link of every Gaia source in gaiadr3: one row per Gaia source, so a
+// 2MASS source that is the best neighbour of several is kept for each.
+// RowsKept counts rows with both ids, RowsInserted the links written.
+func ingestXmatch(dbPath, filePath string, batchSize int) (summary Summary, err error) {
+	start := time.Now()
+	if batchSize <= 0 {
+		batchSize = 100000
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return summary, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return summary, fmt.Errorf("corrupt gzip stream: %w", err)
+	}
+	defer gz.Close()
+
+	var gzipTime, csvTime, sqliteTime time.Duration
+	defer func() {
+		summary.Stages = Stages{
+			Gzip:   milliseconds(gzipTime),
+			CSV:    milliseconds(csvTime),
+			SQLite: milliseconds(sqliteTime),
+		}
+	}()
+
+	reader := csv.NewReader(&timedReader{reader: gz, spent: &gzipTime})
+	reader.Comment = '#'
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return summary, fmt.Errorf("reading header: %w", err)
+	}
+	position := make(map[string]int, len(header))
+	for i, name := range header {
+		position[name] = i
+	}
+	indices := make([]int, len(xmatchColumns))
+	for i, column := range xmatchColumns {
+		index, ok := position[column]
+		if !ok {
+			return summary, fmt.Errorf("column %q is not in the file", column)
+		}
+		indices[i] = index
+	}
+
+	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=60000")
+	if err != nil {
+		return summary, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if err := checkSchemaVersion(db); err != nil {
+		return summary, err
+	}
+
+	batch := make([][]any, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		start := time.Now()
+		inserted, err := insertBatch(db, dbPath, xmatchQuery, batch)
+		sqliteTime += time.Since(start)
+		summary.RowsInserted += inserted
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		readStart, gzipBefore := time.Now(), gzipTime
+		record, err := reader.Read()
+		csvTime += time.Since(readStart) - (gzipTime - gzipBefore)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return summary, fmt.Errorf("corrupt gzip stream: %w", err)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("line %d: %w", summary.RowsRead+2, err)
+		}
+		summary.RowsRead++
+
+		sourceID, tmassID := record[indices[0]], record[indices[1]]
+		if sourceID == "" || tmassID == "" {
+			continue
+		}
+		summary.RowsKept++
+
+		batch = append(batch, []any{
+			sourceID,
+			tmassID,
+			convert(xmatchColumns[2], record[indices[2]]),
+			convert(xmatchColumns[3], record[indices[3]]),
+			convert(xmatchColumns[4], record[indices[4]]),
+			sourceID,
+		})
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return summary, err
+	}
+
+	summary.DurationMs = time.Since(start).Milliseconds()
+	return summary, nil
+}
@@ -0,0 +1,46 @@
+// How to run (build the library first with `make -C ../go`):
+// deno run --allow-read --allow-ffi test-go-ffi.ts
+
+import { GoBatchReader } from "../../src/ffi/go.ts";
+
+const filePath = "./test.csv.gz";
+
+const columnsToKeep = [
+  "source_id",
+  "ra",
+  "dec",
+  "parallax",
+  "pmra",
+  "pmdec",
+  "radial_velocity",
+  "phot_g_mean_flux",
+  "phot_bp_mean_flux",
+  "phot_rp_mean_flux",
+  "teff_gspphot",
+  "logg_gspphot",
+  "mh_gspphot",
+];
+
+console.log("Reading:", filePath);
+console.log("Using Go FFI batch reader");
+
+const start = performance.now();
+
+const reader = GoBatchReader.open(filePath, columnsToKeep, 100000);
+let rows = 0;
+try {
+  for (let batch = await reader.next(); batch; batch = await reader.next()) {
+    rows += batch.rows;
+  }
+} finally {
+  reader.close();
+}
+
+const duration = (performance.now() - start) / 1000;
+
+console.log(
+  `\nParsed ${rows.toLocaleString()} rows in ${duration.toFixed(2)}s`,
+);
+console.log(
+  `Rate: ${Math.round(rows / duration).toLocaleString()} rows/sec`,
+);
@@ -0,0 +1,46 @@
+// How to run (build the reader first with `make -C ../go wasm`):
+// deno run --allow-read test-wasm.ts
+//
+// Compares the Go reader compiled to WebAssembly with the native
+// TypeScript parser on the same file, with no magnitude filtering.
+
+import { DEFAULT_CONFIG } from "../../src/config.ts";
+import { streamAndFilterCSV } from "../../src/utils.ts";
+
+const filePath = "./test.csv.gz";
+
+console.log("Reading:", filePath);
+
+const results: { parser: string; rows: number; seconds: number }[] = [];
+
+for (const useWasmParser of [false, true]) {
+  const parser = useWasmParser ? "WebAssembly (Go)" : "TypeScript";
+  console.log(`Using ${parser} parser`);
+
+  const start = performance.now();
+
+  const records = await streamAndFilterCSV(filePath, {
+    ...DEFAULT_CONFIG,
+    // Keep every row, so only parsing is measured
+    magnitudeLimit: Infinity,
+    useWasmParser,
+  });
+
+  results.push({
+    parser,
+    rows: records.length,
+    seconds: (performance.now() - start) / 1000,
+  });
+}
+
+console.log("");
+for (const { parser, rows, seconds } of results) {
+  console.log(
+    `${parser.padEnd(18)} ${rows.toLocaleString()} rows in ${
+      seconds.toFixed(2)
+    }s (${Math.round(rows / seconds).toLocaleString()} rows/sec)`,
+  );
+}
+console.log(
+  `\nSpeedup: ${(results[0].seconds / results[1].seconds).toFixed(2)}x`,
+);
@@ -2,18 +2,42 @@
 // go run test.go
 // Or compile and run:
 // go build -o test-go test.go && ./test-go
+//
+// Profiling (go tool pprof / go tool trace):
+// go run test.go -cpuprofile cpu.prof -memprofile mem.prof -trace trace.out
+// go run test.go -pprof localhost:6060 ./other.csv.gz
 
 package main
 
 import (
 	"compress/gzip"
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"io"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
 	"time"
 )
 
+// timedReader adds the time spent in Read to spent
+type timedReader struct {
+	reader io.Reader
+	spent  *time.Duration
+}
+
+func (r timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.reader.Read(p)
+	*r.spent += time.Since(start)
+	return n, err
+}
+
 func formatNumber(n uint64) string {
 	s := fmt.Sprintf("%d", n)
 	result := ""
@@ -26,12 +50,50 @@ func formatNumber(n uint64) string {
 	return result
 }
 
+func exitOnError(message string, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", message, err)
+		os.Exit(1)
+	}
+}
+
 func main() {
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile to `file`")
+	memProfile := flag.String("memprofile", "", "write a heap profile to `file`")
+	traceFile := flag.String("trace", "", "write an execution trace to `file`")
+	pprofAddress := flag.String("pprof", "", "serve /debug/pprof/ on `address`")
+	flag.Parse()
+
 	filePath := "./test.csv.gz"
+	if flag.NArg() > 0 {
+		filePath = flag.Arg(0)
+	}
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		exitOnError("Error creating CPU profile", err)
+		defer f.Close()
+		exitOnError("Error starting CPU profile", pprof.StartCPUProfile(f))
+		defer pprof.StopCPUProfile()
+	}
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		exitOnError("Error creating trace", err)
+		defer f.Close()
+		exitOnError("Error starting trace", trace.Start(f))
+		defer trace.Stop()
+	}
+	if *pprofAddress != "" {
+		go func() {
+			exitOnError("pprof listener", http.ListenAndServe(*pprofAddress, nil))
+		}()
+		fmt.Printf("pprof: http://%s/debug/pprof/\n", *pprofAddress)
+	}
 
 	fmt.Printf("Reading: %s\n", filePath)
 
 	start := time.Now()
+	var gzipTime, readTime, parseTime time.Duration
 
 	// Open gzipped file
 	file, err := os.Open(filePath)
@@ -49,23 +111,34 @@ func main() {
 	}
 	defer gzReader.Close()
 
-	// Create CSV reader
-	csvReader := csv.NewReader(gzReader)
+	// Create CSV reader; time in the gzip reader is counted separately
+	csvReader := csv.NewReader(timedReader{gzReader, &gzipTime})
 	csvReader.Comment = '#'
 	csvReader.ReuseRecord = true // Reuse the same slice for better performance
 
 	var count uint64 = 0
 
 	// Read header (first non-comment line)
-	_, err = csvReader.Read()
+	header, err := csvReader.Read()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading header: %v\n", err)
 		os.Exit(1)
 	}
 
+	// Float parsing is timed on the columns populate keeps
+	var numeric []int
+	for i, name := range header {
+		switch name {
+		case "ra", "dec", "parallax", "pmra", "pmdec", "phot_g_mean_flux":
+			numeric = append(numeric, i)
+		}
+	}
+
 	// Count rows
 	for {
-		_, err := csvReader.Read()
+		readStart := time.Now()
+		record, err := csvReader.Read()
+		readTime += time.Since(readStart)
 		if err == io.EOF {
 			break
 		}
@@ -73,11 +146,43 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Error reading record: %v\n", err)
 			os.Exit(1)
 		}
+
+		parseStart := time.Now()
+		for _, i := range numeric {
+			if i < len(record) && record[i] != "" && record[i] != "null" {
+				strconv.ParseFloat(record[i], 64)
+			}
+		}
+		parseTime += time.Since(parseStart)
 		count++
 	}
 
-	duration := time.Since(start).Seconds()
+	elapsed := time.Since(start)
+	duration := elapsed.Seconds()
 
 	fmt.Printf("\nParsed %s rows in %.2fs\n", formatNumber(count), duration)
 	fmt.Printf("Rate: %s rows/sec\n", formatNumber(uint64(float64(count)/duration)))
+
+	stages := []struct {
+		name  string
+		spent time.Duration
+	}{
+		{"gzip", gzipTime},
+		{"csv", readTime - gzipTime},
+		{"float parsing", parseTime},
+		{"other", elapsed - readTime - parseTime},
+	}
+	fmt.Println("\nStages:")
+	for _, stage := range stages {
+		fmt.Printf("  %-14s %8.3fs  %5.1f%%\n", stage.name, stage.spent.Seconds(),
+			100*stage.spent.Seconds()/duration)
+	}
+
+	if *memProfile != "" {
+		f, err := os.Create(*memProfile)
+		exitOnError("Error creating heap profile", err)
+		defer f.Close()
+		runtime.GC() // up-to-date statistics
+		exitOnError("Error writing heap profile", pprof.WriteHeapProfile(f))
+	}
 }
@@ -26,14 +26,107 @@
 export { createGaia, Gaia } from "./src/gaia.ts";
 export { GaiaDatabase } from "./src/database.ts";
 
+// Local or remote catalogues
+export {
+  CatalogueError,
+  LocalCatalogue,
+  openCatalogue,
+  RecordStream,
+  RemoteCatalogue,
+} from "./src/client.ts";
+export type {
+  Catalogue,
+  CatalogueOptions,
+  RemoteCatalogueOptions,
+  RequestOptions,
+} from "./src/client.ts";
+
+// HTTP server
+export { createHandler, serve } from "./src/server/server.ts";
+export type { ServerOptions } from "./src/server/server.ts";
+export type { ApiKey, RateLimits } from "./src/server/limits.ts";
+export { JobQueue } from "./src/server/jobs.ts";
+export type {
+  JobFormat,
+  JobInfo,
+  JobOperation,
+  JobQueueOptions,
+  JobRequest,
+  JobStatus,
+} from "./src/server/jobs.ts";
+
+// Query cache and metrics
+export { canonicalQueryKey, QueryCache } from "./src/cache.ts";
+export type { CacheRegion, QueryCacheOptions } from "./src/cache.ts";
+export { Counter, Metrics, metrics } from "./src/metrics.ts";
+
+// Metadata catalogue
+export {
+  columnInfo,
+  computedColumnInfo,
+  gaiaColumnInfo,
+  tableDescriptions,
+} from "./src/schema.ts";
+export type { ColumnInfo } from "./src/schema.ts";
+
+// Content hashes
+export {
+  compareContentHashes,
+  hashContent,
+  readContentHash,
+  storeContentHash,
+} from "./src/hash.ts";
+export type { ContentHash, HashDifference, TableHash } from "./src/hash.ts";
+
+// Schema migrations
+export {
+  MIGRATIONS,
+  PendingMigrationsError,
+  SCHEMA_VERSION,
+  SchemaVersionError,
+} from "./src/migrations.ts";
+export type { Migration } from "./src/migrations.ts";
+
+// Raw SQL with the Go library's functions and table-valued searches
+export { queryGo } from "./src/ffi/go.ts";
+export type { GoQueryResult } from "./src/ffi/go.ts";
+
+// Typed rows
+export { column, nullable, RowScanner, ScanError } from "./src/scan.ts";
+export type { ColumnType, Field, Fields, RowOf } from "./src/scan.ts";
+
+// HEALPix
+export {
+  angToPix,
+  healpixFromSourceId,
+  parseHealpixRange,
+  pixToAng,
+} from "./src/healpix.ts";
+
 // Configuration
 export { DEFAULT_CONFIG } from "./src/config.ts";
 export type { CLIConfig as Config } from "./src/config.ts";
 
 // Types
 export type {
+  ColumnDescription,
   GaiaRecord,
+  TableDescription,
   TmassRecord,
   TmassXmatchRecord,
 } from "./src/database.ts";
-export type { GaiaOptions, PhotometryOutput } from "./src/gaia.ts";
+export type {
+  GaiaOptions,
+  PhotometryOutput,
+  XmatchTarget,
+} from "./src/gaia.ts";
+export type {
+  Classification,
+  LuminosityClass,
+  SpectralType,
+} from "./src/classification.ts";
+export type {
+  ExtinctionOptions,
+  ExtinctionSource,
+  ExtinctionValueSource,
+} from "./src/photometry.ts";
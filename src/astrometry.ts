@@ -0,0 +1,95 @@
+/**
+ * Proper-motion helpers for Gaia DR3 astrometry
+ */
+
+const DEG = Math.PI / 180;
+const MAS_TO_RAD = DEG / 3600000;
+
+/**
+ * Reference epoch of Gaia DR3 positions (Julian year, TCB)
+ */
+export const GAIA_DR3_EPOCH = 2016.0;
+
+export interface EquatorialPosition {
+  ra: number;
+  dec: number;
+}
+
+/**
+ * Great-circle separation between two positions in degrees
+ */
+export function angularSeparation(
+  a: EquatorialPosition,
+  b: EquatorialPosition,
+): number {
+  const dRa = (b.ra - a.ra) * DEG;
+  const dec1 = a.dec * DEG;
+  const dec2 = b.dec * DEG;
+
+  // Vincenty formula, stable at small and large separations
+  const num = Math.hypot(
+    Math.cos(dec2) * Math.sin(dRa),
+    Math.cos(dec1) * Math.sin(dec2) -
+      Math.sin(dec1) * Math.cos(dec2) * Math.cos(dRa),
+  );
+  const den = Math.sin(dec1) * Math.sin(dec2) +
+    Math.cos(dec1) * Math.cos(dec2) * Math.cos(dRa);
+
+  return Math.atan2(num, den) / DEG;
+}
+
+/**
+ * Total proper motion in mas/yr. pmra already includes the cos(dec) factor.
+ */
+export function totalProperMotion(pmra: number, pmdec: number): number {
+  return Math.sqrt(pmra * pmra + pmdec * pmdec);
+}
+
+/**
+ * Position angle of the proper motion in degrees, east of north (0–360)
+ */
+export function motionPositionAngle(pmra: number, pmdec: number): number {
+  const angle = Math.atan2(pmra, pmdec) / DEG;
+  return angle < 0 ? angle + 360 : angle;
+}
+
+/**
+ * Propagate a position from the Gaia DR3 epoch to another epoch, assuming
+ * uniform motion on the sky. Works on unit vectors so it stays well behaved
+ * near the poles. Parallax and radial velocity (perspective acceleration) are
+ * ignored, which is accurate to well under a milliarcsecond for all but the
+ * very nearest stars over a few decades.
+ */
+export function propagatePosition(
+  ra: number,
+  dec: number,
+  pmra: number,
+  pmdec: number,
+  epoch: number,
+  fromEpoch = GAIA_DR3_EPOCH,
+): { ra: number; dec: number } {
+  const dt = epoch - fromEpoch;
+  const a = ra * DEG;
+  const d = dec * DEG;
+
+  // Position and the local east (p) / north (q) directions
+  const r = [Math.cos(d) * Math.cos(a), Math.cos(d) * Math.sin(a), Math.sin(d)];
+  const p = [-Math.sin(a), Math.cos(a), 0];
+  const q = [
+    -Math.sin(d) * Math.cos(a),
+    -Math.sin(d) * Math.sin(a),
+    Math.cos(d),
+  ];
+
+  const muA = pmra * MAS_TO_RAD * dt;
+  const muD = pmdec * MAS_TO_RAD * dt;
+  const moved = r.map((value, i) => value + p[i] * muA + q[i] * muD);
+  const norm = Math.hypot(moved[0], moved[1], moved[2]);
+
+  const newRa = Math.atan2(moved[1], moved[0]) / DEG;
+
+  return {
+    ra: newRa < 0 ? newRa + 360 : newRa,
+    dec: Math.asin(moved[2] / norm) / DEG,
+  };
+}
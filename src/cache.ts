@@ -0,0 +1,442 @@
+/**
+ * Query result cache: an in-memory LRU with an optional on-disk layer.
+ *
+ * Entries are keyed by a canonical form of the query (kind, arguments and
+ * every option that changes the output), and remember the sky region they
+ * cover. When `populate` commits a file it records the file's HEALPix range
+ * in the `cache_invalidations` table; before each lookup the cache reads
+ * new invalidations and drops entries whose region intersects them. This
+ * works across processes, e.g. a `serve` process picks up a concurrent
+ * `populate`. The disk layer is capped in bytes and drops the files read or
+ * written longest ago first.
+ */
+
+import type { CacheInvalidation, GaiaRecord, Region } from "./database.ts";
+import { coneIntersectsPixels, GAIA_FILE_LEVEL } from "./healpix.ts";
+import {
+  type Counter,
+  type Metrics,
+  metrics as defaultMetrics,
+} from "./metrics.ts";
+import type { LogLevel, Logger } from "./types.ts";
+import { createLogger } from "./utils.ts";
+
+/**
+ * Sky covered by a cached result: cones, level-8 HEALPix pixels, or null
+ * for the whole sky
+ */
+export type CacheRegion = { cones: Region[] } | { pixels: number[] } | null;
+
+export interface CacheQuery {
+  /** Query type, e.g. "cone" */
+  kind: string;
+  /** Query arguments: position, ids, thresholds, epoch */
+  args: Record<string, unknown>;
+  /** Options that change the output: filters, columns, photometry */
+  options: Record<string, unknown>;
+}
+
+export interface InvalidationSource {
+  getCacheInvalidations(sinceId: number): CacheInvalidation[];
+}
+
+export interface QueryCacheOptions {
+  /**
+   * Results kept in memory
+   * @default 256
+   */
+  maxEntries?: number;
+  /** Directory for the on-disk layer; omitted for memory only */
+  directory?: string;
+  /**
+   * Bytes the on-disk layer may hold, 0 for no limit
+   * @default 1 GiB
+   */
+  maxDiskBytes?: number;
+  /** Registry for hit/miss counters */
+  metrics?: Metrics;
+  /**
+   * @default "WARN"
+   */
+  logLevel?: LogLevel;
+}
+
+interface Entry {
+  key: string;
+  region: CacheRegion;
+  /** Latest invalidation applied when the entry was stored */
+  invalidationId: number;
+  records: GaiaRecord[];
+}
+
+/**
+ * Stable string form of a value: object keys sorted and numbers rounded to
+ * 12 significant digits, so equivalent queries share a key
+ */
+export function canonicalQueryKey(query: CacheQuery): string {
+  const canonical = (value: unknown): unknown => {
+    if (typeof value === "number") {
+      return Number.isFinite(value) ? Number(value.toPrecision(12)) : value;
+    }
+    if (Array.isArray(value)) {
+      return value.map(canonical);
+    }
+    if (value && typeof value === "object") {
+      const object = value as Record<string, unknown>;
+      return Object.fromEntries(
+        Object.keys(object)
+          .sort()
+          .filter((key) => object[key] !== undefined)
+          .map((key) => [key, canonical(object[key])]),
+      );
+    }
+    return value;
+  };
+
+  return JSON.stringify(canonical(query));
+}
+
+/**
+ * 64-bit FNV-1a of a string as 16 hex digits, for file names
+ */
+function hashKey(key: string): string {
+  let hash = 0xcbf29ce484222325n;
+  for (let i = 0; i < key.length; i++) {
+    hash ^= BigInt(key.charCodeAt(i));
+    hash = (hash * 0x100000001b3n) & 0xffffffffffffffffn;
+  }
+  return hash.toString(16).padStart(16, "0");
+}
+
+function intersects(
+  region: CacheRegion,
+  invalidation: CacheInvalidation,
+): boolean {
+  const { healpix_start: start, healpix_end: end } = invalidation;
+  if (region === null || start === null || end === null) {
+    return true;
+  }
+
+  if ("pixels" in region) {
+    return region.pixels.some((pixel) => pixel >= start && pixel <= end);
+  }
+
+  return region.cones.some((cone) =>
+    coneIntersectsPixels(cone, GAIA_FILE_LEVEL, start, end)
+  );
+}
+
+export const DEFAULT_MAX_DISK_BYTES = 1024 ** 3;
+
+export class QueryCache {
+  private entries = new Map<string, Entry>();
+  private maxEntries: number;
+  private directory?: string;
+  private maxDiskBytes: number;
+  private logger: Logger;
+  /** Latest invalidation applied; -1 before the first lookup */
+  private lastInvalidation = -1;
+  private directoryReady = false;
+  /**
+   * Sizes of the files on disk, least recently used first; read from the
+   * directory on first use
+   */
+  private diskFiles: Map<string, number> | null = null;
+  private diskBytes = 0;
+
+  private hits: Counter;
+  private misses: Counter;
+  private evictions: Counter;
+  private invalidations: Counter;
+
+  constructor(options: QueryCacheOptions = {}) {
+    this.maxEntries = options.maxEntries ?? 256;
+    this.directory = options.directory;
+    this.maxDiskBytes = options.maxDiskBytes ?? DEFAULT_MAX_DISK_BYTES;
+    this.logger = createLogger(options.logLevel ?? "WARN", "Cache");
+
+    const registry = options.metrics ?? defaultMetrics;
+    this.hits = registry.counter(
+      "gaiaoffline_cache_hits_total",
+      "Query cache hits by layer",
+    );
+    this.misses = registry.counter(
+      "gaiaoffline_cache_misses_total",
+      "Query cache misses",
+    );
+    this.evictions = registry.counter(
+      "gaiaoffline_cache_evictions_total",
+      "Entries evicted to keep a layer within its size",
+    );
+    this.invalidations = registry.counter(
+      "gaiaoffline_cache_invalidations_total",
+      "Entries dropped because populate added rows to their region",
+    );
+  }
+
+  /**
+   * Apply invalidations recorded since the last lookup
+   */
+  private sync(source: InvalidationSource): void {
+    const pending = source.getCacheInvalidations(
+      Math.max(this.lastInvalidation, 0),
+    );
+
+    if (this.lastInvalidation < 0) {
+      // Nothing in memory yet; disk entries are checked as they are read
+      this.lastInvalidation = pending.at(-1)?.id ?? 0;
+      return;
+    }
+
+    if (pending.length === 0) {
+      return;
+    }
+
+    for (const [key, entry] of this.entries) {
+      const stale = pending.some((invalidation) =>
+        intersects(entry.region, invalidation)
+      );
+      if (stale) {
+        this.entries.delete(key);
+        this.removeFromDisk(key);
+        this.invalidations.inc({ layer: "memory" });
+      }
+    }
+
+    this.lastInvalidation = pending[pending.length - 1].id;
+  }
+
+  private diskPath(key: string): string | null {
+    return this.directory ? `${this.directory}/${hashKey(key)}.json` : null;
+  }
+
+  private readFromDisk(
+    key: string,
+    source: InvalidationSource,
+  ): Entry | null {
+    const path = this.diskPath(key);
+    if (!path) {
+      return null;
+    }
+
+    let entry: Entry;
+    try {
+      entry = JSON.parse(Deno.readTextFileSync(path));
+    } catch (error) {
+      if (!(error instanceof Deno.errors.NotFound)) {
+        this.logger.warn(
+          `Ignoring unreadable cache file ${path}: ${error}`,
+        );
+      }
+      return null;
+    }
+
+    // Guard against hash collisions
+    if (entry.key !== key) {
+      return null;
+    }
+
+    const stale = source.getCacheInvalidations(entry.invalidationId)
+      .some((invalidation) => intersects(entry.region, invalidation));
+    if (stale) {
+      this.removeFromDisk(key);
+      this.invalidations.inc({ layer: "disk" });
+      return null;
+    }
+
+    // Keep the file from being evicted next, here and after a restart
+    try {
+      const now = new Date();
+      Deno.utimeSync(path, now, now);
+      this.trackOnDisk(path, Deno.statSync(path).size);
+    } catch {
+      // Removed by another process since it was read
+    }
+
+    return entry;
+  }
+
+  /**
+   * Files in the directory with their sizes, least recently used first
+   */
+  private diskIndex(): Map<string, number> {
+    if (this.diskFiles) {
+      return this.diskFiles;
+    }
+
+    const files: { path: string; size: number; used: number }[] = [];
+    try {
+      for (const file of Deno.readDirSync(this.directory!)) {
+        if (file.isFile && file.name.endsWith(".json")) {
+          const path = `${this.directory}/${file.name}`;
+          const info = Deno.statSync(path);
+          const used = info.mtime?.getTime() ?? 0;
+          files.push({ path, size: info.size, used });
+        }
+      }
+    } catch {
+      // Directory doesn't exist yet
+    }
+
+    files.sort((a, b) => a.used - b.used);
+    this.diskFiles = new Map(files.map((file) => [file.path, file.size]));
+    this.diskBytes = files.reduce((total, file) => total + file.size, 0);
+    return this.diskFiles;
+  }
+
+  /**
+   * Record a file as the most recently used
+   */
+  private trackOnDisk(path: string, size: number): void {
+    const files = this.diskIndex();
+    this.diskBytes += size - (files.get(path) ?? 0);
+    files.delete(path);
+    files.set(path, size);
+  }
+
+  /**
+   * Remove the least recently used files until the layer fits its cap
+   */
+  private trimDisk(): void {
+    if (this.maxDiskBytes <= 0) {
+      return;
+    }
+
+    const files = this.diskIndex();
+    for (const [path, size] of files) {
+      if (this.diskBytes <= this.maxDiskBytes) {
+        break;
+      }
+      try {
+        Deno.removeSync(path);
+      } catch {
+        // Already removed, e.g. by another process
+      }
+      files.delete(path);
+      this.diskBytes -= size;
+      this.evictions.inc({ layer: "disk" });
+    }
+  }
+
+  private writeToDisk(entry: Entry): void {
+    const path = this.diskPath(entry.key);
+    if (!path) {
+      return;
+    }
+
+    try {
+      if (!this.directoryReady) {
+        Deno.mkdirSync(this.directory!, { recursive: true });
+        this.directoryReady = true;
+      }
+      Deno.writeTextFileSync(path, JSON.stringify(entry));
+      this.trackOnDisk(path, Deno.statSync(path).size);
+    } catch (error) {
+      this.logger.warn(`Failed to write cache file ${path}: ${error}`);
+      return;
+    }
+    this.trimDisk();
+  }
+
+  private removeFromDisk(key: string): void {
+    const path = this.diskPath(key);
+    if (!path) {
+      return;
+    }
+
+    try {
+      Deno.removeSync(path);
+    } catch {
+      // Not on disk
+    }
+
+    const files = this.diskIndex();
+    this.diskBytes -= files.get(path) ?? 0;
+    files.delete(path);
+  }
+
+  private remember(entry: Entry): void {
+    this.entries.delete(entry.key);
+    this.entries.set(entry.key, entry);
+
+    while (this.entries.size > this.maxEntries) {
+      const oldest = this.entries.keys().next().value!;
+      this.entries.delete(oldest);
+      this.evictions.inc({ layer: "memory" });
+    }
+  }
+
+  /**
+   * Cached records for a query, or undefined on a miss. The array is the
+   * caller's own, but the records in it are shared with the cache and must
+   * not be modified.
+   */
+  get(
+    query: CacheQuery,
+    source: InvalidationSource,
+  ): GaiaRecord[] | undefined {
+    this.sync(source);
+    const key = canonicalQueryKey(query);
+
+    const cached = this.entries.get(key);
+    if (cached) {
+      this.remember(cached);
+      this.hits.inc({ layer: "memory" });
+      return [...cached.records];
+    }
+
+    const fromDisk = this.readFromDisk(key, source);
+    if (fromDisk) {
+      this.remember({ ...fromDisk, invalidationId: this.lastInvalidation });
+      this.hits.inc({ layer: "disk" });
+      return [...fromDisk.records];
+    }
+
+    this.misses.inc();
+    return undefined;
+  }
+
+  /**
+   * Store the records for a query that covered `region`. Call after `get`
+   * missed, so invalidations up to the query are already applied.
+   */
+  set(query: CacheQuery, region: CacheRegion, records: GaiaRecord[]): void {
+    const entry: Entry = {
+      key: canonicalQueryKey(query),
+      region,
+      invalidationId: Math.max(this.lastInvalidation, 0),
+      // The caller keeps `records`
+      records: [...records],
+    };
+
+    if (this.maxEntries > 0) {
+      this.remember(entry);
+    }
+    this.writeToDisk(entry);
+  }
+
+  /**
+   * Drop every entry, in memory and on disk
+   */
+  clear(): void {
+    for (const key of this.entries.keys()) {
+      this.removeFromDisk(key);
+    }
+    this.entries.clear();
+    this.diskFiles = null;
+
+    if (!this.directory) {
+      return;
+    }
+
+    try {
+      for (const file of Deno.readDirSync(this.directory)) {
+        if (file.isFile && file.name.endsWith(".json")) {
+          Deno.removeSync(`${this.directory}/${file.name}`);
+        }
+      }
+    } catch {
+      // Directory doesn't exist yet
+    }
+  }
+}
@@ -0,0 +1,218 @@
+import { assertEquals } from "@std/assert";
+import {
+  type CacheQuery,
+  canonicalQueryKey,
+  type InvalidationSource,
+  QueryCache,
+  type QueryCacheOptions,
+} from "./cache.ts";
+import type { CacheInvalidation, GaiaRecord } from "./database.ts";
+import { angToPix, GAIA_FILE_LEVEL } from "./healpix.ts";
+import { Metrics } from "./metrics.ts";
+
+/**
+ * Invalidations as `populate` would record them, appended by `add`
+ */
+function invalidationLog(): InvalidationSource & {
+  add(start: number | null, end?: number | null): void;
+} {
+  const log: CacheInvalidation[] = [];
+  return {
+    getCacheInvalidations: (sinceId) => log.filter((i) => i.id > sinceId),
+    add: (start, end = start) =>
+      log.push({ id: log.length + 1, healpix_start: start, healpix_end: end }),
+  };
+}
+
+function cone(ra: number, dec: number, radius = 0.1): CacheQuery {
+  return { kind: "cone", args: { ra, dec, radius }, options: {} };
+}
+
+function records(...ids: string[]): GaiaRecord[] {
+  return ids.map((source_id) => ({ source_id, ra: 0, dec: 0 }));
+}
+
+function newCache(options: QueryCacheOptions = {}) {
+  const metrics = new Metrics();
+  const cache = new QueryCache({ logLevel: "ERROR", metrics, ...options });
+  const count = (name: string, labels = {}) =>
+    metrics.counter(`gaiaoffline_cache_${name}_total`, "").get(labels);
+  return { cache, count };
+}
+
+Deno.test("equivalent queries share a key", () => {
+  assertEquals(
+    canonicalQueryKey({
+      kind: "cone",
+      args: { ra: 0.1 + 0.2, dec: 6, after: undefined },
+      options: { b: 1, a: [2] },
+    }),
+    canonicalQueryKey({
+      kind: "cone",
+      args: { dec: 6, ra: 0.3 },
+      options: { a: [2], b: 1 },
+    }),
+  );
+});
+
+Deno.test("only invalidations that touch an entry's region drop it", () => {
+  const { cache, count } = newCache();
+  const log = invalidationLog();
+  const pixel = angToPix(GAIA_FILE_LEVEL, 45, 6);
+  const far = angToPix(GAIA_FILE_LEVEL, 225, -60);
+
+  const near = cone(45, 6);
+  const byPixel = { kind: "lookup", args: { ids: ["1"] }, options: {} };
+  const allSky = { kind: "brightness", args: {}, options: {} };
+  for (const query of [near, byPixel, allSky]) {
+    cache.get(query, log);
+    cache.set(
+      query,
+      query === near
+        ? { cones: [{ ra: 45, dec: 6, radius: 0.1 }] }
+        : query === byPixel
+        ? { pixels: [pixel] }
+        : null,
+      records("1"),
+    );
+  }
+
+  // A file elsewhere on the sky only affects the all-sky result
+  log.add(far);
+  assertEquals(cache.get(near, log)?.length, 1);
+  assertEquals(cache.get(byPixel, log)?.length, 1);
+  assertEquals(cache.get(allSky, log), undefined);
+
+  // A file covering the cone's pixel affects both others
+  log.add(pixel - 1, pixel + 1);
+  assertEquals(cache.get(near, log), undefined);
+  assertEquals(cache.get(byPixel, log), undefined);
+  assertEquals(count("invalidations", { layer: "memory" }), 3);
+
+  // A file with no known range affects everything
+  cache.set(near, { cones: [{ ra: 45, dec: 6, radius: 0.1 }] }, records("1"));
+  log.add(null);
+  assertEquals(cache.get(near, log), undefined);
+});
+
+Deno.test("the least recently used entry is evicted from memory", () => {
+  const { cache, count } = newCache({ maxEntries: 2 });
+  const log = invalidationLog();
+  const [a, b, c] = [cone(1, 1), cone(2, 2), cone(3, 3)];
+  cache.get(a, log);
+  cache.set(a, null, records("a"));
+  cache.set(b, null, records("b"));
+  // Using a makes b the oldest
+  cache.get(a, log);
+  cache.set(c, null, records("c"));
+
+  assertEquals(cache.get(b, log), undefined);
+  assertEquals(cache.get(a, log), records("a"));
+  assertEquals(cache.get(c, log), records("c"));
+  assertEquals(count("evictions", { layer: "memory" }), 1);
+});
+
+Deno.test("callers get their own arrays", () => {
+  const { cache } = newCache();
+  const log = invalidationLog();
+  const query = cone(1, 1);
+  const stored = records("a", "b");
+  cache.get(query, log);
+  cache.set(query, null, stored);
+  stored.pop();
+
+  const first = cache.get(query, log)!;
+  first.push(...records("c"));
+  const second = cache.get(query, log)!;
+  assertEquals(second, records("a", "b"));
+  assertEquals(first === second, false);
+});
+
+function withDirectory(test: (directory: string) => void) {
+  return () => {
+    const directory = Deno.makeTempDirSync();
+    try {
+      test(directory);
+    } finally {
+      Deno.removeSync(directory, { recursive: true });
+    }
+  };
+}
+
+function files(directory: string): number {
+  return [...Deno.readDirSync(directory)].length;
+}
+
+Deno.test(
+  "results survive a restart on disk until invalidated",
+  withDirectory((directory) => {
+    const log = invalidationLog();
+    const query = cone(45, 6);
+    const first = newCache({ directory });
+    first.cache.get(query, log);
+    first.cache.set(
+      query,
+      { cones: [{ ra: 45, dec: 6, radius: 0.1 }] },
+      records("1"),
+    );
+
+    const second = newCache({ directory });
+    assertEquals(second.cache.get(query, log), records("1"));
+    assertEquals(second.count("hits", { layer: "disk" }), 1);
+
+    // Invalidated while no process held it in memory
+    log.add(angToPix(GAIA_FILE_LEVEL, 45, 6));
+    const third = newCache({ directory });
+    assertEquals(third.cache.get(query, log), undefined);
+    assertEquals(third.count("invalidations", { layer: "disk" }), 1);
+    assertEquals(files(directory), 0);
+  }),
+);
+
+Deno.test(
+  "the disk layer drops the least recently used files past its size",
+  withDirectory((directory) => {
+    const log = invalidationLog();
+    const big = (id: string) =>
+      records(...Array.from({ length: 50 }, (_, i) => `${id}${i}`));
+    // Every result has the same size on disk
+    const probe = `${directory}/probe`;
+    const sizer = newCache({ directory: probe, maxEntries: 0 });
+    sizer.cache.get(cone(0, 0), log);
+    sizer.cache.set(cone(0, 0), null, big("a"));
+    const [file] = Deno.readDirSync(probe);
+    const size = Deno.statSync(`${probe}/${file.name}`).size;
+
+    // Room for two results, and memory off so every hit reads the disk
+    const dir = `${directory}/cache`;
+    const { cache, count } = newCache({
+      directory: dir,
+      maxEntries: 0,
+      maxDiskBytes: Math.floor(size * 2.5),
+    });
+    const [a, b, c] = [cone(1, 1), cone(2, 2), cone(3, 3)];
+    cache.get(a, log);
+    cache.set(a, null, big("a"));
+    cache.set(b, null, big("b"));
+    // Reading a makes b the oldest
+    assertEquals(cache.get(a, log)?.length, 50);
+    cache.set(c, null, big("c"));
+
+    assertEquals(files(dir), 2);
+    assertEquals(cache.get(b, log), undefined);
+    assertEquals(cache.get(a, log)?.length, 50);
+    assertEquals(cache.get(c, log)?.length, 50);
+    assertEquals(count("evictions", { layer: "disk" }), 1);
+
+    // A new process counts the files already there
+    const restarted = newCache({
+      directory: dir,
+      maxEntries: 0,
+      maxDiskBytes: Math.floor(size * 2.5),
+    });
+    restarted.cache.get(b, log);
+    restarted.cache.set(b, null, big("b"));
+    assertEquals(files(dir), 2);
+    assertEquals(restarted.count("evictions", { layer: "disk" }), 1);
+  }),
+);
@@ -0,0 +1,255 @@
+/**
+ * Minimal raster drawing and PNG encoding, enough to render line charts
+ * without pulling in a canvas implementation or native dependencies.
+ */
+
+export type Color = [number, number, number];
+
+/**
+ * Distinguishable line colours for chart series
+ */
+export const PALETTE: Color[] = [
+  [31, 119, 180],
+  [255, 127, 14],
+  [44, 160, 44],
+  [214, 39, 40],
+  [148, 103, 189],
+  [140, 86, 75],
+  [227, 119, 194],
+  [127, 127, 127],
+  [188, 189, 34],
+  [23, 190, 207],
+];
+
+// 3x5 bitmap glyphs, one string per row, "#" = set pixel
+const GLYPHS: Record<string, string[]> = {
+  "0": ["###", "#.#", "#.#", "#.#", "###"],
+  "1": [".#.", "##.", ".#.", ".#.", "###"],
+  "2": ["###", "..#", "###", "#..", "###"],
+  "3": ["###", "..#", "###", "..#", "###"],
+  "4": ["#.#", "#.#", "###", "..#", "..#"],
+  "5": ["###", "#..", "###", "..#", "###"],
+  "6": ["###", "#..", "###", "#.#", "###"],
+  "7": ["###", "..#", ".#.", ".#.", ".#."],
+  "8": ["###", "#.#", "###", "#.#", "###"],
+  "9": ["###", "#.#", "###", "..#", "###"],
+  ":": ["...", ".#.", "...", ".#.", "..."],
+  ".": ["...", "...", "...", "...", ".#."],
+  "-": ["...", "...", "###", "...", "..."],
+  " ": ["...", "...", "...", "...", "..."],
+  "A": [".#.", "#.#", "###", "#.#", "#.#"],
+  "B": ["##.", "#.#", "##.", "#.#", "##."],
+  "C": ["###", "#..", "#..", "#..", "###"],
+  "D": ["##.", "#.#", "#.#", "#.#", "##."],
+  "E": ["###", "#..", "##.", "#..", "###"],
+  "F": ["###", "#..", "##.", "#..", "#.."],
+  "G": ["###", "#..", "#.#", "#.#", "###"],
+  "H": ["#.#", "#.#", "###", "#.#", "#.#"],
+  "I": ["###", ".#.", ".#.", ".#.", "###"],
+  "J": ["..#", "..#", "..#", "#.#", "###"],
+  "K": ["#.#", "#.#", "##.", "#.#", "#.#"],
+  "L": ["#..", "#..", "#..", "#..", "###"],
+  "M": ["#.#", "###", "###", "#.#", "#.#"],
+  "N": ["##.", "#.#", "#.#", "#.#", "#.#"],
+  "O": ["###", "#.#", "#.#", "#.#", "###"],
+  "P": ["###", "#.#", "###", "#..", "#.."],
+  "Q": ["###", "#.#", "#.#", "###", "..#"],
+  "R": ["##.", "#.#", "##.", "#.#", "#.#"],
+  "S": ["###", "#..", "###", "..#", "###"],
+  "T": ["###", ".#.", ".#.", ".#.", ".#."],
+  "U": ["#.#", "#.#", "#.#", "#.#", "###"],
+  "V": ["#.#", "#.#", "#.#", "#.#", ".#."],
+  "W": ["#.#", "#.#", "###", "###", "#.#"],
+  "X": ["#.#", "#.#", ".#.", "#.#", "#.#"],
+  "Y": ["#.#", "#.#", ".#.", ".#.", ".#."],
+  "Z": ["###", "..#", ".#.", "#..", "###"],
+};
+
+/**
+ * An RGB raster with simple drawing primitives
+ */
+export class Raster {
+  readonly width: number;
+  readonly height: number;
+  private pixels: Uint8Array;
+
+  constructor(
+    width: number,
+    height: number,
+    background: Color = [255, 255, 255],
+  ) {
+    this.width = width;
+    this.height = height;
+    this.pixels = new Uint8Array(width * height * 3);
+
+    for (let i = 0; i < width * height; i++) {
+      this.pixels.set(background, i * 3);
+    }
+  }
+
+  setPixel(x: number, y: number, color: Color): void {
+    const px = Math.round(x);
+    const py = Math.round(y);
+    if (px < 0 || py < 0 || px >= this.width || py >= this.height) {
+      return;
+    }
+    this.pixels.set(color, (py * this.width + px) * 3);
+  }
+
+  fillRect(x: number, y: number, w: number, h: number, color: Color): void {
+    for (let dy = 0; dy < h; dy++) {
+      for (let dx = 0; dx < w; dx++) {
+        this.setPixel(x + dx, y + dy, color);
+      }
+    }
+  }
+
+  /**
+   * Draw a line using Bresenham's algorithm, optionally thickened
+   */
+  line(
+    x0: number,
+    y0: number,
+    x1: number,
+    y1: number,
+    color: Color,
+    thickness = 1,
+  ): void {
+    let x = Math.round(x0);
+    let y = Math.round(y0);
+    const xEnd = Math.round(x1);
+    const yEnd = Math.round(y1);
+    const dx = Math.abs(xEnd - x);
+    const dy = -Math.abs(yEnd - y);
+    const sx = x < xEnd ? 1 : -1;
+    const sy = y < yEnd ? 1 : -1;
+    const offset = Math.floor(thickness / 2);
+    let err = dx + dy;
+
+    while (true) {
+      this.fillRect(x - offset, y - offset, thickness, thickness, color);
+      if (x === xEnd && y === yEnd) {
+        break;
+      }
+      const e2 = 2 * err;
+      if (e2 >= dy) {
+        err += dy;
+        x += sx;
+      }
+      if (e2 <= dx) {
+        err += dx;
+        y += sy;
+      }
+    }
+  }
+
+  /**
+   * Draw text with the built-in 3x5 font. Unknown characters render blank.
+   */
+  text(x: number, y: number, value: string, color: Color, scale = 2): void {
+    let cursor = x;
+    for (const char of value.toUpperCase()) {
+      const glyph = GLYPHS[char] ?? GLYPHS[" "];
+      glyph.forEach((row, gy) => {
+        for (let gx = 0; gx < row.length; gx++) {
+          if (row[gx] === "#") {
+            this.fillRect(
+              cursor + gx * scale,
+              y + gy * scale,
+              scale,
+              scale,
+              color,
+            );
+          }
+        }
+      });
+      cursor += 4 * scale;
+    }
+  }
+
+  /**
+   * Width in pixels of text drawn with `text`
+   */
+  static textWidth(value: string, scale = 2): number {
+    return value.length * 4 * scale - scale;
+  }
+
+  /**
+   * Encode the raster as an 8-bit RGB PNG
+   */
+  async toPNG(): Promise<Uint8Array> {
+    // Each scanline is prefixed with filter type 0 (none)
+    const stride = this.width * 3;
+    const raw = new Uint8Array((stride + 1) * this.height);
+    for (let y = 0; y < this.height; y++) {
+      raw[y * (stride + 1)] = 0;
+      raw.set(
+        this.pixels.subarray(y * stride, (y + 1) * stride),
+        y * (stride + 1) + 1,
+      );
+    }
+
+    // CompressionStream("deflate") produces the zlib wrapper PNG expects
+    const compressed = new Uint8Array(
+      await new Response(
+        new Blob([raw]).stream().pipeThrough(new CompressionStream("deflate")),
+      ).arrayBuffer(),
+    );
+
+    const header = new Uint8Array(13);
+    const view = new DataView(header.buffer);
+    view.setUint32(0, this.width);
+    view.setUint32(4, this.height);
+    header[8] = 8; // bit depth
+    header[9] = 2; // colour type: truecolour
+    header[10] = 0; // compression
+    header[11] = 0; // filter
+    header[12] = 0; // interlace
+
+    const chunks = [
+      new Uint8Array([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]),
+      pngChunk("IHDR", header),
+      pngChunk("IDAT", compressed),
+      pngChunk("IEND", new Uint8Array(0)),
+    ];
+
+    const total = chunks.reduce((sum, chunk) => sum + chunk.length, 0);
+    const png = new Uint8Array(total);
+    let offset = 0;
+    for (const chunk of chunks) {
+      png.set(chunk, offset);
+      offset += chunk.length;
+    }
+    return png;
+  }
+}
+
+const CRC_TABLE = (() => {
+  const table = new Uint32Array(256);
+  for (let n = 0; n < 256; n++) {
+    let c = n;
+    for (let k = 0; k < 8; k++) {
+      c = c & 1 ? 0xedb88320 ^ (c >>> 1) : c >>> 1;
+    }
+    table[n] = c >>> 0;
+  }
+  return table;
+})();
+
+function crc32(bytes: Uint8Array): number {
+  let crc = 0xffffffff;
+  for (const byte of bytes) {
+    crc = CRC_TABLE[(crc ^ byte) & 0xff] ^ (crc >>> 8);
+  }
+  return (crc ^ 0xffffffff) >>> 0;
+}
+
+function pngChunk(type: string, data: Uint8Array): Uint8Array {
+  const chunk = new Uint8Array(12 + data.length);
+  const view = new DataView(chunk.buffer);
+  view.setUint32(0, data.length);
+  chunk.set(new TextEncoder().encode(type), 4);
+  chunk.set(data, 8);
+  view.setUint32(8 + data.length, crc32(chunk.subarray(4, 8 + data.length)));
+  return chunk;
+}
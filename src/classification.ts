@@ -0,0 +1,188 @@
+/**
+ * Approximate stellar classification from Gaia GSP-Phot parameters.
+ *
+ * These are coarse categories for filtering, not spectroscopic types.
+ *
+ * Spectral type from teff_gspphot (K):
+ *
+ * Type | Teff range
+ * --|--
+ * O | >= 30000
+ * B | 10000 – 30000
+ * A | 7500 – 10000
+ * F | 6000 – 7500
+ * G | 5200 – 6000
+ * K | 3700 – 5200
+ * M | < 3700
+ *
+ * Luminosity class from logg_gspphot (dex), when available:
+ *
+ * Class | logg range
+ * --|--
+ * V (dwarf) | >= 4.0
+ * IV (subgiant) | 3.5 – 4.0
+ * III (giant) | < 3.5
+ *
+ * Without logg, absolute G (from parallax) is compared with the main
+ * sequence at the star's teff: more than 1.5 mag brighter is a giant,
+ * 0.5–1.5 mag brighter a subgiant, otherwise a dwarf.
+ *
+ * The evolutionary stage is "main_sequence" for dwarfs and "giant" for
+ * subgiants and giants.
+ */
+
+export const spectralTypes = ["O", "B", "A", "F", "G", "K", "M"] as const;
+
+export type SpectralType = (typeof spectralTypes)[number];
+
+export const luminosityClasses = ["dwarf", "subgiant", "giant"] as const;
+
+export type LuminosityClass = (typeof luminosityClasses)[number];
+
+export type EvolutionaryStage = "main_sequence" | "giant";
+
+export interface Classification {
+  spectral_type: SpectralType | null;
+  luminosity_class: LuminosityClass | null;
+  evolutionary_stage: EvolutionaryStage | null;
+  abs_g_mag: number | null;
+}
+
+// Lower teff bound of each spectral type, hottest first
+const SPECTRAL_BOUNDARIES: Array<[SpectralType, number]> = [
+  ["O", 30000],
+  ["B", 10000],
+  ["A", 7500],
+  ["F", 6000],
+  ["G", 5200],
+  ["K", 3700],
+  ["M", 0],
+];
+
+// Approximate main-sequence absolute G by teff, coolest first
+const MAIN_SEQUENCE: Array<[number, number]> = [
+  [2650, 15.0],
+  [3050, 11.6],
+  [3400, 9.8],
+  [3850, 8.1],
+  [4400, 6.8],
+  [5200, 5.6],
+  [5600, 4.9],
+  [5900, 4.2],
+  [6500, 3.3],
+  [7200, 2.5],
+  [8100, 1.9],
+  [9700, 1.0],
+  [15700, -1.1],
+  [31000, -3.9],
+];
+
+export function isSpectralType(value: unknown): value is SpectralType {
+  return typeof value === "string" &&
+    (spectralTypes as readonly string[]).includes(value);
+}
+
+export function isLuminosityClass(value: unknown): value is LuminosityClass {
+  return typeof value === "string" &&
+    (luminosityClasses as readonly string[]).includes(value);
+}
+
+/**
+ * Spectral type letter for an effective temperature
+ */
+export function spectralType(teff: number | null): SpectralType | null {
+  if (teff === null || !isFinite(teff) || teff <= 0) {
+    return null;
+  }
+
+  for (const [type, minTeff] of SPECTRAL_BOUNDARIES) {
+    if (teff >= minTeff) {
+      return type;
+    }
+  }
+
+  return null;
+}
+
+/**
+ * Absolute G magnitude from apparent G and parallax (mas).
+ * Returns null for non-positive parallaxes, where distance is undefined.
+ */
+export function absoluteMagnitude(
+  mag: number | null,
+  parallax: number | null,
+): number | null {
+  if (mag === null || parallax === null || parallax <= 0) {
+    return null;
+  }
+
+  return mag + 5 * Math.log10(parallax) - 10;
+}
+
+/**
+ * Interpolated main-sequence absolute G at an effective temperature
+ */
+export function mainSequenceAbsoluteG(teff: number): number {
+  if (teff <= MAIN_SEQUENCE[0][0]) {
+    return MAIN_SEQUENCE[0][1];
+  }
+
+  for (let i = 1; i < MAIN_SEQUENCE.length; i++) {
+    const [t1, m1] = MAIN_SEQUENCE[i];
+    if (teff <= t1) {
+      const [t0, m0] = MAIN_SEQUENCE[i - 1];
+      return m0 + (m1 - m0) * (teff - t0) / (t1 - t0);
+    }
+  }
+
+  return MAIN_SEQUENCE[MAIN_SEQUENCE.length - 1][1];
+}
+
+/**
+ * Luminosity class from surface gravity, falling back to the height of
+ * absolute G above the main sequence
+ */
+export function luminosityClass(
+  logg: number | null,
+  absG: number | null,
+  teff: number | null,
+): LuminosityClass | null {
+  if (logg !== null && isFinite(logg)) {
+    if (logg >= 4.0) return "dwarf";
+    if (logg >= 3.5) return "subgiant";
+    return "giant";
+  }
+
+  if (absG === null || teff === null || teff <= 0) {
+    return null;
+  }
+
+  const brighterBy = mainSequenceAbsoluteG(teff) - absG;
+  if (brighterBy > 1.5) return "giant";
+  if (brighterBy > 0.5) return "subgiant";
+  return "dwarf";
+}
+
+/**
+ * Classify a star from its GSP-Phot parameters, G magnitude and parallax
+ */
+export function classify(params: {
+  teff: number | null;
+  logg: number | null;
+  gMag: number | null;
+  parallax: number | null;
+}): Classification {
+  const absG = absoluteMagnitude(params.gMag, params.parallax);
+  const lumClass = luminosityClass(params.logg, absG, params.teff);
+
+  return {
+    spectral_type: spectralType(params.teff),
+    luminosity_class: lumClass,
+    evolutionary_stage: lumClass === null
+      ? null
+      : lumClass === "dwarf"
+      ? "main_sequence"
+      : "giant",
+    abs_g_mag: absG,
+  };
+}
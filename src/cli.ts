@@ -2,8 +2,16 @@
 
 import { parseConfig, printUsage } from "./config.ts";
 import { populateCommand } from "./commands/populate.ts";
+import { daemonCommand } from "./commands/daemon.ts";
 import { queryCommand } from "./commands/query.ts";
+import { hashCommand } from "./commands/hash.ts";
+import { migrateCommand } from "./commands/migrate.ts";
+import { highPmCommand } from "./commands/high-pm.ts";
+import { indexCommand } from "./commands/index.ts";
+import { serveCommand } from "./commands/serve.ts";
+import { sqlCommand } from "./commands/sql.ts";
 import { statsCommand } from "./commands/stats.ts";
+import { visibilityCommand } from "./commands/visibility.ts";
 
 async function main(): Promise<void> {
   const args = Deno.args;
@@ -34,14 +42,46 @@ async function main(): Promise<void> {
         await populateCommand(config, "tmass", args.slice(1));
         break;
 
+      case "daemon":
+        await daemonCommand(config, args.slice(1));
+        break;
+
       case "query":
         queryCommand(config, args.slice(1));
         break;
 
+      case "hash":
+        hashCommand(config, args.slice(1));
+        break;
+
+      case "migrate":
+        migrateCommand(config, args.slice(1));
+        break;
+
+      case "high-pm":
+        highPmCommand(config, args.slice(1));
+        break;
+
+      case "index":
+        await indexCommand(config, args.slice(1));
+        break;
+
+      case "serve":
+        await serveCommand(config, args.slice(1));
+        break;
+
+      case "sql":
+        await sqlCommand(config, args.slice(1));
+        break;
+
       case "stats":
         statsCommand(config);
         break;
 
+      case "visibility":
+        await visibilityCommand(config, args.slice(1));
+        break;
+
       default:
         console.error(`Unknown command: ${command}\n`);
         printUsage();
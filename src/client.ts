@@ -0,0 +1,453 @@
+/**
+ * One query interface over a local database or a remote `serve` instance,
+ * so callers can switch between the two by configuration.
+ *
+ * @example
+ * ```ts
+ * const catalogue = openCatalogue({ url: "http://gaia.internal:8080" });
+ * for await (const star of catalogue.coneSearch(56.75, 24.12, 1)) {
+ *   console.log(star.source_id);
+ * }
+ * const nearest = await catalogue.nearest(56.75, 24.12, 5).toArray();
+ * catalogue.close();
+ * ```
+ */
+
+import { Gaia, type GaiaOptions, type XmatchTarget } from "./gaia.ts";
+import type { GaiaRecord } from "./database.ts";
+
+export interface RequestOptions {
+  /** Abort the request, including any pending retries */
+  signal?: AbortSignal;
+}
+
+/**
+ * Records from a query, available one at a time as they are decoded or all
+ * at once with `toArray()`
+ */
+export class RecordStream implements AsyncIterable<GaiaRecord> {
+  private source: () => AsyncIterable<GaiaRecord[]>;
+
+  /**
+   * @param source - Produces the result in batches, e.g. one per page
+   */
+  constructor(source: () => AsyncIterable<GaiaRecord[]>) {
+    this.source = source;
+  }
+
+  async *[Symbol.asyncIterator](): AsyncIterator<GaiaRecord> {
+    for await (const batch of this.source()) {
+      yield* batch;
+    }
+  }
+
+  async toArray(): Promise<GaiaRecord[]> {
+    const records: GaiaRecord[] = [];
+    for await (const batch of this.source()) {
+      records.push(...batch);
+    }
+    return records;
+  }
+}
+
+/**
+ * Query interface shared by local and remote catalogues
+ */
+export interface Catalogue {
+  /** Stars within `radius` degrees of RA, Dec */
+  coneSearch(
+    ra: number,
+    dec: number,
+    radius: number,
+    options?: RequestOptions,
+  ): RecordStream;
+  /** The `count` stars nearest RA, Dec, closest first */
+  nearest(
+    ra: number,
+    dec: number,
+    count: number,
+    options?: RequestOptions,
+  ): RecordStream;
+  /** Stars by Gaia DR3 source_id */
+  lookup(sourceIds: string[], options?: RequestOptions): RecordStream;
+  /** The closest star within `radiusArcsec` of each target */
+  xmatch(
+    targets: XmatchTarget[],
+    radiusArcsec: number,
+    options?: RequestOptions,
+  ): RecordStream;
+  close(): void;
+}
+
+/**
+ * A catalogue backed by a local database
+ */
+export class LocalCatalogue implements Catalogue {
+  private gaia: Gaia;
+
+  constructor(options: GaiaOptions = {}) {
+    this.gaia = new Gaia(options);
+  }
+
+  private run(
+    query: () => GaiaRecord[],
+    options: RequestOptions,
+  ): RecordStream {
+    return new RecordStream(async function* () {
+      options.signal?.throwIfAborted();
+      yield query();
+    });
+  }
+
+  coneSearch(
+    ra: number,
+    dec: number,
+    radius: number,
+    options: RequestOptions = {},
+  ): RecordStream {
+    return this.run(() => this.gaia.coneSearch(ra, dec, radius), options);
+  }
+
+  nearest(
+    ra: number,
+    dec: number,
+    count: number,
+    options: RequestOptions = {},
+  ): RecordStream {
+    return this.run(() => this.gaia.nearest(ra, dec, count), options);
+  }
+
+  lookup(sourceIds: string[], options: RequestOptions = {}): RecordStream {
+    return this.run(() => this.gaia.lookup(sourceIds), options);
+  }
+
+  xmatch(
+    targets: XmatchTarget[],
+    radiusArcsec: number,
+    options: RequestOptions = {},
+  ): RecordStream {
+    return this.run(() => this.gaia.xmatch(targets, radiusArcsec), options);
+  }
+
+  close(): void {
+    this.gaia.close();
+  }
+}
+
+export type RemoteCatalogueOptions =
+  & Pick<
+    GaiaOptions,
+    | "magnitudeLimit"
+    | "photometryOutput"
+    | "tmassCrossmatch"
+    | "classify"
+    | "spectralTypes"
+    | "luminosityClasses"
+    | "extinction"
+  >
+  & {
+    /** Base URL of a `gaiaoffline serve` instance */
+    url: string;
+    /** Sent as `X-API-Key` */
+    apiKey?: string;
+    /**
+     * Rows fetched per request
+     * @default 1000
+     */
+    pageSize?: number;
+    /**
+     * Retries for network errors and 429, 502, 503 and 504 responses
+     * @default 3
+     */
+    retries?: number;
+    /**
+     * First retry delay in milliseconds, doubled for each further attempt.
+     * A `Retry-After` header takes precedence.
+     * @default 500
+     */
+    retryDelay?: number;
+    /**
+     * Per-request timeout in milliseconds, 0 for none
+     * @default 30000
+     */
+    timeout?: number;
+  };
+
+/**
+ * An error response from the server
+ */
+export class CatalogueError extends Error {
+  status: number;
+
+  constructor(status: number, message: string) {
+    super(message);
+    this.name = "CatalogueError";
+    this.status = status;
+  }
+}
+
+/**
+ * Too many requests, and a proxy or server that is down or overloaded. A
+ * 500 is an error in the query, which would fail again.
+ */
+const RETRYABLE_STATUS = [429, 502, 503, 504];
+
+/**
+ * Source ids per `/lookup` request, which keeps the query string to a few
+ * kilobytes
+ */
+const LOOKUP_BATCH_SIZE = 200;
+
+function sleep(ms: number, signal?: AbortSignal): Promise<void> {
+  return new Promise((resolve, reject) => {
+    signal?.throwIfAborted();
+    const timer = setTimeout(() => {
+      signal?.removeEventListener("abort", onAbort);
+      resolve();
+    }, ms);
+    const onAbort = () => {
+      clearTimeout(timer);
+      reject(signal!.reason);
+    };
+    signal?.addEventListener("abort", onAbort, { once: true });
+  });
+}
+
+/**
+ * A catalogue served over HTTP by `gaiaoffline serve`. Results are fetched
+ * a page at a time as they are iterated.
+ */
+export class RemoteCatalogue implements Catalogue {
+  private options: Required<Omit<RemoteCatalogueOptions, "apiKey">> & {
+    apiKey?: string;
+  };
+
+  constructor(options: RemoteCatalogueOptions) {
+    this.options = {
+      url: options.url.replace(/\/+$/, ""),
+      apiKey: options.apiKey,
+      pageSize: options.pageSize || 1000,
+      retries: options.retries ?? 3,
+      retryDelay: options.retryDelay ?? 500,
+      timeout: options.timeout ?? 30000,
+      magnitudeLimit: options.magnitudeLimit || [-3, 20],
+      photometryOutput: options.photometryOutput || "flux",
+      tmassCrossmatch: options.tmassCrossmatch || false,
+      classify: options.classify || false,
+      spectralTypes: options.spectralTypes || [],
+      luminosityClasses: options.luminosityClasses || [],
+      extinction: options.extinction || false,
+    };
+  }
+
+  /**
+   * Query parameters for the configured output options
+   */
+  private queryParams(): Record<string, string> {
+    const { options } = this;
+    const params: Record<string, string> = {
+      photometry: options.photometryOutput,
+      magnitude_limit: options.magnitudeLimit.join(","),
+    };
+
+    if (options.tmassCrossmatch) params.xmatch = "true";
+    if (options.classify) params.classify = "true";
+    if (options.spectralTypes.length > 0) {
+      params.spectral_type = options.spectralTypes.join(",");
+    }
+    if (options.luminosityClasses.length > 0) {
+      params.luminosity_class = options.luminosityClasses.join(",");
+    }
+    if (options.extinction) {
+      params.deredden = "true";
+      if (options.extinction.ag !== undefined) {
+        params.ag = String(options.extinction.ag);
+      }
+      if (options.extinction.ebpminrp !== undefined) {
+        params.ebpminrp = String(options.extinction.ebpminrp);
+      }
+    }
+
+    return params;
+  }
+
+  /**
+   * Send one request, retrying transient failures
+   */
+  private async request(
+    path: string,
+    params: Record<string, string>,
+    body: unknown,
+    signal?: AbortSignal,
+  ): Promise<unknown> {
+    const url = `${this.options.url}${path}?${new URLSearchParams(params)}`;
+    const headers: Record<string, string> = { Accept: "application/json" };
+    if (this.options.apiKey) headers["X-API-Key"] = this.options.apiKey;
+    if (body !== undefined) headers["Content-Type"] = "application/json";
+
+    for (let attempt = 0;; attempt++) {
+      signal?.throwIfAborted();
+
+      const signals: AbortSignal[] = signal ? [signal] : [];
+      if (this.options.timeout > 0) {
+        signals.push(AbortSignal.timeout(this.options.timeout));
+      }
+
+      let delay = this.options.retryDelay * 2 ** attempt;
+
+      try {
+        const response = await fetch(url, {
+          method: body === undefined ? "GET" : "POST",
+          headers,
+          body: body === undefined ? undefined : JSON.stringify(body),
+          signal: signals.length > 0 ? AbortSignal.any(signals) : undefined,
+        });
+
+        if (response.ok) {
+          return await response.json();
+        }
+
+        const message = await response.json()
+          .then((error) => error?.error ?? response.statusText)
+          .catch(() => response.statusText);
+
+        if (
+          !RETRYABLE_STATUS.includes(response.status) ||
+          attempt >= this.options.retries
+        ) {
+          throw new CatalogueError(response.status, message);
+        }
+
+        const retryAfter = Number(response.headers.get("Retry-After"));
+        if (retryAfter > 0) {
+          delay = retryAfter * 1000;
+        }
+      } catch (error) {
+        // Give up on server errors, caller aborts and exhausted retries
+        if (
+          error instanceof CatalogueError || signal?.aborted ||
+          attempt >= this.options.retries
+        ) {
+          throw error;
+        }
+      }
+
+      await sleep(delay, signal);
+    }
+  }
+
+  /**
+   * Follow `next_cursor` through every page of a list endpoint
+   */
+  private async *pages(
+    path: string,
+    query: Record<string, string>,
+    body: unknown,
+    signal?: AbortSignal,
+  ): AsyncIterable<GaiaRecord[]> {
+    let cursor: string | null = null;
+    do {
+      const page = await this.request(
+        path,
+        cursor ? { ...query, cursor } : query,
+        body,
+        signal,
+      ) as { data: GaiaRecord[]; next_cursor: string | null };
+
+      yield page.data;
+      cursor = page.next_cursor;
+    } while (cursor);
+  }
+
+  private paged(
+    path: string,
+    params: Record<string, string>,
+    options: RequestOptions,
+    body?: unknown,
+  ): RecordStream {
+    const query = {
+      ...this.queryParams(),
+      ...params,
+      page_size: String(this.options.pageSize),
+    };
+
+    return new RecordStream(() =>
+      this.pages(path, query, body, options.signal)
+    );
+  }
+
+  coneSearch(
+    ra: number,
+    dec: number,
+    radius: number,
+    options: RequestOptions = {},
+  ): RecordStream {
+    return this.paged("/cone", {
+      ra: String(ra),
+      dec: String(dec),
+      radius: String(radius),
+    }, options);
+  }
+
+  nearest(
+    ra: number,
+    dec: number,
+    count: number,
+    options: RequestOptions = {},
+  ): RecordStream {
+    return this.paged("/nearest", {
+      ra: String(ra),
+      dec: String(dec),
+      n: String(count),
+    }, options);
+  }
+
+  lookup(sourceIds: string[], options: RequestOptions = {}): RecordStream {
+    const query = {
+      ...this.queryParams(),
+      page_size: String(this.options.pageSize),
+    };
+    const pages = (ids: string[]) =>
+      this.pages(
+        "/lookup",
+        { ...query, source_id: ids.join(",") },
+        undefined,
+        options.signal,
+      );
+
+    // One request (and its pages) per batch of ids
+    return new RecordStream(async function* () {
+      for (let i = 0; i < sourceIds.length; i += LOOKUP_BATCH_SIZE) {
+        yield* pages(sourceIds.slice(i, i + LOOKUP_BATCH_SIZE));
+      }
+    });
+  }
+
+  xmatch(
+    targets: XmatchTarget[],
+    radiusArcsec: number,
+    options: RequestOptions = {},
+  ): RecordStream {
+    return this.paged("/xmatch", {}, options, {
+      targets,
+      radius: radiusArcsec,
+    });
+  }
+
+  close(): void {
+    // Nothing held open between requests
+  }
+}
+
+export type CatalogueOptions =
+  | (GaiaOptions & { url?: undefined })
+  | RemoteCatalogueOptions;
+
+/**
+ * Open a remote catalogue when `url` is set, otherwise the local database
+ */
+export function openCatalogue(options: CatalogueOptions = {}): Catalogue {
+  return options.url
+    ? new RemoteCatalogue(options as RemoteCatalogueOptions)
+    : new LocalCatalogue(options as GaiaOptions);
+}
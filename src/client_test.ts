@@ -0,0 +1,243 @@
+import { assertEquals, assertRejects } from "@std/assert";
+import {
+  type Catalogue,
+  CatalogueError,
+  LocalCatalogue,
+  type RecordStream,
+  RemoteCatalogue,
+  type RemoteCatalogueOptions,
+} from "./client.ts";
+import { DEFAULT_CONFIG } from "./config.ts";
+import { GaiaDatabase } from "./database.ts";
+import { Gaia } from "./gaia.ts";
+import { createHandler } from "./server/server.ts";
+
+/**
+ * Run `test` against a local server answering with `handler`, and a
+ * catalogue pointed at it that retries without waiting
+ */
+function withServer(
+  handler: (request: Request) => Response | Promise<Response>,
+  test: (
+    catalogue: (options?: Partial<RemoteCatalogueOptions>) => RemoteCatalogue,
+  ) => Promise<void>,
+) {
+  return async () => {
+    const server = Deno.serve(
+      { port: 0, hostname: "127.0.0.1", onListen: () => {} },
+      handler,
+    );
+    const url = `http://127.0.0.1:${server.addr.port}`;
+    try {
+      await test((options) =>
+        new RemoteCatalogue({ url, retryDelay: 1, ...options })
+      );
+    } finally {
+      await server.shutdown();
+    }
+  };
+}
+
+const page = (data: unknown[], next_cursor: string | null = null) =>
+  Response.json({ data, count: data.length, next_cursor });
+
+Deno.test(
+  "transient failures are retried",
+  (() => {
+    const statuses = [503, 429, 502, 200];
+    let requests = 0;
+    return withServer(() => {
+      const status = statuses[requests++];
+      return status === 200
+        ? page([{ source_id: "1" }])
+        : Response.json({ error: "busy" }, { status });
+    }, async (catalogue) => {
+      const records = await catalogue().coneSearch(45, 6, 1).toArray();
+      assertEquals(records, [{ source_id: "1" }]);
+      assertEquals(requests, 4);
+    });
+  })(),
+);
+
+Deno.test(
+  "errors in the query are not retried",
+  (() => {
+    let requests = 0;
+    return withServer(() => {
+      requests++;
+      return Response.json({ error: "Invalid ra" }, { status: 500 });
+    }, async (catalogue) => {
+      const error = await assertRejects(
+        () => catalogue().coneSearch(45, 6, 1).toArray(),
+        CatalogueError,
+        "Invalid ra",
+      );
+      assertEquals(error.status, 500);
+      assertEquals(requests, 1);
+    });
+  })(),
+);
+
+Deno.test(
+  "retries give up with the last error",
+  (() => {
+    let requests = 0;
+    return withServer(() => {
+      requests++;
+      return new Response("down", { status: 503, statusText: "Unavailable" });
+    }, async (catalogue) => {
+      const error = await assertRejects(
+        () => catalogue({ retries: 2 }).nearest(45, 6, 5).toArray(),
+        CatalogueError,
+        "Unavailable",
+      );
+      assertEquals(error.status, 503);
+      assertEquals(requests, 3);
+    });
+  })(),
+);
+
+Deno.test(
+  "aborting stops a pending retry",
+  withServer(
+    () =>
+      new Response(null, { status: 429, headers: { "Retry-After": "60" } }),
+    async (catalogue) => {
+      const controller = new AbortController();
+      const result = catalogue().coneSearch(45, 6, 1, {
+        signal: controller.signal,
+      }).toArray();
+      setTimeout(() => controller.abort(new Error("stop")), 50);
+      await assertRejects(() => result, Error, "stop");
+    },
+  ),
+);
+
+Deno.test(
+  "pages are followed by cursor with the same query",
+  (() => {
+    const seen: URLSearchParams[] = [];
+    const keys: (string | null)[] = [];
+    return withServer((request) => {
+      const params = new URL(request.url).searchParams;
+      seen.push(params);
+      keys.push(request.headers.get("X-API-Key"));
+      const cursor = params.get("cursor");
+      if (cursor === null) return page([{ source_id: "1" }], "two");
+      if (cursor === "two") return page([{ source_id: "2" }], "three");
+      return page([{ source_id: "3" }]);
+    }, async (catalogue) => {
+      const remote = catalogue({
+        apiKey: "secret",
+        pageSize: 1,
+        photometryOutput: "magnitude",
+      });
+      const ids = [];
+      for await (const record of remote.coneSearch(45, 6, 1)) {
+        ids.push(record.source_id);
+      }
+      assertEquals(ids, ["1", "2", "3"]);
+      assertEquals(seen.map((params) => params.get("cursor")), [
+        null,
+        "two",
+        "three",
+      ]);
+      for (const params of seen) {
+        assertEquals(params.get("ra"), "45");
+        assertEquals(params.get("page_size"), "1");
+        assertEquals(params.get("photometry"), "magnitude");
+      }
+      assertEquals(keys, ["secret", "secret", "secret"]);
+    });
+  })(),
+);
+
+Deno.test(
+  "long lookups are split across requests",
+  (() => {
+    const batches: number[] = [];
+    return withServer((request) => {
+      const ids = new URL(request.url).searchParams.get("source_id")!
+        .split(",");
+      batches.push(ids.length);
+      return page(ids.map((source_id) => ({ source_id })));
+    }, async (catalogue) => {
+      const ids = Array.from({ length: 450 }, (_, i) => String(i));
+      const records = await catalogue().lookup(ids).toArray();
+      assertEquals(batches, [200, 200, 50]);
+      assertEquals(records.map((record) => record.source_id), ids);
+    });
+  })(),
+);
+
+Deno.test("local and remote catalogues return the same records", async () => {
+  const dir = Deno.makeTempDirSync();
+  const options = {
+    databasePath: `${dir}/gaia.db`,
+    logLevel: "ERROR" as const,
+    photometryOutput: "magnitude" as const,
+  };
+  const db = new GaiaDatabase({
+    ...DEFAULT_CONFIG,
+    databasePath: options.databasePath,
+    logLevel: options.logLevel,
+  });
+  db.initialize();
+  const insert = db.prepare(
+    "INSERT INTO gaiadr3 (source_id, ra, dec, parallax, phot_g_mean_flux) VALUES (?, ?, ?, ?, ?)",
+  );
+  for (let i = 0; i < 30; i++) {
+    const n = (i * 11) % 30;
+    insert.run(
+      String(5000 + n),
+      45 + n * 0.003,
+      6 - n * 0.002,
+      n % 4 === 0 ? null : n / 10,
+      1e4 * (n + 1),
+    );
+  }
+
+  const gaia = new Gaia(options, db);
+  const handler = createHandler(gaia, {
+    rateLimits: { requestsPerMinute: 0, rowsPerMinute: 0 },
+    corsOrigins: [],
+    logLevel: "ERROR",
+  });
+  const server = Deno.serve(
+    { port: 0, hostname: "127.0.0.1", onListen: () => {} },
+    (request) => handler(request, "127.0.0.1"),
+  );
+  const local = new LocalCatalogue(options);
+  const remote = new RemoteCatalogue({
+    url: `http://127.0.0.1:${server.addr.port}`,
+    pageSize: 7,
+    photometryOutput: options.photometryOutput,
+  });
+
+  try {
+    const targets = [
+      { id: "a", ra: 45.003, dec: 5.998 },
+      { id: "b", ra: 45.06, dec: 5.96 },
+      { id: "none", ra: 100, dec: 10 },
+    ];
+    const ids = ["5003", "5029", "missing", "5000"];
+    const queries: Record<string, (catalogue: Catalogue) => RecordStream> = {
+      cone: (catalogue) => catalogue.coneSearch(45, 6, 1),
+      nearest: (catalogue) => catalogue.nearest(45, 6, 12),
+      lookup: (catalogue) => catalogue.lookup(ids),
+      xmatch: (catalogue) => catalogue.xmatch(targets, 2),
+    };
+    for (const [name, query] of Object.entries(queries)) {
+      const expected = await query(local).toArray();
+      assertEquals(await query(remote).toArray(), expected, name);
+    }
+    assertEquals((await local.coneSearch(45, 6, 1).toArray()).length, 30);
+  } finally {
+    local.close();
+    remote.close();
+    await server.shutdown();
+    gaia.close();
+    db.close();
+    Deno.removeSync(dir, { recursive: true });
+  }
+});
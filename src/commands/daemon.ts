@@ -0,0 +1,355 @@
+import { type CLIConfig, parseConfig } from "../config.ts";
+import { serve } from "../server/server.ts";
+import type { Logger } from "../types.ts";
+import { createLogger, formatDuration } from "../utils.ts";
+import { type PopulateType, runPopulate } from "./populate.ts";
+import { parseServeOptions } from "./serve.ts";
+import { parseArgs } from "@std/cli/parse-args";
+
+const POPULATE_TYPES: PopulateType[] = [
+  "all",
+  "gaia",
+  "tmass-xmatch",
+  "tmass",
+];
+
+/** Default base delay before retrying a failed file */
+const DEFAULT_RETRY_BACKOFF = 15 * 60 * 1000;
+
+/** How often to check the time windows */
+const TICK = 60 * 1000;
+
+/** A daily time window in minutes since local midnight; may wrap midnight */
+export interface TimeWindow {
+  start: number;
+  end: number;
+}
+
+interface DaemonOptions {
+  /** Config file flags followed by the command line's */
+  args: string[];
+  config: CLIConfig;
+  interval: number;
+  windows: TimeWindow[];
+  stages: PopulateType[];
+  fileLimit?: number;
+  hash: boolean;
+  serve: boolean;
+}
+
+/**
+ * Keep the database up to date in one long-lived process: refresh the
+ * file listings every interval, populate new and previously failed files
+ * (with backoff) inside the configured time windows, and serve queries
+ * meanwhile. SIGHUP reloads the config file. Only --go-ingest inserts off
+ * the main thread; with the other parsers the server stalls during each
+ * insert batch.
+ * @param config - The configuration for the database
+ * @param args - The arguments for the command
+ * @returns void
+ */
+export async function daemonCommand(_config: CLIConfig, args: string[]) {
+  const configFile = parseArgs(args, { string: ["config"] }).config;
+  let options = await loadOptions(configFile, args);
+  const logger = createLogger(options.config.logLevel, "Daemon");
+
+  const server = options.serve
+    ? serve(await parseServeOptions(options.config, options.args))
+    : undefined;
+
+  let shuttingDown = false;
+  let reloadRequested = false;
+  let populating: AbortController | undefined;
+  let wake = () => {};
+
+  const shutdown = () => {
+    if (!shuttingDown) {
+      logger.info("🛑 Shutting down after the batch in progress…");
+    }
+    shuttingDown = true;
+    populating?.abort();
+    wake();
+  };
+  const signals: Deno.Signal[] = Deno.build.os === "windows"
+    ? ["SIGINT"]
+    : ["SIGINT", "SIGTERM"];
+  for (const signal of signals) {
+    Deno.addSignalListener(signal, shutdown);
+  }
+  const reload = () => {
+    reloadRequested = true;
+    wake();
+  };
+  if (Deno.build.os !== "windows") {
+    Deno.addSignalListener("SIGHUP", reload);
+  }
+
+  logDaemonOptions(logger, options);
+  let nextRun = 0;
+
+  while (!shuttingDown) {
+    if (reloadRequested) {
+      reloadRequested = false;
+      try {
+        options = await loadOptions(configFile, args);
+        nextRun = 0;
+        logger.info(
+          `🔄 Reloaded ${configFile ?? "options"} (server settings apply after a restart)`,
+        );
+        logDaemonOptions(logger, options);
+      } catch (error) {
+        logger.error(
+          `Failed to reload ${configFile}, keeping the previous settings: ${
+            error instanceof Error ? error.message : error
+          }`,
+        );
+      }
+    }
+
+    if (Date.now() >= nextRun && inWindows(options.windows, new Date())) {
+      const startTime = Date.now();
+      populating = new AbortController();
+      const current = options;
+      // Finish the batch in progress and stop once the window closes
+      const windowCheck = setInterval(() => {
+        if (!inWindows(current.windows, new Date())) {
+          logger.info("⏸️  Time window closed, pausing after this batch");
+          populating?.abort();
+        }
+      }, TICK);
+
+      let failed = false;
+      try {
+        for (const stage of current.stages) {
+          if (populating.signal.aborted) {
+            break;
+          }
+          await runPopulate(current.config, stage, {
+            fileLimit: current.fileLimit,
+            hash: current.hash,
+            signal: populating.signal,
+          });
+        }
+      } catch (error) {
+        failed = true;
+        logger.error(
+          `Populate failed: ${error instanceof Error ? error.message : error}`,
+        );
+      } finally {
+        clearInterval(windowCheck);
+      }
+
+      // Pick up where it stopped in the next window; retry failures early
+      nextRun = populating.signal.aborted ? 0 : startTime + (failed
+        ? Math.min(current.interval, current.config.retryBackoff!)
+        : current.interval);
+      populating = undefined;
+      logger.info(
+        `Populate finished in ${formatDuration(Date.now() - startTime)}${
+          nextRun ? `, next run ${new Date(nextRun).toLocaleString()}` : ""
+        }`,
+      );
+      continue;
+    }
+
+    // Sleep until the next run or window check, or a signal
+    await new Promise<void>((resolve) => {
+      const timer = setTimeout(
+        resolve,
+        Math.max(Math.min(nextRun - Date.now(), TICK), 1000),
+      );
+      wake = () => {
+        clearTimeout(timer);
+        resolve();
+      };
+    });
+    wake = () => {};
+  }
+
+  for (const signal of signals) {
+    Deno.removeSignalListener(signal, shutdown);
+  }
+  if (Deno.build.os !== "windows") {
+    Deno.removeSignalListener("SIGHUP", reload);
+  }
+  await server?.shutdown();
+}
+
+/**
+ * Merge the config file's flags with the command line's, which win, and
+ * parse them
+ */
+async function loadOptions(
+  configFile: string | undefined,
+  args: string[],
+): Promise<DaemonOptions> {
+  const merged = configFile
+    ? [...configArgs(await readConfigFile(configFile)), ...args]
+    : args;
+
+  const parsed = parseArgs(merged, {
+    string: ["interval", "window", "stages", "file-limit"],
+    boolean: ["hash", "serve"],
+    negatable: ["serve"],
+    default: { interval: "6h", stages: "gaia", serve: true },
+  });
+
+  const stages = parsed.stages.split(",").map((stage) => stage.trim());
+  const unknown = stages.filter((stage) =>
+    !POPULATE_TYPES.includes(stage as PopulateType)
+  );
+  if (unknown.length > 0) {
+    throw new Error(
+      `Invalid stages: ${unknown.join(", ")}. Must be one of ${
+        POPULATE_TYPES.join(", ")
+      }.`,
+    );
+  }
+
+  const config = parseConfig(merged);
+  config.retryBackoff ??= DEFAULT_RETRY_BACKOFF;
+
+  return {
+    args: merged,
+    config,
+    interval: parseDuration(parsed.interval, "--interval"),
+    windows: parsed.window ? parseWindows(parsed.window) : [],
+    stages: stages as PopulateType[],
+    fileLimit: parsed["file-limit"]
+      ? parseInt(parsed["file-limit"])
+      : undefined,
+    hash: parsed.hash,
+    serve: parsed.serve,
+  };
+}
+
+async function readConfigFile(
+  path: string,
+): Promise<Record<string, unknown>> {
+  let config: unknown;
+  try {
+    config = JSON.parse(await Deno.readTextFile(path));
+  } catch (error) {
+    throw new Error(
+      `Failed to read config file ${path}: ${
+        error instanceof Error ? error.message : error
+      }`,
+    );
+  }
+  if (typeof config !== "object" || config === null || Array.isArray(config)) {
+    throw new Error(`Config file ${path} must hold a JSON object of options`);
+  }
+  return config as Record<string, unknown>;
+}
+
+/**
+ * A config file's options as flags: `{"go-ingest": true, "port": 8080}`
+ * becomes `--go-ingest --port 8080`, false becomes `--no-<flag>` and
+ * arrays are joined with commas
+ */
+export function configArgs(config: Record<string, unknown>): string[] {
+  return Object.entries(config).flatMap(([key, value]) => {
+    if (value === true) {
+      return [`--${key}`];
+    }
+    if (value === false) {
+      return [`--no-${key}`];
+    }
+    if (value === null || value === undefined) {
+      return [];
+    }
+    return [`--${key}`, Array.isArray(value) ? value.join(",") : `${value}`];
+  });
+}
+
+/**
+ * A duration such as 90 (seconds), 90s, 30m, 6h or 1d, in milliseconds
+ */
+export function parseDuration(value: string, flag: string): number {
+  const match = value.trim().match(/^(\d+(?:\.\d+)?)\s*([smhd]?)$/i);
+  const units: Record<string, number> = {
+    "": 1000,
+    s: 1000,
+    m: 60 * 1000,
+    h: 60 * 60 * 1000,
+    d: 24 * 60 * 60 * 1000,
+  };
+  const ms = match ? parseFloat(match[1]) * units[match[2].toLowerCase()] : 0;
+  if (!(ms > 0)) {
+    throw new Error(
+      `Invalid ${flag}: ${value}. Use e.g. 90s, 30m, 6h or 1d.`,
+    );
+  }
+  return ms;
+}
+
+/**
+ * Comma-separated HH:MM-HH:MM windows in local time, e.g.
+ * 22:00-06:00,12:00-13:00
+ */
+export function parseWindows(value: string): TimeWindow[] {
+  const minutes = (time: string) => {
+    const match = time.match(/^(\d{1,2}):(\d{2})$/);
+    const hours = match ? Number(match[1]) : NaN;
+    const mins = match ? Number(match[2]) : NaN;
+    if (!(hours <= 24 && mins < 60) || (hours === 24 && mins > 0)) {
+      throw new Error(
+        `Invalid --window: ${value}. Use HH:MM-HH:MM, e.g. 22:00-06:00.`,
+      );
+    }
+    return hours * 60 + mins;
+  };
+
+  return value.split(",").map((window) => {
+    const [start, end, ...rest] = window.trim().split("-");
+    if (end === undefined || rest.length > 0) {
+      throw new Error(
+        `Invalid --window: ${value}. Use HH:MM-HH:MM, e.g. 22:00-06:00.`,
+      );
+    }
+    return { start: minutes(start), end: minutes(end) };
+  });
+}
+
+/**
+ * Whether a time falls in any window; no windows means always. A window
+ * that starts and ends at the same time covers the whole day.
+ */
+export function inWindows(windows: TimeWindow[], date: Date): boolean {
+  if (windows.length === 0) {
+    return true;
+  }
+  const now = date.getHours() * 60 + date.getMinutes();
+  return windows.some(({ start, end }) =>
+    start < end
+      ? now >= start && now < end
+      : start === end || now >= start || now < end
+  );
+}
+
+function logDaemonOptions(logger: Logger, options: DaemonOptions): void {
+  const time = (minutes: number) =>
+    `${String(Math.floor(minutes / 60)).padStart(2, "0")}:${
+      String(minutes % 60).padStart(2, "0")
+    }`;
+  logger.info(
+    `⏱️  Populating ${options.stages.join(", ")} every ${
+      formatDuration(options.interval)
+    }, ${
+      options.windows.length > 0
+        ? `within ${
+          options.windows.map((w) => `${time(w.start)}-${time(w.end)}`)
+            .join(", ")
+        }`
+        : "at any time"
+    }; failed files retried after ${
+      formatDuration(options.config.retryBackoff!)
+    } (doubling)`,
+  );
+  // Every other parser inserts synchronously on the thread serving requests
+  if (options.serve && !options.config.useGoIngest) {
+    logger.warn(
+      "Without --go-ingest, queries and /health wait while each batch of rows is inserted",
+    );
+  }
+}
@@ -0,0 +1,86 @@
+import { assertEquals, assertThrows } from "@std/assert";
+import {
+  configArgs,
+  inWindows,
+  parseDuration,
+  parseWindows,
+} from "./daemon.ts";
+
+Deno.test("durations take seconds or a unit", () => {
+  const cases: [string, number][] = [
+    ["90", 90_000],
+    ["90s", 90_000],
+    ["30m", 30 * 60_000],
+    ["6h", 6 * 3_600_000],
+    ["1.5h", 1.5 * 3_600_000],
+    ["1d", 86_400_000],
+    [" 2 H ", 2 * 3_600_000],
+  ];
+  for (const [value, ms] of cases) {
+    assertEquals(parseDuration(value, "--interval"), ms, value);
+  }
+  for (const value of ["", "0", "0m", "-5m", "6w", "h", "1h30m"]) {
+    assertThrows(
+      () => parseDuration(value, "--interval"),
+      Error,
+      "Invalid --interval",
+    );
+  }
+});
+
+Deno.test("windows are parsed into minutes since midnight", () => {
+  assertEquals(parseWindows("22:00-06:00"), [{ start: 1320, end: 360 }]);
+  assertEquals(parseWindows("9:30-12:00, 13:00-24:00"), [
+    { start: 570, end: 720 },
+    { start: 780, end: 1440 },
+  ]);
+  for (
+    const value of ["22:00", "22:00-06:00-07:00", "25:00-06:00", "10:60-11:00"]
+  ) {
+    assertThrows(() => parseWindows(value), Error, "Invalid --window");
+  }
+  assertThrows(() => parseWindows("24:01-01:00"), Error, "Invalid --window");
+});
+
+Deno.test("windows may wrap midnight", () => {
+  const at = (hours: number, minutes = 0) =>
+    new Date(2025, 0, 15, hours, minutes);
+  const night = parseWindows("22:00-06:00");
+  assertEquals(inWindows(night, at(23)), true);
+  assertEquals(inWindows(night, at(0)), true);
+  assertEquals(inWindows(night, at(5, 59)), true);
+  assertEquals(inWindows(night, at(6)), false);
+  assertEquals(inWindows(night, at(12)), false);
+  assertEquals(inWindows(night, at(22)), true);
+
+  const lunch = parseWindows("12:00-13:00,22:00-06:00");
+  assertEquals(inWindows(lunch, at(12, 30)), true);
+  assertEquals(inWindows(lunch, at(13)), false);
+
+  // No windows, or one that starts where it ends, covers the whole day
+  assertEquals(inWindows([], at(15)), true);
+  assertEquals(inWindows(parseWindows("08:00-08:00"), at(3)), true);
+});
+
+Deno.test("config file options become flags", () => {
+  assertEquals(
+    configArgs({
+      "go-ingest": true,
+      serve: false,
+      port: 8080,
+      stages: ["gaia", "tmass"],
+      window: "22:00-06:00",
+      "cache-dir": null,
+    }),
+    [
+      "--go-ingest",
+      "--no-serve",
+      "--port",
+      "8080",
+      "--stages",
+      "gaia,tmass",
+      "--window",
+      "22:00-06:00",
+    ],
+  );
+});
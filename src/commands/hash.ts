@@ -0,0 +1,154 @@
+import type { CLIConfig } from "../config.ts";
+import { GaiaDatabase } from "../database.ts";
+import {
+  compareContentHashes,
+  CONTENT_TABLES,
+  type ContentHash,
+  DEFAULT_HASH_LEVEL,
+  hashContent,
+  isContentHashStale,
+  readContentHash,
+  storeContentHash,
+} from "../hash.ts";
+import { formatDuration } from "../utils.ts";
+import { parseArgs } from "@std/cli/parse-args";
+
+/**
+ * Compute canonical content digests per table and per HEALPix region,
+ * store them in the metadata table and optionally compare them with
+ * another database's
+ * @param config - The configuration for the database
+ * @param args - The arguments for the command
+ * @returns void
+ */
+export function hashCommand(config: CLIConfig, args: string[]) {
+  const parsed = parseArgs(args, {
+    string: ["level", "tables", "compare"],
+    boolean: ["store", "json"],
+    negatable: ["store"],
+    default: { store: true },
+  });
+
+  const level = parsed.level === undefined
+    ? DEFAULT_HASH_LEVEL
+    : Number(parsed.level);
+  if (!Number.isInteger(level) || level < 0 || level > 12) {
+    throw new Error(`Invalid --level: ${parsed.level}. Must be 0–12.`);
+  }
+
+  const tables = parsed.tables?.split(",") ?? CONTENT_TABLES;
+  const unknown = tables.filter((table) => !CONTENT_TABLES.includes(table));
+  if (unknown.length > 0) {
+    throw new Error(
+      `Invalid tables: ${unknown.join(", ")}. Must be one of ${
+        CONTENT_TABLES.join(", ")
+      }.`,
+    );
+  }
+
+  const hash = withDatabase(config, (db) => {
+    const startTime = Date.now();
+    const hash = hashContent(db, { level, tables });
+    if (!parsed.json) {
+      console.log(
+        `Hashed ${config.databasePath} in ${
+          formatDuration(Date.now() - startTime)
+        }`,
+      );
+    }
+
+    if (parsed.store && db.hasTable("metadata")) {
+      storeContentHash(db, hash);
+    }
+    return hash;
+  });
+
+  if (!parsed.compare) {
+    if (parsed.json) {
+      console.log(JSON.stringify(hash, null, 2));
+    } else {
+      printHash(hash);
+    }
+    return;
+  }
+
+  // Reuse the other database's digests when they are current
+  const other = withDatabase(
+    { ...config, databasePath: parsed.compare },
+    (db) => {
+      const stored = readContentHash(db);
+      if (
+        stored && stored.version === hash.version && stored.level === level &&
+        !isContentHashStale(db, stored)
+      ) {
+        return stored;
+      }
+      return hashContent(db, { level, tables });
+    },
+  );
+
+  const differences = compareContentHashes(hash, {
+    ...other,
+    tables: Object.fromEntries(
+      Object.entries(other.tables).filter(([table]) => tables.includes(table)),
+    ),
+  });
+
+  if (parsed.json) {
+    console.log(
+      JSON.stringify(
+        { identical: differences.length === 0, differences },
+        null,
+        2,
+      ),
+    );
+  } else if (differences.length === 0) {
+    console.log(`\n✅ ${parsed.compare} has the same content`);
+  } else {
+    console.log(`\n❌ ${parsed.compare} differs:`);
+    for (const difference of differences) {
+      const where = difference.region === undefined
+        ? difference.table
+        : `${difference.table} pixel ${difference.region} (level ${level})`;
+      console.log(`  ${where}: ${difference.reason}`);
+    }
+  }
+
+  if (differences.length > 0) {
+    Deno.exitCode = 1;
+  }
+}
+
+/**
+ * Open an existing database, without creating or initialising it
+ */
+function withDatabase<T>(
+  config: CLIConfig,
+  callback: (db: GaiaDatabase) => T,
+): T {
+  try {
+    Deno.statSync(config.databasePath);
+  } catch {
+    throw new Error(`Database not found: ${config.databasePath}`);
+  }
+
+  const db = new GaiaDatabase(config);
+  try {
+    return callback(db);
+  } finally {
+    db.close();
+  }
+}
+
+function printHash(hash: ContentHash): void {
+  console.log(
+    `\nContent hash v${hash.version}, regions at level ${hash.level}`,
+  );
+  console.log("─".repeat(30));
+  for (const [table, tableHash] of Object.entries(hash.tables)) {
+    console.log(`${table}:`);
+    console.log(`  Rows:    ${tableHash.rows.toLocaleString()}`);
+    console.log(`  Digest:  ${tableHash.digest}`);
+    console.log(`  Regions: ${Object.keys(tableHash.regions).length}`);
+  }
+}
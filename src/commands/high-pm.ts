@@ -0,0 +1,94 @@
+import type { CLIConfig } from "../config.ts";
+import { createGaia } from "../gaia.ts";
+import { parseArgs } from "@std/cli/parse-args";
+import {
+  getExtinctionOptions,
+  getLuminosityClasses,
+  getMagnitudeLimit,
+  getPhotometryOutput,
+  getSpectralTypes,
+} from "./query.ts";
+
+/**
+ * Search for high proper-motion stars, all-sky or within a cone
+ * @param config - The configuration for the database
+ * @param args - The arguments for the command
+ * @returns void
+ */
+export function highPmCommand(config: CLIConfig, args: string[]) {
+  const parsed = parseArgs(args, {
+    string: [
+      "min-pm",
+      "ra",
+      "dec",
+      "radius",
+      "epoch",
+      "magnitude-limit",
+      "limit",
+      "photometry",
+      "spectral-type",
+      "luminosity-class",
+      "ag",
+      "ebpminrp",
+    ],
+    boolean: [
+      "xmatch",
+      "classify",
+      "deredden",
+    ],
+  });
+
+  if (!parsed["min-pm"]) {
+    throw new Error("--min-pm is required (mas/yr)");
+  }
+
+  const minPm = parseFloat(parsed["min-pm"]);
+  if (isNaN(minPm)) {
+    throw new Error(
+      `Invalid --min-pm: ${parsed["min-pm"]}. Must be a number in mas/yr.`,
+    );
+  }
+
+  const regionArgs = [parsed.ra, parsed.dec, parsed.radius];
+  const hasRegion = regionArgs.every((value) => value !== undefined);
+  if (!hasRegion && regionArgs.some((value) => value !== undefined)) {
+    throw new Error("--ra, --dec and --radius must be given together");
+  }
+
+  const region = hasRegion
+    ? {
+      ra: parseFloat(parsed.ra!),
+      dec: parseFloat(parsed.dec!),
+      radius: parseFloat(parsed.radius!),
+    }
+    : undefined;
+
+  const epoch = parsed.epoch ? parseFloat(parsed.epoch) : undefined;
+  if (epoch !== undefined && isNaN(epoch)) {
+    throw new Error(
+      `Invalid epoch: ${parsed.epoch}. Must be a decimal year, e.g. 2025.5.`,
+    );
+  }
+
+  const instance = createGaia({
+    ...config,
+    limit: Number(parsed.limit ?? 0),
+    photometryOutput: getPhotometryOutput(parsed.photometry),
+    magnitudeLimit: getMagnitudeLimit(parsed["magnitude-limit"]) ?? [-3, 20],
+    tmassCrossmatch: parsed["xmatch"],
+    classify: parsed["classify"],
+    spectralTypes: getSpectralTypes(parsed["spectral-type"]),
+    luminosityClasses: getLuminosityClasses(parsed["luminosity-class"]),
+    extinction: getExtinctionOptions(
+      parsed["deredden"],
+      parsed.ag,
+      parsed.ebpminrp,
+    ),
+  });
+
+  const results = instance.run((gaia) => {
+    return gaia.highProperMotionSearch(minPm, { region, epoch });
+  });
+
+  console.log(results);
+}
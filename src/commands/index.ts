@@ -0,0 +1,217 @@
+import type { CLIConfig } from "../config.ts";
+import { GaiaDatabase } from "../database.ts";
+import { execGo, hasGoLib } from "../ffi/go.ts";
+import {
+  createIndexSql,
+  type IndexDefinition,
+  STANDARD_INDEXES,
+} from "../indexes.ts";
+import { formatDuration } from "../utils.ts";
+import { parseArgs } from "@std/cli/parse-args";
+
+const SUBCOMMANDS = ["list", "build", "drop", "analyze"];
+
+/** How often to report an index that is still building */
+const PROGRESS_INTERVAL = 10_000;
+
+/**
+ * List, build, drop and analyze the database's indices
+ * @param config - The configuration for the database
+ * @param args - The arguments for the command
+ * @returns void
+ */
+export async function indexCommand(config: CLIConfig, args: string[]) {
+  const parsed = parseArgs(args, {
+    boolean: ["redundant"],
+  });
+  const [subcommand = "list", ...names] = parsed._.map(String);
+  if (!SUBCOMMANDS.includes(subcommand)) {
+    throw new Error(
+      `Unknown index command: ${subcommand}. Must be one of ${
+        SUBCOMMANDS.join(", ")
+      }.`,
+    );
+  }
+
+  try {
+    Deno.statSync(config.databasePath);
+  } catch {
+    throw new Error(`Database not found: ${config.databasePath}`);
+  }
+
+  const db = new GaiaDatabase(config);
+  try {
+    switch (subcommand) {
+      case "list":
+        listIndexes(db, parsed.redundant);
+        break;
+      case "build":
+        await buildIndexes(db, config, names);
+        break;
+      case "drop":
+        dropIndexes(db, names, parsed.redundant);
+        break;
+      case "analyze":
+        analyze(db, names[0]);
+        break;
+    }
+  } finally {
+    db.close();
+  }
+}
+
+/**
+ * Print every index, marking those another index covers; with
+ * `redundantOnly`, print only those
+ */
+function listIndexes(db: GaiaDatabase, redundantOnly: boolean) {
+  const redundant = new Map(
+    db.findRedundantIndexes().map((entry) => [entry.index.name, entry]),
+  );
+  const indexes = db.listIndexes().filter((index) =>
+    !redundantOnly || redundant.has(index.name)
+  );
+
+  console.table(indexes.map((index) => ({
+    name: index.name,
+    table: index.table,
+    columns: index.columns.join(", "),
+    kind: index.origin === "pk"
+      ? "primary key"
+      : index.origin === "u"
+      ? "unique"
+      : index.unique
+      ? "unique index"
+      : "index",
+    redundant: redundant.get(index.name)?.reason ?? "",
+  })));
+
+  const missing = db.missingIndexes();
+  if (missing.length > 0) {
+    console.log(
+      `\nNot built: ${
+        missing.map((index) => index.name).join(", ")
+      }; run index build`,
+    );
+  }
+  if (redundant.size > 0) {
+    console.log(
+      `${redundant.size} redundant index(es); run index drop --redundant`,
+    );
+  }
+}
+
+/**
+ * Build the named standard indices, or every missing one. Builds run in
+ * the Go library when it is built, so progress is reported while each one
+ * runs; otherwise they run here and are reported when done.
+ */
+async function buildIndexes(
+  db: GaiaDatabase,
+  config: CLIConfig,
+  names: string[],
+) {
+  let indexes: IndexDefinition[];
+  if (names.length > 0) {
+    const unknown = names.filter((name) =>
+      !STANDARD_INDEXES.some((index) => index.name === name)
+    );
+    if (unknown.length > 0) {
+      throw new Error(
+        `Unknown index: ${unknown.join(", ")}. Must be one of ${
+          STANDARD_INDEXES.map((index) => index.name).join(", ")
+        }.`,
+      );
+    }
+    const missing = new Set(db.missingIndexes().map((index) => index.name));
+    indexes = STANDARD_INDEXES.filter((index) =>
+      names.includes(index.name) && missing.has(index.name)
+    );
+  } else {
+    indexes = db.missingIndexes();
+  }
+
+  if (indexes.length === 0) {
+    console.log("✅ Every index is built");
+    return;
+  }
+
+  const useGo = hasGoLib();
+  const startTime = Date.now();
+  for (const [i, index] of indexes.entries()) {
+    console.log(
+      `🗂️  [${i + 1}/${indexes.length}] Building ${index.name} on ${index.table}(${
+        index.columns.join(", ")
+      })…`,
+    );
+    const indexStart = Date.now();
+    if (useGo) {
+      const progress = setInterval(() => {
+        console.log(
+          `   still building ${index.name} (${
+            formatDuration(Date.now() - indexStart)
+          })`,
+        );
+      }, PROGRESS_INTERVAL);
+      try {
+        await execGo(config.databasePath, createIndexSql(index));
+      } finally {
+        clearInterval(progress);
+      }
+    } else {
+      db.createIndex(index);
+    }
+    console.log(`   done in ${formatDuration(Date.now() - indexStart)}`);
+  }
+
+  console.log(
+    `\n✅ Built ${indexes.length} index(es) in ${
+      formatDuration(Date.now() - startTime)
+    }; run index analyze to update the planner's statistics`,
+  );
+}
+
+/**
+ * Drop the named indices, or with `redundant` every index another index
+ * covers
+ */
+function dropIndexes(db: GaiaDatabase, names: string[], redundant: boolean) {
+  const drop = redundant
+    ? db.findRedundantIndexes().map(({ index, reason }) => {
+      console.log(`  ${index.name}: ${reason}`);
+      return index.name;
+    })
+    : names;
+  if (!redundant && drop.length === 0) {
+    throw new Error("Give the indices to drop, or --redundant");
+  }
+  if (drop.length === 0) {
+    console.log("✅ No redundant indices");
+    return;
+  }
+
+  const startTime = Date.now();
+  for (const name of drop) {
+    db.dropIndex(name);
+    console.log(`🗑️  Dropped ${name}`);
+  }
+  console.log(
+    `\n✅ Dropped ${drop.length} index(es) in ${
+      formatDuration(Date.now() - startTime)
+    }; the file keeps its size until it is vacuumed`,
+  );
+}
+
+/**
+ * Rebuild the query planner's statistics for a table or index, or every
+ * one
+ */
+function analyze(db: GaiaDatabase, name?: string) {
+  const startTime = Date.now();
+  db.analyze(name);
+  console.log(
+    `✅ Analyzed ${name ?? "every table"} in ${
+      formatDuration(Date.now() - startTime)
+    }`,
+  );
+}
@@ -0,0 +1,71 @@
+import type { CLIConfig } from "../config.ts";
+import { GaiaDatabase } from "../database.ts";
+import { SCHEMA_VERSION } from "../migrations.ts";
+import { formatDuration } from "../utils.ts";
+import { parseArgs } from "@std/cli/parse-args";
+
+/**
+ * Bring the database schema up to date
+ * @param config - The configuration for the database
+ * @param args - The arguments for the command
+ * @returns void
+ */
+export function migrateCommand(config: CLIConfig, args: string[]) {
+  const parsed = parseArgs(args, {
+    string: ["backup"],
+    boolean: ["dry-run"],
+  });
+
+  try {
+    Deno.statSync(config.databasePath);
+  } catch {
+    throw new Error(`Database not found: ${config.databasePath}`);
+  }
+
+  // Refuses databases from a newer version
+  const db = new GaiaDatabase(config);
+  try {
+    const version = db.getSchemaVersion();
+    const pending = db.pendingMigrations();
+
+    console.log(`Database:        ${config.databasePath}`);
+    console.log(`Schema version:  ${version}`);
+    console.log(`Latest version:  ${SCHEMA_VERSION}`);
+
+    if (pending.length === 0) {
+      console.log("\n✅ Schema is up to date");
+      return;
+    }
+
+    console.log(`\nPending migrations:`);
+    for (const migration of pending) {
+      console.log(`  ${migration.version}. ${migration.description}`);
+    }
+
+    if (parsed["dry-run"]) {
+      console.log("\nDry run: nothing was changed");
+      return;
+    }
+
+    if (args.includes("--backup")) {
+      const path = parsed.backup ||
+        `${config.databasePath}.v${version}.bak`;
+      const startTime = Date.now();
+      db.backup(path);
+      console.log(
+        `\n💾 Backed up to ${path} in ${formatDuration(Date.now() - startTime)}`,
+      );
+    }
+
+    console.log();
+    const startTime = Date.now();
+    const applied = db.migrate();
+    console.log(
+      `\n✅ Applied ${applied.length} migration(s) in ${
+        formatDuration(Date.now() - startTime)
+      }; schema version is now ${db.getSchemaVersion()}`,
+    );
+  } finally {
+    db.close();
+  }
+}
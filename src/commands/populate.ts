@@ -1,8 +1,20 @@
 import type { CLIConfig } from "../config.ts";
-import { PopulateCoordinator } from "../coordinator.ts";
+import { PopulateCoordinator, type PopulateStats } from "../coordinator.ts";
 import { GaiaDatabase } from "../database.ts";
+import { hashContent, storeContentHash } from "../hash.ts";
+import { RunHooks } from "../hooks.ts";
+import { createLogger, formatDuration } from "../utils.ts";
 
-type PopulateType = "all" | "gaia" | "tmass-xmatch" | "tmass";
+export type PopulateType = "all" | "gaia" | "tmass-xmatch" | "tmass";
+
+export interface PopulateOptions {
+  /** Limit the number of files per stage (for testing) */
+  fileLimit?: number;
+  /** Store content digests after populating */
+  hash?: boolean;
+  /** Stops populating after the batch in progress when aborted */
+  signal?: AbortSignal;
+}
 
 /**
  * Populate the database with the Gaia DR3 data
@@ -36,28 +48,136 @@ export async function populateCommand(
     console.log(`⚠️  File limit: ${fileLimit} files (testing mode)\n`);
   }
 
+  await runPopulate(config, type, {
+    fileLimit,
+    hash: args.includes("--hash"),
+  });
+}
+
+/**
+ * Run the populate stages of `type`, with run hooks and profiling
+ * @returns The stats of each stage that finished
+ */
+export async function runPopulate(
+  config: CLIConfig,
+  type: PopulateType,
+  options: PopulateOptions = {},
+): Promise<Record<string, PopulateStats>> {
+  const { fileLimit, signal } = options;
+  const hooks = new RunHooks({
+    url: config.hookUrl,
+    command: config.hookCommand,
+    retries: config.hookRetries,
+    failureThreshold: config.hookFailureThreshold,
+    database: config.databasePath,
+  }, createLogger(config.logLevel, "Hooks"));
+
   const db = new GaiaDatabase(config);
-  const coordinator = new PopulateCoordinator(db, config);
+  const coordinator = new PopulateCoordinator(db, config, hooks);
+  const stopProfile = await startProfile(config);
+  const stop = () => coordinator.stop();
+  signal?.addEventListener("abort", stop);
   const cleanup = async () => {
+    signal?.removeEventListener("abort", stop);
     await coordinator.cleanup();
+    stopProfile();
     db.close();
   };
 
+  const stages: Record<string, PopulateStats> = {};
+  const runStage = async (
+    stage: Exclude<PopulateType, "all">,
+    populate: () => Promise<PopulateStats>,
+  ) => {
+    if (signal?.aborted) {
+      return;
+    }
+    const stats = { ...await populate() };
+    stages[stage] = stats;
+    await hooks.notify("stage_complete", { stage, stats });
+  };
+
+  await hooks.notify("run_start", { stage: type });
+
   try {
-    if (type === "all") {
-      await coordinator.populateGaiaDR3(fileLimit);
-      await coordinator.populateTmassXmatch(fileLimit);
-      await coordinator.populateTmass(fileLimit);
-    } else if (type === "gaia") {
-      await coordinator.populateGaiaDR3(fileLimit);
-    } else if (type === "tmass-xmatch") {
-      await coordinator.populateTmassXmatch(fileLimit);
-    } else if (type === "tmass") {
-      await coordinator.populateTmass(fileLimit);
+    if (type === "all" || type === "gaia") {
+      await runStage("gaia", () => coordinator.populateGaiaDR3(fileLimit));
+    }
+    if (type === "all" || type === "tmass-xmatch") {
+      await runStage(
+        "tmass-xmatch",
+        () => coordinator.populateTmassXmatch(fileLimit),
+      );
+    }
+    if (type === "all" || type === "tmass") {
+      await runStage("tmass", () => coordinator.populateTmass(fileLimit));
     }
+
+    if (config.deferIndexes && !signal?.aborted) {
+      const startTime = Date.now();
+      db.createIndices();
+      db.analyze();
+      console.log(
+        `🗂️  Indices built in ${formatDuration(Date.now() - startTime)}\n`,
+      );
+    }
+
+    if (options.hash && !signal?.aborted) {
+      const startTime = Date.now();
+      const hash = hashContent(db);
+      storeContentHash(db, hash);
+      console.log(
+        `🔏 Content hash stored in ${formatDuration(Date.now() - startTime)}`,
+      );
+      for (const [table, { digest }] of Object.entries(hash.tables)) {
+        console.log(`  ${table.padEnd(14)}${digest}`);
+      }
+      console.log();
+    }
+
     await cleanup();
   } catch (error) {
     await cleanup();
+    await hooks.notify("run_end", {
+      stage: type,
+      status: "failed",
+      error: error instanceof Error ? error.message : String(error),
+      stages,
+    });
     throw error;
   }
+
+  await hooks.notify("run_end", { stage: type, status: "success", stages });
+  return stages;
+}
+
+/**
+ * Start the Go library's profilers if any were requested, returning a
+ * function that stops them and writes the files
+ */
+async function startProfile(config: CLIConfig): Promise<() => void> {
+  const requested = config.cpuProfile || config.memProfile ||
+    config.traceFile || config.pprofAddress;
+  if (!requested) {
+    return () => {};
+  }
+  if (!config.useGoIngest && !config.useGoParser) {
+    console.warn(
+      "⚠️  --cpuprofile, --memprofile, --trace and --pprof profile the Go library; use them with --go-ingest or --go-ffi\n",
+    );
+    return () => {};
+  }
+
+  const { startGoProfile, stopGoProfile } = await import("../ffi/go.ts");
+  const address = startGoProfile({
+    cpuprofile: config.cpuProfile,
+    memprofile: config.memProfile,
+    trace: config.traceFile,
+    pprof: config.pprofAddress,
+  });
+  if (address) {
+    console.log(`📈 Go pprof: http://${address}/debug/pprof/\n`);
+  }
+
+  return stopGoProfile;
 }
@@ -2,6 +2,15 @@ import type { CLIConfig } from "../config.ts";
 import { createGaia } from "../gaia.ts";
 import { parseArgs } from "@std/cli/parse-args";
 import { PhotometryOutput } from "../types.ts";
+import {
+  isLuminosityClass,
+  isSpectralType,
+  type LuminosityClass,
+  luminosityClasses,
+  type SpectralType,
+  spectralTypes,
+} from "../classification.ts";
+import type { ExtinctionOptions } from "../photometry.ts";
 
 /**
  * Query the database with the Gaia DR3 data
@@ -18,9 +27,15 @@ export function queryCommand(config: CLIConfig, args: string[]) {
       "magnitude-limit",
       "limit",
       "photometry",
+      "spectral-type",
+      "luminosity-class",
+      "ag",
+      "ebpminrp",
     ],
     boolean: [
       "xmatch",
+      "classify",
+      "deredden",
     ],
   });
 
@@ -48,6 +63,14 @@ export function queryCommand(config: CLIConfig, args: string[]) {
     photometryOutput: getPhotometryOutput(parsed.photometry),
     magnitudeLimit: getMagnitudeLimit(parsed["magnitude-limit"]) ?? [-3, 20],
     tmassCrossmatch: parsed["xmatch"],
+    classify: parsed["classify"],
+    spectralTypes: getSpectralTypes(parsed["spectral-type"]),
+    luminosityClasses: getLuminosityClasses(parsed["luminosity-class"]),
+    extinction: getExtinctionOptions(
+      parsed["deredden"],
+      parsed.ag,
+      parsed.ebpminrp,
+    ),
   });
 
   const results = instance.run((gaia) => {
@@ -57,7 +80,7 @@ export function queryCommand(config: CLIConfig, args: string[]) {
   console.log(results);
 }
 
-function getPhotometryOutput(
+export function getPhotometryOutput(
   photometry?: string,
 ): PhotometryOutput | undefined {
   if (!photometry) {
@@ -77,7 +100,7 @@ function getPhotometryOutput(
   );
 }
 
-function getMagnitudeLimit(magLimit?: string): [number, number] | undefined {
+export function getMagnitudeLimit(magLimit?: string): [number, number] | undefined {
   if (!magLimit) {
     return undefined;
   }
@@ -92,3 +115,65 @@ function getMagnitudeLimit(magLimit?: string): [number, number] | undefined {
 
   return [minMag, maxMag];
 }
+
+export function getSpectralTypes(types?: string): SpectralType[] {
+  if (!types) {
+    return [];
+  }
+
+  return types.split(",").map((type) => {
+    const upper = type.trim().toUpperCase();
+    if (!isSpectralType(upper)) {
+      throw new Error(
+        `Invalid spectral type: ${type}. Must be one of ${
+          spectralTypes.join(", ")
+        }.`,
+      );
+    }
+    return upper;
+  });
+}
+
+export function getLuminosityClasses(classes?: string): LuminosityClass[] {
+  if (!classes) {
+    return [];
+  }
+
+  return classes.split(",").map((value) => {
+    const lower = value.trim().toLowerCase();
+    if (!isLuminosityClass(lower)) {
+      throw new Error(
+        `Invalid luminosity class: ${value}. Must be one of ${
+          luminosityClasses.join(", ")
+        }.`,
+      );
+    }
+    return lower;
+  });
+}
+
+/**
+ * Dereddening is enabled by --deredden or by giving a fallback constant
+ */
+export function getExtinctionOptions(
+  deredden: boolean,
+  ag?: string,
+  ebpminrp?: string,
+): ExtinctionOptions | false {
+  if (!deredden && ag === undefined && ebpminrp === undefined) {
+    return false;
+  }
+
+  const parse = (name: string, value?: string) => {
+    if (value === undefined) {
+      return undefined;
+    }
+    const num = parseFloat(value);
+    if (isNaN(num)) {
+      throw new Error(`Invalid --${name}: ${value}. Must be a number.`);
+    }
+    return num;
+  };
+
+  return { ag: parse("ag", ag), ebpminrp: parse("ebpminrp", ebpminrp) };
+}
@@ -0,0 +1,95 @@
+import type { CLIConfig } from "../config.ts";
+import { parseArgs } from "@std/cli/parse-args";
+import { DEFAULT_MAX_DISK_BYTES } from "../cache.ts";
+import { type ApiKey, loadApiKeys } from "../server/limits.ts";
+import {
+  DEFAULT_MAX_BODY_BYTES,
+  serve,
+  type ServerOptions,
+} from "../server/server.ts";
+
+/**
+ * Serve the local catalogue over HTTP
+ * @param config - The configuration for the database
+ * @param args - The arguments for the command
+ * @returns void
+ */
+export async function serveCommand(config: CLIConfig, args: string[]) {
+  const server = serve(await parseServeOptions(config, args));
+  await server.finished;
+}
+
+/**
+ * Server options from the serve command's flags, shared with the daemon
+ */
+export async function parseServeOptions(
+  config: CLIConfig,
+  args: string[],
+): Promise<ServerOptions> {
+  const parsed = parseArgs(args, {
+    string: [
+      "port",
+      "hostname",
+      "api-keys",
+      "cors-origin",
+      "rate-limit-requests",
+      "rate-limit-rows",
+      "cache-entries",
+      "cache-dir",
+      "cache-size",
+      "jobs-dir",
+      "job-workers",
+      "job-retention",
+      "max-body",
+    ],
+    default: {
+      port: "8080",
+      hostname: "127.0.0.1",
+      "rate-limit-requests": "0",
+      "rate-limit-rows": "0",
+      "cache-entries": "256",
+      "cache-size": String(DEFAULT_MAX_DISK_BYTES / 1024 / 1024),
+      "job-workers": "2",
+      "job-retention": "7",
+      "max-body": String(DEFAULT_MAX_BODY_BYTES / 1024 / 1024),
+    },
+  });
+
+  const number = (name: string, value: string) => {
+    const num = Number(value);
+    if (!Number.isInteger(num) || num < 0) {
+      throw new Error(`Invalid --${name}: ${value}. Must be a whole number.`);
+    }
+    return num;
+  };
+
+  let apiKeys: ApiKey[] | undefined;
+  if (parsed["api-keys"]) {
+    apiKeys = await loadApiKeys(parsed["api-keys"]);
+  }
+
+  return {
+    port: number("port", parsed.port),
+    hostname: parsed.hostname,
+    gaia: { ...config, magnitudeLimit: undefined },
+    apiKeys,
+    rateLimits: {
+      requestsPerMinute: number(
+        "rate-limit-requests",
+        parsed["rate-limit-requests"],
+      ),
+      rowsPerMinute: number("rate-limit-rows", parsed["rate-limit-rows"]),
+    },
+    corsOrigins: parsed["cors-origin"]
+      ? parsed["cors-origin"].split(",").map((origin) => origin.trim())
+      : [],
+    cacheEntries: number("cache-entries", parsed["cache-entries"]),
+    cacheDirectory: parsed["cache-dir"],
+    cacheDiskBytes: number("cache-size", parsed["cache-size"]) * 1024 * 1024,
+    jobsDirectory: parsed["jobs-dir"],
+    jobWorkers: number("job-workers", parsed["job-workers"]),
+    jobRetentionDays: number("job-retention", parsed["job-retention"]),
+    maxBodyBytes: number("max-body", parsed["max-body"]) * 1024 * 1024,
+    logLevel: config.logLevel,
+  };
+}
@@ -0,0 +1,63 @@
+import type { CLIConfig } from "../config.ts";
+import { queryGo } from "../ffi/go.ts";
+import { formatDuration } from "../utils.ts";
+import { parseArgs } from "@std/cli/parse-args";
+import { stringify } from "@std/csv";
+
+const FORMATS = ["table", "json", "csv"];
+
+/**
+ * Run a read-only SQL statement against the database in Go, with the
+ * astronomy functions ang_sep, in_cone, healpix, healpix_from_source_id
+ * and flux_to_mag, and the table-valued searches cone, box and nearest
+ * @param config - The configuration for the database
+ * @param args - The arguments for the command
+ * @returns void
+ */
+export async function sqlCommand(config: CLIConfig, args: string[]) {
+  const parsed = parseArgs(args, {
+    string: ["file", "limit", "format"],
+    default: { limit: "100", format: "table" },
+  });
+
+  const sql = parsed.file
+    ? await Deno.readTextFile(parsed.file)
+    : parsed._.map(String).join(" ");
+  if (!sql.trim()) {
+    throw new Error("Give a SQL statement, or --file with one");
+  }
+
+  const limit = Number(parsed.limit);
+  if (!Number.isInteger(limit) || limit < 0) {
+    throw new Error(`Invalid limit: ${parsed.limit}. Use 0 for every row.`);
+  }
+  if (!FORMATS.includes(parsed.format)) {
+    throw new Error(
+      `Invalid format: ${parsed.format}. Must be one of ${FORMATS.join(", ")}.`,
+    );
+  }
+
+  try {
+    Deno.statSync(config.databasePath);
+  } catch {
+    throw new Error(`Database not found: ${config.databasePath}`);
+  }
+
+  const result = await queryGo(config.databasePath, sql, limit);
+  const records = result.rows.map((row) =>
+    Object.fromEntries(result.columns.map((column, i) => [column, row[i]]))
+  );
+
+  if (parsed.format === "json") {
+    console.log(JSON.stringify(records, null, 2));
+  } else if (parsed.format === "csv") {
+    console.log(stringify(records, { columns: result.columns }).trimEnd());
+  } else {
+    console.table(records);
+    console.log(
+      `${records.length} row(s) in ${formatDuration(result.duration_ms)}${
+        result.truncated ? `; more rows left, raise --limit to see them` : ""
+      }`,
+    );
+  }
+}
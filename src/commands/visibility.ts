@@ -0,0 +1,510 @@
+import type { CLIConfig } from "../config.ts";
+import { createGaia } from "../gaia.ts";
+import type { GaiaRecord } from "../database.ts";
+import { parseArgs } from "@std/cli/parse-args";
+import { parse as parseCSV } from "@std/csv";
+import {
+  airmass,
+  findNight,
+  julianDate,
+  moonIllumination,
+  moonPosition,
+  type Night,
+  riseTransitSet,
+  type RiseTransitSet,
+  type Site,
+  toHorizontal,
+} from "../ephemeris.ts";
+import { type Color, PALETTE, Raster } from "../chart.ts";
+import { angularSeparation } from "../astrometry.ts";
+
+interface Target {
+  name: string;
+  ra: number;
+  dec: number;
+  gMag: number | null;
+}
+
+interface TargetVisibility {
+  target: Target;
+  rts: RiseTransitSet;
+  /** Altitude samples across the night, parallel to `times` */
+  altitudes: number[];
+  maxAltitude: number;
+  bestTime: Date;
+  minAirmass: number;
+  /** Moon separation at the best time, in degrees */
+  moonSeparation: number;
+  /** Hours in the dark window below the airmass limit */
+  observableHours: number;
+}
+
+const TWILIGHT_ALTITUDES: Record<string, number> = {
+  civil: -6,
+  nautical: -12,
+  astronomical: -18,
+};
+
+/**
+ * Compute rise/transit/set, airmass and moon separation of catalogue stars
+ * for a site and night
+ * @param config - The configuration for the database
+ * @param args - The arguments for the command
+ * @returns void
+ */
+export async function visibilityCommand(
+  config: CLIConfig,
+  args: string[],
+): Promise<void> {
+  const parsed = parseArgs(args, {
+    string: [
+      "lat",
+      "lon",
+      "elevation",
+      "date",
+      "targets",
+      "source-id",
+      "ra",
+      "dec",
+      "radius",
+      "limit",
+      "step",
+      "twilight",
+      "max-airmass",
+      "format",
+      "output",
+    ],
+    default: {
+      elevation: "0",
+      step: "10",
+      twilight: "astronomical",
+      "max-airmass": "2",
+      format: "table",
+      output: "visibility.png",
+      limit: "20",
+    },
+  });
+
+  if (parsed.lat === undefined || parsed.lon === undefined) {
+    throw new Error("--lat and --lon are required");
+  }
+
+  const site: Site = {
+    latitude: parseFloat(parsed.lat),
+    longitude: parseFloat(parsed.lon),
+    elevation: parseFloat(parsed.elevation),
+  };
+
+  if (isNaN(site.latitude) || isNaN(site.longitude) || isNaN(site.elevation)) {
+    throw new Error("--lat, --lon and --elevation must be numbers");
+  }
+
+  const date = parsed.date ? new Date(parsed.date) : new Date();
+  if (isNaN(date.getTime())) {
+    throw new Error(`Invalid date: ${parsed.date}. Use YYYY-MM-DD.`);
+  }
+
+  const twilight = TWILIGHT_ALTITUDES[parsed.twilight] ??
+    parseFloat(parsed.twilight);
+  if (isNaN(twilight)) {
+    throw new Error(
+      `Invalid twilight: ${parsed.twilight}. Use civil, nautical, astronomical or an altitude in degrees.`,
+    );
+  }
+
+  const stepMinutes = parseFloat(parsed.step);
+  const maxAirmass = parseFloat(parsed["max-airmass"]);
+  if (!Number.isFinite(stepMinutes) || stepMinutes <= 0) {
+    throw new Error(
+      `Invalid step: ${parsed.step}. Use a positive number of minutes.`,
+    );
+  }
+  // Airmass is 1 at the zenith and grows toward the horizon
+  if (!Number.isFinite(maxAirmass) || maxAirmass < 1) {
+    throw new Error(
+      `Invalid max airmass: ${
+        parsed["max-airmass"]
+      }. Use a number of at least 1.`,
+    );
+  }
+
+  const night = findNight(date, site, twilight);
+  if (!night) {
+    throw new Error(
+      "The Sun does not reach the twilight altitude on this date at this site",
+    );
+  }
+
+  const targets = await loadTargets(config, {
+    sourceIds: parsed["source-id"],
+    targetsFile: parsed.targets,
+    ra: parsed.ra,
+    dec: parsed.dec,
+    radius: parsed.radius,
+    limit: parsed.limit,
+  });
+  if (targets.length === 0) {
+    throw new Error(
+      "No targets found. Pass --targets, --source-id or --ra/--dec/--radius.",
+    );
+  }
+
+  // Sample from sunset to sunrise so the chart shows twilight too
+  const times: Date[] = [];
+  for (
+    let t = night.sunset.getTime();
+    t <= night.sunrise.getTime();
+    t += stepMinutes * 60000
+  ) {
+    times.push(new Date(t));
+  }
+
+  const moon = times.map((time) => moonPosition(julianDate(time), site));
+  const midnight = new Date(
+    (night.start.getTime() + night.end.getTime()) / 2,
+  );
+
+  const visibility = targets.map((target) =>
+    computeVisibility(target, site, night, times, moon, midnight, maxAirmass)
+  );
+
+  if (parsed.format === "png") {
+    const png = await renderAirmassChart(visibility, times, night);
+    await Deno.writeFile(parsed.output, png);
+    console.log(`Airmass chart written to ${parsed.output}`);
+    printLegend(visibility);
+    return;
+  }
+
+  if (parsed.format !== "table") {
+    throw new Error(
+      `Invalid format: ${parsed.format}. Must be "table" or "png".`,
+    );
+  }
+
+  printTable(visibility, site, night, midnight, maxAirmass);
+}
+
+interface TargetOptions {
+  sourceIds?: string;
+  targetsFile?: string;
+  ra?: string;
+  dec?: string;
+  radius?: string;
+  limit: string;
+}
+
+/**
+ * Resolve targets from a CSV list, source_ids and/or a cone search.
+ * CSV rows may name a catalogue star by source_id or give ra/dec directly.
+ */
+async function loadTargets(
+  config: CLIConfig,
+  options: TargetOptions,
+): Promise<Target[]> {
+  const sourceIds: string[] = [];
+  const targets: Target[] = [];
+
+  if (options.sourceIds) {
+    sourceIds.push(...options.sourceIds.split(",").map((id) => id.trim()));
+  }
+
+  if (options.targetsFile) {
+    const rows = parseCSV(await Deno.readTextFile(options.targetsFile), {
+      skipFirstRow: true,
+    }) as Record<string, string>[];
+
+    for (const row of rows) {
+      if (row.source_id) {
+        sourceIds.push(row.source_id.trim());
+      } else if (row.ra && row.dec) {
+        targets.push({
+          name: row.name || `${row.ra},${row.dec}`,
+          ra: parseFloat(row.ra),
+          dec: parseFloat(row.dec),
+          gMag: null,
+        });
+      }
+    }
+  }
+
+  const { ra, dec, radius } = options;
+  const cone = ra !== undefined && dec !== undefined && radius !== undefined
+    ? { ra: parseFloat(ra), dec: parseFloat(dec), radius: parseFloat(radius) }
+    : null;
+
+  if (sourceIds.length === 0 && !cone) {
+    return targets;
+  }
+
+  const instance = createGaia({
+    ...config,
+    photometryOutput: "magnitude",
+    limit: Number(options.limit),
+  });
+
+  const records = instance.run((gaia) => {
+    const found: GaiaRecord[] = [];
+    if (sourceIds.length > 0) {
+      found.push(...gaia.lookup(sourceIds));
+    }
+    if (cone) {
+      found.push(...gaia.coneSearch(cone.ra, cone.dec, cone.radius));
+    }
+    return found;
+  });
+
+  for (const record of records) {
+    targets.push({
+      name: record.source_id,
+      ra: record.ra,
+      dec: record.dec,
+      gMag: typeof record.phot_g_mean_mag === "number"
+        ? record.phot_g_mean_mag
+        : null,
+    });
+  }
+
+  return targets;
+}
+
+function computeVisibility(
+  target: Target,
+  site: Site,
+  night: Night,
+  times: Date[],
+  moon: { ra: number; dec: number }[],
+  midnight: Date,
+  maxAirmass: number,
+): TargetVisibility {
+  const altitudes = times.map((time) =>
+    toHorizontal(target, site, julianDate(time)).altitude
+  );
+
+  let best = -1;
+  let observableSamples = 0;
+  const stepHours = times.length > 1
+    ? (times[1].getTime() - times[0].getTime()) / 3600000
+    : 0;
+
+  for (let i = 0; i < times.length; i++) {
+    const time = times[i].getTime();
+    const isDark = time >= night.start.getTime() &&
+      time <= night.end.getTime();
+    if (!isDark) {
+      continue;
+    }
+    if (best === -1 || altitudes[i] > altitudes[best]) {
+      best = i;
+    }
+    if (airmass(altitudes[i]) <= maxAirmass) {
+      observableSamples++;
+    }
+  }
+
+  // The dark window can be shorter than one step near the poles
+  if (best === -1) {
+    best = altitudes.indexOf(Math.max(...altitudes));
+  }
+
+  return {
+    target,
+    rts: riseTransitSet(target, site, midnight),
+    altitudes,
+    maxAltitude: altitudes[best],
+    bestTime: times[best],
+    minAirmass: airmass(altitudes[best]),
+    moonSeparation: angularSeparation(target, moon[best]),
+    observableHours: observableSamples * stepHours,
+  };
+}
+
+function formatTime(date: Date | null): string {
+  return date ? date.toISOString().slice(11, 16) : "--:--";
+}
+
+function printTable(
+  visibility: TargetVisibility[],
+  site: Site,
+  night: Night,
+  midnight: Date,
+  maxAirmass: number,
+): void {
+  const illumination = moonIllumination(julianDate(midnight));
+
+  console.log("🔭 Gaia Offline - Target Visibility\n");
+  console.log(
+    `Site:        lat ${site.latitude}°, lon ${site.longitude}°, elevation ${site.elevation}m`,
+  );
+  console.log(
+    `Night (UTC): sunset ${formatTime(night.sunset)}, dark ${
+      formatTime(night.start)
+    }–${formatTime(night.end)}, sunrise ${formatTime(night.sunrise)}`,
+  );
+  console.log(`Moon:        ${(illumination * 100).toFixed(0)}% illuminated`);
+  console.log();
+
+  const header = [
+    "Target",
+    "RA",
+    "Dec",
+    "G",
+    "Rise",
+    "Transit",
+    "Set",
+    "Max alt",
+    "Min X",
+    "Moon sep",
+    `Hours X<${maxAirmass}`,
+  ];
+
+  const rows = visibility.map((v) => [
+    v.target.name,
+    v.target.ra.toFixed(4),
+    v.target.dec.toFixed(4),
+    v.target.gMag !== null ? v.target.gMag.toFixed(2) : "",
+    v.rts.circumpolar ? "circ." : formatTime(v.rts.rise),
+    formatTime(v.rts.transit),
+    v.rts.circumpolar ? "circ." : formatTime(v.rts.set),
+    `${v.maxAltitude.toFixed(1)}°`,
+    isFinite(v.minAirmass) ? v.minAirmass.toFixed(2) : "-",
+    `${v.moonSeparation.toFixed(1)}°`,
+    v.observableHours.toFixed(1),
+  ]);
+
+  const widths = header.map((title, i) =>
+    Math.max(title.length, ...rows.map((row) => row[i].length))
+  );
+  const format = (row: string[]) =>
+    row.map((cell, i) => cell.padEnd(widths[i])).join("  ").trimEnd();
+
+  console.log(format(header));
+  console.log(widths.map((w) => "─".repeat(w)).join("  "));
+  for (const row of rows) {
+    console.log(format(row));
+  }
+}
+
+function printLegend(visibility: TargetVisibility[]): void {
+  visibility.forEach((v, i) => {
+    console.log(`  ${i + 1}. ${v.target.name}`);
+  });
+}
+
+/**
+ * Render an airmass-vs-time chart, airmass 1 at the top
+ */
+async function renderAirmassChart(
+  visibility: TargetVisibility[],
+  times: Date[],
+  night: Night,
+): Promise<Uint8Array> {
+  const width = 960;
+  const height = 540;
+  const margin = { left: 70, right: 30, top: 30, bottom: 60 };
+  const plotWidth = width - margin.left - margin.right;
+  const plotHeight = height - margin.top - margin.bottom;
+  const minX = 1;
+  const maxX = 3;
+
+  const black: Color = [0, 0, 0];
+  const grid: Color = [220, 220, 220];
+  const twilight: Color = [235, 235, 245];
+
+  const start = times[0].getTime();
+  const end = times[times.length - 1].getTime();
+  const xOf = (time: number) =>
+    margin.left + ((time - start) / (end - start)) * plotWidth;
+  const yOf = (x: number) =>
+    margin.top + ((x - minX) / (maxX - minX)) * plotHeight;
+
+  const raster = new Raster(width, height);
+
+  // Shade twilight on either side of the dark window
+  raster.fillRect(
+    margin.left,
+    margin.top,
+    xOf(night.start.getTime()) - margin.left,
+    plotHeight,
+    twilight,
+  );
+  raster.fillRect(
+    xOf(night.end.getTime()),
+    margin.top,
+    margin.left + plotWidth - xOf(night.end.getTime()),
+    plotHeight,
+    twilight,
+  );
+
+  // Airmass grid and labels
+  for (let x = minX; x <= maxX + 1e-9; x += 0.5) {
+    const y = yOf(x);
+    raster.line(margin.left, y, margin.left + plotWidth, y, grid);
+    const label = x.toFixed(1);
+    raster.text(
+      margin.left - 10 - Raster.textWidth(label),
+      y - 5,
+      label,
+      black,
+    );
+  }
+
+  // Hourly time grid and labels
+  const firstHour = Math.ceil(start / 3600000) * 3600000;
+  for (let t = firstHour; t <= end; t += 3600000) {
+    const x = xOf(t);
+    raster.line(x, margin.top, x, margin.top + plotHeight, grid);
+    const label = formatTime(new Date(t));
+    raster.text(
+      x - Raster.textWidth(label) / 2,
+      margin.top + plotHeight + 10,
+      label,
+      black,
+    );
+  }
+
+  raster.text(
+    margin.left + plotWidth / 2 - Raster.textWidth("UTC") / 2,
+    height - 25,
+    "UTC",
+    black,
+  );
+  raster.text(10, margin.top - 20, "AIRMASS", black);
+
+  // One curve per target, broken where it drops below the chart
+  visibility.forEach((v, index) => {
+    const color = PALETTE[index % PALETTE.length];
+    let previous: { x: number; y: number } | null = null;
+    let peak: { x: number; y: number } | null = null;
+
+    for (let i = 0; i < times.length; i++) {
+      const x = airmass(v.altitudes[i]);
+      if (x > maxX) {
+        previous = null;
+        continue;
+      }
+      const point = { x: xOf(times[i].getTime()), y: yOf(x) };
+      if (previous) {
+        raster.line(previous.x, previous.y, point.x, point.y, color, 2);
+      }
+      if (!peak || point.y < peak.y) {
+        peak = point;
+      }
+      previous = point;
+    }
+
+    if (peak) {
+      raster.text(peak.x + 4, peak.y - 14, `${index + 1}`, color);
+    }
+  });
+
+  // Plot frame
+  const right = margin.left + plotWidth;
+  const bottom = margin.top + plotHeight;
+  raster.line(margin.left, margin.top, right, margin.top, black);
+  raster.line(margin.left, bottom, right, bottom, black);
+  raster.line(margin.left, margin.top, margin.left, bottom, black);
+  raster.line(right, margin.top, right, bottom, black);
+
+  return await raster.toPNG();
+}
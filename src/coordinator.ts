@@ -9,6 +9,9 @@ import {
   streamAndFilterCSV,
 } from "./utils.ts";
 import type { CLIConfig } from "./config.ts";
+import type { RunHooks } from "./hooks.ts";
+import { HttpClient } from "./http.ts";
+import { bandOverlaps, getCoveredDecCells, getTmassBands } from "./tmass.ts";
 import { Logger } from "./types.ts";
 import type { DownloadProgress } from "./downloader.ts";
 
@@ -18,8 +21,17 @@ export interface PopulateStats {
   failedFiles: number;
   totalRecords: number;
   duration: number;
+  /** Milliseconds per stage, summed over files ingested in Go */
+  stages?: Record<string, number>;
 }
 
+/** populate stage of each tracking table, as reported to run hooks */
+const STAGES: Record<string, string> = {
+  file_tracking_gaiadr3: "gaia",
+  file_tracking_tmass_xmatch: "tmass-xmatch",
+  file_tracking_tmass: "tmass",
+};
+
 /**
  * Coordinates parallel downloads with sequential database inserts
  */
@@ -36,15 +48,21 @@ export class PopulateCoordinator {
   };
   private logger: Logger;
   private interval: number = 0;
+  private hooks?: RunHooks;
+  private client: HttpClient;
+  private stopped = false;
 
-  constructor(db: GaiaDatabase, config: CLIConfig) {
+  constructor(db: GaiaDatabase, config: CLIConfig, hooks?: RunHooks) {
     this.db = db;
     this.config = config;
+    this.hooks = hooks;
     this.logger = createLogger(config.logLevel, "GaiaPopulate");
+    this.client = new HttpClient(config);
     this.downloader = new ParallelDownloader(
       config.downloadDir,
       config.maxParallelDownloads,
       createLogger(config.logLevel, "Downloader"),
+      this.client,
     );
   }
 
@@ -61,6 +79,7 @@ export class PopulateCoordinator {
 
     this.logger.info("📋 Fetching list of Gaia DR3 files…");
     const allUrls = await getCSVUrls(
+      this.client,
       "https://cdn.gea.esac.esa.int/Gaia/gdr3/gaia_source/",
     );
 
@@ -72,9 +91,7 @@ export class PopulateCoordinator {
     this.db.initializeTracking("file_tracking_gaiadr3", allUrls);
 
     // Filter out already processed files
-    let pendingUrls = allUrls.filter(
-      (url) => !this.db.isFileProcessed("file_tracking_gaiadr3", url),
-    );
+    let pendingUrls = this.pendingFiles("file_tracking_gaiadr3", allUrls);
 
     if (fileLimit) {
       pendingUrls = pendingUrls.slice(0, fileLimit);
@@ -89,8 +106,14 @@ export class PopulateCoordinator {
     // Process in batches: download N files in parallel, then insert sequentially
     await this.processBatchedPipeline(pendingUrls, "file_tracking_gaiadr3");
 
-    this.db.createIndices();
-    this.db.optimize();
+    if (!this.config.deferIndexes) {
+      this.db.createIndices();
+    }
+    // VACUUM rewrites the whole file, so skip it when nothing changed (as
+    // in most daemon runs)
+    if (this.stats.completedFiles > 0) {
+      this.db.optimize();
+    }
 
     this.stats.duration = Date.now() - startTime;
 
@@ -99,6 +122,32 @@ export class PopulateCoordinator {
     return this.stats;
   }
 
+  /**
+   * Stop after the batch in progress. Files already inserted stay
+   * committed; the rest are picked up by the next populate.
+   */
+  stop(): void {
+    this.stopped = true;
+  }
+
+  /**
+   * Files not yet processed, leaving out failed ones still backing off when
+   * config.retryBackoff is set
+   */
+  private pendingFiles(trackingTable: string, urls: string[]): string[] {
+    const backingOff = this.config.retryBackoff
+      ? this.db.getBackingOffFiles(trackingTable, this.config.retryBackoff)
+      : new Set<string>();
+    if (backingOff.size > 0) {
+      this.logger.info(
+        `⏳ ${backingOff.size} failed file(s) waiting to be retried`,
+      );
+    }
+    return urls.filter((url) =>
+      !this.db.isFileProcessed(trackingTable, url) && !backingOff.has(url)
+    );
+  }
+
   private printDownloadProgress() {
     if (this.config.logLevel !== "INFO") {
       return;
@@ -141,7 +190,7 @@ export class PopulateCoordinator {
     const batchSize = this.config.maxParallelDownloads;
     const totalBatches = Math.ceil(urls.length / batchSize);
 
-    for (let i = 0; i < urls.length; i += batchSize) {
+    for (let i = 0; i < urls.length && !this.stopped; i += batchSize) {
       const batchUrls = urls.slice(i, i + batchSize);
       const batchNum = Math.floor(i / batchSize) + 1;
       const startTime = Date.now();
@@ -151,6 +200,8 @@ export class PopulateCoordinator {
         url: string;
         records: GaiaRecord[] | null;
         error: string | null;
+        /** Rows inserted directly by the Go ingester */
+        ingested?: number;
       }>;
 
       if (this.config.useStreaming) {
@@ -236,12 +287,52 @@ export class PopulateCoordinator {
 
             const csvStartTime = Date.now();
 
+            if (this.config.useGoIngest) {
+              // Dynamically import Go FFI only when needed; it inserts too
+              const { ingestGaiaFileGo } = await import("./utils-go.ts");
+              const summary = await ingestGaiaFileGo(
+                result.filePath,
+                this.config,
+              );
+
+              this.logger.info(
+                `${result.url} ingested in ${
+                  Date.now() - csvStartTime
+                }ms (${summary.rows_kept}/${summary.rows_read} rows kept)`,
+              );
+
+              this.stats.stages ??= {};
+              for (const [stage, ms] of Object.entries(summary.stages)) {
+                this.stats.stages[stage] = (this.stats.stages[stage] ?? 0) +
+                  ms;
+              }
+
+              if (this.config.cleanUpDownloadedFiles) {
+                try {
+                  await Deno.remove(result.filePath);
+                } catch {
+                  // Ignore cleanup errors
+                }
+              }
+
+              return {
+                url: result.url,
+                records: null,
+                error: null,
+                ingested: summary.rows_inserted,
+              };
+            }
+
             // Use FFI parser if enabled, otherwise TypeScript
             let records: GaiaRecord[];
             if (this.config.useCParser) {
               // Dynamically import C FFI only when needed (fastest option)
               const { streamAndFilterCSVC } = await import("./utils-c.ts");
               records = await streamAndFilterCSVC(result.filePath, this.config);
+            } else if (this.config.useGoParser) {
+              // Dynamically import Go FFI only when needed
+              const { streamAndFilterCSVGo } = await import("./utils-go.ts");
+              records = await streamAndFilterCSVGo(result.filePath, this.config);
             } else if (this.config.useRustParser) {
               // Dynamically import Rust FFI only when needed
               const { streamAndFilterCSVRust } = await import(
@@ -346,6 +437,15 @@ export class PopulateCoordinator {
         }
       }
 
+      // Files ingested in Go are already in the database
+      for (const result of processResults) {
+        if (result.ingested !== undefined) {
+          this.stats.totalRecords += result.ingested;
+          this.db.markFileCompleted(trackingTable, result.url);
+          this.stats.completedFiles++;
+        }
+      }
+
       // Show progress
       const progress = this.db.getTrackingProgress(trackingTable);
       const percentage = progress.total > 0
@@ -360,6 +460,7 @@ export class PopulateCoordinator {
       ].filter(Boolean).join(" | ");
 
       this.logger.info(parts + "\n");
+      await this.hooks?.checkFailures(STAGES[trackingTable], this.stats);
     }
   }
 
@@ -379,6 +480,27 @@ export class PopulateCoordinator {
     this.logger.info(
       `Duration:         ${formatDuration(this.stats.duration)}`,
     );
+    if (this.stats.totalRecords > 0 && this.stats.duration > 0) {
+      this.logger.info(
+        `Rate:             ${
+          Math.round(this.stats.totalRecords / (this.stats.duration / 1000))
+            .toLocaleString()
+        } rows/sec`,
+      );
+    }
+    if (this.stats.stages) {
+      // Stages run in parallel across files, so these add up to more than
+      // the duration; compare them with each other
+      const total = Object.values(this.stats.stages).reduce((a, b) => a + b);
+      this.logger.info("Stage timings (summed across files):");
+      for (const [stage, ms] of Object.entries(this.stats.stages)) {
+        this.logger.info(
+          `  ${stage.replace(/_ms$/, "").padEnd(16)}${
+            formatDuration(Math.round(ms)).padStart(10)
+          }  ${(total > 0 ? (ms / total) * 100 : 0).toFixed(1)}%`,
+        );
+      }
+    }
     this.logger.info(`Database path:    ${this.config.databasePath}`);
     this.logger.info("=".repeat(60) + "\n");
   }
@@ -404,6 +526,7 @@ export class PopulateCoordinator {
 
     this.logger.info("📋 Fetching list of 2MASS crossmatch files…");
     const allUrls = await getCSVUrls(
+      this.client,
       "https://cdn.gea.esac.esa.int/Gaia/gedr3/cross_match/tmasspscxsc_best_neighbour/",
     );
 
@@ -421,9 +544,7 @@ export class PopulateCoordinator {
     this.db.initializeTracking("file_tracking_tmass_xmatch", allUrls);
 
     // Filter out already processed files
-    let pendingUrls = allUrls.filter(
-      (url) => !this.db.isFileProcessed("file_tracking_tmass_xmatch", url),
-    );
+    let pendingUrls = this.pendingFiles("file_tracking_tmass_xmatch", allUrls);
 
     if (fileLimit) {
       pendingUrls = pendingUrls.slice(0, fileLimit);
@@ -441,7 +562,9 @@ export class PopulateCoordinator {
       "file_tracking_tmass_xmatch",
     );
 
-    this.db.createIndices();
+    if (!this.config.deferIndexes) {
+      this.db.createIndices();
+    }
 
     this.stats.duration = Date.now() - startTime;
     this.printSummary();
@@ -470,11 +593,33 @@ export class PopulateCoordinator {
 
     this.logger.info("📋 Fetching list of 2MASS catalog files…");
     const allUrls = await getCSVUrls(
+      this.client,
       "https://irsa.ipac.caltech.edu/2MASS/download/allsky/",
     );
 
     // Exclude last 3 files (as per Python implementation)
-    const filteredUrls = allUrls.slice(0, -3);
+    let filteredUrls = allUrls.slice(0, -3);
+
+    // A partial Gaia build only needs the bands it covers
+    const cells = getCoveredDecCells(this.db, this.logger);
+    if (cells) {
+      const bands = await getTmassBands(
+        this.db,
+        this.client,
+        filteredUrls,
+        this.logger,
+      );
+      if (bands) {
+        const skipped = new Set(
+          bands.filter((band) => !bandOverlaps(band, cells))
+            .map((band) => band.url),
+        );
+        filteredUrls = filteredUrls.filter((url) => !skipped.has(url));
+        this.logger.info(
+          `🗺️  Gaia coverage is partial: skipping ${skipped.size} of ${bands.length} 2MASS declination bands`,
+        );
+      }
+    }
 
     const totalFiles = fileLimit ?? filteredUrls.length;
     this.stats = {
@@ -490,9 +635,7 @@ export class PopulateCoordinator {
     this.db.initializeTracking("file_tracking_tmass", filteredUrls);
 
     // Filter out already processed files
-    let pendingUrls = filteredUrls.filter(
-      (url) => !this.db.isFileProcessed("file_tracking_tmass", url),
-    );
+    let pendingUrls = this.pendingFiles("file_tracking_tmass", filteredUrls);
 
     if (fileLimit) {
       pendingUrls = pendingUrls.slice(0, fileLimit);
@@ -507,7 +650,9 @@ export class PopulateCoordinator {
     // Process files
     await this.processTmassBatch(pendingUrls, "file_tracking_tmass");
 
-    this.db.createIndices();
+    if (!this.config.deferIndexes) {
+      this.db.createIndices();
+    }
 
     this.stats.duration = Date.now() - startTime;
     this.printSummary();
@@ -525,7 +670,7 @@ export class PopulateCoordinator {
     const batchSize = this.config.maxParallelDownloads;
     const totalBatches = Math.ceil(urls.length / batchSize);
 
-    for (let i = 0; i < urls.length; i += batchSize) {
+    for (let i = 0; i < urls.length && !this.stopped; i += batchSize) {
       const batchUrls = urls.slice(i, i + batchSize);
       const batchNum = Math.floor(i / batchSize) + 1;
 
@@ -546,13 +691,15 @@ export class PopulateCoordinator {
         }
 
         try {
-          const processResult = await processTmassXmatchFile(
-            result.filePath,
-            result.url,
-            this.db,
-            this.config,
-            trackingTable,
-          );
+          const processResult = this.config.useGoIngest
+            ? await this.ingestTmassXmatchGo(result.filePath, result.url)
+            : await processTmassXmatchFile(
+              result.filePath,
+              result.url,
+              this.db,
+              this.config,
+              trackingTable,
+            );
 
           if (processResult.success) {
             this.stats.completedFiles++;
@@ -585,6 +732,51 @@ export class PopulateCoordinator {
           percentage.toFixed(1)
         }%) | Records: ${this.stats.totalRecords.toLocaleString()}\n`,
       );
+      await this.hooks?.checkFailures(STAGES[trackingTable], this.stats);
+    }
+  }
+
+  /**
+   * Insert a crossmatch file's links in Go, tracking it like
+   * processTmassXmatchFile does
+   */
+  private async ingestTmassXmatchGo(
+    filePath: string,
+    url: string,
+  ): Promise<{ success: boolean; recordCount: number; error?: string }> {
+    const trackingTable = "file_tracking_tmass_xmatch";
+    if (this.db.isFileProcessed(trackingTable, url)) {
+      this.logger.debug(`Skipping already processed: ${url}`);
+      return { success: true, recordCount: 0 };
+    }
+
+    try {
+      // Dynamically import Go FFI only when needed; it inserts too
+      const { ingestTmassXmatchFileGo } = await import("./utils-go.ts");
+      const summary = await ingestTmassXmatchFileGo(filePath, this.config);
+
+      this.stats.stages ??= {};
+      for (const [stage, ms] of Object.entries(summary.stages)) {
+        this.stats.stages[stage] = (this.stats.stages[stage] ?? 0) + ms;
+      }
+
+      this.db.markFileCompleted(trackingTable, url);
+      return { success: true, recordCount: summary.rows_inserted };
+    } catch (error) {
+      this.db.markFileFailed(trackingTable, url);
+      return {
+        success: false,
+        recordCount: 0,
+        error: error instanceof Error ? error.message : String(error),
+      };
+    } finally {
+      if (this.config.cleanUpDownloadedFiles) {
+        try {
+          await Deno.remove(filePath);
+        } catch {
+          // Ignore cleanup errors
+        }
+      }
     }
   }
 
@@ -598,7 +790,7 @@ export class PopulateCoordinator {
     const batchSize = this.config.maxParallelDownloads;
     const totalBatches = Math.ceil(urls.length / batchSize);
 
-    for (let i = 0; i < urls.length; i += batchSize) {
+    for (let i = 0; i < urls.length && !this.stopped; i += batchSize) {
       const batchUrls = urls.slice(i, i + batchSize);
       const batchNum = Math.floor(i / batchSize) + 1;
 
@@ -657,6 +849,7 @@ export class PopulateCoordinator {
           percentage.toFixed(1)
         }%) | Records: ${this.stats.totalRecords.toLocaleString()}\n`,
       );
+      await this.hooks?.checkFailures(STAGES[trackingTable], this.stats);
     }
   }
 
@@ -666,14 +859,18 @@ export class PopulateCoordinator {
   cleanup() {
     // await this.downloader.cleanup();
     clearInterval(this.interval);
+    this.client.close();
   }
 }
 
 /**
  * Fetch all CSV URLs from a Gaia directory listing
  */
-export async function getCSVUrls(baseUrl: string): Promise<string[]> {
-  const response = await fetch(baseUrl);
+export async function getCSVUrls(
+  client: HttpClient,
+  baseUrl: string,
+): Promise<string[]> {
+  const response = await client.fetch(baseUrl);
   if (!response.ok) {
     throw new Error(`Failed to fetch ${baseUrl}: ${response.statusText}`);
   }
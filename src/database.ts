@@ -1,7 +1,29 @@
 import { Database } from "@db/sqlite";
-import type { CLIConfig } from "./config.ts";
-import type { Logger } from "./types.ts";
+import { type CLIConfig, VERSION } from "./config.ts";
+import type { GaiaColumn, Logger } from "./types.ts";
 import { createLogger, formatDuration } from "./utils.ts";
+import { angularSeparation, totalProperMotion } from "./astrometry.ts";
+import { parseHealpixRange } from "./healpix.ts";
+import { type ColumnInfo, columnInfo, tableDescriptions } from "./schema.ts";
+import {
+  applyMigrations,
+  checkSchemaVersion,
+  getSchemaVersion,
+  type Migration,
+  PendingMigrationsError,
+  pendingMigrations,
+  SCHEMA_VERSION,
+  stampSchemaVersion,
+} from "./migrations.ts";
+import {
+  createIndexSql,
+  findRedundantIndexes,
+  type IndexDefinition,
+  type IndexInfo,
+  listIndexes,
+  missingIndexes,
+  type RedundantIndex,
+} from "./indexes.ts";
 
 export interface FileTrackingRecord {
   url: string;
@@ -18,6 +40,12 @@ export interface GaiaRecord {
 export interface TmassXmatchRecord {
   gaiadr3_source_id: string;
   tmass_source_id: string;
+  /** Distance between the Gaia and 2MASS positions, arcsec */
+  angular_distance?: number | null;
+  /** 2MASS sources within the match radius of the Gaia source */
+  number_of_neighbours?: number | null;
+  /** Other Gaia sources with the same 2MASS best neighbour */
+  number_of_mates?: number | null;
 }
 
 export interface TmassRecord {
@@ -34,6 +62,37 @@ export interface TrackingProgress {
   pending: number;
 }
 
+export interface Region {
+  ra: number;
+  dec: number;
+  radius: number;
+}
+
+/**
+ * A region that gained rows, as a level-8 HEALPix range; null bounds mean
+ * the whole sky
+ */
+export interface CacheInvalidation {
+  id: number;
+  healpix_start: number | null;
+  healpix_end: number | null;
+}
+
+export interface ColumnDescription {
+  name: string;
+  type: string;
+  unit: string | null;
+  description: string | null;
+}
+
+export interface TableDescription {
+  name: string;
+  description: string | null;
+  /** Upper bound on the row count, cheap to read on large tables */
+  approximateRows: number;
+  columns: ColumnDescription[];
+}
+
 export type GaiaDatabaseOptions = Pick<
   CLIConfig,
   "databasePath" | "logLevel" | "storedColumns" | "zeropoints"
@@ -46,16 +105,37 @@ export class GaiaDatabase {
 
   constructor(config: GaiaDatabaseOptions) {
     this.db = new Database(config.databasePath);
+    // The Go ingester writes through its own connection
+    this.db.exec("PRAGMA busy_timeout = 60000");
     this.config = config;
     this.logger = createLogger(config.logLevel, "Database");
+    try {
+      checkSchemaVersion(this.db, config.databasePath);
+    } catch (error) {
+      this.db.close();
+      throw error;
+    }
   }
 
   /**
-   * Initialize database schema
+   * Initialize database schema. Existing databases must be at the current
+   * version; `migrate` brings older ones up to date.
    */
   initialize(): void {
+    const created = !this.hasTable("gaiadr3");
+
+    // Migrations change existing tables, so they are left to `migrate`,
+    // which can list them first and back up the database
+    const pending = created ? [] : this.pendingMigrations();
+    if (pending.length > 0) {
+      const path = this.config.databasePath;
+      throw new PendingMigrationsError(
+        `${path} has schema version ${this.getSchemaVersion()} and needs ${pending.length} migration(s) to reach version ${SCHEMA_VERSION}. Run gaiaoffline migrate --db-path ${path} first (--dry-run lists them, --backup copies the database).`,
+      );
+    }
+
     // Create main Gaia table
-    const columnDefs = this.config.storedColumns
+    const columnDefs = this.getInsertColumns()
       .map((col) => {
         if (col === "source_id") {
           return `${col} TEXT PRIMARY KEY`;
@@ -74,7 +154,10 @@ export class GaiaDatabase {
     this.db.exec(`
       CREATE TABLE IF NOT EXISTS tmass_xmatch (
         gaiadr3_source_id TEXT PRIMARY KEY,
-        tmass_source_id TEXT NOT NULL
+        tmass_source_id TEXT NOT NULL,
+        angular_distance REAL,
+        number_of_neighbours INTEGER,
+        number_of_mates INTEGER
       );
     `);
 
@@ -89,10 +172,238 @@ export class GaiaDatabase {
       );
     `);
 
+    // Declination band of each 2MASS PSC file; see tmass.ts
+    this.db.exec(`
+      CREATE TABLE IF NOT EXISTS tmass_bands (
+        url TEXT PRIMARY KEY,
+        dec_start REAL NOT NULL
+      );
+    `);
+
     // Create file tracking tables
     this.createTrackingTable("file_tracking_gaiadr3");
     this.createTrackingTable("file_tracking_tmass_xmatch");
     this.createTrackingTable("file_tracking_tmass");
+
+    // Regions changed by populate, read by query caches in other processes
+    this.db.exec(`
+      CREATE TABLE IF NOT EXISTS cache_invalidations (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        healpix_start INTEGER,
+        healpix_end INTEGER,
+        url TEXT,
+        created_at TEXT DEFAULT CURRENT_TIMESTAMP
+      );
+    `);
+
+    this.db.exec(`
+      CREATE TABLE IF NOT EXISTS metadata (
+        key TEXT PRIMARY KEY,
+        value TEXT
+      );
+    `);
+    this.db.exec(`
+      CREATE TABLE IF NOT EXISTS column_metadata (
+        table_name TEXT NOT NULL,
+        column_name TEXT NOT NULL,
+        unit TEXT,
+        description TEXT,
+        PRIMARY KEY (table_name, column_name)
+      );
+    `);
+
+    if (created) {
+      stampSchemaVersion(this.db);
+    }
+    this.writeMetadata();
+  }
+
+  /**
+   * The schema version, 0 for databases from before versioning
+   */
+  getSchemaVersion(): number {
+    return getSchemaVersion(this.db);
+  }
+
+  /**
+   * Migrations not yet applied to this database
+   */
+  pendingMigrations(): Migration[] {
+    return pendingMigrations(this.db);
+  }
+
+  /**
+   * Apply pending schema migrations
+   * @returns The migrations applied
+   */
+  migrate(): Migration[] {
+    return applyMigrations(this.db, (migration, ms) => {
+      this.logger.info(
+        `Migrated schema to version ${migration.version} (${migration.description}) in ${
+          formatDuration(ms)
+        }`,
+      );
+    });
+  }
+
+  /**
+   * Copy the database to a new file, consistent even while it is in use
+   */
+  backup(path: string): void {
+    this.db.prepare("VACUUM INTO ?").run(path);
+  }
+
+  /**
+   * Record build properties and the units and descriptions of every column
+   */
+  private writeMetadata(): void {
+    const now = new Date().toISOString();
+    this.db.prepare(
+      "INSERT OR IGNORE INTO metadata (key, value) VALUES ('created_at', ?)",
+    ).run(now);
+
+    const properties: Record<string, string> = {
+      data_release: "Gaia DR3",
+      gaiaoffline_version: VERSION,
+      stored_columns: this.getInsertColumns().join(","),
+      zeropoints: this.config.zeropoints.join(","),
+    };
+    for (const [key, value] of Object.entries(properties)) {
+      this.setMetadata(key, value);
+    }
+
+    const stmt = this.db.prepare(
+      `INSERT OR REPLACE INTO column_metadata (table_name, column_name, unit, description)
+       VALUES (?, ?, ?, ?)`,
+    );
+    this.db.transaction(() => {
+      for (const table of this.getTableNames()) {
+        for (const column of this.getColumns(table)) {
+          const known = columnInfo(table, column.name);
+          if (known) {
+            stmt.run(table, column.name, known.unit, known.description);
+          }
+        }
+      }
+    })();
+    stmt.finalize();
+  }
+
+  setMetadata(key: string, value: string): void {
+    this.db.prepare(
+      "INSERT OR REPLACE INTO metadata (key, value) VALUES (?, ?)",
+    ).run(key, value);
+  }
+
+  /**
+   * Build properties, e.g. `created_at` and `stored_columns`
+   */
+  getMetadata(): Record<string, string> {
+    if (!this.hasTable("metadata")) {
+      return {};
+    }
+
+    const rows = this.db.prepare("SELECT key, value FROM metadata ORDER BY key")
+      .all<{ key: string; value: string }>();
+    return Object.fromEntries(rows.map((row) => [row.key, row.value]));
+  }
+
+  private getTableNames(): string[] {
+    return this.db.prepare(
+      `SELECT name FROM sqlite_master
+       WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`,
+    ).all<{ name: string }>().map((row) => row.name);
+  }
+
+  private getColumns(table: string): { name: string; type: string }[] {
+    return this.db.prepare(`PRAGMA table_info(${table})`).all<
+      { name: string; type: string }
+    >();
+  }
+
+  /**
+   * Every table with its columns, their units and descriptions. Uses the
+   * `column_metadata` table, falling back to the built-in catalogue for
+   * databases created before it existed.
+   */
+  describeTables(): TableDescription[] {
+    const stored = new Map<string, ColumnInfo>();
+    if (this.hasTable("column_metadata")) {
+      const rows = this.db.prepare(
+        "SELECT table_name, column_name, unit, description FROM column_metadata",
+      ).all<{
+        table_name: string;
+        column_name: string;
+        unit: string | null;
+        description: string;
+      }>();
+      for (const row of rows) {
+        stored.set(`${row.table_name}.${row.column_name}`, row);
+      }
+    }
+
+    return this.getTableNames().map((table) => {
+      const rows = this.db.prepare(
+        `SELECT COALESCE(MAX(rowid), 0) AS count FROM ${table}`,
+      ).get<{ count: number }>();
+
+      return {
+        name: table,
+        description: tableDescriptions[table] ?? null,
+        approximateRows: rows?.count ?? 0,
+        columns: this.getColumns(table).map((column) => {
+          const known = stored.get(`${table}.${column.name}`) ??
+            columnInfo(table, column.name);
+          return {
+            name: column.name,
+            type: column.type,
+            unit: known?.unit ?? null,
+            description: known?.description ?? null,
+          };
+        }),
+      };
+    });
+  }
+
+  /**
+   * Level-8 HEALPix ranges of the completed files in a tracking table
+   */
+  getCompletedHealpixRanges(tableName: string): [number, number][] {
+    if (!this.hasTable(tableName)) {
+      return [];
+    }
+
+    return this.db.prepare(
+      `SELECT url FROM ${tableName} WHERE status = 'completed'`,
+    ).all<{ url: string }>()
+      .map((row) => parseHealpixRange(row.url))
+      .filter((range): range is [number, number] => range !== null);
+  }
+
+  /**
+   * Columns written on insert: the stored columns, plus the total proper
+   * motion `pm` whenever pmra and pmdec are stored, so high proper-motion
+   * searches can use an index instead of a full scan.
+   */
+  private getInsertColumns(): GaiaColumn[] {
+    const columns = [...this.config.storedColumns];
+    if (this.storesDerivedProperMotion()) {
+      columns.push("pm");
+    }
+    return columns;
+  }
+
+  private storesDerivedProperMotion(): boolean {
+    const columns = this.config.storedColumns;
+    return columns.includes("pmra") && columns.includes("pmdec") &&
+      !columns.includes("pm");
+  }
+
+  /**
+   * Check whether a table has a column
+   */
+  hasColumn(table: string, column: string): boolean {
+    return this.getColumns(table).some((c) => c.name === column);
   }
 
   /**
@@ -102,7 +413,11 @@ export class GaiaDatabase {
     this.db.exec(`
       CREATE TABLE IF NOT EXISTS ${tableName} (
         url TEXT PRIMARY KEY,
-        status TEXT DEFAULT 'pending'
+        status TEXT DEFAULT 'pending',
+        attempts INTEGER DEFAULT 0,
+        failed_at TEXT,
+        completed_at TEXT,
+        gaiaoffline_version TEXT
       );
     `);
   }
@@ -148,17 +463,71 @@ export class GaiaDatabase {
    */
   markFileCompleted(tableName: string, url: string): void {
     this.db.prepare(
-      `UPDATE ${tableName} SET status = 'completed' WHERE url = ?`,
+      `UPDATE ${tableName} SET status = 'completed', attempts = 0, failed_at = NULL, completed_at = ?, gaiaoffline_version = ? WHERE url = ?`,
     )
-      .run(url);
+      .run(new Date().toISOString(), VERSION, url);
+    this.recordCacheInvalidation(url);
+    this.setMetadata("updated_at", new Date().toISOString());
+  }
+
+  /**
+   * Record that a file's rows are now in the database, so cached queries
+   * over its HEALPix range (or the whole sky, if the file name has no
+   * range) are dropped
+   */
+  private recordCacheInvalidation(url: string): void {
+    const range = parseHealpixRange(url);
+    this.db.prepare(
+      `INSERT INTO cache_invalidations (healpix_start, healpix_end, url) VALUES (?, ?, ?)`,
+    ).run(range?.[0] ?? null, range?.[1] ?? null, url);
+  }
+
+  /**
+   * Invalidations recorded after `sinceId`, oldest first
+   */
+  getCacheInvalidations(sinceId: number): CacheInvalidation[] {
+    if (!this.hasTable("cache_invalidations")) {
+      return [];
+    }
+
+    return this.db.prepare(
+      `SELECT id, healpix_start, healpix_end FROM cache_invalidations WHERE id > ? ORDER BY id`,
+    ).all<CacheInvalidation>(sinceId);
   }
 
   /**
    * Mark a file as failed
    */
   markFileFailed(tableName: string, url: string): void {
-    this.db.prepare(`UPDATE ${tableName} SET status = 'failed' WHERE url = ?`)
-      .run(url);
+    this.db.prepare(
+      `UPDATE ${tableName} SET status = 'failed', attempts = COALESCE(attempts, 0) + 1, failed_at = ? WHERE url = ?`,
+    ).run(new Date().toISOString(), url);
+  }
+
+  /**
+   * Failed files still waiting to be retried: the wait starts at `delay`
+   * ms after the first failure and doubles with each further one, up to
+   * `maxDelay`
+   */
+  getBackingOffFiles(
+    tableName: string,
+    delay: number,
+    maxDelay = 24 * 60 * 60 * 1000,
+  ): Set<string> {
+    const rows = this.db.prepare(
+      `SELECT url, attempts, failed_at FROM ${tableName} WHERE status = 'failed' AND failed_at IS NOT NULL`,
+    ).all<{ url: string; attempts: number; failed_at: string }>();
+
+    const now = Date.now();
+    return new Set(
+      rows.filter((row) => {
+        const wait = Math.min(
+          delay * 2 ** Math.max(row.attempts - 1, 0),
+          maxDelay,
+        );
+        return Date.parse(row.failed_at) + wait > now;
+      }).map((row) => row.url),
+    );
   }
 
   /**
@@ -199,8 +568,10 @@ export class GaiaDatabase {
     );
 
     // Build dynamic INSERT statement based on columns
-    const columns = this.config.storedColumns.join(", ");
-    const placeholders = this.config.storedColumns.map(() => "?").join(", ");
+    const insertColumns = this.getInsertColumns();
+    const derivePm = this.storesDerivedProperMotion();
+    const columns = insertColumns.join(", ");
+    const placeholders = insertColumns.map(() => "?").join(", ");
 
     const stmt = this.db.prepare(
       `INSERT OR IGNORE INTO gaiadr3 (${columns}) VALUES (${placeholders})`,
@@ -211,6 +582,14 @@ export class GaiaDatabase {
     this.db.transaction(() => {
       for (const record of records) {
         const values = this.config.storedColumns.map((col) => record[col]);
+        if (derivePm) {
+          const { pmra, pmdec } = record;
+          values.push(
+            typeof pmra === "number" && typeof pmdec === "number"
+              ? totalProperMotion(pmra, pmdec)
+              : null,
+          );
+        }
         stmt.run(...values);
         insertedCount++;
       }
@@ -226,20 +605,32 @@ export class GaiaDatabase {
   }
 
   /**
-   * Insert 2MASS crossmatch records
+   * Insert 2MASS crossmatch records. Links already present get the match
+   * statistics, for databases crossmatched before they were kept.
    */
   insertTmassXmatchRecords(records: TmassXmatchRecord[]): number {
     if (records.length === 0) return 0;
 
     const stmt = this.db.prepare(
-      `INSERT OR IGNORE INTO tmass_xmatch (gaiadr3_source_id, tmass_source_id) VALUES (?, ?)`,
+      `INSERT INTO tmass_xmatch (gaiadr3_source_id, tmass_source_id, angular_distance, number_of_neighbours, number_of_mates)
+       VALUES (?, ?, ?, ?, ?)
+       ON CONFLICT (gaiadr3_source_id) DO UPDATE SET
+         angular_distance = excluded.angular_distance,
+         number_of_neighbours = excluded.number_of_neighbours,
+         number_of_mates = excluded.number_of_mates`,
     );
 
     let insertedCount = 0;
 
     this.db.transaction(() => {
       for (const record of records) {
-        stmt.run(record.gaiadr3_source_id, record.tmass_source_id);
+        stmt.run(
+          record.gaiadr3_source_id,
+          record.tmass_source_id,
+          record.angular_distance ?? null,
+          record.number_of_neighbours ?? null,
+          record.number_of_mates ?? null,
+        );
         insertedCount++;
       }
     })();
@@ -277,13 +668,50 @@ export class GaiaDatabase {
     return insertedCount;
   }
 
+  /**
+   * First-row declinations of the 2MASS files probed so far
+   */
+  getTmassBandStarts(): Map<string, number> {
+    if (!this.hasTable("tmass_bands")) {
+      return new Map();
+    }
+    const rows = this.db.prepare("SELECT url, dec_start FROM tmass_bands")
+      .all<{ url: string; dec_start: number }>();
+    return new Map(rows.map((row) => [row.url, row.dec_start]));
+  }
+
+  setTmassBandStart(url: string, decStart: number): void {
+    this.db.prepare(
+      "INSERT OR REPLACE INTO tmass_bands (url, dec_start) VALUES (?, ?)",
+    ).run(url, decStart);
+  }
+
+  /**
+   * Whole-degree declination cells (floor of the declination) holding Gaia
+   * sources with a 2MASS match, widened by `margin` degrees
+   */
+  getMatchedDecCells(margin: number): Set<number> {
+    const rows = this.db.prepare(
+      `SELECT CAST(floor(g.dec - ?) AS INTEGER) AS cell
+       FROM gaiadr3 g JOIN tmass_xmatch x ON x.gaiadr3_source_id = g.source_id
+       UNION
+       SELECT CAST(floor(g.dec + ?) AS INTEGER) AS cell
+       FROM gaiadr3 g JOIN tmass_xmatch x ON x.gaiadr3_source_id = g.source_id`,
+    ).all<{ cell: number }>(margin, margin);
+    return new Set(rows.map((row) => row.cell));
+  }
+
   /**
    * Check if 2MASS table exists
    */
   hasTmassTable(): boolean {
+    return this.hasTable("tmass");
+  }
+
+  hasTable(table: string): boolean {
     const result = this.db.prepare(
-      `SELECT name FROM sqlite_master WHERE type='table' AND name='tmass'`,
-    ).get() as { name: string } | undefined;
+      `SELECT name FROM sqlite_master WHERE type='table' AND name=?`,
+    ).get(table) as { name: string } | undefined;
 
     return result !== undefined;
   }
@@ -303,38 +731,95 @@ export class GaiaDatabase {
   }
 
   /**
-   * Create indices on commonly queried columns
+   * Build the standard indices that are missing, logging each with its
+   * time. Throws once the rest have been tried if any fails.
    */
   createIndices(): void {
+    const missing = missingIndexes(this.db);
+    if (missing.length === 0) {
+      return;
+    }
+
     const startTime = Date.now();
-    this.logger.debug("Creating database indices…");
-
-    const indices = [
-      "CREATE INDEX IF NOT EXISTS idx_source_id ON gaiadr3(source_id)",
-      "CREATE INDEX IF NOT EXISTS idx_ra ON gaiadr3(ra)",
-      "CREATE INDEX IF NOT EXISTS idx_dec ON gaiadr3(dec)",
-      "CREATE INDEX IF NOT EXISTS idx_ra_dec ON gaiadr3(ra, dec)",
-      "CREATE INDEX IF NOT EXISTS idx_phot_g_mean_flux ON gaiadr3(phot_g_mean_flux)",
-      "CREATE INDEX IF NOT EXISTS idx_tmass_xmatch_gaiadr3 ON tmass_xmatch(gaiadr3_source_id)",
-      "CREATE INDEX IF NOT EXISTS idx_tmass_xmatch_tmass ON tmass_xmatch(tmass_source_id)",
-      "CREATE INDEX IF NOT EXISTS idx_tmass_gaiadr3 ON tmass(gaiadr3_source_id)",
-      "CREATE INDEX IF NOT EXISTS idx_tmass_tmass ON tmass(tmass_source_id)",
-    ];
-
-    for (const indexSql of indices) {
+    const failures: string[] = [];
+    missing.forEach((index, i) => {
+      const indexStart = Date.now();
+      this.logger.info(
+        `🗂️  [${i + 1}/${missing.length}] Building ${index.name} on ${index.table}(${
+          index.columns.join(", ")
+        })…`,
+      );
       try {
-        this.db.exec(indexSql);
+        this.createIndex(index);
+        this.logger.info(
+          `   ${index.name} built in ${formatDuration(Date.now() - indexStart)}`,
+        );
       } catch (error) {
-        this.logger.error(`Failed to create index: ${error}`);
+        failures.push(
+          `${index.name}: ${error instanceof Error ? error.message : error}`,
+        );
       }
-    }
+    });
 
-    const duration = Date.now() - startTime;
+    if (failures.length > 0) {
+      throw new Error(`Failed to create indices: ${failures.join("; ")}`);
+    }
     this.logger.debug(
-      `Indices created successfully in ${formatDuration(duration)}`,
+      `Indices created in ${formatDuration(Date.now() - startTime)}`,
     );
   }
 
+  createIndex(index: IndexDefinition): void {
+    this.db.exec(createIndexSql(index));
+  }
+
+  /**
+   * Every index of every table
+   */
+  listIndexes(): IndexInfo[] {
+    return listIndexes(this.db);
+  }
+
+  /**
+   * Indexes another index or a primary key already covers
+   */
+  findRedundantIndexes(): RedundantIndex[] {
+    return findRedundantIndexes(this.db);
+  }
+
+  /**
+   * Standard indices not yet built
+   */
+  missingIndexes(): IndexDefinition[] {
+    return missingIndexes(this.db);
+  }
+
+  /**
+   * Drop an index made with CREATE INDEX
+   */
+  dropIndex(name: string): void {
+    const index = listIndexes(this.db).find((index) => index.name === name);
+    if (!index) {
+      throw new Error(`No index named ${name}`);
+    }
+    if (index.origin !== "c") {
+      throw new Error(
+        `${name} belongs to a ${
+          index.origin === "pk" ? "primary key" : "UNIQUE constraint"
+        } of ${index.table} and cannot be dropped`,
+      );
+    }
+    this.db.exec(`DROP INDEX ${name}`);
+  }
+
+  /**
+   * Gather the statistics the query planner uses to choose indices, for one
+   * table or index or the whole database
+   */
+  analyze(name?: string): void {
+    this.db.exec(name ? `ANALYZE ${name}` : "ANALYZE");
+  }
+
   /**
    * Vacuum and optimize the database
    */
@@ -350,7 +835,8 @@ export class GaiaDatabase {
   }
 
   /**
-   * Execute a cone search query
+   * Execute a cone search query, ordered by source_id. `after` skips to the
+   * stars whose source_id sorts after it, so a result can be read in pages.
    */
   coneSearch(
     ra: number,
@@ -358,52 +844,224 @@ export class GaiaDatabase {
     radius: number,
     magnitudeLimit?: [number, number],
     tmassCrossmatch = false,
+    limit = 0,
+    after?: string,
   ): GaiaRecord[] {
     const startTime = Date.now();
-    const radiusRad = (radius * Math.PI) / 180;
-    const raRad = (ra * Math.PI) / 180;
-    const decRad = (dec * Math.PI) / 180;
+    const { selectClause, fromClause } = this.buildSelect(tmassCrossmatch);
 
-    const sinDec = Math.sin(decRad);
-    const cosDec = Math.cos(decRad);
-    const cosRadius = Math.cos(radiusRad);
+    // Build query with magnitude filter if provided
+    const whereClause = [
+      this.buildRegionClause({ ra, dec, radius }),
+      this.buildMagnitudeClause(magnitudeLimit),
+      after !== undefined ? "g.source_id > ?" : null,
+    ].filter(Boolean).join(" AND ");
+
+    const query =
+      `SELECT ${selectClause} FROM ${fromClause} WHERE ${whereClause} ORDER BY g.source_id${
+        limit > 0 ? ` LIMIT ${limit}` : ""
+      }`;
 
-    // Calculate bounding box
-    const deltaRa = (radius * 180) / (Math.PI * Math.cos(decRad));
-    const deltaDec = radius;
+    const results = this.db.prepare(query).all<GaiaRecord>(
+      ...(after !== undefined ? [after] : []),
+    );
+    const duration = Date.now() - startTime;
+    this.logger.debug(
+      `Cone search completed in ${formatDuration(duration)}`,
+    );
+    return results;
+  }
 
-    const decMin = Math.max(dec - deltaDec, -90);
-    const decMax = Math.min(dec + deltaDec, 90);
-    const raMin = (ra - deltaRa + 360) % 360;
-    const raMax = (ra + deltaRa) % 360;
+  /**
+   * Iterate over a cone search in order of declination without loading the
+   * whole result. Ending the iteration early (`break`, or `return()` on the
+   * iterator) stops the underlying scan.
+   */
+  *iterateConeSearch(
+    ra: number,
+    dec: number,
+    radius: number,
+    magnitudeLimit?: [number, number],
+    tmassCrossmatch = false,
+  ): Generator<GaiaRecord> {
+    const { selectClause, fromClause } = this.buildSelect(tmassCrossmatch);
+    const whereClause = [
+      this.buildRegionClause({ ra, dec, radius }),
+      this.buildMagnitudeClause(magnitudeLimit),
+    ].filter(Boolean).join(" AND ");
+
+    const stmt = this.db.prepare(
+      `SELECT ${selectClause} FROM ${fromClause} WHERE ${whereClause} ORDER BY g.dec`,
+    );
+
+    try {
+      yield* stmt.iter<GaiaRecord>();
+    } finally {
+      stmt.finalize();
+    }
+  }
+
+  /**
+   * Columns of the records queries return, without running one
+   */
+  getQueryColumns(tmassCrossmatch = false): string[] {
+    const { selectClause, fromClause } = this.buildSelect(tmassCrossmatch);
+    const stmt = this.db.prepare(
+      `SELECT ${selectClause} FROM ${fromClause} LIMIT 0`,
+    );
+    try {
+      return stmt.columnNames();
+    } finally {
+      stmt.finalize();
+    }
+  }
 
-    // Build SELECT clause with 2MASS join if needed
+  /**
+   * Find the `count` stars nearest to a position, closest first, with their
+   * `separation` in arcseconds. Searches cones of growing radius until
+   * enough stars are found.
+   */
+  nearest(
+    ra: number,
+    dec: number,
+    count: number,
+    magnitudeLimit?: [number, number],
+    tmassCrossmatch = false,
+  ): GaiaRecord[] {
+    let radius = 0.05;
+
+    while (true) {
+      const results = this.coneSearch(
+        ra,
+        dec,
+        radius,
+        magnitudeLimit,
+        tmassCrossmatch,
+      );
+
+      if (results.length >= count || radius >= 180) {
+        return results
+          .map((record) => ({
+            record,
+            separation: angularSeparation({ ra, dec }, record) * 3600,
+          }))
+          .sort((a, b) => a.separation - b.separation)
+          .slice(0, count)
+          .map(({ record, separation }) => ({ ...record, separation }));
+      }
+
+      radius = Math.min(radius * 4, 180);
+    }
+  }
+
+  /**
+   * Find stars with a total proper motion of at least `minPm` mas/yr,
+   * fastest first, optionally restricted to a cone
+   */
+  highProperMotionSearch(
+    minPm: number,
+    region?: Region,
+    magnitudeLimit?: [number, number],
+    tmassCrossmatch = false,
+    limit = 0,
+  ): GaiaRecord[] {
+    const startTime = Date.now();
+    const { selectClause, fromClause } = this.buildSelect(tmassCrossmatch);
+
+    // Older databases without the derived column fall back to a full scan
+    const hasPm = this.hasColumn("gaiadr3", "pm");
+    const hasComponents = this.hasColumn("gaiadr3", "pmra") &&
+      this.hasColumn("gaiadr3", "pmdec");
+    if (!hasPm && !hasComponents) {
+      throw new Error(
+        `${this.config.databasePath} does not store proper motions. Populate it with pmra and pmdec in --columns to search by proper motion.`,
+      );
+    }
+    const pmExpression = hasPm
+      ? "g.pm"
+      : "sqrt(g.pmra * g.pmra + g.pmdec * g.pmdec)";
+
+    const whereClause = [
+      `${pmExpression} >= ?`,
+      region ? this.buildRegionClause(region) : null,
+      this.buildMagnitudeClause(magnitudeLimit),
+    ].filter(Boolean).join(" AND ");
+
+    const query =
+      `SELECT ${selectClause} FROM ${fromClause} WHERE ${whereClause} ORDER BY ${pmExpression} DESC${
+        limit > 0 ? ` LIMIT ${limit}` : ""
+      }`;
+
+    const results = this.db.prepare(query).all<GaiaRecord>(minPm);
+    this.logger.debug(
+      `High proper-motion search completed in ${
+        formatDuration(Date.now() - startTime)
+      }`,
+    );
+    return results;
+  }
+
+  /**
+   * Build SELECT and FROM clauses with 2MASS join if needed
+   */
+  private buildSelect(
+    tmassCrossmatch: boolean,
+  ): { selectClause: string; fromClause: string } {
     let selectClause = "g.*";
     let fromClause = "gaiadr3 g";
 
     if (tmassCrossmatch) {
       selectClause += ", t.tmass_source_id, t.j_m, t.h_m, t.k_m";
       fromClause += " LEFT JOIN tmass t ON g.source_id = t.gaiadr3_source_id";
+
+      // Match quality, from the best-neighbour statistics. number_of_mates
+      // counts the other Gaia sources sharing the 2MASS source across the
+      // whole catalogue, so no per-row count over tmass_xmatch is needed
+      if (this.hasColumn("tmass_xmatch", "angular_distance")) {
+        selectClause += `, x.angular_distance AS tmass_angular_distance,
+          x.number_of_neighbours AS tmass_neighbours,
+          x.number_of_neighbours > 1 AS tmass_ambiguous,
+          x.number_of_mates > 0 AS tmass_shared`;
+        fromClause +=
+          " LEFT JOIN tmass_xmatch x ON g.source_id = x.gaiadr3_source_id";
+      }
     }
 
-    // Build query with magnitude filter if provided
-    let whereClause = `g.dec BETWEEN ${decMin} AND ${decMax}`;
+    return { selectClause, fromClause };
+  }
 
-    if (raMin > raMax) {
-      whereClause +=
-        ` AND (g.ra BETWEEN ${raMin} AND 360 OR g.ra BETWEEN 0 AND ${raMax})`;
-    } else {
-      whereClause += ` AND g.ra BETWEEN ${raMin} AND ${raMax}`;
-    }
+  /**
+   * Build a WHERE condition for a cone: an indexable bounding box followed
+   * by the exact spherical cap check
+   */
+  private buildRegionClause({ ra, dec, radius }: Region): string {
+    const radiusRad = (radius * Math.PI) / 180;
+    const raRad = (ra * Math.PI) / 180;
+    const decRad = (dec * Math.PI) / 180;
 
-    if (magnitudeLimit) {
-      const [minMag, maxMag] = magnitudeLimit;
-      const zp = this.config.zeropoints[0];
-      const maxFlux = Math.round(10 ** ((zp - minMag) / 2.5));
-      const minFlux = Math.round(10 ** ((zp - maxMag) / 2.5));
+    const sinDec = Math.sin(decRad);
+    const cosDec = Math.cos(decRad);
+    const cosRadius = Math.cos(radiusRad);
+
+    const decMin = Math.max(dec - radius, -90);
+    const decMax = Math.min(dec + radius, 90);
 
-      whereClause +=
-        ` AND g.phot_g_mean_flux < ${maxFlux} AND g.phot_g_mean_flux > ${minFlux}`;
+    let whereClause = `g.dec BETWEEN ${decMin} AND ${decMax}`;
+
+    // Half-width in RA of the bounding box. When the cone touches a pole it
+    // spans every RA, so only the declination band applies.
+    const sinRatio = Math.sin(radiusRad) / cosDec;
+    if (decMin > -90 && decMax < 90 && sinRatio < 1) {
+      const deltaRa = (Math.asin(sinRatio) * 180) / Math.PI;
+      const raMin = (ra - deltaRa + 360) % 360;
+      const raMax = (ra + deltaRa) % 360;
+
+      if (raMin > raMax) {
+        whereClause +=
+          ` AND (g.ra BETWEEN ${raMin} AND 360 OR g.ra BETWEEN 0 AND ${raMax})`;
+      } else {
+        whereClause += ` AND g.ra BETWEEN ${raMin} AND ${raMax}`;
+      }
     }
 
     // Add spherical cap check
@@ -412,14 +1070,45 @@ export class GaiaDatabase {
       cos(radians(g.dec)) * ${cosDec} * cos(radians(g.ra) - ${raRad})
     ) >= ${cosRadius}`;
 
-    const query =
-      `SELECT ${selectClause} FROM ${fromClause} WHERE ${whereClause}`;
+    return whereClause;
+  }
+
+  /**
+   * Build a WHERE condition on G flux for a magnitude range
+   */
+  private buildMagnitudeClause(magnitudeLimit?: [number, number]): string {
+    if (!magnitudeLimit) {
+      return "";
+    }
+
+    const [minMag, maxMag] = magnitudeLimit;
+    const zp = this.config.zeropoints[0];
+    const maxFlux = Math.round(10 ** ((zp - minMag) / 2.5));
+    const minFlux = Math.round(10 ** ((zp - maxMag) / 2.5));
+
+    return `g.phot_g_mean_flux < ${maxFlux} AND g.phot_g_mean_flux > ${minFlux}`;
+  }
+
+  /**
+   * Look up records by Gaia source_id
+   */
+  lookup(sourceIds: string[], tmassCrossmatch = false): GaiaRecord[] {
+    const { selectClause, fromClause } = this.buildSelect(tmassCrossmatch);
+
+    // Batch to stay under SQLite's bound parameter limit
+    const batchSize = 500;
+    const results: GaiaRecord[] = [];
+
+    for (let i = 0; i < sourceIds.length; i += batchSize) {
+      const batch = sourceIds.slice(i, i + batchSize);
+      const placeholders = batch.map(() => "?").join(", ");
+      results.push(
+        ...this.db.prepare(
+          `SELECT ${selectClause} FROM ${fromClause} WHERE g.source_id IN (${placeholders})`,
+        ).all<GaiaRecord>(...batch),
+      );
+    }
 
-    const results = this.db.prepare(query).all<GaiaRecord>();
-    const duration = Date.now() - startTime;
-    this.logger.debug(
-      `Cone search completed in ${formatDuration(duration)}`,
-    );
     return results;
   }
 
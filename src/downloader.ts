@@ -1,5 +1,6 @@
 import { join } from "@std/path";
 import { ensureDir, exists } from "@std/fs";
+import { HttpClient } from "./http.ts";
 import { Logger } from "./types.ts";
 import { formatBytes } from "./utils.ts";
 
@@ -37,12 +38,19 @@ export class ParallelDownloader {
   private resumable: boolean;
   private progress: Map<string, DownloadProgress> = new Map();
   private logger: Logger;
-
-  constructor(tempDir: string, parallelLimit: number, logger: Logger) {
+  private client: HttpClient;
+
+  constructor(
+    tempDir: string,
+    parallelLimit: number,
+    logger: Logger,
+    client = new HttpClient(),
+  ) {
     this.tempDir = tempDir;
     this.parallelLimit = parallelLimit;
     this.resumable = true;
     this.logger = logger;
+    this.client = client;
   }
 
   async initialize(): Promise<void> {
@@ -124,7 +132,7 @@ export class ParallelDownloader {
       if (existingSize > 0) {
         headers["Range"] = `bytes=${existingSize}-`;
       }
-      const response = await fetch(url, { headers });
+      const response = await this.client.fetch(url, { headers });
 
       // Handle 416 Range Not Satisfiable - partial file is invalid
       if (response.status === 416) {
@@ -213,9 +221,9 @@ export class ParallelDownloader {
               totalBytes,
             });
           }
-        } catch (error: unknown) {
-          this.logger.error(`Failed to download file ${url}: ${error}`);
         } finally {
+          // On errors the partial file is kept to resume from, and the
+          // download is marked failed below rather than completed
           file.close();
         }
       }
@@ -282,7 +290,7 @@ export class ParallelDownloader {
           await new Promise((resolve) => setTimeout(resolve, delay));
         }
 
-        const response = await fetch(url);
+        const response = await this.client.fetch(url);
 
         if (!response.ok) {
           throw new Error(`HTTP ${response.status}: ${response.statusText}`);
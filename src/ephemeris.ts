@@ -0,0 +1,358 @@
+/**
+ * Low-precision solar, lunar and horizon calculations for observability
+ * planning. Formulae follow the "low precision" sections of the
+ * Astronomical Almanac, good to roughly 0.01° for the Sun and 0.3° for
+ * the Moon between 1950 and 2050, which is plenty for deciding when a star
+ * is up. Everything here is pure math so it works fully offline.
+ */
+
+import { angularSeparation, type EquatorialPosition } from "./astrometry.ts";
+
+const DEG = Math.PI / 180;
+const J2000 = 2451545.0;
+
+/**
+ * Standard altitude of a star at rise/set, accounting for refraction
+ */
+const STAR_HORIZON = -0.5667;
+
+/**
+ * Ratio of a sidereal to a solar day, used to convert hour angles to time
+ */
+const SIDEREAL_RATE = 1.00273790935;
+
+export interface Site {
+  /** Geodetic latitude in degrees, north positive */
+  latitude: number;
+  /** Longitude in degrees, east positive */
+  longitude: number;
+  /** Elevation above sea level in metres */
+  elevation: number;
+}
+
+export type { EquatorialPosition };
+
+export interface HorizontalPosition {
+  altitude: number;
+  azimuth: number;
+}
+
+export interface RiseTransitSet {
+  rise: Date | null;
+  transit: Date;
+  set: Date | null;
+  /** Whether the target never sets at this latitude */
+  circumpolar: boolean;
+  /** Whether the target never rises at this latitude */
+  neverRises: boolean;
+}
+
+export interface Night {
+  /** Sunset (Sun below the horizon) */
+  sunset: Date;
+  /** Start of the dark window (Sun below the twilight altitude) */
+  start: Date;
+  /** End of the dark window */
+  end: Date;
+  /** Sunrise (Sun above the horizon) */
+  sunrise: Date;
+}
+
+function normalizeDegrees(angle: number): number {
+  const wrapped = angle % 360;
+  return wrapped < 0 ? wrapped + 360 : wrapped;
+}
+
+/**
+ * Convert a date to a Julian date
+ */
+export function julianDate(date: Date): number {
+  return date.getTime() / 86400000 + 2440587.5;
+}
+
+/**
+ * Convert a Julian date back to a date
+ */
+export function fromJulianDate(jd: number): Date {
+  return new Date((jd - 2440587.5) * 86400000);
+}
+
+/**
+ * Greenwich mean sidereal time in degrees
+ */
+export function greenwichSiderealTime(jd: number): number {
+  const t = (jd - J2000) / 36525;
+  return normalizeDegrees(
+    280.46061837 + 360.98564736629 * (jd - J2000) + 0.000387933 * t * t,
+  );
+}
+
+/**
+ * Local mean sidereal time in degrees
+ */
+export function localSiderealTime(jd: number, longitude: number): number {
+  return normalizeDegrees(greenwichSiderealTime(jd) + longitude);
+}
+
+function obliquity(jd: number): number {
+  return 23.439 - 0.0000004 * (jd - J2000);
+}
+
+function eclipticToEquatorial(
+  lambda: number,
+  beta: number,
+  jd: number,
+): EquatorialPosition {
+  const eps = obliquity(jd) * DEG;
+  const l = lambda * DEG;
+  const b = beta * DEG;
+
+  const x = Math.cos(b) * Math.cos(l);
+  const y = Math.cos(eps) * Math.cos(b) * Math.sin(l) -
+    Math.sin(eps) * Math.sin(b);
+  const z = Math.sin(eps) * Math.cos(b) * Math.sin(l) +
+    Math.cos(eps) * Math.sin(b);
+
+  return {
+    ra: normalizeDegrees(Math.atan2(y, x) / DEG),
+    dec: Math.asin(z) / DEG,
+  };
+}
+
+/**
+ * Apparent geocentric position of the Sun
+ */
+export function sunPosition(jd: number): EquatorialPosition {
+  const n = jd - J2000;
+  const meanLongitude = 280.46 + 0.9856474 * n;
+  const meanAnomaly = (357.528 + 0.9856003 * n) * DEG;
+  const lambda = meanLongitude + 1.915 * Math.sin(meanAnomaly) +
+    0.02 * Math.sin(2 * meanAnomaly);
+
+  return eclipticToEquatorial(normalizeDegrees(lambda), 0, jd);
+}
+
+/**
+ * Topocentric position of the Moon as seen from a site.
+ * Parallax is up to a degree, so the correction matters for separations.
+ */
+export function moonPosition(jd: number, site?: Site): EquatorialPosition {
+  const t = (jd - J2000) / 36525;
+  const s = (a: number, b: number) => Math.sin((a + b * t) * DEG);
+  const c = (a: number, b: number) => Math.cos((a + b * t) * DEG);
+
+  const lambda = 218.32 + 481267.881 * t +
+    6.29 * s(135.0, 477198.87) -
+    1.27 * s(259.3, -413335.36) +
+    0.66 * s(235.7, 890534.22) +
+    0.21 * s(269.9, 954397.74) -
+    0.19 * s(357.5, 35999.05) -
+    0.11 * s(186.5, 966404.03);
+  const beta = 5.13 * s(93.3, 483202.02) +
+    0.28 * s(228.2, 960400.89) -
+    0.28 * s(318.3, 6003.15) -
+    0.17 * s(217.6, -407332.21);
+  const parallax = 0.9508 +
+    0.0518 * c(134.9, 477198.87) +
+    0.0095 * c(259.2, -413335.38) +
+    0.0078 * c(235.7, 890534.22) +
+    0.0028 * c(269.9, 954397.7);
+
+  const geocentric = eclipticToEquatorial(normalizeDegrees(lambda), beta, jd);
+  if (!site) {
+    return geocentric;
+  }
+
+  // Distance in Earth radii, then shift the origin to the observer
+  const r = 1 / Math.sin(parallax * DEG);
+  const ra = geocentric.ra * DEG;
+  const dec = geocentric.dec * DEG;
+  const lst = localSiderealTime(jd, site.longitude) * DEG;
+  const lat = site.latitude * DEG;
+
+  const x = r * Math.cos(dec) * Math.cos(ra) - Math.cos(lat) * Math.cos(lst);
+  const y = r * Math.cos(dec) * Math.sin(ra) - Math.cos(lat) * Math.sin(lst);
+  const z = r * Math.sin(dec) - Math.sin(lat);
+
+  return {
+    ra: normalizeDegrees(Math.atan2(y, x) / DEG),
+    dec: Math.atan2(z, Math.hypot(x, y)) / DEG,
+  };
+}
+
+/**
+ * Fraction of the lunar disc that is illuminated (0 = new, 1 = full)
+ */
+export function moonIllumination(jd: number): number {
+  const elongation = angularSeparation(sunPosition(jd), moonPosition(jd));
+  return (1 - Math.cos(elongation * DEG)) / 2;
+}
+
+/**
+ * Altitude and azimuth (north = 0°, east = 90°) of a position at a site
+ */
+export function toHorizontal(
+  position: EquatorialPosition,
+  site: Site,
+  jd: number,
+): HorizontalPosition {
+  const hourAngle = (localSiderealTime(jd, site.longitude) - position.ra) *
+    DEG;
+  const dec = position.dec * DEG;
+  const lat = site.latitude * DEG;
+
+  const sinAlt = Math.sin(dec) * Math.sin(lat) +
+    Math.cos(dec) * Math.cos(lat) * Math.cos(hourAngle);
+  const altitude = Math.asin(Math.max(-1, Math.min(1, sinAlt)));
+  const azimuth = Math.atan2(
+    -Math.sin(hourAngle) * Math.cos(dec),
+    Math.sin(dec) * Math.cos(lat) -
+      Math.cos(dec) * Math.sin(lat) * Math.cos(hourAngle),
+  );
+
+  return {
+    altitude: altitude / DEG,
+    azimuth: normalizeDegrees(azimuth / DEG),
+  };
+}
+
+/**
+ * Airmass for an apparent altitude using Kasten & Young (1989).
+ * Returns Infinity below the horizon.
+ */
+export function airmass(altitude: number): number {
+  if (altitude <= 0) {
+    return Infinity;
+  }
+
+  return 1 /
+    (Math.sin(altitude * DEG) +
+      0.50572 * Math.pow(altitude + 6.07995, -1.6364));
+}
+
+/**
+ * Depression of the horizon for an observer above sea level, in degrees
+ */
+function horizonDip(elevation: number): number {
+  return elevation > 0 ? 0.0347 * Math.sqrt(elevation) : 0;
+}
+
+/**
+ * Rise, transit and set of a fixed position closest to a reference time
+ */
+export function riseTransitSet(
+  position: EquatorialPosition,
+  site: Site,
+  reference: Date,
+): RiseTransitSet {
+  const jd = julianDate(reference);
+  const hourAngle = localSiderealTime(jd, site.longitude) - position.ra;
+  // Wrap into [-180, 180) so the transit is the one nearest the reference
+  const wrapped = normalizeDegrees(hourAngle + 180) - 180;
+  const transitJd = jd - wrapped / 360 / SIDEREAL_RATE;
+
+  const h0 = (STAR_HORIZON - horizonDip(site.elevation)) * DEG;
+  const lat = site.latitude * DEG;
+  const dec = position.dec * DEG;
+  const cosH0 = (Math.sin(h0) - Math.sin(lat) * Math.sin(dec)) /
+    (Math.cos(lat) * Math.cos(dec));
+
+  const transit = fromJulianDate(transitJd);
+
+  if (cosH0 < -1) {
+    return {
+      rise: null,
+      transit,
+      set: null,
+      circumpolar: true,
+      neverRises: false,
+    };
+  }
+
+  if (cosH0 > 1) {
+    return {
+      rise: null,
+      transit,
+      set: null,
+      circumpolar: false,
+      neverRises: true,
+    };
+  }
+
+  const semiArc = Math.acos(cosH0) / DEG / 360 / SIDEREAL_RATE;
+
+  return {
+    rise: fromJulianDate(transitJd - semiArc),
+    transit,
+    set: fromJulianDate(transitJd + semiArc),
+    circumpolar: false,
+    neverRises: false,
+  };
+}
+
+/**
+ * Find the night starting on the evening of a calendar date (UTC) at a site.
+ * The dark window is bounded by the Sun crossing `twilightAltitude`.
+ * Returns null during polar day or when the Sun never reaches the twilight
+ * altitude.
+ */
+export function findNight(
+  date: Date,
+  site: Site,
+  twilightAltitude = -18,
+  stepMinutes = 2,
+): Night | null {
+  // Start from local (mean solar) noon of the requested date
+  const noon = Date.UTC(
+    date.getUTCFullYear(),
+    date.getUTCMonth(),
+    date.getUTCDate(),
+    12,
+  ) - (site.longitude / 15) * 3600000;
+
+  const sunHorizon = -0.833 - horizonDip(site.elevation);
+  const step = stepMinutes * 60000;
+  const crossings: Partial<Night> = {};
+  let previous = sunAltitude(noon, site);
+
+  for (let t = noon + step; t <= noon + 86400000; t += step) {
+    const altitude = sunAltitude(t, site);
+    const crossed = (threshold: number, down: boolean) =>
+      down
+        ? previous >= threshold && altitude < threshold
+        : previous < threshold && altitude >= threshold;
+    const at = (threshold: number) =>
+      new Date(
+        t - step + step * (previous - threshold) / (previous - altitude),
+      );
+
+    if (!crossings.sunset && crossed(sunHorizon, true)) {
+      crossings.sunset = at(sunHorizon);
+    }
+    if (!crossings.start && crossed(twilightAltitude, true)) {
+      crossings.start = at(twilightAltitude);
+    }
+    if (crossings.start && !crossings.end && crossed(twilightAltitude, false)) {
+      crossings.end = at(twilightAltitude);
+    }
+    if (crossings.sunset && !crossings.sunrise && crossed(sunHorizon, false)) {
+      crossings.sunrise = at(sunHorizon);
+    }
+
+    previous = altitude;
+  }
+
+  if (
+    !crossings.sunset || !crossings.start || !crossings.end ||
+    !crossings.sunrise
+  ) {
+    return null;
+  }
+
+  return crossings as Night;
+}
+
+function sunAltitude(time: number, site: Site): number {
+  const jd = julianDate(new Date(time));
+  return toHorizontal(sunPosition(jd), site, jd).altitude;
+}
@@ -0,0 +1,155 @@
+import { assertAlmostEquals, assertEquals, assertLess } from "@std/assert";
+import { angularSeparation } from "./astrometry.ts";
+import {
+  airmass,
+  findNight,
+  greenwichSiderealTime,
+  julianDate,
+  moonIllumination,
+  moonPosition,
+  riseTransitSet,
+  type Site,
+  sunPosition,
+  toHorizontal,
+} from "./ephemeris.ts";
+
+/** One minute in milliseconds, the precision of published rise times */
+const MINUTE = 60_000;
+
+function assertTime(actual: Date | null | undefined, expected: string) {
+  assertAlmostEquals(
+    actual?.getTime() ?? NaN,
+    new Date(expected).getTime(),
+    MINUTE,
+    `${actual?.toISOString()} is not ${expected}`,
+  );
+}
+
+Deno.test("Julian dates and sidereal time match Meeus", () => {
+  assertEquals(julianDate(new Date("2000-01-01T12:00:00Z")), 2451545);
+  // Example 7.a: 1957 October 4.81
+  assertAlmostEquals(
+    julianDate(new Date("1957-10-04T19:26:24Z")),
+    2436116.31,
+    1e-6,
+  );
+  // Examples 12.a and 12.b: 13h10m46.3668s and 8h34m57.0896s
+  assertAlmostEquals(greenwichSiderealTime(2446895.5), 197.693195, 1e-5);
+  assertAlmostEquals(
+    greenwichSiderealTime(julianDate(new Date("1987-04-10T19:21:00Z"))),
+    128.737873,
+    1e-5,
+  );
+});
+
+Deno.test("the Sun and Moon are within the stated precision", () => {
+  // Meeus example 25.a, 1992 October 13.0: 13h13m31.4s, -7°47'06"
+  assertLess(
+    angularSeparation(sunPosition(2448908.5), {
+      ra: 198.38083,
+      dec: -7.78507,
+    }),
+    0.01,
+  );
+  // Meeus example 47.a, 1992 April 12.0, geocentric
+  assertLess(
+    angularSeparation(moonPosition(2448724.5), {
+      ra: 134.688470,
+      dec: 13.768368,
+    }),
+    0.3,
+  );
+
+  // Parallax moves the Moon by up to a degree
+  const jd = julianDate(new Date("2024-01-25T18:00:00Z"));
+  const shift = angularSeparation(
+    moonPosition(jd),
+    moonPosition(jd, { latitude: 51.5, longitude: 0, elevation: 0 }),
+  );
+  assertLess(0.5, shift);
+  assertLess(shift, 1);
+});
+
+Deno.test("the Moon is full and new on the published dates", () => {
+  // January 2024: new 11th 11:57, full 25th 17:54 UT
+  assertLess(moonIllumination(julianDate(new Date("2024-01-11T11:57Z"))), 0.01);
+  assertLess(
+    0.99,
+    moonIllumination(julianDate(new Date("2024-01-25T17:54Z"))),
+  );
+});
+
+Deno.test("rise, transit and set match Meeus example 15.a", () => {
+  // Venus from Boston on 1988 March 20, with positions at 0h TD from the
+  // example, interpolated to each event as Meeus's iteration does
+  const boston: Site = { latitude: 42.3333, longitude: -71.0833, elevation: 0 };
+  const midnight = Date.UTC(1988, 2, 20);
+  const venus = (time: Date) => {
+    const days = (time.getTime() - midnight) / 86_400_000;
+    const [ra, dec] = days < 0
+      ? [41.73129 - 40.68021, 18.44092 - 18.04761]
+      : [42.78204 - 41.73129, 18.82742 - 18.44092];
+    return { ra: 41.73129 + days * ra, dec: 18.44092 + days * dec };
+  };
+
+  const events = {
+    rise: "1988-03-20T12:25:26Z",
+    transit: "1988-03-20T19:40:30Z",
+    set: "1988-03-20T02:54:40Z",
+  };
+  for (const [event, time] of Object.entries(events)) {
+    const at = new Date(time);
+    const times = riseTransitSet(venus(at), boston, at);
+    assertTime(times[event as keyof typeof events], time);
+  }
+
+  const polaris = riseTransitSet({ ra: 37.95, dec: 89.26 }, boston, new Date());
+  assertEquals([polaris.circumpolar, polaris.rise], [true, null]);
+  const south = riseTransitSet({ ra: 0, dec: -60 }, boston, new Date());
+  assertEquals([south.neverRises, south.set], [true, null]);
+});
+
+Deno.test("nights match published sunrise and sunset in London", () => {
+  const london: Site = { latitude: 51.508, longitude: -0.126, elevation: 0 };
+
+  // Winter solstice: sunset 15:53, sunrise 08:04 GMT
+  const winter = findNight(new Date("2024-12-21"), london)!;
+  assertTime(winter.sunset, "2024-12-21T15:53Z");
+  assertTime(winter.sunrise, "2024-12-22T08:04Z");
+  for (const edge of [winter.start, winter.end]) {
+    const jd = julianDate(edge);
+    assertAlmostEquals(
+      toHorizontal(sunPosition(jd), london, jd).altitude,
+      -18,
+      0.05,
+    );
+  }
+  assertLess(winter.sunset.getTime(), winter.start.getTime());
+  assertLess(winter.start.getTime(), winter.end.getTime());
+  assertLess(winter.end.getTime(), winter.sunrise.getTime());
+
+  // Summer solstice: sunset 21:21, sunrise 04:43 BST. The Sun only gets
+  // 15° below the horizon, so there is no astronomical darkness.
+  assertEquals(findNight(new Date("2024-06-20"), london), null);
+  const summer = findNight(new Date("2024-06-20"), london, -12)!;
+  assertTime(summer.sunset, "2024-06-20T20:21Z");
+  assertTime(summer.sunrise, "2024-06-21T03:43Z");
+
+  // Midnight sun
+  const tromso: Site = { latitude: 69.65, longitude: 18.96, elevation: 0 };
+  assertEquals(findNight(new Date("2024-06-21"), tromso, -6), null);
+});
+
+Deno.test("airmass is the secant high up and finite at the horizon", () => {
+  for (const altitude of [90, 60, 45]) {
+    assertAlmostEquals(
+      airmass(altitude),
+      1 / Math.sin(altitude * Math.PI / 180),
+      2e-3,
+    );
+  }
+  assertAlmostEquals(airmass(30), 2, 0.01);
+  assertAlmostEquals(airmass(1e-3), 38, 0.2);
+  assertEquals(airmass(0), Infinity);
+  assertEquals(airmass(-5), Infinity);
+});
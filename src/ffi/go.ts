@@ -0,0 +1,458 @@
+/**
+ * Deno FFI bindings for the Go library: the ingester, which parses, filters
+ * and inserts a file straight into SQLite so no rows cross the FFI
+ * boundary, and the batch reader, which parses columns straight into
+ * buffers allocated here.
+ * Lazy-loaded to avoid requiring --allow-ffi unless actually used
+ */
+
+import { fromFileUrl } from "@std/path";
+
+const libPath = Deno.build.os === "darwin"
+  ? "../../ffi/go/libgaia_ingest.dylib"
+  : Deno.build.os === "windows"
+  ? "../../ffi/go/gaia_ingest.dll"
+  : "../../ffi/go/libgaia_ingest.so";
+
+const symbols = {
+  ingest_file: {
+    parameters: ["buffer", "buffer", "buffer"],
+    result: "pointer",
+    // Runs on its own thread so files are ingested in parallel
+    nonblocking: true,
+  },
+  ingest_xmatch_file: {
+    parameters: ["buffer", "buffer", "i32"],
+    result: "pointer",
+    nonblocking: true,
+  },
+  query_json: {
+    parameters: ["buffer", "buffer", "i32"],
+    result: "pointer",
+    nonblocking: true,
+  },
+  exec_sql: {
+    parameters: ["buffer", "buffer"],
+    result: "pointer",
+    nonblocking: true,
+  },
+  free_string: {
+    parameters: ["pointer"],
+    result: "void",
+  },
+  gaia_layout_version: {
+    parameters: [],
+    result: "u32",
+  },
+  gaia_reader_open: {
+    parameters: ["buffer", "buffer", "buffer"],
+    result: "i64",
+  },
+  gaia_reader_next: {
+    parameters: ["i64"],
+    result: "i32",
+    nonblocking: true,
+  },
+  gaia_reader_close: {
+    parameters: ["i64"],
+    result: "void",
+  },
+  profile_start: {
+    parameters: ["buffer"],
+    result: "pointer",
+  },
+  profile_stop: {
+    parameters: [],
+    result: "pointer",
+  },
+} as const;
+
+let lib: Deno.DynamicLibrary<typeof symbols> | null = null;
+
+/**
+ * Lazy-load the Go library (only loads once)
+ */
+function getGoLib() {
+  if (!lib) {
+    const fullPath = fromFileUrl(new URL(libPath, import.meta.url));
+    lib = Deno.dlopen(fullPath, symbols);
+  }
+  return lib;
+}
+
+/**
+ * Whether the Go library is built and loads
+ */
+export function hasGoLib(): boolean {
+  try {
+    getGoLib();
+    return true;
+  } catch {
+    return false;
+  }
+}
+
+const encoder = new TextEncoder();
+
+/**
+ * What the Go ingester needs from the CLI config
+ */
+export interface GoIngestConfig {
+  /** Stored Gaia columns, in table order */
+  columns: string[];
+  /** Whether to also write the total proper motion `pm` */
+  derive_pm: boolean;
+  magnitude_limit: number;
+  /** G band zeropoint */
+  zeropoint: number;
+  /** Rows per insert transaction */
+  batch_size: number;
+}
+
+/**
+ * Milliseconds spent in each stage of one ingest. csv_ms excludes the
+ * gzip time spent inside the CSV reader.
+ */
+export interface GoIngestStages {
+  gzip_ms: number;
+  csv_ms: number;
+  parse_ms: number;
+  sqlite_ms: number;
+}
+
+export interface GoIngestSummary {
+  rows_read: number;
+  rows_kept: number;
+  rows_inserted: number;
+  duration_ms: number;
+  stages: GoIngestStages;
+}
+
+/**
+ * Ingest a gzipped Gaia CSV file into the database using Go
+ */
+export async function ingestFileGo(
+  databasePath: string,
+  filePath: string,
+  config: GoIngestConfig,
+): Promise<GoIngestSummary> {
+  const goLib = getGoLib();
+
+  const resultPtr = await goLib.symbols.ingest_file(
+    encoder.encode(databasePath + "\0"),
+    encoder.encode(filePath + "\0"),
+    encoder.encode(JSON.stringify(config) + "\0"),
+  );
+
+  if (resultPtr === null) {
+    throw new Error("Failed to ingest file in Go");
+  }
+
+  const result = JSON.parse(
+    new Deno.UnsafePointerView(resultPtr).getCString(),
+  ) as GoIngestSummary & { error?: string };
+  goLib.symbols.free_string(resultPtr);
+
+  if (result.error) {
+    throw new Error(result.error);
+  }
+
+  return result;
+}
+
+/**
+ * Insert the links of a gzipped 2MASS best-neighbour file using Go, keeping
+ * those whose Gaia source is in the database
+ */
+export async function ingestXmatchFileGo(
+  databasePath: string,
+  filePath: string,
+  batchSize: number,
+): Promise<GoIngestSummary> {
+  const goLib = getGoLib();
+
+  const resultPtr = await goLib.symbols.ingest_xmatch_file(
+    encoder.encode(databasePath + "\0"),
+    encoder.encode(filePath + "\0"),
+    batchSize,
+  );
+
+  return takeJSON<GoIngestSummary>(resultPtr);
+}
+
+export interface GoQueryResult {
+  columns: string[];
+  /** Values in column order */
+  rows: (string | number | boolean | null)[][];
+  /** Whether rows beyond the limit were left unread */
+  truncated: boolean;
+  duration_ms: number;
+}
+
+/**
+ * Run one read-only SQL statement in Go, where the astronomy functions
+ * (ang_sep, in_cone, healpix, healpix_from_source_id, flux_to_mag) and the
+ * table-valued searches (cone, box, nearest) are registered; see
+ * ffi/go/functions.go and ffi/go/search.go
+ * @param maxRows - Rows to return at most; 0 for all
+ */
+export async function queryGo(
+  databasePath: string,
+  sql: string,
+  maxRows: number,
+): Promise<GoQueryResult> {
+  const resultPtr = await getGoLib().symbols.query_json(
+    encoder.encode(databasePath + "\0"),
+    encoder.encode(sql + "\0"),
+    maxRows,
+  );
+
+  return takeJSON<GoQueryResult>(resultPtr);
+}
+
+/**
+ * Run statements that change the database, such as CREATE INDEX, in Go.
+ * The call does not block, so the caller can report progress meanwhile.
+ * @returns The time taken in milliseconds
+ */
+export async function execGo(
+  databasePath: string,
+  sql: string,
+): Promise<number> {
+  const resultPtr = await getGoLib().symbols.exec_sql(
+    encoder.encode(databasePath + "\0"),
+    encoder.encode(sql + "\0"),
+  );
+
+  return takeJSON<{ duration_ms: number }>(resultPtr).duration_ms;
+}
+
+/**
+ * Profiles for the Go library to collect; see ffi/go/profile.go
+ */
+export interface GoProfileConfig {
+  cpuprofile?: string;
+  memprofile?: string;
+  trace?: string;
+  /** Address for a /debug/pprof/ listener */
+  pprof?: string;
+}
+
+/**
+ * Read and free a JSON result string from the Go library
+ */
+function takeJSON<T>(
+  pointer: Deno.PointerValue,
+): T & { error?: string } {
+  if (pointer === null) {
+    throw new Error("Go returned no result");
+  }
+  const result = JSON.parse(new Deno.UnsafePointerView(pointer).getCString());
+  getGoLib().symbols.free_string(pointer);
+  if (result.error) {
+    throw new Error(result.error);
+  }
+  return result;
+}
+
+/**
+ * Start collecting profiles in the Go library. Returns the pprof listener's
+ * address, or an empty string without one.
+ */
+export function startGoProfile(config: GoProfileConfig): string {
+  const result = takeJSON<{ pprof: string }>(
+    getGoLib().symbols.profile_start(
+      encoder.encode(JSON.stringify(config) + "\0"),
+    ),
+  );
+  return result.pprof;
+}
+
+/**
+ * Stop profiling, writing the CPU and heap profiles and the trace
+ */
+export function stopGoProfile(): void {
+  takeJSON(getGoLib().symbols.profile_stop());
+}
+
+/**
+ * Version of the batch layout written below. Must match
+ * gaia_layout_version() in ffi/go/batch.go.
+ */
+export const LAYOUT_VERSION = 1;
+
+/** sizeof(gaia_layout) and sizeof(gaia_column) */
+const HEADER_SIZE = 48;
+const COLUMN_SIZE = 32;
+
+const KIND_FLOAT64 = 1;
+const KIND_INT64 = 2;
+
+/** Columns read as BigInt64; other columns are Float64 */
+const INTEGER_COLUMNS = new Set(["source_id", "solution_id"]);
+
+const ERROR_CAPACITY = 1024;
+
+/**
+ * One batch of rows, viewing the reader's buffers directly
+ */
+export interface ColumnBatch {
+  rows: number;
+  columns: Record<string, Float64Array | BigInt64Array>;
+  /** Null bitmaps: bit `row % 8` of byte `row >> 3` is set where null */
+  nulls: Record<string, Uint8Array>;
+}
+
+/**
+ * Whether a row is null in a batch's null bitmap
+ */
+export function isNull(bitmap: Uint8Array, row: number): boolean {
+  return (bitmap[row >> 3] & (1 << (row & 7))) !== 0;
+}
+
+function address(buffer: ArrayBuffer | ArrayBufferView): bigint {
+  return BigInt(Deno.UnsafePointer.value(Deno.UnsafePointer.of(buffer)));
+}
+
+/**
+ * Reads a gzipped Gaia CSV in Go, which writes each batch of columns
+ * straight into buffers allocated here, so nothing is copied or
+ * serialised between the two.
+ *
+ * Lifetime rules:
+ * - The layout descriptor and every buffer it points to belong to this
+ *   object and stay referenced until `close()`; ArrayBuffer memory does
+ *   not move, so Go may keep the pointers until then.
+ * - While `next()` is pending, Go is writing the buffers: don't read them.
+ * - A batch from `next()` is only valid until `next()` is called again;
+ *   copy anything that must outlive it.
+ * - After `close()` Go holds no pointers and the buffers are only
+ *   garbage.
+ */
+export class GoBatchReader {
+  private handle: number | bigint;
+  /** Referenced so the descriptor lives as long as Go's pointer to it */
+  private layout: Uint8Array;
+  private error: Uint8Array;
+  private batch: ColumnBatch;
+  private closed = false;
+
+  private constructor(
+    handle: number | bigint,
+    layout: Uint8Array,
+    error: Uint8Array,
+    batch: ColumnBatch,
+  ) {
+    this.handle = handle;
+    this.layout = layout;
+    this.error = error;
+    this.batch = batch;
+  }
+
+  /**
+   * Open a file, reading up to `capacity` rows of `columns` per batch
+   */
+  static open(
+    filePath: string,
+    columns: string[],
+    capacity = 100000,
+  ): GoBatchReader {
+    const goLib = getGoLib();
+
+    const version = goLib.symbols.gaia_layout_version();
+    if (version !== LAYOUT_VERSION) {
+      throw new Error(
+        `Go library uses batch layout version ${version}, expected ${LAYOUT_VERSION}; rebuild ffi/go`,
+      );
+    }
+
+    const layout = new Uint8Array(HEADER_SIZE + COLUMN_SIZE * columns.length);
+    const error = new Uint8Array(ERROR_CAPACITY);
+    const batch: ColumnBatch = { rows: 0, columns: {}, nulls: {} };
+
+    const view = new DataView(layout.buffer);
+    view.setUint32(0, LAYOUT_VERSION, true);
+    view.setUint32(4, HEADER_SIZE, true);
+    view.setUint32(8, COLUMN_SIZE, true);
+    view.setUint32(12, columns.length, true);
+    view.setUint32(16, capacity, true);
+    view.setUint32(20, 0, true);
+    view.setUint32(24, ERROR_CAPACITY, true);
+    view.setBigUint64(32, address(error), true);
+
+    columns.forEach((name, i) => {
+      const integer = INTEGER_COLUMNS.has(name);
+      const values = integer
+        ? new BigInt64Array(capacity)
+        : new Float64Array(capacity);
+      const nulls = new Uint8Array(Math.ceil(capacity / 8));
+      batch.columns[name] = values;
+      batch.nulls[name] = nulls;
+
+      const offset = HEADER_SIZE + COLUMN_SIZE * i;
+      view.setUint32(offset, integer ? KIND_INT64 : KIND_FLOAT64, true);
+      view.setBigUint64(offset + 8, address(values), true);
+      view.setBigUint64(offset + 16, address(nulls), true);
+    });
+
+    const handle = goLib.symbols.gaia_reader_open(
+      encoder.encode(filePath + "\0"),
+      encoder.encode(JSON.stringify(columns) + "\0"),
+      layout,
+    );
+
+    const reader = new GoBatchReader(handle, layout, error, batch);
+    if (handle < 0) {
+      throw new Error(reader.errorMessage());
+    }
+    return reader;
+  }
+
+  /**
+   * Fill the buffers with the next rows. Returns null at the end of the
+   * file; the batch is only valid until the next call.
+   */
+  async next(): Promise<ColumnBatch | null> {
+    if (this.closed) {
+      return null;
+    }
+
+    const rows = await getGoLib().symbols.gaia_reader_next(this.handle);
+    if (rows < 0) {
+      throw new Error(this.errorMessage());
+    }
+    if (rows === 0) {
+      return null;
+    }
+
+    const columns: ColumnBatch["columns"] = {};
+    for (const [name, values] of Object.entries(this.batch.columns)) {
+      columns[name] = values.subarray(0, rows);
+    }
+    return { rows, columns, nulls: this.batch.nulls };
+  }
+
+  close(): void {
+    if (!this.closed) {
+      this.closed = true;
+      getGoLib().symbols.gaia_reader_close(this.handle);
+    }
+  }
+
+  private errorMessage(): string {
+    const end = this.error.indexOf(0);
+    return new TextDecoder().decode(
+      this.error.subarray(0, end === -1 ? undefined : end),
+    );
+  }
+}
+
+/**
+ * Close the library (cleanup)
+ */
+export function closeGoLib() {
+  if (lib) {
+    lib.close();
+    lib = null;
+  }
+}
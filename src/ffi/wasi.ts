@@ -0,0 +1,184 @@
+/**
+ * Just enough of WASI (wasi_snapshot_preview1) to run the Go reader built
+ * for wasip1 as a reactor: clocks, random numbers and stdout/stderr. There
+ * are no files, arguments or environment, so it needs no permissions.
+ */
+
+const ERRNO_SUCCESS = 0;
+const ERRNO_BADF = 8;
+
+const FILETYPE_CHARACTER_DEVICE = 2;
+
+const EVENTTYPE_CLOCK = 0;
+const SUBSCRIPTION_SIZE = 48;
+const EVENT_SIZE = 32;
+
+const CLOCK_REALTIME = 0;
+
+/**
+ * Thrown when the module calls proc_exit
+ */
+export class WasiExit extends Error {
+  code: number;
+
+  constructor(code: number) {
+    super(`WebAssembly module exited with code ${code}`);
+    this.code = code;
+  }
+}
+
+export class Wasi {
+  private memory: WebAssembly.Memory | null = null;
+  private decoder = new TextDecoder();
+  private output = ["", "", ""];
+
+  /**
+   * The import object to instantiate the module with
+   */
+  get imports(): WebAssembly.Imports {
+    return { wasi_snapshot_preview1: this.functions() };
+  }
+
+  /**
+   * Run the module's initialisation; call once after instantiating
+   */
+  initialize(instance: WebAssembly.Instance): void {
+    this.memory = instance.exports.memory as WebAssembly.Memory;
+    (instance.exports._initialize as () => void)();
+  }
+
+  private view(): DataView {
+    // Re-created on each use, since growing memory detaches the old buffer
+    return new DataView(this.memory!.buffer);
+  }
+
+  private bytes(pointer: number, length: number): Uint8Array {
+    return new Uint8Array(this.memory!.buffer, pointer, length);
+  }
+
+  /**
+   * Write stdout and stderr a line at a time
+   */
+  private print(fd: number, text: string): void {
+    const lines = (this.output[fd] + text).split("\n");
+    this.output[fd] = lines.pop()!;
+    for (const line of lines) {
+      (fd === 1 ? console.log : console.error)(line);
+    }
+  }
+
+  private functions(): Record<string, (...args: never[]) => number | void> {
+    const noArguments = (countPointer: number, sizePointer: number) => {
+      const view = this.view();
+      view.setUint32(countPointer, 0, true);
+      view.setUint32(sizePointer, 0, true);
+      return ERRNO_SUCCESS;
+    };
+
+    return {
+      args_sizes_get: noArguments,
+      args_get: () => ERRNO_SUCCESS,
+      environ_sizes_get: noArguments,
+      environ_get: () => ERRNO_SUCCESS,
+
+      clock_time_get: (id: number, _precision: bigint, pointer: number) => {
+        const nanoseconds = id === CLOCK_REALTIME
+          ? BigInt(Date.now()) * 1_000_000n
+          : BigInt(Math.round(performance.now() * 1_000_000));
+        this.view().setBigUint64(pointer, nanoseconds, true);
+        return ERRNO_SUCCESS;
+      },
+
+      random_get: (pointer: number, length: number) => {
+        // getRandomValues fills at most 64 KiB at a time
+        for (let offset = 0; offset < length; offset += 65536) {
+          crypto.getRandomValues(
+            this.bytes(pointer + offset, Math.min(65536, length - offset)),
+          );
+        }
+        return ERRNO_SUCCESS;
+      },
+
+      fd_write: (
+        fd: number,
+        iovs: number,
+        iovsLength: number,
+        writtenPointer: number,
+      ) => {
+        if (fd !== 1 && fd !== 2) {
+          return ERRNO_BADF;
+        }
+        const view = this.view();
+        let written = 0;
+        for (let i = 0; i < iovsLength; i++) {
+          const pointer = view.getUint32(iovs + i * 8, true);
+          const length = view.getUint32(iovs + i * 8 + 4, true);
+          this.print(
+            fd,
+            this.decoder.decode(this.bytes(pointer, length).slice()),
+          );
+          written += length;
+        }
+        view.setUint32(writtenPointer, written, true);
+        return ERRNO_SUCCESS;
+      },
+
+      fd_fdstat_get: (fd: number, pointer: number) => {
+        if (fd > 2) {
+          return ERRNO_BADF;
+        }
+        const view = this.view();
+        view.setUint8(pointer, FILETYPE_CHARACTER_DEVICE);
+        view.setUint16(pointer + 2, 0, true);
+        view.setBigUint64(pointer + 8, 0n, true);
+        view.setBigUint64(pointer + 16, 0n, true);
+        return ERRNO_SUCCESS;
+      },
+      fd_fdstat_set_flags: (fd: number) =>
+        fd > 2 ? ERRNO_BADF : ERRNO_SUCCESS,
+
+      // No preopened directories, so no files
+      fd_prestat_get: () => ERRNO_BADF,
+      fd_prestat_dir_name: () => ERRNO_BADF,
+      fd_read: () => ERRNO_BADF,
+      fd_close: () => ERRNO_BADF,
+
+      // The runtime polls for timers, e.g. during garbage collection. A
+      // reactor only runs while called and has nothing to wait for, so
+      // every clock fires at once and there are no files to watch.
+      poll_oneoff: (
+        subscriptions: number,
+        events: number,
+        count: number,
+        eventCountPointer: number,
+      ) => {
+        const view = this.view();
+        for (let i = 0; i < count; i++) {
+          const subscription = subscriptions + i * SUBSCRIPTION_SIZE;
+          const event = events + i * EVENT_SIZE;
+          const type = view.getUint8(subscription + 8);
+          view.setBigUint64(
+            event,
+            view.getBigUint64(subscription, true),
+            true,
+          );
+          view.setUint16(
+            event + 8,
+            type === EVENTTYPE_CLOCK ? ERRNO_SUCCESS : ERRNO_BADF,
+            true,
+          );
+          view.setUint8(event + 10, type);
+          view.setBigUint64(event + 16, 0n, true);
+          view.setUint16(event + 24, 0, true);
+        }
+        view.setUint32(eventCountPointer, count, true);
+        return ERRNO_SUCCESS;
+      },
+      sched_yield: () => ERRNO_SUCCESS,
+
+      proc_exit: (code: number) => {
+        throw new WasiExit(code);
+      },
+    };
+  }
+}
@@ -0,0 +1,202 @@
+/**
+ * Bindings for the Go CSV reader compiled to WebAssembly (wasip1). Unlike
+ * the FFI parsers it needs no --allow-ffi and no platform-specific build:
+ * only read access to the .wasm file.
+ * Lazy-loaded so the module is only compiled when used
+ */
+
+import { Wasi } from "./wasi.ts";
+
+const wasmPath = new URL("../../ffi/go/gaia_reader.wasm", import.meta.url);
+
+/** Bytes copied into WebAssembly memory per call */
+const WRITE_SIZE = 1 << 20;
+
+interface ReaderExports {
+  memory: WebAssembly.Memory;
+  alloc(size: number): number;
+  reader_new(configLength: number): number;
+  reader_write(handle: number, length: number): number;
+  reader_close(handle: number): number;
+  reader_next(handle: number): number;
+  reader_column(handle: number, column: number): number;
+  reader_text(handle: number, column: number): number;
+  reader_nulls(handle: number, column: number): number;
+  reader_free(handle: number): void;
+  error_message(): number;
+  error_length(): number;
+}
+
+/**
+ * Parsed rows, column by column. Numeric columns (including booleans, as
+ * 1 and 0) are Float64Arrays and text columns are string arrays.
+ */
+export interface TypedBatch {
+  rows: number;
+  columns: Record<string, Float64Array | string[]>;
+  /** 1 where the value is null or empty */
+  nulls: Record<string, Uint8Array>;
+}
+
+let instance: Promise<ReaderExports> | null = null;
+
+/**
+ * Compile and start the module (only once). One instance serves every
+ * reader; calls into it are synchronous, so they never interleave.
+ */
+function getWasmReader(): Promise<ReaderExports> {
+  instance ??= (async () => {
+    const module = await WebAssembly.compile(await Deno.readFile(wasmPath));
+    const wasi = new Wasi();
+    const wasm = await WebAssembly.instantiate(module, wasi.imports);
+    wasi.initialize(wasm);
+    return wasm.exports as unknown as ReaderExports;
+  })();
+  return instance;
+}
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+/**
+ * An incremental Gaia CSV reader: write gzip or plain CSV bytes as they
+ * arrive and get back typed batches of the requested columns
+ */
+export class WasmCsvReader {
+  private wasm: ReaderExports;
+  private handle: number;
+  private columns: string[];
+
+  private constructor(
+    wasm: ReaderExports,
+    handle: number,
+    columns: string[],
+  ) {
+    this.wasm = wasm;
+    this.handle = handle;
+    this.columns = columns;
+  }
+
+  static async create(
+    columns: string[],
+    batchSize = 100000,
+  ): Promise<WasmCsvReader> {
+    const wasm = await getWasmReader();
+    const config = encoder.encode(
+      JSON.stringify({ columns, batch_size: batchSize }),
+    );
+    const pointer = wasm.alloc(config.length);
+    new Uint8Array(wasm.memory.buffer, pointer, config.length).set(config);
+
+    const handle = wasm.reader_new(config.length);
+    if (handle < 0) {
+      throw new Error(errorMessage(wasm));
+    }
+    return new WasmCsvReader(wasm, handle, columns);
+  }
+
+  /**
+   * Feed the next bytes of the file, returning any batches completed
+   */
+  write(bytes: Uint8Array): TypedBatch[] {
+    const batches: TypedBatch[] = [];
+    for (let offset = 0; offset < bytes.length; offset += WRITE_SIZE) {
+      const piece = bytes.subarray(offset, offset + WRITE_SIZE);
+      const pointer = this.wasm.alloc(piece.length);
+      new Uint8Array(this.wasm.memory.buffer, pointer, piece.length).set(
+        piece,
+      );
+      this.check(this.wasm.reader_write(this.handle, piece.length));
+      batches.push(...this.drain());
+    }
+    return batches;
+  }
+
+  /**
+   * End the input, returning the last batches
+   */
+  close(): TypedBatch[] {
+    this.check(this.wasm.reader_close(this.handle));
+    return this.drain();
+  }
+
+  /**
+   * Release the reader's memory in the module
+   */
+  free(): void {
+    this.wasm.reader_free(this.handle);
+  }
+
+  private check(result: number): void {
+    if (result < 0) {
+      throw new Error(errorMessage(this.wasm));
+    }
+  }
+
+  /**
+   * Copy the ready batches out of WebAssembly memory
+   */
+  private drain(): TypedBatch[] {
+    const batches: TypedBatch[] = [];
+
+    for (
+      let rows = this.wasm.reader_next(this.handle);
+      rows > 0;
+      rows = this.wasm.reader_next(this.handle)
+    ) {
+      const batch: TypedBatch = { rows, columns: {}, nulls: {} };
+      const buffer = this.wasm.memory.buffer;
+
+      this.columns.forEach((name, column) => {
+        batch.nulls[name] = new Uint8Array(
+          buffer,
+          this.wasm.reader_nulls(this.handle, column),
+          rows,
+        ).slice();
+
+        const values = this.wasm.reader_column(this.handle, column);
+        if (!TEXT_COLUMNS.has(name)) {
+          batch.columns[name] = new Float64Array(buffer, values, rows).slice();
+          return;
+        }
+
+        const offsets = new Uint32Array(buffer, values, rows + 1);
+        const bytes = new Uint8Array(
+          buffer,
+          this.wasm.reader_text(this.handle, column),
+          offsets[rows],
+        );
+        const strings = new Array<string>(rows);
+        for (let row = 0; row < rows; row++) {
+          strings[row] = decoder.decode(
+            bytes.subarray(offsets[row], offsets[row + 1]),
+          );
+        }
+        batch.columns[name] = strings;
+      });
+
+      batches.push(batch);
+    }
+
+    return batches;
+  }
+}
+
+/** Columns the reader returns as text (as in reader.go); the rest are numeric */
+const TEXT_COLUMNS = new Set([
+  "source_id",
+  "solution_id",
+  "designation",
+  "phot_variable_flag",
+  "libname_gspphot",
+]);
+
+function errorMessage(wasm: ReaderExports): string {
+  return decoder.decode(
+    new Uint8Array(
+      wasm.memory.buffer,
+      wasm.error_message(),
+      wasm.error_length(),
+    ).slice(),
+  );
+}
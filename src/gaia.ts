@@ -1,10 +1,32 @@
 import {
   GaiaDatabase,
   type GaiaRecord,
+  type Region,
+  type TableDescription,
   type TrackingProgress,
 } from "./database.ts";
 import { type CLIConfig, DEFAULT_CONFIG } from "./config.ts";
 import type { GaiaColumn, PhotometryOutput } from "./types.ts";
+import {
+  angularSeparation,
+  motionPositionAngle,
+  propagatePosition,
+  totalProperMotion,
+} from "./astrometry.ts";
+import type { CacheRegion, QueryCache } from "./cache.ts";
+import { GAIA_FILE_LEVEL, healpixFromSourceId } from "./healpix.ts";
+import {
+  classify,
+  type LuminosityClass,
+  type SpectralType,
+} from "./classification.ts";
+import {
+  convertPhotometry,
+  deredden,
+  type ExtinctionOptions,
+  fluxToMagnitude,
+} from "./photometry.ts";
+import { type Fields, type RowOf, RowScanner } from "./scan.ts";
 
 export type GaiaOptions = {
   /**
@@ -47,14 +69,60 @@ export type GaiaOptions = {
    * @default false
    */
   tmassCrossmatch?: boolean;
+  /**
+   * Whether to add approximate spectral type, luminosity class, evolutionary
+   * stage and absolute G columns derived from GSP-Phot parameters
+   * @default false
+   */
+  classify?: boolean;
+  /**
+   * Only return stars of these spectral types (implies `classify`)
+   * @default []
+   */
+  spectralTypes?: SpectralType[];
+  /**
+   * Only return stars of these luminosity classes (implies `classify`)
+   * @default []
+   */
+  luminosityClasses?: LuminosityClass[];
+  /**
+   * Add extinction-corrected G, BP−RP and absolute G using each star's
+   * stored ag_gspphot / ebpminrp_gspphot, falling back to the given
+   * constants. `false` disables dereddening.
+   * @default false
+   */
+  extinction?: ExtinctionOptions | false;
+  /**
+   * Cache for query results, shared by instances created with `derive`.
+   * `false` disables caching.
+   * @default false
+   */
+  cache?: QueryCache | false;
 };
 
-// 2MASS zeropoints (Vega system)
-const tmassZeropoints = {
-  j: 20.86650085,
-  h: 20.6576004,
-  k: 20.04360008,
-};
+/**
+ * A position to cross-match, with an optional caller-supplied identifier
+ */
+export interface XmatchTarget {
+  id?: string;
+  ra: number;
+  dec: number;
+}
+
+/**
+ * How far a streamed query has got
+ */
+export interface ScanProgress {
+  /** Rows returned so far */
+  rows: number;
+  /** Fraction of the region's declination range scanned, 0 to 1 */
+  complete: number;
+}
+
+export interface ScanBatch {
+  records: GaiaRecord[];
+  progress: ScanProgress;
+}
 
 /**
  * Gaia offline query interface
@@ -63,19 +131,31 @@ const tmassZeropoints = {
 export class Gaia {
   private db: GaiaDatabase;
   private options: Required<GaiaOptions>;
+  private ownsDatabase: boolean;
 
-  constructor(options: GaiaOptions = {}) {
+  /**
+   * @param options - The options for the Gaia instance
+   * @param db - An open database to share instead of opening `databasePath`.
+   * A shared database is left open by `close()`.
+   */
+  constructor(options: GaiaOptions = {}, db?: GaiaDatabase) {
     this.options = {
       magnitudeLimit: options.magnitudeLimit || [-3, 20],
       limit: options.limit || 0,
       photometryOutput: options.photometryOutput || "flux",
       tmassCrossmatch: options.tmassCrossmatch || false,
+      classify: options.classify || false,
+      spectralTypes: options.spectralTypes || [],
+      luminosityClasses: options.luminosityClasses || [],
+      extinction: options.extinction || false,
+      cache: options.cache || false,
       databasePath: options.databasePath || DEFAULT_CONFIG.databasePath,
       storedColumns: options.storedColumns || DEFAULT_CONFIG.storedColumns,
       zeropoints: options.zeropoints || DEFAULT_CONFIG.zeropoints,
       logLevel: options.logLevel || DEFAULT_CONFIG.logLevel,
     };
-    this.db = new GaiaDatabase(this.options);
+    this.ownsDatabase = !db;
+    this.db = db ?? new GaiaDatabase(this.options);
 
     // Check if 2MASS table exists if crossmatch is requested
     if (this.options.tmassCrossmatch && !this.db.hasTmassTable()) {
@@ -86,127 +166,492 @@ export class Gaia {
   }
 
   /**
-   * Perform a cone search around RA, Dec
+   * Perform a cone search around RA, Dec, ordered by source_id. With
+   * `after`, only stars whose source_id sorts after it are returned, so
+   * `limit` and the last source_id of each result page through a cone.
    */
-  coneSearch(ra: number, dec: number, radius: number): GaiaRecord[] {
-    let results = this.db.coneSearch(
-      ra,
-      dec,
-      radius,
+  coneSearch(
+    ra: number,
+    dec: number,
+    radius: number,
+    options: { after?: string } = {},
+  ): GaiaRecord[] {
+    const region = { ra, dec, radius };
+    const args = { ...region, after: options.after };
+    return this.cached("cone", args, { cones: [region] }, () => {
+      // Classification filters run after the query, so limit afterwards too
+      const filtered = this.hasClassificationFilters();
+      let results = this.classifyRecords(this.db.coneSearch(
+        ra,
+        dec,
+        radius,
+        this.options.magnitudeLimit,
+        this.options.tmassCrossmatch,
+        filtered ? 0 : this.options.limit,
+        options.after,
+      ));
+
+      // Apply limit if specified
+      if (this.options.limit > 0) {
+        results = results.slice(0, this.options.limit);
+      }
+
+      // Convert photometry if needed
+      return this.cleanDataFrame(results);
+    });
+  }
+
+  /**
+   * Cone search that yields results in batches of up to `batchSize` rows as
+   * the region is scanned (south to north), with progress. Stopping the
+   * generator stops the scan.
+   */
+  *streamConeSearch(
+    ra: number,
+    dec: number,
+    radius: number,
+    batchSize = 1000,
+  ): Generator<ScanBatch> {
+    const decMin = Math.max(dec - radius, -90);
+    const decMax = Math.min(dec + radius, 90);
+    const span = decMax - decMin;
+    const limit = this.options.limit;
+
+    let rows = 0;
+    let batch: GaiaRecord[] = [];
+
+    const flush = (scannedTo: number): ScanBatch => {
+      let records = this.cleanDataFrame(this.classifyRecords(batch));
+      if (limit > 0) {
+        records = records.slice(0, limit - rows);
+      }
+      batch = [];
+      rows += records.length;
+
+      return {
+        records,
+        progress: {
+          rows,
+          complete: span > 0 ? (scannedTo - decMin) / span : 1,
+        },
+      };
+    };
+
+    for (
+      const record of this.db.iterateConeSearch(
+        ra,
+        dec,
+        radius,
+        this.options.magnitudeLimit,
+        this.options.tmassCrossmatch,
+      )
+    ) {
+      batch.push(record);
+
+      if (batch.length >= batchSize) {
+        yield flush(record.dec);
+        if (limit > 0 && rows >= limit) {
+          return;
+        }
+      }
+    }
+
+    yield flush(decMax);
+  }
+
+  /**
+   * A scanner of this instance's records into a row type, checking on first
+   * use that its columns are among those this instance returns
+   * @example
+   * ```ts
+   * const scanner = gaia.scanner({
+   *   sourceId: column("source_id", "bigint"),
+   *   gFlux: nullable(column("phot_g_mean_flux", "number")),
+   * });
+   * const stars = gaia.coneSearch(45, 6, 0.2).map((r) => scanner.scan(r));
+   * ```
+   */
+  scanner<F extends Fields>(fields: F): RowScanner<F> {
+    return new RowScanner(fields, () => this.getOutputColumns());
+  }
+
+  /**
+   * `streamConeSearch` scanned into a row type, one row at a time
+   */
+  *scanConeSearch<F extends Fields>(
+    fields: F,
+    ra: number,
+    dec: number,
+    radius: number,
+    batchSize = 1000,
+  ): Generator<RowOf<F>> {
+    const scanner = this.scanner(fields);
+    scanner.validate();
+    for (
+      const { records } of this.streamConeSearch(ra, dec, radius, batchSize)
+    ) {
+      yield* scanner.iterate(records);
+    }
+  }
+
+  /**
+   * Columns records can have: those queried, and those the classification,
+   * extinction and photometry options add. A column a conversion replaces
+   * is missing from the rows it was replaced in.
+   */
+  private getOutputColumns(): Set<string> {
+    const columns = new Set(
+      this.db.getQueryColumns(this.options.tmassCrossmatch),
+    );
+    const add = (...names: string[]) => names.forEach((n) => columns.add(n));
+
+    if (this.options.classify || this.hasClassificationFilters()) {
+      add("spectral_type", "luminosity_class", "evolutionary_stage");
+      add("abs_g_mag");
+    }
+    if (this.options.extinction) {
+      add("phot_g_mean_mag_dered", "bp_rp_dered", "abs_g_mag_dered");
+      add("a_g", "e_bp_rp", "extinction_source");
+      add("a_g_source", "e_bp_rp_source");
+    }
+    if (this.options.photometryOutput === "magnitude") {
+      for (const band of ["g", "bp", "rp"]) {
+        if (columns.has(`phot_${band}_mean_flux`)) {
+          add(`phot_${band}_mean_mag`);
+        }
+        if (columns.has(`phot_${band}_mean_flux_error`)) {
+          add(`phot_${band}_mean_mag_error`);
+        }
+      }
+    } else if (this.options.tmassCrossmatch) {
+      add("j_flux", "h_flux", "k_flux");
+    }
+    return columns;
+  }
+
+  /**
+   * Create an instance with different query options that shares this
+   * instance's database connection
+   */
+  derive(options: GaiaOptions): Gaia {
+    const overrides = Object.fromEntries(
+      Object.entries(options).filter(([, value]) => value !== undefined),
+    );
+    return new Gaia({ ...this.options, ...overrides }, this.db);
+  }
+
+  /**
+   * Find the `count` stars nearest to RA, Dec, closest first, with their
+   * `separation` in arcseconds
+   */
+  nearest(ra: number, dec: number, count: number): GaiaRecord[] {
+    // New rows can only change the answer inside the farthest match
+    const region = (records: GaiaRecord[]): CacheRegion =>
+      records.length < count ? null : {
+        cones: [{
+          ra,
+          dec,
+          radius: Math.max(...records.map((r) => r.separation as number)) /
+            3600,
+        }],
+      };
+
+    return this.cached("nearest", { ra, dec, count }, region, () => {
+      const results = this.classifyRecords(this.db.nearest(
+        ra,
+        dec,
+        count,
+        this.options.magnitudeLimit,
+        this.options.tmassCrossmatch,
+      ));
+
+      return this.cleanDataFrame(results);
+    });
+  }
+
+  /**
+   * Cross-match a list of positions against the catalogue, returning the
+   * closest star within `radiusArcsec` of each target. Each match gets
+   * `target_id`, `target_ra`, `target_dec` and `separation` (arcsec);
+   * targets without a match are omitted.
+   */
+  xmatch(targets: XmatchTarget[], radiusArcsec: number): GaiaRecord[] {
+    const region = {
+      cones: targets.map(({ ra, dec }) => ({
+        ra,
+        dec,
+        radius: radiusArcsec / 3600,
+      })),
+    };
+
+    return this.cached(
+      "xmatch",
+      { targets, radiusArcsec },
+      region,
+      () => this.runXmatch(targets, radiusArcsec),
+    );
+  }
+
+  private runXmatch(
+    targets: XmatchTarget[],
+    radiusArcsec: number,
+  ): GaiaRecord[] {
+    const matches: GaiaRecord[] = [];
+
+    targets.forEach((target, index) => {
+      const candidates = this.db.coneSearch(
+        target.ra,
+        target.dec,
+        radiusArcsec / 3600,
+        this.options.magnitudeLimit,
+        this.options.tmassCrossmatch,
+      );
+
+      let best: GaiaRecord | null = null;
+      let bestSeparation = Infinity;
+      for (const candidate of candidates) {
+        const separation = angularSeparation(target, candidate) * 3600;
+        if (separation < bestSeparation) {
+          best = candidate;
+          bestSeparation = separation;
+        }
+      }
+
+      if (best) {
+        matches.push({
+          ...best,
+          target_id: target.id ?? String(index),
+          target_ra: target.ra,
+          target_dec: target.dec,
+          separation: bestSeparation,
+        });
+      }
+    });
+
+    return this.cleanDataFrame(this.classifyRecords(matches));
+  }
+
+  /**
+   * Look up stars by Gaia source_id
+   */
+  lookup(sourceIds: string[]): GaiaRecord[] {
+    let region: CacheRegion;
+    try {
+      region = {
+        pixels: sourceIds.map((id) => healpixFromSourceId(id, GAIA_FILE_LEVEL)),
+      };
+    } catch {
+      // Not numeric source_ids; nothing will match, but stay conservative
+      region = null;
+    }
+
+    return this.cached("lookup", { sourceIds }, region, () => {
+      const results = this.db.lookup(sourceIds, this.options.tmassCrossmatch);
+      return this.cleanDataFrame(this.classifyRecords(results));
+    });
+  }
+
+  /**
+   * Find fast-moving stars with total proper motion >= `minPm` (mas/yr),
+   * all-sky or within a cone. Each result gets `pm` and `pm_position_angle`
+   * (degrees east of north), and when `epoch` (Julian year) is given, its
+   * position propagated to that epoch as `ra_epoch`/`dec_epoch`.
+   */
+  highProperMotionSearch(
+    minPm: number,
+    options: { region?: Region; epoch?: number } = {},
+  ): GaiaRecord[] {
+    return this.cached(
+      "high-pm",
+      { minPm, ...options },
+      options.region ? { cones: [options.region] } : null,
+      () => this.runHighProperMotionSearch(minPm, options),
+    );
+  }
+
+  private runHighProperMotionSearch(
+    minPm: number,
+    options: { region?: Region; epoch?: number },
+  ): GaiaRecord[] {
+    // Classification filters run after the query, so limit afterwards too
+    const filtered = this.hasClassificationFilters();
+    let results = this.classifyRecords(this.db.highProperMotionSearch(
+      minPm,
+      options.region,
       this.options.magnitudeLimit,
       this.options.tmassCrossmatch,
-    );
+      filtered ? 0 : this.options.limit,
+    ));
 
-    // Apply limit if specified
-    if (this.options.limit > 0) {
+    if (filtered && this.options.limit > 0) {
       results = results.slice(0, this.options.limit);
     }
 
-    // Convert photometry if needed
-    return this.cleanDataFrame(results);
+    const withMotion = results.map((record) => {
+      const pmra = record.pmra as number;
+      const pmdec = record.pmdec as number;
+      const enriched: GaiaRecord = {
+        ...record,
+        pm: typeof record.pm === "number"
+          ? record.pm
+          : totalProperMotion(pmra, pmdec),
+        pm_position_angle: motionPositionAngle(pmra, pmdec),
+      };
+
+      if (options.epoch !== undefined) {
+        const position = propagatePosition(
+          record.ra,
+          record.dec,
+          pmra,
+          pmdec,
+          options.epoch,
+        );
+        enriched.epoch = options.epoch;
+        enriched.ra_epoch = position.ra;
+        enriched.dec_epoch = position.dec;
+      }
+
+      return enriched;
+    });
+
+    return this.cleanDataFrame(withMotion);
   }
 
   /**
    * Search for all targets within a brightness limit
    */
   brightnessLimitSearch(magnitudeLimit: [number, number]): GaiaRecord[] {
-    // This would require a full table scan, so we'll use the cone search
-    // with a very large radius as a proxy
-    const results = this.db.coneSearch(
-      0,
-      0,
-      180,
-      magnitudeLimit,
-      this.options.tmassCrossmatch,
-    );
+    return this.cached("brightness", { magnitudeLimit }, null, () => {
+      // This would require a full table scan, so we'll use the cone search
+      // with a very large radius as a proxy
+      const results = this.classifyRecords(this.db.coneSearch(
+        0,
+        0,
+        180,
+        magnitudeLimit,
+        this.options.tmassCrossmatch,
+      ));
+
+      if (this.options.limit > 0) {
+        return this.cleanDataFrame(results.slice(0, this.options.limit));
+      }
+
+      return this.cleanDataFrame(results);
+    });
+  }
+
+  /**
+   * Serve a query from the cache if one is configured, otherwise run it and
+   * cache the result. `region` is the sky the result depends on, or a
+   * function computing it from the result.
+   */
+  private cached(
+    kind: string,
+    args: Record<string, unknown>,
+    region: CacheRegion | ((records: GaiaRecord[]) => CacheRegion),
+    run: () => GaiaRecord[],
+  ): GaiaRecord[] {
+    const { cache } = this.options;
+    if (!cache) {
+      return run();
+    }
 
-    if (this.options.limit > 0) {
-      return this.cleanDataFrame(results.slice(0, this.options.limit));
+    const sorted = (values: string[]) => [...values].sort();
+    const query = {
+      kind,
+      args,
+      options: {
+        magnitudeLimit: this.options.magnitudeLimit,
+        limit: this.options.limit,
+        photometryOutput: this.options.photometryOutput,
+        tmassCrossmatch: this.options.tmassCrossmatch,
+        classify: this.options.classify,
+        spectralTypes: sorted(this.options.spectralTypes),
+        luminosityClasses: sorted(this.options.luminosityClasses),
+        extinction: this.options.extinction,
+        storedColumns: sorted(this.options.storedColumns),
+        zeropoints: this.options.zeropoints,
+      },
+    };
+
+    const hit = cache.get(query, this.db);
+    if (hit) {
+      return hit;
     }
 
-    return this.cleanDataFrame(results);
+    const records = run();
+    cache.set(
+      query,
+      typeof region === "function" ? region(records) : region,
+      records,
+    );
+    return records;
+  }
+
+  private hasClassificationFilters(): boolean {
+    return this.options.spectralTypes.length > 0 ||
+      this.options.luminosityClasses.length > 0;
   }
 
   /**
-   * Convert flux to magnitude or vice versa based on user preferences
+   * Add derived classification columns and apply classification filters.
+   * Runs on raw records, before photometry conversion removes fluxes.
    */
-  private cleanDataFrame(records: GaiaRecord[]): GaiaRecord[] {
-    if (this.options.photometryOutput === "magnitude") {
-      return records.map((record) => {
-        const cleaned = { ...record };
-
-        // Handle Gaia photometry
-        const bands = [
-          { flux: "phot_g_mean_flux", mag: "phot_g_mean_mag", zp: 0 },
-          { flux: "phot_bp_mean_flux", mag: "phot_bp_mean_mag", zp: 1 },
-          { flux: "phot_rp_mean_flux", mag: "phot_rp_mean_mag", zp: 2 },
-        ];
-
-        for (const band of bands) {
-          const flux = record[band.flux] as number;
-          if (flux && flux > 0) {
-            const zeropoint = this.options.zeropoints[band.zp];
-            cleaned[band.mag] = zeropoint - 2.5 * Math.log10(flux);
-
-            // Calculate magnitude error if flux error exists
-            const fluxError = record[`${band.flux}_error`] as number;
-            if (fluxError) {
-              cleaned[`${band.mag}_error`] = (2.5 / Math.log(10)) *
-                (fluxError / flux);
-              delete cleaned[`${band.flux}_error`];
-            }
-
-            delete cleaned[band.flux];
-          }
-        }
-
-        // 2MASS magnitudes are already in magnitude format, just ensure they're numeric
-        if (this.options.tmassCrossmatch) {
-          if (cleaned.j_m !== null && cleaned.j_m !== undefined) {
-            cleaned.j_m = Number(cleaned.j_m);
-          }
-          if (cleaned.h_m !== null && cleaned.h_m !== undefined) {
-            cleaned.h_m = Number(cleaned.h_m);
-          }
-          if (cleaned.k_m !== null && cleaned.k_m !== undefined) {
-            cleaned.k_m = Number(cleaned.k_m);
-          }
-        }
+  private classifyRecords(records: GaiaRecord[]): GaiaRecord[] {
+    if (!this.options.classify && !this.hasClassificationFilters()) {
+      return records;
+    }
 
-        return cleaned;
+    const { spectralTypes, luminosityClasses } = this.options;
+    const zeropoint = this.options.zeropoints[0];
+    const numeric = (value: unknown) =>
+      typeof value === "number" && isFinite(value) ? value : null;
+
+    const classified: GaiaRecord[] = [];
+
+    for (const record of records) {
+      const flux = numeric(record.phot_g_mean_flux);
+      const classification = classify({
+        teff: numeric(record.teff_gspphot),
+        logg: numeric(record.logg_gspphot),
+        gMag: flux !== null && flux > 0
+          ? fluxToMagnitude(flux, zeropoint)
+          : numeric(record.phot_g_mean_mag),
+        parallax: numeric(record.parallax),
       });
-    }
 
-    if (this.options.photometryOutput === "flux") {
-      // Convert 2MASS magnitudes to flux if needed
-      if (this.options.tmassCrossmatch) {
-        return records.map((record) => {
-          const cleaned = { ...record };
-
-          if (cleaned.j_m !== null && cleaned.j_m !== undefined) {
-            const jMag = Number(cleaned.j_m);
-            cleaned.j_flux = 10 ** (-0.4 * (jMag - tmassZeropoints.j));
-            delete cleaned.j_m;
-          }
-
-          if (cleaned.h_m !== null && cleaned.h_m !== undefined) {
-            const hMag = Number(cleaned.h_m);
-            cleaned.h_flux = 10 ** (-0.4 * (hMag - tmassZeropoints.h));
-            delete cleaned.h_m;
-          }
-
-          if (cleaned.k_m !== null && cleaned.k_m !== undefined) {
-            const kMag = Number(cleaned.k_m);
-            cleaned.k_flux = 10 ** (-0.4 * (kMag - tmassZeropoints.k));
-            delete cleaned.k_m;
-          }
-
-          return cleaned;
-        });
+      if (
+        spectralTypes.length > 0 &&
+        (classification.spectral_type === null ||
+          !spectralTypes.includes(classification.spectral_type))
+      ) {
+        continue;
       }
+
+      if (
+        luminosityClasses.length > 0 &&
+        (classification.luminosity_class === null ||
+          !luminosityClasses.includes(classification.luminosity_class))
+      ) {
+        continue;
+      }
+
+      classified.push({ ...record, ...classification });
     }
 
-    return records;
+    return classified;
+  }
+
+  /**
+   * Apply dereddening if requested, then convert flux to magnitude or vice
+   * versa based on user preferences
+   */
+  private cleanDataFrame(records: GaiaRecord[]): GaiaRecord[] {
+    const dereddened = this.options.extinction
+      ? deredden(records, this.options.zeropoints, this.options.extinction)
+      : records;
+
+    return convertPhotometry(dereddened, this.options);
   }
 
   /**
@@ -218,6 +663,15 @@ export class Gaia {
   } {
     const totalRecords = this.db.getRecordCount();
 
+    return {
+      totalRecords,
+      trackingProgress: this.getTrackingProgress(),
+    };
+  }
+
+  private getTrackingProgress(): {
+    [key: string]: TrackingProgress | null;
+  } {
     const trackingTables = [
       "file_tracking_gaiadr3",
       "file_tracking_tmass_xmatch",
@@ -235,9 +689,26 @@ export class Gaia {
       }
     }
 
+    return trackingProgress;
+  }
+
+  /**
+   * Describe the catalogue: build properties, tables and columns with
+   * units and descriptions, download progress, and the level-8 HEALPix
+   * ranges of the Gaia files loaded so far. Unlike `getStats`, cheap on a
+   * full-size database.
+   */
+  describe(): {
+    metadata: Record<string, string>;
+    tables: TableDescription[];
+    trackingProgress: { [key: string]: TrackingProgress | null };
+    coverage: [number, number][];
+  } {
     return {
-      totalRecords,
-      trackingProgress,
+      metadata: this.db.getMetadata(),
+      tables: this.db.describeTables(),
+      trackingProgress: this.getTrackingProgress(),
+      coverage: this.db.getCompletedHealpixRanges("file_tracking_gaiadr3"),
     };
   }
 
@@ -266,7 +737,9 @@ export class Gaia {
    * Close database connection
    */
   close(): void {
-    this.db.close();
+    if (this.ownsDatabase) {
+      this.db.close();
+    }
   }
 }
 
@@ -0,0 +1,318 @@
+/**
+ * Canonical content digests, to tell whether two databases hold the same
+ * catalogue however they were built.
+ *
+ * Only the logical content is hashed: each content table's rows in primary
+ * key order, with columns in name order and values encoded by value rather
+ * than storage class (an INTEGER 1 and a REAL 1.0 hash alike). Row ids,
+ * file tracking, cache invalidations and timestamps are left out, since
+ * they depend on download order and parallelism.
+ *
+ * Rows are also hashed per HEALPix region of their Gaia source_id, so two
+ * builds that differ can be narrowed down to the part of the sky that does.
+ */
+
+import { createHash, type Hash } from "node:crypto";
+import type { GaiaDatabase } from "./database.ts";
+import { healpixFromSourceId } from "./healpix.ts";
+
+/** Bump whenever the encoding below changes */
+export const CONTENT_HASH_VERSION = 1;
+
+/** Default HEALPix level of region digests (192 regions) */
+export const DEFAULT_HASH_LEVEL = 2;
+
+/** Tables holding catalogue content; the rest are bookkeeping */
+export const CONTENT_TABLES = ["gaiadr3", "tmass_xmatch", "tmass"];
+
+/** Column holding the Gaia source_id, which places rows in a region */
+const REGION_COLUMNS = ["source_id", "gaiadr3_source_id"];
+
+const METADATA_KEY = "content_hash";
+
+export interface TableHash {
+  rows: number;
+  /** SHA-256 of the whole table, hex */
+  digest: string;
+  /** SHA-256 per HEALPix pixel, for tables keyed by a Gaia source_id */
+  regions: Record<string, string>;
+}
+
+export interface ContentHash {
+  version: number;
+  /** HEALPix level of the region digests */
+  level: number;
+  /** When the digests were computed */
+  computed_at: string;
+  tables: Record<string, TableHash>;
+}
+
+/** A table or region whose digests differ between two databases */
+export interface HashDifference {
+  table: string;
+  /** HEALPix pixel, or undefined for the table as a whole */
+  region?: number;
+  reason: string;
+}
+
+/**
+ * Appends canonical encodings of values into a reusable buffer
+ */
+class RowEncoder {
+  private buffer = new Uint8Array(1024);
+  private view = new DataView(this.buffer.buffer);
+  private length = 0;
+  private encoder = new TextEncoder();
+
+  reset(): void {
+    this.length = 0;
+  }
+
+  bytes(): Uint8Array {
+    return this.buffer.subarray(0, this.length);
+  }
+
+  private reserve(size: number): void {
+    if (this.length + size <= this.buffer.length) {
+      return;
+    }
+    const grown = new Uint8Array(
+      Math.max(this.buffer.length * 2, this.length + size),
+    );
+    grown.set(this.buffer.subarray(0, this.length));
+    this.buffer = grown;
+    this.view = new DataView(grown.buffer);
+  }
+
+  /**
+   * One tag byte, then: nothing for NULL; a big-endian float64 for numbers
+   * (with -0 as 0); a big-endian int64 for integers outside float64's
+   * range; a uint32 length and the bytes for text (UTF-8) and blobs
+   */
+  value(value: unknown): void {
+    if (value === null || value === undefined) {
+      this.reserve(1);
+      this.buffer[this.length++] = 0;
+    } else if (typeof value === "number") {
+      this.reserve(9);
+      this.buffer[this.length++] = 1;
+      this.view.setFloat64(this.length, value === 0 ? 0 : value);
+      this.length += 8;
+    } else if (typeof value === "bigint") {
+      this.reserve(9);
+      this.buffer[this.length++] = 2;
+      this.view.setBigInt64(this.length, value);
+      this.length += 8;
+    } else if (value instanceof Uint8Array) {
+      this.tagged(4, value);
+    } else {
+      this.tagged(3, this.encoder.encode(String(value)));
+    }
+  }
+
+  private tagged(tag: number, bytes: Uint8Array): void {
+    this.reserve(5 + bytes.length);
+    this.buffer[this.length++] = tag;
+    this.view.setUint32(this.length, bytes.length);
+    this.length += 4;
+    this.buffer.set(bytes, this.length);
+    this.length += bytes.length;
+  }
+}
+
+/**
+ * Hash one table. Every digest starts from the hash version, table name
+ * and sorted column names, so adding or dropping a column changes it.
+ */
+export function hashTable(
+  db: GaiaDatabase,
+  table: string,
+  level = DEFAULT_HASH_LEVEL,
+): TableHash {
+  const info = db.prepare(`PRAGMA table_info(${table})`).all<
+    { name: string; pk: number }
+  >();
+  const columns = info.map((column) => column.name).sort();
+  const key = info.filter((column) => column.pk > 0)
+    .sort((a, b) => a.pk - b.pk)
+    .map((column) => column.name);
+  const regionColumn = REGION_COLUMNS.find((name) => columns.includes(name));
+
+  const header = new RowEncoder();
+  header.value(`gaiaoffline-content-v${CONTENT_HASH_VERSION}`);
+  header.value(table);
+  for (const column of columns) {
+    header.value(column);
+  }
+  const start = (): Hash => createHash("sha256").update(header.bytes());
+
+  const tableHash = start();
+  const regionHashes = new Map<number, Hash>();
+  const row = new RowEncoder();
+  let rows = 0;
+
+  // BINARY collation, so the order is the same everywhere
+  const orderBy = (key.length > 0 ? key : columns)
+    .map((column) => `"${column}"`).join(", ");
+  const statement = db.prepare(
+    `SELECT ${
+      columns.map((column) => `"${column}"`).join(", ")
+    } FROM ${table} ORDER BY ${orderBy}`,
+  );
+
+  for (const record of statement.iter() as Iterable<Record<string, unknown>>) {
+    row.reset();
+    for (const column of columns) {
+      row.value(record[column]);
+    }
+    const bytes = row.bytes();
+    tableHash.update(bytes);
+    rows++;
+
+    const pixel = regionColumn ? regionOf(record[regionColumn], level) : null;
+    if (pixel !== null) {
+      let regionHash = regionHashes.get(pixel);
+      if (!regionHash) {
+        regionHash = start();
+        regionHashes.set(pixel, regionHash);
+      }
+      regionHash.update(bytes);
+    }
+  }
+  statement.finalize();
+
+  const regions: Record<string, string> = {};
+  for (const pixel of [...regionHashes.keys()].sort((a, b) => a - b)) {
+    regions[pixel] = regionHashes.get(pixel)!.digest("hex");
+  }
+
+  return { rows, digest: tableHash.digest("hex"), regions };
+}
+
+function regionOf(sourceId: unknown, level: number): number | null {
+  try {
+    return healpixFromSourceId(sourceId as string, level);
+  } catch {
+    // Not a Gaia source_id
+    return null;
+  }
+}
+
+/**
+ * Hash every content table present in the database
+ */
+export function hashContent(
+  db: GaiaDatabase,
+  options: { level?: number; tables?: string[] } = {},
+): ContentHash {
+  const level = options.level ?? DEFAULT_HASH_LEVEL;
+  const tables: Record<string, TableHash> = {};
+  for (const table of options.tables ?? CONTENT_TABLES) {
+    if (db.hasTable(table)) {
+      tables[table] = hashTable(db, table, level);
+    }
+  }
+
+  return {
+    version: CONTENT_HASH_VERSION,
+    level,
+    computed_at: new Date().toISOString(),
+    tables,
+  };
+}
+
+/**
+ * Store digests in the metadata table, one key per table
+ */
+export function storeContentHash(db: GaiaDatabase, hash: ContentHash): void {
+  const { tables, ...properties } = hash;
+  db.setMetadata(METADATA_KEY, JSON.stringify(properties));
+  for (const [table, tableHash] of Object.entries(tables)) {
+    db.setMetadata(`${METADATA_KEY}.${table}`, JSON.stringify(tableHash));
+  }
+}
+
+/**
+ * Digests stored by `storeContentHash`, or null if there are none
+ */
+export function readContentHash(db: GaiaDatabase): ContentHash | null {
+  const metadata = db.getMetadata();
+  if (!metadata[METADATA_KEY]) {
+    return null;
+  }
+
+  const tables: Record<string, TableHash> = {};
+  for (const [key, value] of Object.entries(metadata)) {
+    if (key.startsWith(`${METADATA_KEY}.`)) {
+      tables[key.slice(METADATA_KEY.length + 1)] = JSON.parse(value);
+    }
+  }
+  return { ...JSON.parse(metadata[METADATA_KEY]), tables };
+}
+
+/**
+ * Whether stored digests predate the last file populate committed
+ */
+export function isContentHashStale(
+  db: GaiaDatabase,
+  hash: ContentHash,
+): boolean {
+  const updatedAt = db.getMetadata().updated_at;
+  return updatedAt !== undefined && updatedAt > hash.computed_at;
+}
+
+/**
+ * Tables and regions whose digests differ. Empty when the content matches.
+ */
+export function compareContentHashes(
+  a: ContentHash,
+  b: ContentHash,
+): HashDifference[] {
+  if (a.version !== b.version || a.level !== b.level) {
+    return [{
+      table: "*",
+      reason:
+        `computed with different settings (version ${a.version}, level ${a.level} vs version ${b.version}, level ${b.level})`,
+    }];
+  }
+
+  const differences: HashDifference[] = [];
+  const tables = new Set([...Object.keys(a.tables), ...Object.keys(b.tables)]);
+  for (const table of [...tables].sort()) {
+    const left = a.tables[table];
+    const right = b.tables[table];
+    if (!left || !right) {
+      differences.push({
+        table,
+        reason: `only in the ${left ? "first" : "second"} database`,
+      });
+      continue;
+    }
+    if (left.digest === right.digest) {
+      continue;
+    }
+
+    differences.push({
+      table,
+      reason: `digests differ (${left.rows.toLocaleString()} vs ${
+        right.rows.toLocaleString()
+      } rows)`,
+    });
+    const pixels = new Set([
+      ...Object.keys(left.regions),
+      ...Object.keys(right.regions),
+    ]);
+    for (const pixel of [...pixels].map(Number).sort((x, y) => x - y)) {
+      if (left.regions[pixel] !== right.regions[pixel]) {
+        differences.push({
+          table,
+          region: pixel,
+          reason: !left.regions[pixel] || !right.regions[pixel]
+            ? `only in the ${left.regions[pixel] ? "first" : "second"} database`
+            : "digests differ",
+        });
+      }
+    }
+  }
+  return differences;
+}
@@ -0,0 +1,244 @@
+import { assertEquals, assertStringIncludes } from "@std/assert";
+import { createHash } from "node:crypto";
+import { DEFAULT_CONFIG } from "./config.ts";
+import { GaiaDatabase } from "./database.ts";
+import {
+  compareContentHashes,
+  CONTENT_HASH_VERSION,
+  type ContentHash,
+  hashContent,
+  hashTable,
+  isContentHashStale,
+  readContentHash,
+  storeContentHash,
+} from "./hash.ts";
+
+/**
+ * Run `test` with a fresh database in a temporary directory
+ */
+function withDatabases(
+  test: (open: (name?: string) => GaiaDatabase) => void,
+) {
+  return () => {
+    const dir = Deno.makeTempDirSync();
+    const opened: GaiaDatabase[] = [];
+    try {
+      test((name = "gaia") => {
+        const db = new GaiaDatabase({
+          ...DEFAULT_CONFIG,
+          databasePath: `${dir}/${name}.db`,
+          logLevel: "ERROR",
+        });
+        db.initialize();
+        opened.push(db);
+        return db;
+      });
+    } finally {
+      opened.forEach((db) => db.close());
+      Deno.removeSync(dir, { recursive: true });
+    }
+  };
+}
+
+/** A source_id in the given level-2 HEALPix pixel */
+function sourceId(pixel: number, n: number): string {
+  return String((BigInt(pixel) << 55n) + BigInt(n));
+}
+
+function insertStars(db: GaiaDatabase, stars: [string, number][]): void {
+  const insert = db.prepare(
+    "INSERT INTO gaiadr3 (source_id, ra, dec, phot_g_mean_flux) VALUES (?, ?, ?, ?)",
+  );
+  for (const [id, flux] of stars) {
+    insert.run(id, flux / 100, -flux / 200, flux);
+  }
+}
+
+Deno.test(
+  "rows are encoded by value with a tag and big-endian fields",
+  withDatabases((open) => {
+    const db = open();
+    db.prepare("CREATE TABLE t (k TEXT PRIMARY KEY, v)").run();
+    const insert = db.prepare("INSERT INTO t VALUES (?, ?)");
+    insert.run("b", null);
+    insert.run("a", 1.5);
+
+    const text = (value: string) => {
+      const bytes = new TextEncoder().encode(value);
+      return [3, 0, 0, 0, bytes.length, ...bytes];
+    };
+    const number = (value: number) => {
+      const bytes = new Uint8Array(9);
+      bytes[0] = 1;
+      new DataView(bytes.buffer).setFloat64(1, value);
+      return [...bytes];
+    };
+    // Header: version, table and sorted columns; then rows in key order
+    const expected = createHash("sha256").update(
+      new Uint8Array([
+        ...text(`gaiaoffline-content-v${CONTENT_HASH_VERSION}`),
+        ...text("t"),
+        ...text("k"),
+        ...text("v"),
+        ...text("a"),
+        ...number(1.5),
+        ...text("b"),
+        0,
+      ]),
+    ).digest("hex");
+    assertEquals(hashTable(db, "t"), {
+      rows: 2,
+      digest: expected,
+      regions: {},
+    });
+  }),
+);
+
+Deno.test(
+  "values hash alike whatever their storage class",
+  withDatabases((open) => {
+    const db = open();
+    db.prepare("CREATE TABLE t (k TEXT PRIMARY KEY, v)").run();
+    const digestOf = (value: unknown) => {
+      db.prepare("DELETE FROM t").run();
+      db.prepare(`INSERT INTO t VALUES ('a', ${value})`).run();
+      return hashTable(db, "t").digest;
+    };
+
+    assertEquals(digestOf("1"), digestOf("1.0"));
+    assertEquals(digestOf("0.0"), digestOf("-0.0"));
+    const distinct = ["NULL", "0", "''", "'0'", "x'00'"].map(digestOf);
+    assertEquals(new Set(distinct).size, distinct.length);
+  }),
+);
+
+Deno.test(
+  "region digests split rows by the HEALPix pixel of their source_id",
+  withDatabases((open) => {
+    const both = open("both");
+    const north = open("north");
+    const south = open("south");
+    const northStars: [string, number][] = [
+      [sourceId(5, 1), 100],
+      [sourceId(5, 2), 200],
+    ];
+    const southStars: [string, number][] = [[sourceId(100, 1), 300]];
+    insertStars(both, [...northStars, ...southStars]);
+    insertStars(north, northStars);
+    insertStars(south, southStars);
+
+    const hash = hashTable(both, "gaiadr3");
+    assertEquals(hash.rows, 3);
+    assertEquals(Object.keys(hash.regions), ["5", "100"]);
+    // A region hashes exactly as a table holding only its rows
+    assertEquals(hash.regions[5], hashTable(north, "gaiadr3").digest);
+    assertEquals(hash.regions[100], hashTable(south, "gaiadr3").digest);
+
+    // At level 0 the two regions are pixels 0 and 6
+    const coarse = hashTable(both, "gaiadr3", 0);
+    assertEquals(coarse.digest, hash.digest);
+    assertEquals(Object.keys(coarse.regions), ["0", "6"]);
+  }),
+);
+
+Deno.test(
+  "insertion order does not change the digests",
+  withDatabases((open) => {
+    const stars: [string, number][] = [
+      [sourceId(5, 1), 100],
+      [sourceId(5, 2), 200],
+      [sourceId(100, 1), 300],
+      [sourceId(191, 7), 400],
+    ];
+    const forward = open("forward");
+    const backward = open("backward");
+    const insert = (db: GaiaDatabase, rows: [string, number][]) => {
+      insertStars(db, rows);
+      const match = db.prepare(
+        "INSERT INTO tmass_xmatch (gaiadr3_source_id, tmass_source_id) VALUES (?, ?)",
+      );
+      for (const [id] of rows) {
+        match.run(id, `2M${id}`);
+      }
+    };
+    insert(forward, stars);
+    insert(backward, stars.toReversed());
+
+    const a = hashContent(forward);
+    const b = hashContent(backward);
+    assertEquals(a.tables, b.tables);
+    assertEquals(compareContentHashes(a, b), []);
+
+    backward.prepare(
+      "UPDATE gaiadr3 SET phot_g_mean_flux = 301 WHERE source_id = ?",
+    ).run(sourceId(100, 1));
+    assertEquals(
+      compareContentHashes(a, hashContent(backward)),
+      [
+        { table: "gaiadr3", reason: "digests differ (4 vs 4 rows)" },
+        { table: "gaiadr3", region: 100, reason: "digests differ" },
+      ],
+    );
+  }),
+);
+
+Deno.test("comparisons name the tables and regions that differ", () => {
+  const table = (digest: string, regions: Record<string, string>) => ({
+    rows: Object.keys(regions).length,
+    digest,
+    regions,
+  });
+  const hash = (tables: ContentHash["tables"], level = 2): ContentHash => ({
+    version: CONTENT_HASH_VERSION,
+    level,
+    computed_at: "2026-01-01T00:00:00.000Z",
+    tables,
+  });
+  const first = hash({
+    gaiadr3: table("g1", { 3: "a", 40: "b" }),
+    tmass: table("t", { 3: "c" }),
+  });
+
+  assertEquals(compareContentHashes(first, first), []);
+  assertEquals(
+    compareContentHashes(
+      first,
+      hash({
+        gaiadr3: table("g2", { 3: "a", 40: "B", 41: "d" }),
+        tmass_xmatch: table("x", {}),
+      }),
+    ),
+    [
+      { table: "gaiadr3", reason: "digests differ (2 vs 3 rows)" },
+      { table: "gaiadr3", region: 40, reason: "digests differ" },
+      {
+        table: "gaiadr3",
+        region: 41,
+        reason: "only in the second database",
+      },
+      { table: "tmass", reason: "only in the first database" },
+      { table: "tmass_xmatch", reason: "only in the second database" },
+    ],
+  );
+
+  const [mismatch] = compareContentHashes(first, hash(first.tables, 3));
+  assertEquals(mismatch.table, "*");
+  assertStringIncludes(mismatch.reason, "level 2 vs version 1, level 3");
+});
+
+Deno.test(
+  "stored digests round-trip and go stale after populate",
+  withDatabases((open) => {
+    const db = open();
+    insertStars(db, [[sourceId(5, 1), 100]]);
+    assertEquals(readContentHash(db), null);
+
+    const hash = hashContent(db);
+    storeContentHash(db, hash);
+    assertEquals(readContentHash(db), hash);
+    assertEquals(isContentHashStale(db, hash), false);
+
+    db.setMetadata("updated_at", "2999-01-01T00:00:00.000Z");
+    assertEquals(isContentHashStale(db, hash), true);
+  }),
+);
@@ -0,0 +1,210 @@
+/**
+ * HEALPix (nested scheme) helpers.
+ *
+ * Gaia DR3 source_ids carry the level-12 HEALPix pixel of the source in
+ * their top bits (`source_id >> 35`), and the bulk-download files are
+ * named after the level-8 pixel range they cover, e.g.
+ * `GaiaSource_000000-003111.csv.gz`.
+ */
+
+import { angularSeparation, type EquatorialPosition } from "./astrometry.ts";
+
+const DEG = Math.PI / 180;
+
+/** HEALPix level of the pixel ranges in Gaia file names */
+export const GAIA_FILE_LEVEL = 8;
+
+/** HEALPix level encoded in Gaia source_ids */
+export const SOURCE_ID_LEVEL = 12;
+
+// Ring and position of the first pixel of each base face
+const JRLL = [2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4];
+const JPLL = [1, 3, 5, 7, 0, 2, 4, 6, 1, 3, 5, 7];
+
+function checkLevel(level: number) {
+  if (!Number.isInteger(level) || level < 0 || level > 13) {
+    throw new Error(`Invalid HEALPix level: ${level}. Must be 0–13.`);
+  }
+}
+
+/**
+ * Interleave the bits of x (even) and y (odd)
+ */
+function interleave(x: number, y: number): number {
+  let result = 0;
+  for (let bit = 0; bit < 14; bit++) {
+    result |= ((x >> bit) & 1) << (2 * bit);
+    result |= ((y >> bit) & 1) << (2 * bit + 1);
+  }
+  return result >>> 0;
+}
+
+function deinterleave(value: number): [number, number] {
+  let x = 0;
+  let y = 0;
+  for (let bit = 0; bit < 14; bit++) {
+    x |= ((value >> (2 * bit)) & 1) << bit;
+    y |= ((value >> (2 * bit + 1)) & 1) << bit;
+  }
+  return [x, y];
+}
+
+/**
+ * Number of pixels over the sky at a level
+ */
+export function pixelCount(level: number): number {
+  checkLevel(level);
+  return 12 * 4 ** level;
+}
+
+/**
+ * Nested pixel index containing a position
+ */
+export function angToPix(level: number, ra: number, dec: number): number {
+  checkLevel(level);
+  const nside = 2 ** level;
+  const z = Math.sin(dec * DEG);
+  const za = Math.abs(z);
+  // Longitude in units of 90°, in [0, 4)
+  const tt = ((((ra % 360) + 360) % 360) / 90) % 4;
+
+  let face: number;
+  let ix: number;
+  let iy: number;
+
+  if (za <= 2 / 3) {
+    // Equatorial region
+    const temp1 = nside * (0.5 + tt);
+    const temp2 = nside * z * 0.75;
+    const jp = Math.floor(temp1 - temp2);
+    const jm = Math.floor(temp1 + temp2);
+    const ifp = Math.floor(jp / nside);
+    const ifm = Math.floor(jm / nside);
+
+    face = ifp === ifm ? (ifp | 4) : ifp < ifm ? ifp : ifm + 8;
+    ix = jm & (nside - 1);
+    iy = nside - (jp & (nside - 1)) - 1;
+  } else {
+    // Polar caps
+    const ntt = Math.min(3, Math.floor(tt));
+    const tp = tt - ntt;
+    const tmp = nside * Math.sqrt(3 * (1 - za));
+    const jp = Math.min(nside - 1, Math.floor(tp * tmp));
+    const jm = Math.min(nside - 1, Math.floor((1 - tp) * tmp));
+
+    if (z >= 0) {
+      face = ntt;
+      ix = nside - jm - 1;
+      iy = nside - jp - 1;
+    } else {
+      face = ntt + 8;
+      ix = jp;
+      iy = jm;
+    }
+  }
+
+  return face * nside * nside + interleave(ix, iy);
+}
+
+/**
+ * Centre of a nested pixel
+ */
+export function pixToAng(level: number, pixel: number): EquatorialPosition {
+  checkLevel(level);
+  const nside = 2 ** level;
+  const npface = nside * nside;
+
+  if (!Number.isInteger(pixel) || pixel < 0 || pixel >= 12 * npface) {
+    throw new Error(`Invalid HEALPix pixel ${pixel} at level ${level}`);
+  }
+
+  const face = Math.floor(pixel / npface);
+  const [ix, iy] = deinterleave(pixel % npface);
+  const jr = JRLL[face] * nside - ix - iy - 1;
+
+  let nr: number;
+  let z: number;
+  let kshift = 0;
+
+  if (jr < nside) {
+    nr = jr;
+    z = 1 - (nr * nr) / (3 * npface);
+  } else if (jr > 3 * nside) {
+    nr = 4 * nside - jr;
+    z = (nr * nr) / (3 * npface) - 1;
+  } else {
+    nr = nside;
+    z = ((2 * nside - jr) * 2) / (3 * nside);
+    kshift = (jr - nside) & 1;
+  }
+
+  let jp = Math.floor((JPLL[face] * nr + ix - iy + 1 + kshift) / 2);
+  if (jp > 4 * nside) jp -= 4 * nside;
+  if (jp < 1) jp += 4 * nside;
+
+  const phi = (jp - (kshift + 1) * 0.5) * (Math.PI / 2 / nr);
+
+  return { ra: phi / DEG, dec: Math.asin(z) / DEG };
+}
+
+/**
+ * Upper bound on the distance from a pixel's centre to any point in it,
+ * in degrees
+ */
+export function maxPixelRadius(level: number): number {
+  checkLevel(level);
+  // 1.5× the mean pixel size comfortably covers the most distorted pixels
+  return (1.5 * Math.sqrt(Math.PI / 3)) / 2 ** level / DEG;
+}
+
+/**
+ * HEALPix pixel of a Gaia source at `level` (default 12), from its source_id
+ */
+export function healpixFromSourceId(
+  sourceId: string | number | bigint,
+  level = SOURCE_ID_LEVEL,
+): number {
+  checkLevel(level);
+  if (level > SOURCE_ID_LEVEL) {
+    throw new Error(`source_ids only encode HEALPix down to level 12`);
+  }
+  const shift = 35n + 2n * BigInt(SOURCE_ID_LEVEL - level);
+  return Number(BigInt(sourceId) >> shift);
+}
+
+/**
+ * Level-8 pixel range covered by a Gaia bulk-download file, from a name
+ * like `GaiaSource_000000-003111.csv.gz`. Returns null when the name has
+ * no range.
+ */
+export function parseHealpixRange(name: string): [number, number] | null {
+  const match = name.match(/_(\d{6})-(\d{6})\.[^/]*$/);
+  if (!match) {
+    return null;
+  }
+  return [Number(match[1]), Number(match[2])];
+}
+
+/**
+ * Whether a cone may overlap any pixel in [start, end] at `level`.
+ * Conservative: may report overlap for pixels just outside the cone.
+ */
+export function coneIntersectsPixels(
+  cone: { ra: number; dec: number; radius: number },
+  level: number,
+  start: number,
+  end: number,
+): boolean {
+  const reach = cone.radius + maxPixelRadius(level);
+  if (reach >= 180) {
+    return true;
+  }
+
+  for (let pixel = start; pixel <= end; pixel++) {
+    if (angularSeparation(cone, pixToAng(level, pixel)) <= reach) {
+      return true;
+    }
+  }
+
+  return false;
+}
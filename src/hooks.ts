@@ -0,0 +1,218 @@
+/**
+ * Run hooks: tell someone how a long populate is going. Each event is sent
+ * as a JSON summary to a webhook (HTTP POST) and/or piped to a local
+ * command's stdin. Delivery is retried, and a hook that still fails is
+ * logged but never fails the run.
+ */
+
+import type { PopulateStats } from "./coordinator.ts";
+import type { Logger } from "./types.ts";
+
+export type HookEvent =
+  | "run_start"
+  | "stage_complete"
+  | "failure_threshold"
+  | "run_end";
+
+export interface HookPayload {
+  event: HookEvent;
+  /** Same for every event of one run */
+  run_id: string;
+  timestamp: string;
+  host: string;
+  database: string;
+  /** populate stage: gaia, tmass-xmatch or tmass */
+  stage?: string;
+  stats?: PopulateStats;
+  /** Stats of each finished stage, on run_end */
+  stages?: Record<string, PopulateStats>;
+  status?: "success" | "failed";
+  error?: string;
+}
+
+export interface RunHooksOptions {
+  /** Webhook to POST each event to */
+  url?: string;
+  /** Shell command run for each event, with the JSON on stdin */
+  command?: string;
+  /** Retries after a failed delivery. @default 3 */
+  retries?: number;
+  /** First retry delay in ms, doubled for each retry. @default 1000 */
+  retryDelay?: number;
+  /** Time allowed for each attempt in ms. @default 10000 */
+  timeout?: number;
+  /**
+   * Send failure_threshold each time a stage's failed files reach another
+   * multiple of this. @default 10
+   */
+  failureThreshold?: number;
+  /** Database path reported in each payload */
+  database: string;
+}
+
+const RETRYABLE_STATUS = [408, 429, 500, 502, 503, 504];
+
+export class RunHooks {
+  private options: Required<Omit<RunHooksOptions, "url" | "command">> & {
+    url?: string;
+    command?: string;
+  };
+  private logger: Logger;
+  private runId = crypto.randomUUID();
+  private host = hostname();
+  /** Failure multiples already notified, per stage */
+  private notifiedFailures = new Map<string, number>();
+
+  constructor(options: RunHooksOptions, logger: Logger) {
+    this.options = {
+      ...options,
+      retries: options.retries ?? 3,
+      retryDelay: options.retryDelay ?? 1000,
+      timeout: options.timeout ?? 10000,
+      failureThreshold: options.failureThreshold ?? 10,
+    };
+    this.logger = logger;
+  }
+
+  get enabled(): boolean {
+    return Boolean(this.options.url || this.options.command);
+  }
+
+  /**
+   * Deliver an event to every configured hook
+   */
+  async notify(
+    event: HookEvent,
+    details: Omit<
+      HookPayload,
+      "event" | "run_id" | "timestamp" | "host" | "database"
+    > = {},
+  ): Promise<void> {
+    if (!this.enabled) {
+      return;
+    }
+
+    const payload: HookPayload = {
+      event,
+      run_id: this.runId,
+      timestamp: new Date().toISOString(),
+      host: this.host,
+      database: this.options.database,
+      ...details,
+    };
+    const body = JSON.stringify(payload);
+
+    const deliveries: Promise<void>[] = [];
+    if (this.options.url) {
+      deliveries.push(this.deliver("webhook", () => this.post(body)));
+    }
+    if (this.options.command) {
+      deliveries.push(this.deliver("command", () => this.run(body, event)));
+    }
+    await Promise.all(deliveries);
+  }
+
+  /**
+   * Send failure_threshold if a stage's failures have reached the next
+   * multiple of the threshold
+   */
+  async checkFailures(stage: string, stats: PopulateStats): Promise<void> {
+    const threshold = this.options.failureThreshold;
+    if (!this.enabled || threshold <= 0) {
+      return;
+    }
+
+    const multiple = Math.floor(stats.failedFiles / threshold);
+    if (multiple > (this.notifiedFailures.get(stage) ?? 0)) {
+      this.notifiedFailures.set(stage, multiple);
+      await this.notify("failure_threshold", { stage, stats: { ...stats } });
+    }
+  }
+
+  /**
+   * Try a delivery until it succeeds or runs out of retries
+   */
+  private async deliver(
+    name: string,
+    attempt: () => Promise<void>,
+  ): Promise<void> {
+    for (let retry = 0;; retry++) {
+      try {
+        await attempt();
+        return;
+      } catch (error) {
+        const message = error instanceof Error ? error.message : String(error);
+        if (
+          error instanceof PermanentHookError || retry >= this.options.retries
+        ) {
+          this.logger.warn(
+            `Hook ${name} failed after ${retry + 1} attempt(s): ${message}`,
+          );
+          return;
+        }
+
+        const delay = this.options.retryDelay * 2 ** retry;
+        this.logger.debug(
+          `Hook ${name} failed (${message}), retrying in ${delay}ms`,
+        );
+        await new Promise((resolve) => setTimeout(resolve, delay));
+      }
+    }
+  }
+
+  private async post(body: string): Promise<void> {
+    const response = await fetch(this.options.url!, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body,
+      signal: AbortSignal.timeout(this.options.timeout),
+    });
+    await response.body?.cancel();
+
+    if (!response.ok) {
+      const message = `HTTP ${response.status} from ${this.options.url}`;
+      throw RETRYABLE_STATUS.includes(response.status)
+        ? new Error(message)
+        : new PermanentHookError(message);
+    }
+  }
+
+  private async run(body: string, event: HookEvent): Promise<void> {
+    const shell = Deno.build.os === "windows" ? ["cmd", "/c"] : ["sh", "-c"];
+    const child = new Deno.Command(shell[0], {
+      args: [shell[1], this.options.command!],
+      stdin: "piped",
+      stdout: "inherit",
+      stderr: "inherit",
+      env: { GAIAOFFLINE_EVENT: event, GAIAOFFLINE_RUN_ID: this.runId },
+      signal: AbortSignal.timeout(this.options.timeout),
+    }).spawn();
+
+    const writer = child.stdin.getWriter();
+    try {
+      await writer.write(new TextEncoder().encode(body + "\n"));
+      await writer.close();
+    } catch {
+      // The command need not read its input
+    }
+
+    const { code } = await child.status;
+    if (code !== 0) {
+      throw new Error(`command exited with code ${code}`);
+    }
+  }
+}
+
+/**
+ * A failure that retrying won't fix, e.g. a 404 from the webhook
+ */
+class PermanentHookError extends Error {}
+
+function hostname(): string {
+  try {
+    return Deno.hostname();
+  } catch {
+    // Needs --allow-sys
+    return "unknown";
+  }
+}
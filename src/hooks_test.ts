@@ -0,0 +1,275 @@
+import {
+  assert,
+  assertEquals,
+  assertGreaterOrEqual,
+  assertMatch,
+  assertStringIncludes,
+} from "@std/assert";
+import type { PopulateStats } from "./coordinator.ts";
+import { type HookPayload, RunHooks } from "./hooks.ts";
+import type { Logger } from "./types.ts";
+
+/**
+ * A logger that keeps its warnings for the test to check
+ */
+function recordingLogger(): Logger & { warnings: string[] } {
+  const warnings: string[] = [];
+  return {
+    warnings,
+    error: () => {},
+    warn: (...args) => warnings.push(args.join(" ")),
+    info: () => {},
+    debug: () => {},
+  };
+}
+
+interface Received {
+  payload: HookPayload;
+  contentType: string | null;
+  at: number;
+}
+
+/**
+ * A local webhook receiver that answers with each status in turn, then
+ * 200
+ */
+function startReceiver(statuses: number[] = []) {
+  const received: Received[] = [];
+  const server = Deno.serve(
+    { hostname: "127.0.0.1", port: 0, onListen: () => {} },
+    async (request) => {
+      received.push({
+        payload: await request.json(),
+        contentType: request.headers.get("content-type"),
+        at: Date.now(),
+      });
+      return new Response(null, { status: statuses.shift() ?? 200 });
+    },
+  );
+  return {
+    url: `http://127.0.0.1:${server.addr.port}/hook`,
+    received,
+    close: () => server.shutdown(),
+  };
+}
+
+const stats: PopulateStats = {
+  totalFiles: 10,
+  completedFiles: 8,
+  failedFiles: 2,
+  totalRecords: 1000,
+  duration: 1234,
+};
+
+Deno.test("webhook payloads carry the run and the event details", async () => {
+  const receiver = startReceiver();
+  try {
+    const hooks = new RunHooks({
+      url: receiver.url,
+      database: "/data/gaia.db",
+    }, recordingLogger());
+    await hooks.notify("run_start", { stage: "all" });
+    await hooks.notify("stage_complete", { stage: "gaia", stats });
+    await hooks.notify("run_end", {
+      stage: "all",
+      status: "success",
+      stages: { gaia: stats },
+    });
+
+    assertEquals(receiver.received.length, 3);
+    const [start, stage, end] = receiver.received.map((r) => r.payload);
+    assertEquals(receiver.received[0].contentType, "application/json");
+    assertEquals(start.event, "run_start");
+    assertEquals(start.stage, "all");
+    assertEquals(start.database, "/data/gaia.db");
+    assertMatch(start.run_id, /^[0-9a-f-]{36}$/);
+    assert(!Number.isNaN(Date.parse(start.timestamp)));
+    assertEquals(typeof start.host, "string");
+
+    assertEquals(stage.event, "stage_complete");
+    assertEquals(stage.stats, stats);
+    assertEquals(end.status, "success");
+    assertEquals(end.stages, { gaia: stats });
+    // One run, one id
+    assertEquals(new Set([start, stage, end].map((p) => p.run_id)).size, 1);
+  } finally {
+    await receiver.close();
+  }
+});
+
+Deno.test("5xx responses are retried with backoff", async () => {
+  const receiver = startReceiver([503, 500, 502]);
+  const logger = recordingLogger();
+  try {
+    const hooks = new RunHooks({
+      url: receiver.url,
+      database: "gaia.db",
+      retries: 3,
+      retryDelay: 50,
+    }, logger);
+    await hooks.notify("run_start");
+
+    assertEquals(receiver.received.length, 4);
+    const gaps = receiver.received.slice(1).map((r, i) =>
+      r.at - receiver.received[i].at
+    );
+    // 50, 100 and 200ms, less a little for timer granularity
+    assertGreaterOrEqual(gaps[0], 45);
+    assertGreaterOrEqual(gaps[1], 95);
+    assertGreaterOrEqual(gaps[2], 195);
+    assertEquals(logger.warnings, []);
+  } finally {
+    await receiver.close();
+  }
+});
+
+Deno.test("a hook that keeps failing is logged, not thrown", async () => {
+  const receiver = startReceiver([500, 500, 500]);
+  const logger = recordingLogger();
+  try {
+    const hooks = new RunHooks({
+      url: receiver.url,
+      database: "gaia.db",
+      retries: 2,
+      retryDelay: 1,
+    }, logger);
+    await hooks.notify("run_end", { status: "failed", error: "boom" });
+
+    assertEquals(receiver.received.length, 3);
+    assertEquals(logger.warnings.length, 1);
+    assertStringIncludes(logger.warnings[0], "after 3 attempt(s)");
+    assertStringIncludes(logger.warnings[0], "HTTP 500");
+  } finally {
+    await receiver.close();
+  }
+});
+
+Deno.test("4xx responses are not retried", async () => {
+  const receiver = startReceiver([404]);
+  const logger = recordingLogger();
+  try {
+    const hooks = new RunHooks({
+      url: receiver.url,
+      database: "gaia.db",
+      retryDelay: 1,
+    }, logger);
+    await hooks.notify("run_start");
+
+    assertEquals(receiver.received.length, 1);
+    assertStringIncludes(logger.warnings[0], "after 1 attempt(s)");
+    assertStringIncludes(logger.warnings[0], "HTTP 404");
+  } finally {
+    await receiver.close();
+  }
+});
+
+Deno.test("429 is retried like a server error", async () => {
+  const receiver = startReceiver([429]);
+  try {
+    const hooks = new RunHooks({
+      url: receiver.url,
+      database: "gaia.db",
+      retryDelay: 1,
+    }, recordingLogger());
+    await hooks.notify("run_start");
+    assertEquals(receiver.received.length, 2);
+  } finally {
+    await receiver.close();
+  }
+});
+
+Deno.test({
+  name: "command hooks get the payload on stdin and the event in env",
+  ignore: Deno.build.os === "windows",
+  fn: async () => {
+    const dir = Deno.makeTempDirSync();
+    try {
+      const hooks = new RunHooks({
+        command:
+          `cat > "${dir}/$GAIAOFFLINE_EVENT.json"; echo "$GAIAOFFLINE_RUN_ID" > "${dir}/run_id"`,
+        database: "gaia.db",
+      }, recordingLogger());
+      await hooks.notify("stage_complete", { stage: "tmass", stats });
+
+      const payload: HookPayload = JSON.parse(
+        Deno.readTextFileSync(`${dir}/stage_complete.json`),
+      );
+      assertEquals(payload.event, "stage_complete");
+      assertEquals(payload.stage, "tmass");
+      assertEquals(payload.stats, stats);
+      assertEquals(
+        Deno.readTextFileSync(`${dir}/run_id`).trim(),
+        payload.run_id,
+      );
+    } finally {
+      Deno.removeSync(dir, { recursive: true });
+    }
+  },
+});
+
+Deno.test({
+  name: "a command's non-zero exit status is retried, then logged",
+  ignore: Deno.build.os === "windows",
+  fn: async () => {
+    const dir = Deno.makeTempDirSync();
+    const logger = recordingLogger();
+    try {
+      // Fails twice, then succeeds
+      const hooks = new RunHooks({
+        command: `echo x >> "${dir}/attempts"; ` +
+          `[ $(wc -l < "${dir}/attempts") -ge 3 ]`,
+        database: "gaia.db",
+        retryDelay: 1,
+      }, logger);
+      await hooks.notify("run_start");
+      assertEquals(
+        Deno.readTextFileSync(`${dir}/attempts`).trim().split("\n").length,
+        3,
+      );
+      assertEquals(logger.warnings, []);
+
+      const failing = new RunHooks({
+        command: "exit 7",
+        database: "gaia.db",
+        retries: 1,
+        retryDelay: 1,
+      }, logger);
+      await failing.notify("run_start");
+      assertEquals(logger.warnings.length, 1);
+      assertStringIncludes(logger.warnings[0], "command exited with code 7");
+      assertStringIncludes(logger.warnings[0], "after 2 attempt(s)");
+    } finally {
+      Deno.removeSync(dir, { recursive: true });
+    }
+  },
+});
+
+Deno.test("failure_threshold is sent once per multiple", async () => {
+  const receiver = startReceiver();
+  try {
+    const hooks = new RunHooks({
+      url: receiver.url,
+      database: "gaia.db",
+      failureThreshold: 5,
+    }, recordingLogger());
+    for (const failedFiles of [1, 4, 5, 6, 9, 10, 12]) {
+      await hooks.checkFailures("gaia", { ...stats, failedFiles });
+    }
+
+    assertEquals(
+      receiver.received.map((r) => [
+        r.payload.event,
+        r.payload.stats?.failedFiles,
+      ]),
+      [["failure_threshold", 5], ["failure_threshold", 10]],
+    );
+  } finally {
+    await receiver.close();
+  }
+});
+
+Deno.test("no hooks, no deliveries", async () => {
+  const hooks = new RunHooks({ database: "gaia.db" }, recordingLogger());
+  assertEquals(hooks.enabled, false);
+  await hooks.notify("run_start");
+});
@@ -0,0 +1,228 @@
+/**
+ * HTTP client for downloads: proxies (with credentials and NO_PROXY), extra
+ * CA bundles, client certificates and timeouts.
+ *
+ * Without any of these options requests go through the global fetch, which
+ * already honours HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+ */
+
+import type { CLIConfig } from "./config.ts";
+
+export type NetworkOptions = Pick<
+  CLIConfig,
+  | "proxy"
+  | "noProxy"
+  | "caCerts"
+  | "clientCert"
+  | "clientKey"
+  | "connectTimeout"
+  | "readTimeout"
+>;
+
+/**
+ * Thrown when a connection or a stalled response body times out. The
+ * message contains "timeout", so the downloader treats it as retryable.
+ */
+export class HttpTimeoutError extends Error {}
+
+export class HttpClient {
+  private options: NetworkOptions;
+  /** Goes through options.proxy, or null to use the global fetch */
+  private proxied: Deno.HttpClient | null = null;
+  /** For hosts in NO_PROXY, when a proxy is set explicitly */
+  private direct: Deno.HttpClient | null = null;
+  private noProxy: string[];
+
+  constructor(options: NetworkOptions = {}) {
+    this.options = options;
+    this.noProxy = parseNoProxy(
+      options.noProxy ?? Deno.env.get("NO_PROXY") ?? Deno.env.get("no_proxy"),
+    );
+
+    const tls = loadTls(options);
+    if (options.proxy) {
+      this.proxied = createClient({
+        ...tls,
+        proxy: parseProxy(options.proxy),
+      });
+      this.direct = createClient(tls);
+    } else if (Object.keys(tls).length > 0) {
+      // Environment proxies still apply to custom clients
+      this.proxied = createClient(tls);
+    }
+  }
+
+  /**
+   * fetch through the configured proxy, CAs and certificate. The connect
+   * timeout runs until the response headers arrive, covering the proxy,
+   * TCP and TLS handshakes; the read timeout is the longest the body may
+   * stall between chunks.
+   */
+  async fetch(url: string | URL, init: RequestInit = {}): Promise<Response> {
+    const client = this.direct && this.bypassesProxy(new URL(url))
+      ? this.direct
+      : this.proxied;
+
+    const controller = new AbortController();
+    const signal = init.signal
+      ? AbortSignal.any([init.signal, controller.signal])
+      : controller.signal;
+    const abortAfter = (ms: number | undefined, message: string) =>
+      ms
+        ? setTimeout(() => controller.abort(new HttpTimeoutError(message)), ms)
+        : undefined;
+
+    const connectTimer = abortAfter(
+      this.options.connectTimeout,
+      `Connection timeout after ${this.options.connectTimeout}ms for ${url}`,
+    );
+    let response: Response;
+    try {
+      response = await fetch(url, {
+        ...init,
+        signal,
+        ...(client ? { client } : {}),
+      } as RequestInit);
+    } catch (error) {
+      throw signal.reason instanceof HttpTimeoutError ? signal.reason : error;
+    } finally {
+      clearTimeout(connectTimer);
+    }
+
+    const readTimeout = this.options.readTimeout;
+    if (!readTimeout || !response.body) {
+      return response;
+    }
+
+    // Restart the read timer on every chunk
+    let readTimer: number | undefined;
+    const restart = () => {
+      clearTimeout(readTimer);
+      readTimer = abortAfter(
+        readTimeout,
+        `Read timeout: no data for ${readTimeout}ms from ${url}`,
+      );
+    };
+    restart();
+    const body = response.body.pipeThrough(
+      new TransformStream<Uint8Array, Uint8Array>({
+        transform(chunk, output) {
+          restart();
+          output.enqueue(chunk);
+        },
+        flush() {
+          clearTimeout(readTimer);
+        },
+      }),
+    );
+    signal.addEventListener("abort", () => clearTimeout(readTimer));
+
+    return new Response(body, {
+      status: response.status,
+      statusText: response.statusText,
+      headers: response.headers,
+    });
+  }
+
+  /**
+   * Whether NO_PROXY lists the host: `*`, an exact host or IP, or a domain
+   * matching itself and its subdomains (with or without a leading dot),
+   * each optionally with a port
+   */
+  bypassesProxy(url: URL): boolean {
+    const host = url.hostname.replace(/^\[|\]$/g, "").toLowerCase();
+    const port = url.port || DEFAULT_PORTS[url.protocol] || "";
+
+    return this.noProxy.some((entry) => {
+      if (entry === "*") {
+        return true;
+      }
+      const match = entry.match(/^\[?([^\]]*?)\]?(?::(\d+))?$/)!;
+      const [, pattern, entryPort] = match;
+      if (entryPort && entryPort !== port) {
+        return false;
+      }
+      const domain = pattern.replace(/^\*?\./, "");
+      return host === domain || host.endsWith(`.${domain}`);
+    });
+  }
+
+  close(): void {
+    this.proxied?.close();
+    this.direct?.close();
+  }
+}
+
+const DEFAULT_PORTS: Record<string, string> = {
+  "http:": "80",
+  "https:": "443",
+};
+
+function parseNoProxy(value: string | undefined): string[] {
+  return (value ?? "").split(",")
+    .map((entry) => entry.trim().toLowerCase())
+    .filter(Boolean);
+}
+
+/**
+ * Deno's proxy option, with credentials in the URL moved to basicAuth
+ */
+function parseProxy(value: string): Deno.Proxy {
+  let url: URL;
+  try {
+    url = new URL(value.includes("://") ? value : `http://${value}`);
+  } catch {
+    throw new Error(`Invalid proxy URL: ${value}`);
+  }
+
+  const { username, password } = url;
+  url.username = "";
+  url.password = "";
+
+  const proxy: Deno.Proxy = { url: url.href.replace(/\/$/, "") };
+  if (username) {
+    proxy.basicAuth = {
+      username: decodeURIComponent(username),
+      password: decodeURIComponent(password),
+    };
+  }
+  return proxy;
+}
+
+function loadTls(
+  options: NetworkOptions,
+): Pick<Deno.CreateHttpClientOptions, "caCerts" | "cert" | "key"> {
+  if (Boolean(options.clientCert) !== Boolean(options.clientKey)) {
+    throw new Error("--client-cert and --client-key must be given together");
+  }
+
+  const read = (path: string, what: string) => {
+    try {
+      return Deno.readTextFileSync(path);
+    } catch (error) {
+      const message = error instanceof Error ? error.message : String(error);
+      throw new Error(`Failed to read ${what} ${path}: ${message}`);
+    }
+  };
+
+  const tls: Pick<Deno.CreateHttpClientOptions, "caCerts" | "cert" | "key"> =
+    {};
+  if (options.caCerts?.length) {
+    // Added to the system and bundled roots, not replacing them
+    tls.caCerts = options.caCerts.map((path) => read(path, "CA bundle"));
+  }
+  if (options.clientCert) {
+    tls.cert = read(options.clientCert, "client certificate");
+    tls.key = read(options.clientKey!, "client key");
+  }
+  return tls;
+}
+
+function createClient(options: Deno.CreateHttpClientOptions): Deno.HttpClient {
+  if (typeof Deno.createHttpClient !== "function") {
+    throw new Error(
+      "Proxy and certificate options need Deno.createHttpClient (Deno 2 or --unstable-net)",
+    );
+  }
+  return Deno.createHttpClient(options);
+}
@@ -0,0 +1,229 @@
+/**
+ * Secondary indexes: the standard set built after populating, and the
+ * checks that find indexes another index or a primary key already covers.
+ *
+ * An index on columns (a) is covered by one on (a, b), since SQLite can use
+ * the longer index for lookups on its leading columns. The covering index
+ * is bigger, so a query on `a` alone reads slightly more pages, but the
+ * space and insert time saved matter more for a catalogue this size.
+ */
+
+import type { Database } from "@db/sqlite";
+
+export interface IndexDefinition {
+  name: string;
+  table: string;
+  columns: string[];
+}
+
+/**
+ * Indexes built after populating. Primary keys already have an index, and
+ * idx_ra_dec serves lookups on ra alone, so neither gets one of its own.
+ */
+export const STANDARD_INDEXES: IndexDefinition[] = [
+  { name: "idx_dec", table: "gaiadr3", columns: ["dec"] },
+  { name: "idx_ra_dec", table: "gaiadr3", columns: ["ra", "dec"] },
+  {
+    name: "idx_phot_g_mean_flux",
+    table: "gaiadr3",
+    columns: ["phot_g_mean_flux"],
+  },
+  { name: "idx_pm", table: "gaiadr3", columns: ["pm"] },
+  {
+    name: "idx_tmass_xmatch_tmass",
+    table: "tmass_xmatch",
+    columns: ["tmass_source_id"],
+  },
+  { name: "idx_tmass_tmass", table: "tmass", columns: ["tmass_source_id"] },
+];
+
+export interface IndexInfo extends IndexDefinition {
+  unique: boolean;
+  /**
+   * `c` for CREATE INDEX, `u` for a UNIQUE constraint, `pk` for a primary
+   * key. Only `c` indexes can be dropped.
+   */
+  origin: "c" | "u" | "pk";
+  /** Whether the index has a WHERE clause */
+  partial: boolean;
+}
+
+export interface RedundantIndex {
+  index: IndexInfo;
+  /** The index or primary key that covers it */
+  coveredBy: string;
+  reason: string;
+}
+
+/**
+ * Every index of every table. Columns of expression indexes are listed as
+ * `<expr>`.
+ */
+export function listIndexes(db: Database): IndexInfo[] {
+  const tables = db.prepare(
+    `SELECT name FROM sqlite_master
+     WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`,
+  ).all<{ name: string }>();
+
+  return tables.flatMap(({ name: table }) =>
+    db.prepare(`PRAGMA index_list(${table})`)
+      .all<{ name: string; unique: number; origin: string; partial: number }>()
+      .map((index) => ({
+        name: index.name,
+        table,
+        columns: db.prepare(`PRAGMA index_info(${index.name})`)
+          .all<{ seqno: number; name: string | null }>()
+          .sort((a, b) => a.seqno - b.seqno)
+          .map((column) => column.name ?? "<expr>"),
+        unique: index.unique === 1,
+        origin: index.origin as IndexInfo["origin"],
+        partial: index.partial === 1,
+      }))
+      .sort((a, b) => a.name.localeCompare(b.name))
+  );
+}
+
+/**
+ * Indexes that can be dropped without losing a lookup: those on an INTEGER
+ * PRIMARY KEY (the rowid), those whose columns lead another index, and the
+ * second of two identical indexes, keeping a standard one or else the
+ * earlier name. A unique index is only covered by a unique index on the
+ * same columns, since it also enforces uniqueness.
+ * Partial and expression indexes are never reported.
+ */
+export function findRedundantIndexes(
+  db: Database,
+  indexes: IndexInfo[] = listIndexes(db),
+): RedundantIndex[] {
+  const redundant: RedundantIndex[] = [];
+
+  for (const index of indexes) {
+    if (
+      index.origin !== "c" || index.partial || index.columns.includes("<expr>")
+    ) {
+      continue;
+    }
+
+    const rowid = integerPrimaryKey(db, index.table);
+    if (rowid !== null && index.columns[0] === rowid) {
+      redundant.push({
+        index,
+        coveredBy: "rowid",
+        reason: `${rowid} is the INTEGER PRIMARY KEY of ${index.table}`,
+      });
+      continue;
+    }
+
+    let cover = coverOf(index, indexes);
+    // Name an index that stays when the one covering this goes too
+    for (
+      let next = cover && coverOf(cover, indexes);
+      next;
+      next = coverOf(next, indexes)
+    ) {
+      cover = next;
+    }
+    if (cover) {
+      redundant.push({
+        index,
+        coveredBy: cover.name,
+        reason: cover.columns.length === index.columns.length
+          ? `same columns as ${describeIndex(cover)}`
+          : `${describeIndex(cover)} starts with (${index.columns.join(", ")})`,
+      });
+    }
+  }
+
+  return redundant;
+}
+
+/**
+ * An index that serves every lookup `index` does
+ */
+function coverOf(
+  index: IndexInfo,
+  indexes: IndexInfo[],
+): IndexInfo | undefined {
+  if (index.origin !== "c") {
+    return undefined;
+  }
+  return indexes.find((other) =>
+    other !== index &&
+    other.table === index.table &&
+    !other.partial &&
+    leads(index.columns, other.columns) &&
+    (index.unique
+      ? other.unique && other.columns.length === index.columns.length
+      : true) &&
+    (other.columns.length > index.columns.length ||
+      other.unique !== index.unique ||
+      keepsOver(other, index))
+  );
+}
+
+/**
+ * Standard indexes not yet in the database, leaving out those whose table
+ * or columns do not exist
+ */
+export function missingIndexes(db: Database): IndexDefinition[] {
+  const existing = new Set(listIndexes(db).map((index) => index.name));
+  return STANDARD_INDEXES.filter((index) => {
+    if (existing.has(index.name)) {
+      return false;
+    }
+    const columns = db.prepare(`PRAGMA table_info(${index.table})`)
+      .all<{ name: string }>()
+      .map((column) => column.name);
+    return index.columns.every((column) => columns.includes(column));
+  });
+}
+
+export function createIndexSql(index: IndexDefinition): string {
+  return `CREATE INDEX IF NOT EXISTS ${index.name} ON ${index.table}(${
+    index.columns.join(", ")
+  })`;
+}
+
+function describeIndex(index: IndexInfo): string {
+  return index.origin === "pk"
+    ? `the primary key of ${index.table}`
+    : index.origin === "u"
+    ? `the UNIQUE constraint ${index.name}`
+    : index.name;
+}
+
+/**
+ * Of two identical indexes, whether to keep `other` rather than `index`:
+ * a constraint's index first, then a standard one, then the earlier name
+ */
+function keepsOver(other: IndexInfo, index: IndexInfo): boolean {
+  if (other.origin !== "c") {
+    return true;
+  }
+  const standard = (name: string) =>
+    STANDARD_INDEXES.some((definition) => definition.name === name);
+  if (standard(other.name) !== standard(index.name)) {
+    return standard(other.name);
+  }
+  return other.name < index.name;
+}
+
+/**
+ * Whether `columns` are the leading columns of `other`
+ */
+function leads(columns: string[], other: string[]): boolean {
+  return columns.length <= other.length &&
+    columns.every((column, i) => other[i] === column);
+}
+
+/**
+ * The table's rowid alias, if it has one
+ */
+function integerPrimaryKey(db: Database, table: string): string | null {
+  const keys = db.prepare(`PRAGMA table_info(${table})`)
+    .all<{ name: string; type: string; pk: number }>()
+    .filter((column) => column.pk > 0);
+  return keys.length === 1 && keys[0].type.toUpperCase() === "INTEGER"
+    ? keys[0].name
+    : null;
+}
@@ -0,0 +1,161 @@
+import { assertEquals } from "@std/assert";
+import { Database } from "@db/sqlite";
+import {
+  createIndexSql,
+  findRedundantIndexes,
+  listIndexes,
+  missingIndexes,
+} from "./indexes.ts";
+
+/**
+ * Run `sql` in a fresh in-memory database and map each redundant index to
+ * what covers it and why
+ */
+function redundant(sql: string): Record<string, [string, string]> {
+  const db = new Database(":memory:");
+  try {
+    db.exec(sql);
+    return Object.fromEntries(
+      findRedundantIndexes(db).map(({ index, coveredBy, reason }) => [
+        index.name,
+        [coveredBy, reason],
+      ]),
+    );
+  } finally {
+    db.close();
+  }
+}
+
+Deno.test("an index is covered by one its columns lead", () => {
+  assertEquals(
+    redundant(`
+      CREATE TABLE t (a, b, c);
+      CREATE INDEX idx_a ON t(a);
+      CREATE INDEX idx_ab ON t(a, b);
+      CREATE INDEX idx_abc ON t(a, b, c);
+      CREATE INDEX idx_b ON t(b);
+      CREATE INDEX idx_ac ON t(a, c);
+    `),
+    {
+      // The cover named is the one that stays
+      idx_a: ["idx_abc", "idx_abc starts with (a)"],
+      idx_ab: ["idx_abc", "idx_abc starts with (a, b)"],
+    },
+  );
+
+  // Only within a table
+  assertEquals(
+    redundant(`
+      CREATE TABLE t (a); CREATE TABLE u (a, b);
+      CREATE INDEX idx_t ON t(a);
+      CREATE INDEX idx_u ON u(a, b);
+    `),
+    {},
+  );
+});
+
+Deno.test("of identical indexes, one is kept", () => {
+  assertEquals(
+    redundant(`
+      CREATE TABLE t (a);
+      CREATE INDEX by_a_2 ON t(a);
+      CREATE INDEX by_a_1 ON t(a);
+    `),
+    { by_a_2: ["by_a_1", "same columns as by_a_1"] },
+  );
+
+  // A standard index is kept over an earlier name
+  assertEquals(
+    redundant(`
+      CREATE TABLE gaiadr3 (source_id TEXT PRIMARY KEY, ra, dec);
+      CREATE INDEX idx_dec ON gaiadr3(dec);
+      CREATE INDEX aaa_dec ON gaiadr3(dec);
+    `),
+    { aaa_dec: ["idx_dec", "same columns as idx_dec"] },
+  );
+});
+
+Deno.test("a unique index is only covered by an identical unique one", () => {
+  assertEquals(
+    redundant(`
+      CREATE TABLE t (a, b, c, d);
+      CREATE INDEX plain_a ON t(a);
+      CREATE UNIQUE INDEX unique_a ON t(a);
+      CREATE UNIQUE INDEX unique_b ON t(b);
+      CREATE INDEX plain_bc ON t(b, c);
+      CREATE UNIQUE INDEX unique_c ON t(c);
+      CREATE UNIQUE INDEX unique_cd ON t(c, d);
+      CREATE INDEX plain_d ON t(d);
+      CREATE UNIQUE INDEX unique_d_2 ON t(d);
+      CREATE UNIQUE INDEX unique_d_1 ON t(d);
+    `),
+    {
+      plain_a: ["unique_a", "same columns as unique_a"],
+      plain_d: ["unique_d_1", "same columns as unique_d_1"],
+      unique_d_2: ["unique_d_1", "same columns as unique_d_1"],
+    },
+  );
+});
+
+Deno.test("keys and constraints cover indexes but are never dropped", () => {
+  assertEquals(
+    redundant(`
+      CREATE TABLE t (k TEXT PRIMARY KEY, u TEXT UNIQUE, v);
+      CREATE INDEX idx_k ON t(k);
+      CREATE INDEX idx_u ON t(u);
+      CREATE TABLE r (id INTEGER PRIMARY KEY, x);
+      CREATE INDEX idx_id_x ON r(id, x);
+      CREATE INDEX idx_x ON r(x);
+    `),
+    {
+      idx_id_x: ["rowid", "id is the INTEGER PRIMARY KEY of r"],
+      idx_k: ["sqlite_autoindex_t_1", "same columns as the primary key of t"],
+      idx_u: [
+        "sqlite_autoindex_t_2",
+        "same columns as the UNIQUE constraint sqlite_autoindex_t_2",
+      ],
+    },
+  );
+});
+
+Deno.test("partial and expression indexes are left alone", () => {
+  assertEquals(
+    redundant(`
+      CREATE TABLE t (a, b);
+      CREATE INDEX full_a ON t(a);
+      CREATE INDEX some_a ON t(a) WHERE a > 0;
+      CREATE INDEX some_ab ON t(a, b) WHERE b IS NOT NULL;
+      CREATE INDEX lower_b ON t(lower(b));
+      CREATE INDEX lower_b_2 ON t(lower(b));
+    `),
+    {},
+  );
+});
+
+Deno.test("standard indexes are listed when their columns exist", () => {
+  const db = new Database(":memory:");
+  try {
+    db.exec(`
+      CREATE TABLE gaiadr3 (source_id TEXT PRIMARY KEY, ra, dec);
+      CREATE INDEX idx_dec ON gaiadr3(dec);
+    `);
+    const missing = missingIndexes(db);
+    assertEquals(missing.map((index) => index.name), ["idx_ra_dec"]);
+    db.exec(createIndexSql(missing[0]));
+
+    assertEquals(
+      listIndexes(db).map(({ name, columns, origin }) => [
+        name,
+        columns,
+        origin,
+      ]),
+      [
+        ["idx_dec", ["dec"], "c"],
+        ["idx_ra_dec", ["ra", "dec"], "c"],
+        ["sqlite_autoindex_gaiadr3_1", ["source_id"], "pk"],
+      ],
+    );
+  } finally {
+    db.close();
+  }
+});
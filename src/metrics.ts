@@ -0,0 +1,80 @@
+/**
+ * Process-wide counters, exported by the server at `/metrics` in the
+ * Prometheus text format
+ */
+
+export type Labels = Record<string, string>;
+
+export class Counter {
+  readonly name: string;
+  readonly help: string;
+  private values = new Map<string, { labels: Labels; value: number }>();
+
+  constructor(name: string, help: string) {
+    this.name = name;
+    this.help = help;
+  }
+
+  inc(labels: Labels = {}, amount = 1): void {
+    const key = JSON.stringify(Object.entries(labels).sort());
+    const entry = this.values.get(key);
+    if (entry) {
+      entry.value += amount;
+    } else {
+      this.values.set(key, { labels, value: amount });
+    }
+  }
+
+  /**
+   * Current value for a label set
+   */
+  get(labels: Labels = {}): number {
+    const key = JSON.stringify(Object.entries(labels).sort());
+    return this.values.get(key)?.value ?? 0;
+  }
+
+  render(): string {
+    const lines = [
+      `# HELP ${this.name} ${this.help}`,
+      `# TYPE ${this.name} counter`,
+    ];
+
+    for (const { labels, value } of this.values.values()) {
+      const labelText = Object.entries(labels)
+        .map(([key, val]) => `${key}="${val.replace(/["\\\n]/g, "\\$&")}"`)
+        .join(",");
+      lines.push(
+        `${this.name}${labelText ? `{${labelText}}` : ""} ${value}`,
+      );
+    }
+
+    return lines.join("\n");
+  }
+}
+
+export class Metrics {
+  private counters = new Map<string, Counter>();
+
+  /**
+   * Get or create a counter
+   */
+  counter(name: string, help: string): Counter {
+    let counter = this.counters.get(name);
+    if (!counter) {
+      counter = new Counter(name, help);
+      this.counters.set(name, counter);
+    }
+    return counter;
+  }
+
+  render(): string {
+    return [...this.counters.values()]
+      .map((counter) => counter.render())
+      .join("\n\n") + "\n";
+  }
+}
+
+/**
+ * Default registry
+ */
+export const metrics = new Metrics();
@@ -0,0 +1,208 @@
+/**
+ * Versioned schema migrations. `CREATE TABLE IF NOT EXISTS` never alters a
+ * table that already exists, so changes to existing tables are made here,
+ * in order, and recorded in the `schema_version` table.
+ *
+ * New databases are created with the latest schema and stamped with every
+ * version. Databases from before `schema_version` are version 0, so each
+ * migration checks what is there before changing it.
+ */
+
+import type { Database } from "@db/sqlite";
+import { VERSION } from "./config.ts";
+
+export interface Migration {
+  version: number;
+  description: string;
+  up(db: Database): void;
+}
+
+const TRACKING_TABLES = [
+  "file_tracking_gaiadr3",
+  "file_tracking_tmass_xmatch",
+  "file_tracking_tmass",
+];
+
+/**
+ * Every migration, in version order. Append new ones; never edit or
+ * reorder one that has been released.
+ */
+export const MIGRATIONS: Migration[] = [
+  {
+    version: 1,
+    description: "Add the total proper motion column pm to gaiadr3",
+    up(db) {
+      const columns = getColumns(db, "gaiadr3");
+      if (
+        columns.includes("pmra") && columns.includes("pmdec") &&
+        !columns.includes("pm")
+      ) {
+        db.exec(`ALTER TABLE gaiadr3 ADD COLUMN pm REAL`);
+        db.exec(
+          `UPDATE gaiadr3 SET pm = sqrt(pmra * pmra + pmdec * pmdec) WHERE pmra IS NOT NULL AND pmdec IS NOT NULL`,
+        );
+      }
+    },
+  },
+  {
+    version: 2,
+    description: "Add attempts and failed_at to file tracking for retries",
+    up(db) {
+      addColumns(db, TRACKING_TABLES, {
+        attempts: "INTEGER DEFAULT 0",
+        failed_at: "TEXT",
+      });
+    },
+  },
+  {
+    version: 3,
+    description:
+      "Add completed_at and gaiaoffline_version provenance to file tracking",
+    up(db) {
+      addColumns(db, TRACKING_TABLES, {
+        completed_at: "TEXT",
+        gaiaoffline_version: "TEXT",
+      });
+    },
+  },
+  {
+    version: 4,
+    description: "Add angular_distance and neighbour counts to tmass_xmatch",
+    up(db) {
+      addColumns(db, ["tmass_xmatch"], {
+        angular_distance: "REAL",
+        number_of_neighbours: "INTEGER",
+        number_of_mates: "INTEGER",
+      });
+    },
+  },
+];
+
+/** The schema version this gaiaoffline creates and understands */
+export const SCHEMA_VERSION = MIGRATIONS[MIGRATIONS.length - 1].version;
+
+/**
+ * Thrown when a database was migrated by a newer gaiaoffline
+ */
+export class SchemaVersionError extends Error {}
+
+/**
+ * Thrown when a database has migrations to apply before it can be written
+ */
+export class PendingMigrationsError extends Error {}
+
+/**
+ * The database's schema version: 0 before versioning
+ */
+export function getSchemaVersion(db: Database): number {
+  if (!hasTable(db, "schema_version")) {
+    return 0;
+  }
+  const row = db.prepare(
+    "SELECT COALESCE(MAX(version), 0) AS version FROM schema_version",
+  ).get<{ version: number }>();
+  return row?.version ?? 0;
+}
+
+/**
+ * Refuse databases with a schema newer than this gaiaoffline knows, which
+ * it could misread or damage
+ */
+export function checkSchemaVersion(db: Database, path: string): void {
+  const version = getSchemaVersion(db);
+  if (version > SCHEMA_VERSION) {
+    throw new SchemaVersionError(
+      `${path} has schema version ${version}, but gaiaoffline ${VERSION} supports up to ${SCHEMA_VERSION}. Upgrade gaiaoffline to open it.`,
+    );
+  }
+}
+
+/**
+ * Migrations newer than the database's version
+ */
+export function pendingMigrations(db: Database): Migration[] {
+  const version = getSchemaVersion(db);
+  return MIGRATIONS.filter((migration) => migration.version > version);
+}
+
+/**
+ * Apply pending migrations in order, each in its own transaction with its
+ * `schema_version` row, so a failure leaves the last good version
+ * @param onApply - Called after each migration with its duration in ms
+ * @returns The migrations applied
+ */
+export function applyMigrations(
+  db: Database,
+  onApply?: (migration: Migration, ms: number) => void,
+): Migration[] {
+  createVersionTable(db);
+  const pending = pendingMigrations(db);
+  for (const migration of pending) {
+    const startTime = Date.now();
+    db.transaction(() => {
+      migration.up(db);
+      recordVersion(db, migration);
+    })();
+    onApply?.(migration, Date.now() - startTime);
+  }
+  return pending;
+}
+
+/**
+ * Record every migration as applied, for a database just created with the
+ * latest schema
+ */
+export function stampSchemaVersion(db: Database): void {
+  createVersionTable(db);
+  db.transaction(() => {
+    for (const migration of pendingMigrations(db)) {
+      recordVersion(db, migration);
+    }
+  })();
+}
+
+function createVersionTable(db: Database): void {
+  db.exec(`
+    CREATE TABLE IF NOT EXISTS schema_version (
+      version INTEGER PRIMARY KEY,
+      description TEXT NOT NULL,
+      applied_at TEXT DEFAULT CURRENT_TIMESTAMP
+    );
+  `);
+}
+
+function recordVersion(db: Database, migration: Migration): void {
+  db.prepare(
+    "INSERT INTO schema_version (version, description) VALUES (?, ?)",
+  ).run(migration.version, migration.description);
+}
+
+function hasTable(db: Database, table: string): boolean {
+  return db.prepare(
+    `SELECT name FROM sqlite_master WHERE type='table' AND name=?`,
+  ).get(table) !== undefined;
+}
+
+function getColumns(db: Database, table: string): string[] {
+  return db.prepare(`PRAGMA table_info(${table})`)
+    .all<{ name: string }>()
+    .map((column) => column.name);
+}
+
+/**
+ * Add columns missing from the tables that exist
+ */
+function addColumns(
+  db: Database,
+  tables: string[],
+  columns: Record<string, string>,
+): void {
+  for (const table of tables.filter((table) => hasTable(db, table))) {
+    const existing = getColumns(db, table);
+    for (const [column, definition] of Object.entries(columns)) {
+      if (!existing.includes(column)) {
+        db.exec(`ALTER TABLE ${table} ADD COLUMN ${column} ${definition}`);
+      }
+    }
+  }
+}
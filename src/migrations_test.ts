@@ -0,0 +1,219 @@
+import {
+  assertEquals,
+  assertStringIncludes,
+  assertThrows,
+} from "@std/assert";
+import { Database } from "@db/sqlite";
+import { DEFAULT_CONFIG } from "./config.ts";
+import { GaiaDatabase } from "./database.ts";
+import {
+  applyMigrations,
+  checkSchemaVersion,
+  getSchemaVersion,
+  MIGRATIONS,
+  PendingMigrationsError,
+  pendingMigrations,
+  SCHEMA_VERSION,
+  SchemaVersionError,
+} from "./migrations.ts";
+
+/**
+ * A database as gaiaoffline built it before schema versioning
+ */
+function createVersion0(path: string): void {
+  const db = new Database(path);
+  db.exec(`
+    CREATE TABLE gaiadr3 (
+      source_id TEXT PRIMARY KEY, ra REAL, dec REAL, pmra REAL, pmdec REAL
+    );
+    CREATE TABLE tmass_xmatch (
+      gaiadr3_source_id TEXT PRIMARY KEY,
+      tmass_source_id TEXT NOT NULL
+    );
+    CREATE TABLE tmass (
+      gaiadr3_source_id TEXT PRIMARY KEY,
+      tmass_source_id TEXT NOT NULL,
+      j_m REAL, h_m REAL, k_m REAL
+    );
+    CREATE TABLE file_tracking_gaiadr3 (
+      url TEXT PRIMARY KEY, status TEXT DEFAULT 'pending'
+    );
+    CREATE TABLE file_tracking_tmass_xmatch (
+      url TEXT PRIMARY KEY, status TEXT DEFAULT 'pending'
+    );
+    CREATE TABLE file_tracking_tmass (
+      url TEXT PRIMARY KEY, status TEXT DEFAULT 'pending'
+    );
+    INSERT INTO gaiadr3 VALUES ('1', 10, 20, 3, 4), ('2', 11, 21, NULL, 5);
+    INSERT INTO tmass_xmatch VALUES ('1', '00400000+2000000');
+    INSERT INTO file_tracking_gaiadr3 (url, status)
+      VALUES ('GaiaSource_000000-003111.csv.gz', 'completed');
+  `);
+  db.close();
+}
+
+function columns(db: Database, table: string): string[] {
+  return db.prepare(`PRAGMA table_info(${table})`)
+    .all<{ name: string }>()
+    .map((column) => column.name);
+}
+
+function withTempDatabase(test: (path: string) => void | Promise<void>) {
+  return async () => {
+    const dir = Deno.makeTempDirSync();
+    try {
+      await test(`${dir}/gaia.db`);
+    } finally {
+      Deno.removeSync(dir, { recursive: true });
+    }
+  };
+}
+
+const options = { ...DEFAULT_CONFIG, logLevel: "ERROR" as const };
+
+Deno.test("migrations are in version order", () => {
+  assertEquals(
+    MIGRATIONS.map((migration) => migration.version),
+    MIGRATIONS.map((_, i) => i + 1),
+  );
+});
+
+Deno.test(
+  "every migration applies to a version 0 database",
+  withTempDatabase((path) => {
+    createVersion0(path);
+    const db = new Database(path);
+    try {
+      assertEquals(getSchemaVersion(db), 0);
+      assertEquals(pendingMigrations(db).length, MIGRATIONS.length);
+
+      const applied: number[] = [];
+      applyMigrations(db, (migration) => applied.push(migration.version));
+      assertEquals(applied, MIGRATIONS.map((migration) => migration.version));
+      assertEquals(getSchemaVersion(db), SCHEMA_VERSION);
+      assertEquals(pendingMigrations(db), []);
+
+      // 1: total proper motion, NULL where a component is missing
+      assertEquals(
+        db.prepare("SELECT source_id, pm FROM gaiadr3 ORDER BY source_id")
+          .all(),
+        [{ source_id: "1", pm: 5 }, { source_id: "2", pm: null }],
+      );
+      // 2 and 3: retry and provenance columns on every tracking table
+      for (
+        const table of [
+          "file_tracking_gaiadr3",
+          "file_tracking_tmass_xmatch",
+          "file_tracking_tmass",
+        ]
+      ) {
+        assertEquals(columns(db, table), [
+          "url",
+          "status",
+          "attempts",
+          "failed_at",
+          "completed_at",
+          "gaiaoffline_version",
+        ]);
+      }
+      assertEquals(
+        db.prepare("SELECT attempts FROM file_tracking_gaiadr3").get(),
+        { attempts: 0 },
+      );
+      // 4: match statistics, NULL for existing links
+      assertEquals(columns(db, "tmass_xmatch"), [
+        "gaiadr3_source_id",
+        "tmass_source_id",
+        "angular_distance",
+        "number_of_neighbours",
+        "number_of_mates",
+      ]);
+
+      // Applying again changes nothing
+      assertEquals(applyMigrations(db), []);
+      assertEquals(
+        db.prepare("SELECT COUNT(*) AS n FROM schema_version").get(),
+        { n: MIGRATIONS.length },
+      );
+    } finally {
+      db.close();
+    }
+  }),
+);
+
+Deno.test(
+  "migrations skip tables and columns that are not there",
+  withTempDatabase((path) => {
+    const db = new Database(path);
+    try {
+      db.exec("CREATE TABLE gaiadr3 (source_id TEXT PRIMARY KEY, ra REAL)");
+      applyMigrations(db);
+      assertEquals(columns(db, "gaiadr3"), ["source_id", "ra"]);
+      assertEquals(getSchemaVersion(db), SCHEMA_VERSION);
+    } finally {
+      db.close();
+    }
+  }),
+);
+
+Deno.test(
+  "a database from a newer gaiaoffline is refused",
+  withTempDatabase((path) => {
+    const db = new Database(path);
+    applyMigrations(db);
+    db.prepare(
+      "INSERT INTO schema_version (version, description) VALUES (?, ?)",
+    ).run(SCHEMA_VERSION + 1, "From the future");
+    assertThrows(
+      () => checkSchemaVersion(db, path),
+      SchemaVersionError,
+      `schema version ${SCHEMA_VERSION + 1}`,
+    );
+    db.close();
+
+    assertThrows(
+      () => new GaiaDatabase({ ...options, databasePath: path }),
+      SchemaVersionError,
+    );
+  }),
+);
+
+Deno.test(
+  "initialize refuses a database with pending migrations",
+  withTempDatabase((path) => {
+    createVersion0(path);
+    const db = new GaiaDatabase({ ...options, databasePath: path });
+    try {
+      const error = assertThrows(
+        () => db.initialize(),
+        PendingMigrationsError,
+      );
+      assertStringIncludes(error.message, "gaiaoffline migrate");
+      // Nothing was changed
+      assertEquals(db.getSchemaVersion(), 0);
+      assertEquals(db.hasTable("tmass_bands"), false);
+
+      db.migrate();
+      db.initialize();
+      assertEquals(db.getSchemaVersion(), SCHEMA_VERSION);
+    } finally {
+      db.close();
+    }
+  }),
+);
+
+Deno.test(
+  "new databases are stamped with the latest version",
+  withTempDatabase((path) => {
+    const db = new GaiaDatabase({ ...options, databasePath: path });
+    try {
+      db.initialize();
+      assertEquals(db.getSchemaVersion(), SCHEMA_VERSION);
+      assertEquals(db.pendingMigrations(), []);
+      // Initializing again is fine
+      db.initialize();
+    } finally {
+      db.close();
+    }
+  }),
+);
@@ -0,0 +1,250 @@
+import type { GaiaRecord } from "./database.ts";
+import type { PhotometryOutput } from "./types.ts";
+
+// 2MASS zeropoints (Vega system)
+export const tmassZeropoints = {
+  j: 20.86650085,
+  h: 20.6576004,
+  k: 20.04360008,
+};
+
+/**
+ * Ratio A_G / E(BP−RP) used to convert between the two extinction measures
+ * when only one is known. Appropriate for typical (FGK) stars with
+ * modest extinction; it varies with spectral type and reddening.
+ */
+export const AG_PER_EBPMINRP = 2.0;
+
+/**
+ * Fallback extinction used for stars without GSP-Phot values. Give either
+ * (or both) of the G-band extinction and the BP−RP colour excess; a missing
+ * one is derived with `AG_PER_EBPMINRP`.
+ */
+export interface ExtinctionOptions {
+  /** Constant G-band extinction A_G (mag) */
+  ag?: number;
+  /** Constant colour excess E(BP−RP) (mag) */
+  ebpminrp?: number;
+}
+
+/**
+ * Where the extinction applied to a row came from
+ */
+export type ExtinctionSource = "gspphot" | "constant" | "none";
+
+/**
+ * Where one extinction value came from: measured by GSP-Phot, the
+ * configured constant, or derived from the other value with
+ * `AG_PER_EBPMINRP`
+ */
+export type ExtinctionValueSource = ExtinctionSource | "derived";
+
+export interface PhotometryConversionOptions {
+  photometryOutput: PhotometryOutput;
+  zeropoints: number[];
+  tmassCrossmatch: boolean;
+}
+
+/**
+ * Convert a flux (e-/s) to a magnitude
+ */
+export function fluxToMagnitude(flux: number, zeropoint: number): number {
+  return zeropoint - 2.5 * Math.log10(flux);
+}
+
+function numeric(value: unknown): number | null {
+  return typeof value === "number" && isFinite(value) ? value : null;
+}
+
+function magnitudeFromRecord(
+  record: GaiaRecord,
+  band: "g" | "bp" | "rp",
+  zeropoint: number,
+): number | null {
+  const flux = numeric(record[`phot_${band}_mean_flux`]);
+  if (flux !== null && flux > 0) {
+    return fluxToMagnitude(flux, zeropoint);
+  }
+  return numeric(record[`phot_${band}_mean_mag`]);
+}
+
+/**
+ * Pick the extinction for a star: its own GSP-Phot A_G / E(BP−RP) when
+ * stored, otherwise the configured constant. Each value is flagged by its
+ * own source, since one may be derived from the other.
+ */
+function resolveExtinction(
+  record: GaiaRecord,
+  fallback: ExtinctionOptions,
+): {
+  ag: number;
+  ebpminrp: number;
+  source: ExtinctionSource;
+  agSource: ExtinctionValueSource;
+  ebpminrpSource: ExtinctionValueSource;
+} | null {
+  const pick = (
+    ag: number | null,
+    ebpminrp: number | null,
+    source: ExtinctionSource,
+  ) => {
+    if (ag === null && ebpminrp === null) {
+      return null;
+    }
+    return {
+      ag: ag ?? ebpminrp! * AG_PER_EBPMINRP,
+      ebpminrp: ebpminrp ?? ag! / AG_PER_EBPMINRP,
+      source,
+      agSource: ag !== null ? source : "derived" as const,
+      ebpminrpSource: ebpminrp !== null ? source : "derived" as const,
+    };
+  };
+
+  return pick(
+    numeric(record.ag_gspphot),
+    numeric(record.ebpminrp_gspphot),
+    "gspphot",
+  ) ?? pick(fallback.ag ?? null, fallback.ebpminrp ?? null, "constant");
+}
+
+/**
+ * Add extinction-corrected photometry to each record:
+ * `phot_g_mean_mag_dered`, `bp_rp_dered` and `abs_g_mag_dered`, the applied
+ * `a_g` and `e_bp_rp`, and `extinction_source` recording whether the values
+ * came from the star's GSP-Phot fit, the configured constant, or neither
+ * (in which case the corrected columns are null). `a_g_source` and
+ * `e_bp_rp_source` flag each value, `derived` where it was converted from
+ * the other.
+ *
+ * Must run on raw records, before fluxes are converted or removed.
+ */
+export function deredden(
+  records: GaiaRecord[],
+  zeropoints: number[],
+  fallback: ExtinctionOptions = {},
+): GaiaRecord[] {
+  return records.map((record) => {
+    const extinction = resolveExtinction(record, fallback);
+    const g = magnitudeFromRecord(record, "g", zeropoints[0]);
+    const bp = magnitudeFromRecord(record, "bp", zeropoints[1]);
+    const rp = magnitudeFromRecord(record, "rp", zeropoints[2]);
+    const parallax = numeric(record.parallax);
+
+    if (!extinction) {
+      return {
+        ...record,
+        phot_g_mean_mag_dered: null,
+        bp_rp_dered: null,
+        abs_g_mag_dered: null,
+        a_g: null,
+        e_bp_rp: null,
+        extinction_source: "none",
+        a_g_source: "none",
+        e_bp_rp_source: "none",
+      };
+    }
+
+    const gDered = g !== null ? g - extinction.ag : null;
+
+    return {
+      ...record,
+      phot_g_mean_mag_dered: gDered,
+      bp_rp_dered: bp !== null && rp !== null
+        ? bp - rp - extinction.ebpminrp
+        : null,
+      abs_g_mag_dered: gDered !== null && parallax !== null && parallax > 0
+        ? gDered + 5 * Math.log10(parallax) - 10
+        : null,
+      a_g: extinction.ag,
+      e_bp_rp: extinction.ebpminrp,
+      extinction_source: extinction.source,
+      a_g_source: extinction.agSource,
+      e_bp_rp_source: extinction.ebpminrpSource,
+    };
+  });
+}
+
+/**
+ * Convert flux to magnitude or vice versa based on user preferences
+ */
+export function convertPhotometry(
+  records: GaiaRecord[],
+  options: PhotometryConversionOptions,
+): GaiaRecord[] {
+  if (options.photometryOutput === "magnitude") {
+    return records.map((record) => {
+      const cleaned = { ...record };
+
+      // Handle Gaia photometry
+      const bands = [
+        { flux: "phot_g_mean_flux", mag: "phot_g_mean_mag", zp: 0 },
+        { flux: "phot_bp_mean_flux", mag: "phot_bp_mean_mag", zp: 1 },
+        { flux: "phot_rp_mean_flux", mag: "phot_rp_mean_mag", zp: 2 },
+      ];
+
+      for (const band of bands) {
+        const flux = record[band.flux] as number;
+        if (flux && flux > 0) {
+          const zeropoint = options.zeropoints[band.zp];
+          cleaned[band.mag] = fluxToMagnitude(flux, zeropoint);
+
+          // Calculate magnitude error if flux error exists
+          const fluxError = record[`${band.flux}_error`] as number;
+          if (fluxError) {
+            cleaned[`${band.mag}_error`] = (2.5 / Math.log(10)) *
+              (fluxError / flux);
+            delete cleaned[`${band.flux}_error`];
+          }
+
+          delete cleaned[band.flux];
+        }
+      }
+
+      // 2MASS magnitudes are already in magnitude format, just ensure they're numeric
+      if (options.tmassCrossmatch) {
+        if (cleaned.j_m !== null && cleaned.j_m !== undefined) {
+          cleaned.j_m = Number(cleaned.j_m);
+        }
+        if (cleaned.h_m !== null && cleaned.h_m !== undefined) {
+          cleaned.h_m = Number(cleaned.h_m);
+        }
+        if (cleaned.k_m !== null && cleaned.k_m !== undefined) {
+          cleaned.k_m = Number(cleaned.k_m);
+        }
+      }
+
+      return cleaned;
+    });
+  }
+
+  if (options.photometryOutput === "flux") {
+    // Convert 2MASS magnitudes to flux if needed
+    if (options.tmassCrossmatch) {
+      return records.map((record) => {
+        const cleaned = { ...record };
+
+        if (cleaned.j_m !== null && cleaned.j_m !== undefined) {
+          const jMag = Number(cleaned.j_m);
+          cleaned.j_flux = 10 ** (-0.4 * (jMag - tmassZeropoints.j));
+          delete cleaned.j_m;
+        }
+
+        if (cleaned.h_m !== null && cleaned.h_m !== undefined) {
+          const hMag = Number(cleaned.h_m);
+          cleaned.h_flux = 10 ** (-0.4 * (hMag - tmassZeropoints.h));
+          delete cleaned.h_m;
+        }
+
+        if (cleaned.k_m !== null && cleaned.k_m !== undefined) {
+          const kMag = Number(cleaned.k_m);
+          cleaned.k_flux = 10 ** (-0.4 * (kMag - tmassZeropoints.k));
+          delete cleaned.k_m;
+        }
+
+        return cleaned;
+      });
+    }
+  }
+
+  return records;
+}
@@ -0,0 +1,171 @@
+/**
+ * Typed rows from query results.
+ *
+ * A row type maps each field to the column it is read from, with the
+ * column's type, much like struct tags:
+ *
+ * ```ts
+ * const Star = {
+ *   sourceId: column("source_id", "bigint"),
+ *   ra: column("ra", "number"),
+ *   dec: column("dec", "number"),
+ *   gFlux: nullable(column("phot_g_mean_flux", "number")),
+ * };
+ * type Star = RowOf<typeof Star>;
+ * ```
+ *
+ * Fields that can be NULL must be declared `nullable`, making them
+ * `T | null`; a NULL in any other field is an error rather than a value of
+ * the wrong type. The columns are checked against the database when the
+ * scanner is first used, so a misspelt or unstored column fails before any
+ * row is read.
+ */
+
+export type ColumnType = "string" | "number" | "bigint" | "boolean";
+
+type ValueOf<T extends ColumnType> = T extends "string" ? string
+  : T extends "number" ? number
+  : T extends "bigint" ? bigint
+  : boolean;
+
+/**
+ * A field of a row type: the column it is read from and how
+ */
+export interface Field<T> {
+  column: string;
+  type: ColumnType;
+  nullable: boolean;
+  /** Carries the field's type; never set */
+  readonly value?: T;
+}
+
+export type Fields = Record<string, Field<unknown>>;
+
+/** The row a row type scans into */
+export type RowOf<F extends Fields> = {
+  [K in keyof F]: F[K] extends Field<infer T> ? T : never;
+};
+
+/**
+ * Thrown when a row type does not fit the database or a row
+ */
+export class ScanError extends Error {}
+
+/**
+ * A field read from `name`, converted to `type`
+ */
+export function column<T extends ColumnType>(
+  name: string,
+  type: T,
+): Field<ValueOf<T>> {
+  return { column: name, type, nullable: false };
+}
+
+/**
+ * The same field, read as null when the column is NULL or absent from a row
+ */
+export function nullable<T>(field: Field<T>): Field<T | null> {
+  return { ...field, nullable: true };
+}
+
+/**
+ * Scans records into rows of a row type
+ */
+export class RowScanner<F extends Fields> {
+  private fields: [string, Field<unknown>][];
+  private columns: () => Iterable<string>;
+  private validated = false;
+
+  /**
+   * @param fields - The row type
+   * @param columns - The columns records can have, read on first use
+   */
+  constructor(fields: F, columns: () => Iterable<string>) {
+    this.fields = Object.entries(fields);
+    this.columns = columns;
+  }
+
+  /**
+   * Check that every field's column exists. Called on first use.
+   */
+  validate(): void {
+    if (this.validated) {
+      return;
+    }
+    const available = new Set(this.columns());
+    const missing = this.fields.filter(([, field]) =>
+      !available.has(field.column)
+    );
+    if (missing.length > 0) {
+      throw new ScanError(
+        `Columns not in the database: ${
+          missing.map(([name, field]) => `${field.column} (field ${name})`)
+            .join(", ")
+        }`,
+      );
+    }
+    this.validated = true;
+  }
+
+  /**
+   * Scan one record into a row
+   */
+  scan(record: Record<string, unknown>): RowOf<F> {
+    this.validate();
+    const row: Record<string, unknown> = {};
+    for (const [name, field] of this.fields) {
+      row[name] = convert(name, field, record[field.column]);
+    }
+    return row as RowOf<F>;
+  }
+
+  /**
+   * Scan records as they are iterated, such as those of a streamed query.
+   * The columns are checked before the first record is read.
+   */
+  *iterate(
+    records: Iterable<Record<string, unknown>>,
+  ): Generator<RowOf<F>> {
+    this.validate();
+    for (const record of records) {
+      yield this.scan(record);
+    }
+  }
+}
+
+function convert(name: string, field: Field<unknown>, value: unknown) {
+  if (value === null || value === undefined) {
+    if (field.nullable) {
+      return null;
+    }
+    throw new ScanError(
+      `${field.column} is NULL but field ${name} is not nullable`,
+    );
+  }
+
+  switch (field.type) {
+    case "string":
+      return String(value);
+    case "number": {
+      const number = Number(value);
+      if (typeof value === "string" && (value.trim() === "" || isNaN(number))) {
+        throw new ScanError(
+          `${field.column} value ${value} is not a number (field ${name})`,
+        );
+      }
+      return number;
+    }
+    case "bigint":
+      try {
+        return BigInt(value as string | number | bigint | boolean);
+      } catch {
+        throw new ScanError(
+          `${field.column} value ${value} is not an integer (field ${name})`,
+        );
+      }
+    case "boolean":
+      return typeof value === "string"
+        ? value !== "" && value !== "0" && value !== "false"
+        : Boolean(value);
+  }
+}
@@ -0,0 +1,379 @@
+/**
+ * Metadata catalogue: units and descriptions for every table and column
+ * the tool writes or computes, from the Gaia DR3 and 2MASS data models.
+ * `initialize` copies it into the `column_metadata` table so the database
+ * describes itself to other SQLite clients too.
+ */
+
+import type { GaiaColumn } from "./types.ts";
+
+export interface ColumnInfo {
+  /** Unit, or null for dimensionless values, flags and identifiers */
+  unit: string | null;
+  description: string;
+}
+
+const info = (unit: string | null, description: string): ColumnInfo => ({
+  unit,
+  description,
+});
+
+/**
+ * A GSP-Phot parameter with its 16th and 84th percentiles
+ */
+function percentiles(
+  name: string,
+  unit: string | null,
+  description: string,
+): Record<string, ColumnInfo> {
+  return {
+    [name]: info(unit, `${description} from GSP-Phot`),
+    [`${name}_lower`]: info(unit, `Lower confidence level (16%) of ${name}`),
+    [`${name}_upper`]: info(unit, `Upper confidence level (84%) of ${name}`),
+  };
+}
+
+/**
+ * The flux, magnitude and observation count columns of a photometric band
+ */
+function band(key: "g" | "bp" | "rp", label: string) {
+  return {
+    [`phot_${key}_n_obs`]: info(null, `Number of ${label} observations`),
+    [`phot_${key}_mean_flux`]: info("e-/s", `${label} mean flux`),
+    [`phot_${key}_mean_flux_error`]: info(
+      "e-/s",
+      `Error on ${label} mean flux`,
+    ),
+    [`phot_${key}_mean_flux_over_error`]: info(
+      null,
+      `${label} mean flux divided by its error`,
+    ),
+    [`phot_${key}_mean_mag`]: info("mag", `${label} mean magnitude (Vega)`),
+  };
+}
+
+function correlation(a: string, b: string): ColumnInfo {
+  return info(null, `Correlation between ${a} and ${b}`);
+}
+
+export const gaiaColumnInfo = {
+  solution_id: info(null, "Solution identifier"),
+  designation: info(null, "Unique source designation, `Gaia DR3 <source_id>`"),
+  source_id: info(
+    null,
+    "Unique source identifier; `source_id >> 35` is the level-12 HEALPix pixel",
+  ),
+  random_index: info(null, "Random index for drawing random subsets"),
+  ref_epoch: info("yr", "Reference epoch of the astrometry (J2016.0)"),
+  ra: info("deg", "Right ascension (ICRS) at the reference epoch"),
+  ra_error: info("mas", "Standard uncertainty in right ascension × cos(dec)"),
+  dec: info("deg", "Declination (ICRS) at the reference epoch"),
+  dec_error: info("mas", "Standard uncertainty in declination"),
+  parallax: info("mas", "Parallax"),
+  parallax_error: info("mas", "Standard uncertainty in parallax"),
+  parallax_over_error: info(null, "Parallax divided by its uncertainty"),
+  pm: info("mas/yr", "Total proper motion"),
+  pmra: info("mas/yr", "Proper motion in right ascension × cos(dec)"),
+  pmra_error: info("mas/yr", "Standard uncertainty in pmra"),
+  pmdec: info("mas/yr", "Proper motion in declination"),
+  pmdec_error: info("mas/yr", "Standard uncertainty in pmdec"),
+  ra_dec_corr: correlation("ra", "dec"),
+  ra_parallax_corr: correlation("ra", "parallax"),
+  ra_pmra_corr: correlation("ra", "pmra"),
+  ra_pmdec_corr: correlation("ra", "pmdec"),
+  dec_parallax_corr: correlation("dec", "parallax"),
+  dec_pmra_corr: correlation("dec", "pmra"),
+  dec_pmdec_corr: correlation("dec", "pmdec"),
+  parallax_pmra_corr: correlation("parallax", "pmra"),
+  parallax_pmdec_corr: correlation("parallax", "pmdec"),
+  pmra_pmdec_corr: correlation("pmra", "pmdec"),
+  astrometric_n_obs_al: info(null, "Total number of along-scan observations"),
+  astrometric_n_obs_ac: info(null, "Total number of across-scan observations"),
+  astrometric_n_good_obs_al: info(
+    null,
+    "Number of good along-scan observations",
+  ),
+  astrometric_n_bad_obs_al: info(null, "Number of bad along-scan observations"),
+  astrometric_gof_al: info(null, "Goodness of fit of the astrometric solution"),
+  astrometric_chi2_al: info(null, "Along-scan chi-square of the solution"),
+  astrometric_excess_noise: info("mas", "Excess noise of the source"),
+  astrometric_excess_noise_sig: info(null, "Significance of the excess noise"),
+  astrometric_params_solved: info(
+    null,
+    "Parameters solved: 3 = position, 31 = 5-parameter, 95 = 6-parameter",
+  ),
+  astrometric_primary_flag: info(
+    null,
+    "Whether the source was a primary in the astrometric solution",
+  ),
+  nu_eff_used_in_astrometry: info(
+    "1/um",
+    "Effective wavenumber used in the astrometric solution",
+  ),
+  pseudocolour: info("1/um", "Astrometrically estimated pseudocolour"),
+  pseudocolour_error: info("1/um", "Standard uncertainty in pseudocolour"),
+  ra_pseudocolour_corr: correlation("ra", "pseudocolour"),
+  dec_pseudocolour_corr: correlation("dec", "pseudocolour"),
+  parallax_pseudocolour_corr: correlation("parallax", "pseudocolour"),
+  pmra_pseudocolour_corr: correlation("pmra", "pseudocolour"),
+  pmdec_pseudocolour_corr: correlation("pmdec", "pseudocolour"),
+  astrometric_matched_transits: info(
+    null,
+    "Field-of-view transits used in the astrometric solution",
+  ),
+  visibility_periods_used: info(null, "Number of visibility periods used"),
+  astrometric_sigma5d_max: info(
+    "mas",
+    "Longest semi-major axis of the 5-d error ellipsoid",
+  ),
+  matched_transits: info(null, "Field-of-view transits matched to the source"),
+  new_matched_transits: info(null, "Transits newly matched in this release"),
+  matched_transits_removed: info(null, "Transits removed from the source"),
+  ipd_gof_harmonic_amplitude: info(
+    null,
+    "Amplitude of the image fit goodness-of-fit versus scan angle",
+  ),
+  ipd_gof_harmonic_phase: info(
+    "deg",
+    "Phase of the image fit goodness-of-fit versus scan angle",
+  ),
+  ipd_frac_multi_peak: info("%", "Windows with more than one peak"),
+  ipd_frac_odd_win: info("%", "Transits with truncated or gated windows"),
+  ruwe: info(null, "Renormalised unit weight error; > 1.4 suggests a binary"),
+  scan_direction_strength_k1: info(
+    null,
+    "Concentration of scan directions, order 1",
+  ),
+  scan_direction_strength_k2: info(
+    null,
+    "Concentration of scan directions, order 2",
+  ),
+  scan_direction_strength_k3: info(
+    null,
+    "Concentration of scan directions, order 3",
+  ),
+  scan_direction_strength_k4: info(
+    null,
+    "Concentration of scan directions, order 4",
+  ),
+  scan_direction_mean_k1: info("deg", "Mean scan position angle, order 1"),
+  scan_direction_mean_k2: info("deg", "Mean scan position angle, order 2"),
+  scan_direction_mean_k3: info("deg", "Mean scan position angle, order 3"),
+  scan_direction_mean_k4: info("deg", "Mean scan position angle, order 4"),
+  duplicated_source: info(null, "Source had a duplicate removed in processing"),
+  ...band("g", "G-band"),
+  ...band("bp", "BP"),
+  ...band("rp", "RP"),
+  phot_bp_rp_excess_factor: info(null, "BP/RP flux excess factor"),
+  phot_bp_n_contaminated_transits: info(
+    null,
+    "BP transits contaminated by neighbours",
+  ),
+  phot_bp_n_blended_transits: info(null, "BP transits blended with neighbours"),
+  phot_rp_n_contaminated_transits: info(
+    null,
+    "RP transits contaminated by neighbours",
+  ),
+  phot_rp_n_blended_transits: info(null, "RP transits blended with neighbours"),
+  phot_proc_mode: info(null, "Photometric processing mode"),
+  bp_rp: info("mag", "BP − RP colour"),
+  bp_g: info("mag", "BP − G colour"),
+  g_rp: info("mag", "G − RP colour"),
+  radial_velocity: info("km/s", "Radial velocity"),
+  radial_velocity_error: info("km/s", "Uncertainty in radial velocity"),
+  rv_method_used: info(null, "Method used to obtain the radial velocity"),
+  rv_nb_transits: info(null, "Transits used for the radial velocity"),
+  rv_nb_deblended_transits: info(
+    null,
+    "Deblended transits used for the radial velocity",
+  ),
+  rv_visibility_periods_used: info(
+    null,
+    "Visibility periods used for the radial velocity",
+  ),
+  rv_expected_sig_to_noise: info(
+    null,
+    "Expected signal-to-noise of the RVS spectrum",
+  ),
+  rv_renormalised_gof: info(
+    null,
+    "Radial velocity renormalised goodness of fit",
+  ),
+  rv_chisq_pvalue: info(null, "P-value of constant radial velocity"),
+  rv_time_duration: info("d", "Time covered by the radial velocity transits"),
+  rv_amplitude_robust: info("km/s", "Robust amplitude of the radial velocity"),
+  rv_template_teff: info("K", "Effective temperature of the RV template"),
+  rv_template_logg: info("log(cm/s2)", "Surface gravity of the RV template"),
+  rv_template_fe_h: info("dex", "Metallicity of the RV template"),
+  rv_atm_param_origin: info(null, "Origin of the RV template parameters"),
+  vbroad: info("km/s", "Spectral line broadening"),
+  vbroad_error: info("km/s", "Uncertainty in vbroad"),
+  vbroad_nb_transits: info(null, "Transits used for vbroad"),
+  grvs_mag: info("mag", "Integrated G_RVS magnitude"),
+  grvs_mag_error: info("mag", "Uncertainty in grvs_mag"),
+  grvs_mag_nb_transits: info(null, "Transits used for grvs_mag"),
+  rvs_spec_sig_to_noise: info(null, "Signal-to-noise of the mean RVS spectrum"),
+  phot_variable_flag: info(null, "Photometric variability flag"),
+  l: info("deg", "Galactic longitude"),
+  b: info("deg", "Galactic latitude"),
+  ecl_lon: info("deg", "Ecliptic longitude"),
+  ecl_lat: info("deg", "Ecliptic latitude"),
+  in_qso_candidates: info(null, "In the quasar candidates table"),
+  in_galaxy_candidates: info(null, "In the galaxy candidates table"),
+  non_single_star: info(null, "Non-single-star flags (bitmask)"),
+  has_xp_continuous: info(null, "BP/RP continuous spectra are available"),
+  has_xp_sampled: info(null, "BP/RP sampled spectra are available"),
+  has_rvs: info(null, "A mean RVS spectrum is available"),
+  has_epoch_photometry: info(null, "Epoch photometry is available"),
+  has_epoch_rv: info(null, "Epoch radial velocities are available"),
+  has_mcmc_gspphot: info(null, "GSP-Phot MCMC samples are available"),
+  has_mcmc_msc: info(null, "MSC MCMC samples are available"),
+  in_andromeda_survey: info(null, "In the Gaia Andromeda Photometric Survey"),
+  classprob_dsc_combmod_quasar: info(null, "DSC probability of being a quasar"),
+  classprob_dsc_combmod_galaxy: info(null, "DSC probability of being a galaxy"),
+  classprob_dsc_combmod_star: info(null, "DSC probability of being a star"),
+  ...percentiles("teff_gspphot", "K", "Effective temperature"),
+  ...percentiles("logg_gspphot", "log(cm/s2)", "Surface gravity"),
+  ...percentiles("mh_gspphot", "dex", "Metallicity [M/H]"),
+  ...percentiles("distance_gspphot", "pc", "Distance"),
+  ...percentiles("azero_gspphot", "mag", "Extinction A0 at 541.4 nm"),
+  ...percentiles("ag_gspphot", "mag", "G-band extinction"),
+  ...percentiles("ebpminrp_gspphot", "mag", "Reddening E(BP−RP)"),
+  libname_gspphot: info(null, "Atmosphere library of the best GSP-Phot fit"),
+} as Record<GaiaColumn, ColumnInfo>;
+
+/**
+ * Columns of the tables other than gaiadr3
+ */
+export const tableColumnInfo: Record<string, Record<string, ColumnInfo>> = {
+  tmass_xmatch: {
+    gaiadr3_source_id: info(null, "Gaia DR3 source_id"),
+    tmass_source_id: info(null, "2MASS designation of the best neighbour"),
+    angular_distance: info("arcsec", "Gaia to 2MASS separation"),
+    number_of_neighbours: info(
+      null,
+      "2MASS sources within the match radius of the Gaia source",
+    ),
+    number_of_mates: info(
+      null,
+      "Other Gaia sources with the same 2MASS best neighbour",
+    ),
+  },
+  tmass: {
+    gaiadr3_source_id: info(null, "Gaia DR3 source_id"),
+    tmass_source_id: info(null, "2MASS designation"),
+    j_m: info("mag", "2MASS J magnitude"),
+    h_m: info("mag", "2MASS H magnitude"),
+    k_m: info("mag", "2MASS Ks magnitude"),
+  },
+  cache_invalidations: {
+    id: info(null, "Sequence number"),
+    healpix_start: info(null, "First level-8 HEALPix pixel changed"),
+    healpix_end: info(null, "Last level-8 HEALPix pixel changed"),
+    url: info(null, "File whose rows were committed"),
+    created_at: info(null, "When the file was committed (UTC)"),
+  },
+  metadata: {
+    key: info(null, "Property name"),
+    value: info(null, "Property value"),
+  },
+  tmass_bands: {
+    url: info(null, "2MASS Point Source Catalog file"),
+    dec_start: info("deg", "Declination of the file's first row"),
+  },
+  schema_version: {
+    version: info(null, "Schema migration number"),
+    description: info(null, "What the migration changed"),
+    applied_at: info(null, "When it was applied (UTC)"),
+  },
+  column_metadata: {
+    table_name: info(null, "Table"),
+    column_name: info(null, "Column"),
+    unit: info(null, "Unit, if any"),
+    description: info(null, "What the column holds"),
+  },
+};
+
+for (const table of ["gaiadr3", "tmass_xmatch", "tmass"]) {
+  tableColumnInfo[`file_tracking_${table}`] = {
+    url: info(null, `Bulk-download file for ${table}`),
+    status: info(null, "pending, completed or failed"),
+    attempts: info(null, "Failures since the file last completed"),
+    failed_at: info(null, "When the file last failed (UTC)"),
+    completed_at: info(null, "When the file was committed (UTC)"),
+    gaiaoffline_version: info(null, "gaiaoffline version that loaded it"),
+  };
+}
+
+export const tableDescriptions: Record<string, string> = {
+  gaiadr3: "Gaia DR3 sources, with the columns chosen at populate time",
+  tmass_xmatch: "Best 2MASS neighbour of each Gaia source",
+  tmass: "2MASS JHK photometry of crossmatched sources",
+  file_tracking_gaiadr3: "Progress of the Gaia source download",
+  file_tracking_tmass_xmatch: "Progress of the 2MASS crossmatch download",
+  file_tracking_tmass: "Progress of the 2MASS photometry download",
+  cache_invalidations: "Regions changed by populate, read by query caches",
+  metadata: "Build properties: versions, options and timestamps",
+  column_metadata: "Units and descriptions of every column",
+  tmass_bands: "Declination band of each 2MASS photometry file",
+  schema_version: "Schema migrations applied to this database",
+};
+
+/**
+ * Columns added to query results rather than stored
+ */
+export const computedColumnInfo: Record<string, ColumnInfo> = {
+  phot_g_mean_mag: info(
+    "mag",
+    "G magnitude from the flux, with `photometry=magnitude`",
+  ),
+  phot_bp_mean_mag: info("mag", "BP magnitude from the flux"),
+  phot_rp_mean_mag: info("mag", "RP magnitude from the flux"),
+  phot_g_mean_mag_error: info(
+    "mag",
+    "G magnitude uncertainty from the flux error",
+  ),
+  spectral_type: info(null, "O–M from teff_gspphot, with `classify`"),
+  luminosity_class: info(null, "dwarf, subgiant or giant, with `classify`"),
+  evolutionary_stage: info(null, "main_sequence or giant, with `classify`"),
+  abs_g_mag: info("mag", "Absolute G magnitude from the parallax"),
+  phot_g_mean_mag_dered: info("mag", "Extinction-corrected G, with `deredden`"),
+  bp_rp_dered: info("mag", "Reddening-corrected BP − RP"),
+  abs_g_mag_dered: info("mag", "Extinction-corrected absolute G"),
+  a_g: info("mag", "G-band extinction applied"),
+  e_bp_rp: info("mag", "E(BP−RP) applied"),
+  extinction_source: info(null, "gspphot, constant or none"),
+  a_g_source: info(null, "gspphot, constant, derived or none"),
+  e_bp_rp_source: info(null, "gspphot, constant, derived or none"),
+  pm_position_angle: info("deg", "Direction of proper motion, east of north"),
+  epoch: info("yr", "Epoch positions were propagated to"),
+  ra_epoch: info("deg", "Right ascension at `epoch`"),
+  dec_epoch: info("deg", "Declination at `epoch`"),
+  separation: info("arcsec", "Distance from the search position"),
+  target_id: info(null, "Crossmatch target id, or its index"),
+  target_ra: info("deg", "Crossmatch target right ascension"),
+  target_dec: info("deg", "Crossmatch target declination"),
+  tmass_angular_distance: info(
+    "arcsec",
+    "Gaia to 2MASS separation, with xmatch",
+  ),
+  tmass_neighbours: info(null, "2MASS candidates within the match radius"),
+  tmass_ambiguous: info(null, "1 when several 2MASS sources were candidates"),
+  tmass_shared: info(
+    null,
+    "1 when other Gaia sources have the same 2MASS match",
+  ),
+};
+
+/**
+ * Metadata for a column of a table, if the catalogue knows it
+ */
+export function columnInfo(
+  table: string,
+  column: string,
+): ColumnInfo | undefined {
+  if (table === "gaiadr3") {
+    return (gaiaColumnInfo as Record<string, ColumnInfo>)[column];
+  }
+  return tableColumnInfo[table]?.[column];
+}
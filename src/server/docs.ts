@@ -0,0 +1,330 @@
+/**
+ * Self-contained HTML documentation for the catalogue: build properties,
+ * coverage, every table and column with units and descriptions, example
+ * queries and a cone search form. Plain server-rendered HTML with inline
+ * styles, so it works offline and without JavaScript.
+ */
+
+import type { Gaia } from "../gaia.ts";
+import type { GaiaRecord } from "../database.ts";
+import { GAIA_FILE_LEVEL, pixelCount, pixToAng } from "../healpix.ts";
+import { computedColumnInfo } from "../schema.ts";
+
+/** Level of the cells drawn on the coverage map */
+const MAP_LEVEL = 4;
+
+const STYLE = `
+  body { font: 15px/1.5 system-ui, sans-serif; margin: 0 auto; max-width: 1100px;
+    padding: 1rem 2rem; color: #1a202c; }
+  h1 { margin-bottom: 0; }
+  h2 { border-bottom: 1px solid #cbd5e0; padding-bottom: .25rem; margin-top: 2rem; }
+  table { border-collapse: collapse; width: 100%; margin: .5rem 0; }
+  th, td { text-align: left; padding: .2rem .6rem; border-bottom: 1px solid #edf2f7;
+    vertical-align: top; }
+  th { background: #f7fafc; }
+  td.num { text-align: right; font-variant-numeric: tabular-nums; }
+  code, pre { font: 13px ui-monospace, monospace; background: #f7fafc; }
+  pre { padding: .6rem; overflow-x: auto; }
+  details { margin: .4rem 0; }
+  summary { cursor: pointer; font-weight: 600; }
+  form { display: flex; flex-wrap: wrap; gap: .75rem; align-items: end; }
+  label { display: flex; flex-direction: column; font-size: 13px; }
+  input, select { font: inherit; padding: .2rem .4rem; width: 9rem; }
+  .muted { color: #718096; }
+  .error { color: #c53030; font-weight: 600; }
+  .scroll { overflow-x: auto; }
+`;
+
+export function escapeHtml(value: unknown): string {
+  return String(value ?? "")
+    .replace(/&/g, "&amp;")
+    .replace(/</g, "&lt;")
+    .replace(/>/g, "&gt;")
+    .replace(/"/g, "&quot;");
+}
+
+function page(title: string, body: string): string {
+  return `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>${escapeHtml(title)}</title>
+<style>${STYLE}</style>
+</head>
+<body>
+${body}
+</body>
+</html>
+`;
+}
+
+export interface ConeFormValues {
+  ra?: number;
+  dec?: number;
+  radius?: number;
+  photometry?: string;
+  magnitude_limit?: string;
+  rows?: number;
+  api_key?: string;
+}
+
+/**
+ * The cone search form, filled in with the last search
+ */
+function coneForm(values: ConeFormValues, apiKeys: boolean): string {
+  const field = (
+    name: keyof ConeFormValues,
+    label: string,
+    fallback: string | number,
+    type = "number",
+  ) =>
+    `<label>${label}<input name="${name}" type="${type}" step="any" value="${
+      escapeHtml(values[name] ?? fallback)
+    }"></label>`;
+
+  const photometry = values.photometry ?? "magnitude";
+  const options = ["magnitude", "flux"]
+    .map((value) =>
+      `<option${value === photometry ? " selected" : ""}>${value}</option>`
+    )
+    .join("");
+
+  return `<form method="get" action="/docs/cone">
+  ${field("ra", "RA (deg)", 56.75)}
+  ${field("dec", "Dec (deg)", 24.12)}
+  ${field("radius", "Radius (deg)", 0.5)}
+  ${field("magnitude_limit", "G range", "-3,20", "text")}
+  ${field("rows", "Max rows", 100)}
+  <label>Photometry<select name="photometry">${options}</select></label>
+  ${apiKeys ? field("api_key", "API key", "", "password") : ""}
+  <button type="submit">Search</button>
+</form>`;
+}
+
+/**
+ * Equirectangular map of the sky, shaded by the fraction of each level-4
+ * HEALPix cell whose Gaia files are loaded
+ */
+function coverageMap(coverage: [number, number][]): string {
+  const cells = new Float64Array(pixelCount(MAP_LEVEL));
+  const shift = 2 * (GAIA_FILE_LEVEL - MAP_LEVEL);
+  const perCell = 4 ** (GAIA_FILE_LEVEL - MAP_LEVEL);
+
+  for (const [start, end] of coverage) {
+    for (let pixel = start; pixel <= end; pixel++) {
+      cells[pixel >> shift] += 1 / perCell;
+    }
+  }
+
+  const dots: string[] = [];
+  cells.forEach((fraction, cell) => {
+    const { ra, dec } = pixToAng(MAP_LEVEL, cell);
+    // RA increases to the left, as on the sky
+    const x = (360 - ra).toFixed(1);
+    const y = (90 - dec).toFixed(1);
+    const fill = fraction > 0
+      ? `rgba(43,108,176,${(0.25 + 0.75 * fraction).toFixed(2)})`
+      : "#edf2f7";
+    dots.push(`<circle cx="${x}" cy="${y}" r="2.6" fill="${fill}"/>`);
+  });
+
+  return `<svg viewBox="0 0 360 180" width="720" height="360" role="img"
+  aria-label="Sky coverage" style="max-width:100%;background:#fff;border:1px solid #e2e8f0">
+  ${dots.join("")}
+  <line x1="180" y1="0" x2="180" y2="180" stroke="#cbd5e0" stroke-width=".3"/>
+  <line x1="0" y1="90" x2="360" y2="90" stroke="#cbd5e0" stroke-width=".3"/>
+</svg>
+<p class="muted">Right ascension runs from 360° (left) to 0° (right), declination from +90° (top) to −90°. Darker cells have more of their Gaia files loaded.</p>`;
+}
+
+function columnRows(
+  columns: {
+    name: string;
+    type?: string;
+    unit: string | null;
+    description: string | null;
+  }[],
+): string {
+  return columns
+    .map((column) =>
+      `<tr><td><code>${escapeHtml(column.name)}</code></td>` +
+      (column.type !== undefined
+        ? `<td>${escapeHtml(column.type)}</td>`
+        : "") +
+      `<td>${escapeHtml(column.unit ?? "")}</td>` +
+      `<td>${
+        column.description
+          ? escapeHtml(column.description)
+          : '<span class="muted">—</span>'
+      }</td></tr>`
+    )
+    .join("\n");
+}
+
+/**
+ * The documentation page
+ */
+export function renderDocs(
+  gaia: Gaia,
+  options: { version: string; apiKeys: boolean },
+): string {
+  const { metadata, tables, trackingProgress, coverage } = gaia.describe();
+
+  const properties = Object.entries({
+    "API version": options.version,
+    ...metadata,
+  })
+    .map(([key, value]) =>
+      `<tr><th>${escapeHtml(key)}</th><td>${escapeHtml(value)}</td></tr>`
+    )
+    .join("\n");
+
+  const progress = Object.entries(trackingProgress)
+    .filter(([, value]) => value !== null && value.total > 0)
+    .map(([table, value]) =>
+      `<tr><td><code>${escapeHtml(table.replace("file_tracking_", ""))}</code></td>` +
+      `<td class="num">${value!.completed}</td>` +
+      `<td class="num">${value!.total}</td>` +
+      `<td class="num">${(100 * value!.completed / value!.total).toFixed(1)}%</td>` +
+      `<td class="num">${value!.failed}</td></tr>`
+    )
+    .join("\n");
+
+  const tableSections = tables
+    .map((table) =>
+      `<details${table.name === "gaiadr3" ? " open" : ""}>
+<summary><code>${escapeHtml(table.name)}</code> <span class="muted">≈ ${table.approximateRows.toLocaleString("en")} rows${
+        table.description ? ` — ${escapeHtml(table.description)}` : ""
+      }</span></summary>
+<table><tr><th>Column</th><th>Type</th><th>Unit</th><th>Description</th></tr>
+${columnRows(table.columns)}
+</table>
+</details>`
+    )
+    .join("\n");
+
+  const computed = columnRows(
+    Object.entries(computedColumnInfo).map(([name, info]) => ({
+      name,
+      ...info,
+    })),
+  );
+
+  const keyHint = options.apiKeys
+    ? `<p class="muted">This server requires an API key: send <code>X-API-Key</code> or <code>Authorization: Bearer</code>, or add <code>api_key=</code> to the URL.</p>`
+    : "";
+
+  const body = `<h1>Gaia Offline</h1>
+<p class="muted">A local copy of the Gaia DR3 catalogue. The machine-readable API is described at <a href="/openapi.json">/openapi.json</a>.</p>
+
+<h2>Cone search</h2>
+${coneForm({}, options.apiKeys)}
+
+<h2>Build</h2>
+<table>${properties}</table>
+
+<h2>Coverage</h2>
+${
+    progress
+      ? `<table><tr><th>Download</th><th>Files loaded</th><th>Files</th><th>Complete</th><th>Failed</th></tr>
+${progress}</table>`
+      : '<p class="muted">No files have been tracked yet; run <code>populate</code>.</p>'
+  }
+${coverage.length > 0 ? coverageMap(coverage) : ""}
+
+<h2>Example queries</h2>
+${keyHint}
+<ul>
+<li><a href="/cone?ra=56.75&amp;dec=24.12&amp;radius=1&amp;photometry=magnitude">/cone?ra=56.75&amp;dec=24.12&amp;radius=1&amp;photometry=magnitude</a> — the Pleiades</li>
+<li><a href="/nearest?ra=266.4168&amp;dec=-29.0078&amp;n=5">/nearest?ra=266.4168&amp;dec=-29.0078&amp;n=5</a> — five stars nearest Sgr A*</li>
+<li><a href="/high-pm?min_pm=3000">/high-pm?min_pm=3000</a> — stars moving faster than 3″ a year</li>
+<li><a href="/cone?ra=132.825&amp;dec=11.8&amp;radius=0.5&amp;classify=true&amp;luminosity_class=giant">/cone?ra=132.825&amp;dec=11.8&amp;radius=0.5&amp;classify=true&amp;luminosity_class=giant</a> — giants in M67</li>
+<li><a href="/stats">/stats</a> — row counts and download progress</li>
+</ul>
+<pre>curl -X POST -H "Content-Type: application/json" \\
+  -d '{"targets": [{"id": "m45", "ra": 56.75, "dec": 24.12}], "radius": 60}' \\
+  http://localhost:8080/xmatch
+
+gaiaoffline query --ra 56.75 --dec 24.12 --radius 0.5 --photometry magnitude
+
+sqlite3 gaiaoffline.db "SELECT source_id, ra, dec FROM gaiadr3 WHERE dec BETWEEN 24 AND 24.2 LIMIT 10"</pre>
+
+<h2>Tables</h2>
+${tableSections}
+
+<h2>Computed columns</h2>
+<p class="muted">Added to query results by the options shown; not stored.</p>
+<table><tr><th>Column</th><th>Unit</th><th>Description</th></tr>
+${computed}
+</table>`;
+
+  return page("Gaia Offline", body);
+}
+
+/**
+ * The cone search form with its results
+ */
+export function renderConeResults(
+  values: ConeFormValues,
+  records: GaiaRecord[],
+  options: { apiKeys: boolean; truncated: boolean },
+): string {
+  const columns = records.length > 0 ? Object.keys(records[0]) : [];
+  const format = (value: unknown) =>
+    typeof value === "number" && !Number.isInteger(value)
+      ? value.toPrecision(8)
+      : escapeHtml(value);
+
+  const rows = records
+    .map((record) =>
+      `<tr>${
+        columns
+          .map((column) =>
+            typeof record[column] === "number"
+              ? `<td class="num">${format(record[column])}</td>`
+              : `<td>${format(record[column])}</td>`
+          )
+          .join("")
+      }</tr>`
+    )
+    .join("\n");
+
+  const summary = records.length === 0
+    ? "No stars found."
+    : `${records.length} star${records.length === 1 ? "" : "s"}${
+      options.truncated ? " (more available; raise Max rows)" : ""
+    }.`;
+
+  const body = `<h1>Cone search</h1>
+<p><a href="/docs">← Documentation</a></p>
+${coneForm(values, options.apiKeys)}
+<p>${summary}</p>
+${
+    records.length > 0
+      ? `<div class="scroll"><table><tr>${
+        columns.map((column) => `<th>${escapeHtml(column)}</th>`).join("")
+      }</tr>
+${rows}</table></div>`
+      : ""
+  }`;
+
+  return page("Cone search — Gaia Offline", body);
+}
+
+/**
+ * An error page for the form, so the user keeps their input
+ */
+export function renderConeError(
+  values: ConeFormValues,
+  message: string,
+  apiKeys: boolean,
+): string {
+  return page(
+    "Cone search — Gaia Offline",
+    `<h1>Cone search</h1>
+<p><a href="/docs">← Documentation</a></p>
+${coneForm(values, apiKeys)}
+<p class="error">${escapeHtml(message)}</p>`,
+  );
+}
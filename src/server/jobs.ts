@@ -0,0 +1,619 @@
+/**
+ * Asynchronous jobs for work too large for one request: crossmatching a
+ * large target list, looking up many source_ids or exporting a big cone.
+ *
+ * Jobs and their checkpoints live in `jobs.db` inside the jobs directory,
+ * next to each job's input and result files. A fixed number of workers
+ * take jobs oldest first and process them in chunks, yielding between
+ * chunks so requests are still served. After a restart, interrupted
+ * crossmatch and lookup jobs resume from their last checkpoint and cone
+ * exports start over; a job interrupted too often fails.
+ */
+
+import { Database } from "@db/sqlite";
+import { stringify } from "@std/csv";
+import type { Gaia, GaiaOptions, XmatchTarget } from "../gaia.ts";
+import type { GaiaRecord } from "../database.ts";
+import type { LogLevel, Logger } from "../types.ts";
+import { createLogger } from "../utils.ts";
+import { metrics } from "../metrics.ts";
+
+export type JobOperation = "xmatch" | "lookup" | "cone";
+export type JobFormat = "csv" | "ndjson" | "json";
+export type JobStatus =
+  | "queued"
+  | "running"
+  | "completed"
+  | "failed"
+  | "cancelled";
+
+export const jobOperations: JobOperation[] = ["xmatch", "lookup", "cone"];
+export const jobFormats: JobFormat[] = ["csv", "ndjson", "json"];
+
+export const MAX_JOB_INPUT = 2_000_000;
+
+/**
+ * What to run. Exactly one of `targets`, `sourceIds` or `cone` is set,
+ * matching `operation`.
+ */
+export interface JobRequest {
+  operation: JobOperation;
+  format: JobFormat;
+  /** Query options applied to the catalogue, e.g. photometry */
+  options: GaiaOptions;
+  targets?: XmatchTarget[];
+  /** Match radius for xmatch (arcsec) */
+  matchRadius?: number;
+  sourceIds?: string[];
+  cone?: { ra: number; dec: number; radius: number };
+}
+
+/**
+ * A job as reported to clients
+ */
+export interface JobInfo {
+  id: string;
+  operation: JobOperation;
+  format: JobFormat;
+  status: JobStatus;
+  /** Fraction of the input processed, 0–1 */
+  progress: number;
+  rows: number;
+  error: string | null;
+  created_at: string;
+  started_at: string | null;
+  finished_at: string | null;
+}
+
+export interface JobQueueOptions {
+  /** Directory for `jobs.db`, inputs and results */
+  directory: string;
+  /**
+   * Jobs run at once
+   * @default 2
+   */
+  workers?: number;
+  /**
+   * Days to keep finished jobs and their results
+   * @default 7
+   */
+  retentionDays?: number;
+  /**
+   * @default "INFO"
+   */
+  logLevel?: LogLevel;
+}
+
+interface JobRow extends JobInfo {
+  owner: string;
+  request: string;
+  columns: string | null;
+  checkpoint_input: number;
+  checkpoint_bytes: number;
+  attempts: number;
+}
+
+/** Restarts tolerated before an interrupted job is failed */
+const MAX_ATTEMPTS = 3;
+
+/** Input items (targets or source_ids) per checkpoint */
+const CHUNK_SIZE = 500;
+
+/** Rows scanned per checkpoint when exporting a cone */
+const CONE_BATCH_SIZE = 5000;
+
+const encoder = new TextEncoder();
+
+/**
+ * Thrown inside a running job when it is cancelled
+ */
+class JobCancelled extends Error {}
+
+export class JobQueue {
+  private db: Database;
+  private gaia: Gaia;
+  private directory: string;
+  private workers: number;
+  private retentionDays: number;
+  private logger: Logger;
+  private running = new Set<string>();
+  private cancelled = new Set<string>();
+  private stopped = false;
+  private wake: (() => void) | null = null;
+  private loops: Promise<void>[] = [];
+
+  constructor(gaia: Gaia, options: JobQueueOptions) {
+    this.gaia = gaia;
+    this.directory = options.directory;
+    this.workers = options.workers ?? 2;
+    this.retentionDays = options.retentionDays ?? 7;
+    this.logger = createLogger(options.logLevel ?? "INFO", "Jobs");
+
+    Deno.mkdirSync(this.directory, { recursive: true });
+    this.db = new Database(`${this.directory}/jobs.db`);
+    this.db.exec("PRAGMA journal_mode = WAL");
+    this.db.exec(`
+      CREATE TABLE IF NOT EXISTS jobs (
+        id TEXT PRIMARY KEY,
+        owner TEXT NOT NULL,
+        operation TEXT NOT NULL,
+        format TEXT NOT NULL,
+        request TEXT NOT NULL,
+        status TEXT NOT NULL,
+        progress REAL NOT NULL DEFAULT 0,
+        rows INTEGER NOT NULL DEFAULT 0,
+        error TEXT,
+        columns TEXT,
+        checkpoint_input INTEGER NOT NULL DEFAULT 0,
+        checkpoint_bytes INTEGER NOT NULL DEFAULT 0,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        created_at TEXT NOT NULL,
+        started_at TEXT,
+        finished_at TEXT
+      )
+    `);
+    this.db.exec(
+      "CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status, created_at)",
+    );
+  }
+
+  /**
+   * Recover jobs interrupted by a restart and start the workers
+   */
+  start(): void {
+    this.recover();
+    this.purge();
+
+    for (let i = 0; i < this.workers; i++) {
+      this.loops.push(this.work());
+    }
+    this.logger.info(
+      `${this.workers} job worker(s) started in ${this.directory}`,
+    );
+  }
+
+  /**
+   * Stop taking jobs and wait for the workers to reach a checkpoint.
+   * Running jobs resume on the next start.
+   */
+  async close(): Promise<void> {
+    this.stopped = true;
+    this.wake?.();
+    await Promise.all(this.loops);
+    this.db.close();
+  }
+
+  /**
+   * Queue a job, storing its input alongside the database
+   */
+  submit(owner: string, request: JobRequest): JobInfo {
+    const id = crypto.randomUUID();
+    const { targets, sourceIds, ...rest } = request;
+
+    const input = targets ?? sourceIds;
+    if (input) {
+      Deno.writeTextFileSync(this.inputPath(id), JSON.stringify(input));
+    }
+
+    this.db.prepare(
+      `INSERT INTO jobs (id, owner, operation, format, request, status, created_at)
+       VALUES (?, ?, ?, ?, ?, 'queued', ?)`,
+    ).run(
+      id,
+      owner,
+      request.operation,
+      request.format,
+      JSON.stringify(rest),
+      new Date().toISOString(),
+    );
+
+    jobCounter.inc({ operation: request.operation, status: "queued" });
+    this.logger.info(`Queued ${request.operation} job ${id} for ${owner}`);
+    this.wake?.();
+
+    return this.get(id, owner)!;
+  }
+
+  /**
+   * A job, if it exists and belongs to `owner`
+   */
+  get(id: string, owner: string): JobInfo | null {
+    const row = this.db.prepare(
+      "SELECT * FROM jobs WHERE id = ? AND owner = ?",
+    ).get<JobRow>(id, owner);
+    return row ? toInfo(row) : null;
+  }
+
+  /**
+   * The owner's jobs, newest first
+   */
+  list(owner: string): JobInfo[] {
+    // rowid orders jobs submitted in the same millisecond, so pages of the
+    // list don't overlap
+    return this.db.prepare(
+      "SELECT * FROM jobs WHERE owner = ? ORDER BY created_at DESC, rowid DESC",
+    ).all<JobRow>(owner).map(toInfo);
+  }
+
+  /**
+   * Cancel a job if it hasn't finished, and delete it with its files.
+   * Returns false if there is no such job.
+   */
+  delete(id: string, owner: string): boolean {
+    const job = this.get(id, owner);
+    if (!job) {
+      return false;
+    }
+
+    if (this.running.has(id)) {
+      // The worker removes the files when it reaches its next checkpoint
+      this.cancelled.add(id);
+    } else {
+      this.removeFiles(id, job.format);
+    }
+
+    if (job.status === "queued" || job.status === "running") {
+      jobCounter.inc({ operation: job.operation, status: "cancelled" });
+    }
+    this.db.prepare("DELETE FROM jobs WHERE id = ?").run(id);
+    return true;
+  }
+
+  /**
+   * Path of a completed job's result file
+   */
+  resultPath(id: string, format: JobFormat): string {
+    return `${this.directory}/${id}.${format}`;
+  }
+
+  private inputPath(id: string): string {
+    return `${this.directory}/${id}.input.json`;
+  }
+
+  private removeFiles(id: string, format: JobFormat): void {
+    for (const path of [this.inputPath(id), this.resultPath(id, format)]) {
+      try {
+        Deno.removeSync(path);
+      } catch {
+        // Never written
+      }
+    }
+  }
+
+  /**
+   * Requeue jobs that were running when the server stopped
+   */
+  private recover(): void {
+    const interrupted = this.db.prepare(
+      "SELECT * FROM jobs WHERE status = 'running'",
+    ).all<JobRow>();
+
+    for (const job of interrupted) {
+      let reason: string | null = null;
+
+      if (job.attempts >= MAX_ATTEMPTS) {
+        reason = `Interrupted ${job.attempts} times`;
+      } else if (job.operation !== "cone") {
+        try {
+          Deno.statSync(this.inputPath(job.id));
+        } catch {
+          reason = "Input file is missing";
+        }
+      }
+
+      if (reason) {
+        this.finish(job.id, "failed", `${reason}; resubmit the job`);
+        continue;
+      }
+
+      // Cone exports aren't checkpointed, so they start over
+      const restart = job.operation === "cone";
+      this.db.prepare(
+        `UPDATE jobs SET status = 'queued',
+           checkpoint_input = ?, checkpoint_bytes = ?, rows = ?, progress = ?,
+           columns = ?
+         WHERE id = ?`,
+      ).run(
+        restart ? 0 : job.checkpoint_input,
+        restart ? 0 : job.checkpoint_bytes,
+        restart ? 0 : job.rows,
+        restart ? 0 : job.progress,
+        restart ? null : job.columns,
+        job.id,
+      );
+      this.logger.info(
+        `Job ${job.id} was interrupted; ${restart ? "restarting" : "resuming"}`,
+      );
+    }
+  }
+
+  /**
+   * Delete jobs that finished more than `retentionDays` ago
+   */
+  private purge(): void {
+    if (this.retentionDays <= 0) {
+      return;
+    }
+
+    const cutoff = new Date(
+      Date.now() - this.retentionDays * 86_400_000,
+    ).toISOString();
+    const expired = this.db.prepare(
+      `SELECT id, format FROM jobs
+       WHERE status IN ('completed', 'failed', 'cancelled') AND finished_at < ?`,
+    ).all<{ id: string; format: JobFormat }>(cutoff);
+
+    for (const { id, format } of expired) {
+      this.removeFiles(id, format);
+      this.db.prepare("DELETE FROM jobs WHERE id = ?").run(id);
+    }
+
+    if (expired.length > 0) {
+      this.logger.info(`Removed ${expired.length} expired job(s)`);
+    }
+  }
+
+  /**
+   * One worker: take the oldest queued job, run it, repeat
+   */
+  private async work(): Promise<void> {
+    while (!this.stopped) {
+      const job = this.take();
+      if (!job) {
+        await new Promise<void>((resolve) => {
+          const previous = this.wake;
+          this.wake = () => {
+            this.wake = null;
+            previous?.();
+            resolve();
+          };
+        });
+        continue;
+      }
+
+      this.running.add(job.id);
+      try {
+        await this.run(job);
+        this.finish(job.id, "completed", null);
+        this.logger.info(`Job ${job.id} completed`);
+      } catch (error) {
+        if (error instanceof JobCancelled) {
+          this.removeFiles(job.id, job.format);
+          this.logger.info(`Job ${job.id} cancelled`);
+        } else if (!this.stopped) {
+          this.finish(job.id, "failed", (error as Error).message);
+          this.logger.warn(`Job ${job.id} failed: ${error}`);
+        }
+      } finally {
+        this.running.delete(job.id);
+        this.cancelled.delete(job.id);
+      }
+
+      this.purge();
+    }
+  }
+
+  private take(): JobRow | null {
+    const job = this.db.prepare(
+      `SELECT * FROM jobs WHERE status = 'queued'
+       ORDER BY created_at LIMIT 1`,
+    ).get<JobRow>();
+    if (!job) {
+      return null;
+    }
+
+    this.db.prepare(
+      `UPDATE jobs SET status = 'running', attempts = attempts + 1,
+         started_at = COALESCE(started_at, ?)
+       WHERE id = ?`,
+    ).run(new Date().toISOString(), job.id);
+    return job;
+  }
+
+  private finish(id: string, status: JobStatus, error: string | null): void {
+    const job = this.db.prepare("SELECT operation FROM jobs WHERE id = ?")
+      .get<{ operation: string }>(id);
+    if (!job) {
+      return;
+    }
+
+    this.db.prepare(
+      `UPDATE jobs SET status = ?, error = ?, finished_at = ?,
+         progress = CASE WHEN ? = 'completed' THEN 1 ELSE progress END
+       WHERE id = ?`,
+    ).run(status, error, new Date().toISOString(), status, id);
+    jobCounter.inc({ operation: job.operation, status });
+  }
+
+  /**
+   * Run a job from its checkpoint, writing rows to its result file
+   */
+  private async run(job: JobRow): Promise<void> {
+    const request = JSON.parse(job.request) as JobRequest;
+    const gaia = this.gaia.derive({ ...request.options, cache: false });
+    const writer = await ResultWriter.open(
+      this.resultPath(job.id, job.format),
+      job.format,
+      job.checkpoint_bytes,
+      job.rows,
+      job.columns ? JSON.parse(job.columns) : null,
+    );
+
+    const checkpoint = (inputDone: number, progress: number) => {
+      this.db.prepare(
+        `UPDATE jobs SET checkpoint_input = ?, checkpoint_bytes = ?, rows = ?,
+           progress = ?, columns = ?
+         WHERE id = ?`,
+      ).run(
+        inputDone,
+        writer.bytes,
+        writer.rows,
+        progress,
+        writer.columns ? JSON.stringify(writer.columns) : null,
+        job.id,
+      );
+    };
+
+    const yieldToServer = async () => {
+      await new Promise((resolve) => setTimeout(resolve, 0));
+      if (this.cancelled.has(job.id)) {
+        throw new JobCancelled();
+      }
+      if (this.stopped) {
+        throw new Error("Server stopping");
+      }
+    };
+
+    try {
+      if (request.operation === "cone") {
+        const { ra, dec, radius } = request.cone!;
+        const batches = gaia.streamConeSearch(ra, dec, radius, CONE_BATCH_SIZE);
+        try {
+          for (const { records, progress } of batches) {
+            await writer.write(records);
+            checkpoint(0, progress.complete);
+            await yieldToServer();
+          }
+        } finally {
+          batches.return(undefined);
+        }
+      } else {
+        const input = JSON.parse(
+          await Deno.readTextFile(this.inputPath(job.id)),
+        ) as (XmatchTarget | string)[];
+
+        for (
+          let start = job.checkpoint_input;
+          start < input.length;
+          start += CHUNK_SIZE
+        ) {
+          const chunk = input.slice(start, start + CHUNK_SIZE);
+          const records = request.operation === "xmatch"
+            ? gaia.xmatch(
+              (chunk as XmatchTarget[]).map((target, i) => ({
+                ...target,
+                id: target.id ?? String(start + i),
+              })),
+              request.matchRadius ?? 1,
+            )
+            : gaia.lookup(chunk as string[]);
+
+          await writer.write(records);
+          const done = Math.min(start + CHUNK_SIZE, input.length);
+          checkpoint(done, done / input.length);
+          await yieldToServer();
+        }
+      }
+
+      await writer.end();
+    } finally {
+      writer.close();
+    }
+  }
+}
+
+const jobCounter = metrics.counter(
+  "gaiaoffline_jobs_total",
+  "Jobs by operation and status reached",
+);
+
+function toInfo(row: JobRow): JobInfo {
+  return {
+    id: row.id,
+    operation: row.operation,
+    format: row.format,
+    status: row.status,
+    progress: row.progress,
+    rows: row.rows,
+    error: row.error,
+    created_at: row.created_at,
+    started_at: row.started_at,
+    finished_at: row.finished_at,
+  };
+}
+
+/**
+ * Appends rows to a result file in one of the job formats, tracking the
+ * bytes written so a resumed job can truncate back to its checkpoint
+ */
+class ResultWriter {
+  file: Deno.FsFile;
+  format: JobFormat;
+  bytes: number;
+  rows: number;
+  columns: string[] | null;
+
+  private constructor(
+    file: Deno.FsFile,
+    format: JobFormat,
+    bytes: number,
+    rows: number,
+    columns: string[] | null,
+  ) {
+    this.file = file;
+    this.format = format;
+    this.bytes = bytes;
+    this.rows = rows;
+    this.columns = columns;
+  }
+
+  static async open(
+    path: string,
+    format: JobFormat,
+    bytes: number,
+    rows: number,
+    columns: string[] | null,
+  ): Promise<ResultWriter> {
+    const file = await Deno.open(path, { write: true, create: true });
+    // Drop anything written after the checkpoint
+    await file.truncate(bytes);
+    await file.seek(bytes, Deno.SeekMode.Start);
+    return new ResultWriter(file, format, bytes, rows, columns);
+  }
+
+  async write(records: GaiaRecord[]): Promise<void> {
+    if (records.length === 0) {
+      return;
+    }
+
+    let text: string;
+    if (this.format === "csv") {
+      const header = this.columns === null;
+      this.columns ??= Object.keys(records[0]);
+      text = stringify(records as Record<string, unknown>[], {
+        columns: this.columns,
+        headers: header,
+      });
+    } else if (this.format === "ndjson") {
+      text = records.map((record) => JSON.stringify(record) + "\n").join("");
+    } else {
+      text = (this.rows === 0 ? "[\n" : ",\n") +
+        records.map((record) => JSON.stringify(record)).join(",\n");
+    }
+
+    await this.append(text);
+    this.rows += records.length;
+  }
+
+  /**
+   * Finish the file, e.g. close the JSON array
+   */
+  async end(): Promise<void> {
+    if (this.format === "json") {
+      await this.append(this.rows === 0 ? "[]\n" : "\n]\n");
+    }
+  }
+
+  close(): void {
+    this.file.close();
+  }
+
+  private async append(text: string): Promise<void> {
+    const data = encoder.encode(text);
+    let written = 0;
+    while (written < data.length) {
+      written += await this.file.write(data.subarray(written));
+    }
+    this.bytes += data.length;
+  }
+}
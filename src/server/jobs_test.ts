@@ -0,0 +1,347 @@
+import { assertEquals } from "@std/assert";
+import { Database } from "@db/sqlite";
+import { DEFAULT_CONFIG } from "../config.ts";
+import { GaiaDatabase } from "../database.ts";
+import { Gaia, type GaiaOptions } from "../gaia.ts";
+import { type JobInfo, JobQueue, type JobRequest } from "./jobs.ts";
+
+const OWNER = "ip:127.0.0.1";
+
+/** Source_ids 1000…2199, which take three lookup checkpoints */
+const IDS = Array.from({ length: 1200 }, (_, i) => String(1000 + i));
+
+/**
+ * Run `test` against a catalogue of the stars in `IDS`, all within 0.1° of
+ * (45, 6), and a temporary directory for jobs
+ */
+function withCatalogue(test: (gaia: Gaia, dir: string) => Promise<void>) {
+  return async () => {
+    const dir = Deno.makeTempDirSync();
+    const config = {
+      ...DEFAULT_CONFIG,
+      logLevel: "ERROR" as const,
+      databasePath: `${dir}/gaia.db`,
+    };
+    const db = new GaiaDatabase(config);
+    db.initialize();
+    const insert = db.prepare(
+      "INSERT INTO gaiadr3 (source_id, ra, dec, phot_g_mean_flux) VALUES (?, ?, ?, 1e5)",
+    );
+    IDS.forEach((id, i) => {
+      insert.run(id, 45 + (i % 40) * 0.001, 6 + Math.floor(i / 40) * 0.001);
+    });
+
+    const gaia = new Gaia(
+      { databasePath: config.databasePath, logLevel: "ERROR" },
+      db,
+    );
+    try {
+      await test(gaia, dir);
+    } finally {
+      gaia.close();
+      db.close();
+      Deno.removeSync(dir, { recursive: true });
+    }
+  };
+}
+
+function openQueue(gaia: Gaia, directory: string, retentionDays = 7) {
+  return new JobQueue(gaia, {
+    directory,
+    workers: 1,
+    retentionDays,
+    logLevel: "ERROR",
+  });
+}
+
+/**
+ * `gaia` with `onLookup` called before each lookup a job makes, numbered
+ * from 1
+ */
+function interceptLookups(
+  gaia: Gaia,
+  onLookup: (call: number) => void,
+): Gaia {
+  let calls = 0;
+  return {
+    derive(options: GaiaOptions) {
+      const derived = gaia.derive(options);
+      const lookup = derived.lookup.bind(derived);
+      derived.lookup = (sourceIds) => {
+        onLookup(++calls);
+        return lookup(sourceIds);
+      };
+      return derived;
+    },
+  } as unknown as Gaia;
+}
+
+async function waitFor(condition: () => boolean, what: string) {
+  for (let i = 0; i < 2000 && !condition(); i++) {
+    await new Promise((resolve) => setTimeout(resolve, 5));
+  }
+  if (!condition()) {
+    throw new Error(`Timed out waiting for ${what}`);
+  }
+}
+
+async function finished(queue: JobQueue, id: string): Promise<JobInfo> {
+  let job: JobInfo | null = null;
+  await waitFor(() => {
+    job = queue.get(id, OWNER);
+    return job?.status === "completed" || job?.status === "failed";
+  }, `job ${id}`);
+  return job!;
+}
+
+/**
+ * Result of running `request` uninterrupted in a directory of its own
+ */
+async function uninterrupted(
+  gaia: Gaia,
+  directory: string,
+  request: JobRequest,
+): Promise<string> {
+  const queue = openQueue(gaia, directory);
+  queue.start();
+  try {
+    const job = await finished(queue, queue.submit(OWNER, request).id);
+    assertEquals(job.status, "completed");
+    return Deno.readTextFileSync(queue.resultPath(job.id, request.format));
+  } finally {
+    await queue.close();
+  }
+}
+
+/**
+ * Change a job's row in `jobs.db` as a crash would have left it
+ */
+function updateJob(directory: string, id: string, set: string): void {
+  const db = new Database(`${directory}/jobs.db`);
+  try {
+    db.prepare(`UPDATE jobs SET ${set} WHERE id = ?`).run(id);
+  } finally {
+    db.close();
+  }
+}
+
+function exists(path: string): boolean {
+  try {
+    Deno.statSync(path);
+    return true;
+  } catch {
+    return false;
+  }
+}
+
+for (const format of ["csv", "ndjson", "json"] as const) {
+  Deno.test(
+    `an interrupted ${format} job resumes without losing or repeating rows`,
+    withCatalogue(async (gaia, dir) => {
+      const request: JobRequest = {
+        operation: "lookup",
+        format,
+        options: {},
+        sourceIds: IDS,
+      };
+      const expected = await uninterrupted(gaia, `${dir}/reference`, request);
+
+      // Stop during the second of three chunks
+      const directory = `${dir}/jobs`;
+      let stopping: Promise<void> | undefined;
+      const queue = openQueue(
+        interceptLookups(gaia, (call) => {
+          if (call === 2) stopping = queue.close();
+        }),
+        directory,
+      );
+      queue.start();
+      const { id } = queue.submit(OWNER, request);
+      await waitFor(() => stopping !== undefined, "the second chunk");
+      await stopping;
+
+      // Half a chunk written after the checkpoint, as if the process had
+      // died mid-chunk; longer than the rest of the result
+      const path = `${directory}/${id}.${format}`;
+      const checkpoint = Deno.readTextFileSync(path);
+      Deno.writeTextFileSync(
+        path,
+        checkpoint + checkpoint.slice(0, checkpoint.length / 2),
+      );
+
+      const resumed = openQueue(gaia, directory);
+      const stopped = resumed.get(id, OWNER)!;
+      assertEquals([stopped.status, stopped.rows], ["running", 1000]);
+      resumed.start();
+      try {
+        const job = await finished(resumed, id);
+        assertEquals(job.status, "completed");
+        assertEquals(job.rows, IDS.length);
+        assertEquals(Deno.readTextFileSync(path), expected);
+      } finally {
+        await resumed.close();
+      }
+    }),
+  );
+}
+
+Deno.test(
+  "an interrupted cone export starts over",
+  withCatalogue(async (gaia, dir) => {
+    const request: JobRequest = {
+      operation: "cone",
+      format: "ndjson",
+      options: {},
+      cone: { ra: 45, dec: 6, radius: 0.1 },
+    };
+    const expected = await uninterrupted(gaia, `${dir}/reference`, request);
+    assertEquals(expected.trim().split("\n").length, IDS.length);
+
+    const directory = `${dir}/jobs`;
+    const queue = openQueue(gaia, directory);
+    const { id } = queue.submit(OWNER, request);
+    await queue.close();
+    const path = `${directory}/${id}.ndjson`;
+    Deno.writeTextFileSync(path, expected.slice(0, 500));
+    updateJob(
+      directory,
+      id,
+      "status = 'running', attempts = 1, rows = 5, checkpoint_bytes = 400",
+    );
+
+    const restarted = openQueue(gaia, directory);
+    restarted.start();
+    try {
+      const job = await finished(restarted, id);
+      assertEquals([job.status, job.rows], ["completed", IDS.length]);
+      assertEquals(Deno.readTextFileSync(path), expected);
+    } finally {
+      await restarted.close();
+    }
+  }),
+);
+
+Deno.test(
+  "jobs interrupted too often or without their input fail",
+  withCatalogue(async (gaia, dir) => {
+    const request: JobRequest = {
+      operation: "lookup",
+      format: "csv",
+      options: {},
+      sourceIds: IDS.slice(0, 10),
+    };
+    const queue = openQueue(gaia, dir);
+    const retried = queue.submit(OWNER, request).id;
+    const lost = queue.submit(OWNER, request).id;
+    await queue.close();
+    updateJob(dir, retried, "status = 'running', attempts = 3");
+    updateJob(dir, lost, "status = 'running', attempts = 1");
+    Deno.removeSync(`${dir}/${lost}.input.json`);
+
+    const restarted = openQueue(gaia, dir);
+    restarted.start();
+    try {
+      const failures = [retried, lost].map((id) => restarted.get(id, OWNER));
+      assertEquals(failures.map((job) => [job?.status, job?.error]), [
+        ["failed", "Interrupted 3 times; resubmit the job"],
+        ["failed", "Input file is missing; resubmit the job"],
+      ]);
+    } finally {
+      await restarted.close();
+    }
+  }),
+);
+
+Deno.test(
+  "cancelling a job stops it and removes its files",
+  withCatalogue(async (gaia, dir) => {
+    const request: JobRequest = {
+      operation: "lookup",
+      format: "csv",
+      options: {},
+      sourceIds: IDS,
+    };
+
+    // Queued: removed at once
+    const idle = openQueue(gaia, `${dir}/idle`);
+    const queued = idle.submit(OWNER, request).id;
+    assertEquals(idle.delete(queued, "ip:10.0.0.1"), false);
+    assertEquals(idle.delete(queued, OWNER), true);
+    assertEquals(exists(`${dir}/idle/${queued}.input.json`), false);
+    await idle.close();
+
+    // Running: stops at the next checkpoint
+    let id = "";
+    const queue = openQueue(
+      interceptLookups(gaia, (call) => {
+        if (call === 1) queue.delete(id, OWNER);
+      }),
+      dir,
+    );
+    queue.start();
+    try {
+      id = queue.submit(OWNER, request).id;
+      await waitFor(
+        () =>
+          !exists(`${dir}/${id}.input.json`) && !exists(`${dir}/${id}.csv`),
+        "the cancelled job's files to be removed",
+      );
+      assertEquals(queue.get(id, OWNER), null);
+      assertEquals(queue.list(OWNER), []);
+
+      // The worker carries on with the next job
+      const next = queue.submit(OWNER, { ...request, sourceIds: ["1000"] });
+      assertEquals((await finished(queue, next.id)).status, "completed");
+    } finally {
+      await queue.close();
+    }
+  }),
+);
+
+Deno.test(
+  "finished jobs are purged after the retention period",
+  withCatalogue(async (gaia, dir) => {
+    const request: JobRequest = {
+      operation: "lookup",
+      format: "json",
+      options: {},
+      sourceIds: ["1000", "1001"],
+    };
+    const queue = openQueue(gaia, dir);
+    queue.start();
+    const old = queue.submit(OWNER, request).id;
+    const recent = queue.submit(OWNER, request).id;
+    const pending = queue.submit(OWNER, request).id;
+    await finished(queue, old);
+    await finished(queue, recent);
+    await finished(queue, pending);
+    await queue.close();
+
+    const eightDaysAgo = new Date(Date.now() - 8 * 86_400_000).toISOString();
+    updateJob(dir, old, `finished_at = '${eightDaysAgo}'`);
+
+    // No retention keeps everything
+    const keeping = openQueue(gaia, dir, 0);
+    keeping.start();
+    await keeping.close();
+    assertEquals(exists(`${dir}/${old}.json`), true);
+
+    updateJob(
+      dir,
+      pending,
+      `status = 'queued', finished_at = '${eightDaysAgo}'`,
+    );
+    const purging = openQueue(gaia, dir);
+    purging.start();
+    try {
+      assertEquals(purging.get(old, OWNER), null);
+      assertEquals(exists(`${dir}/${old}.json`), false);
+      assertEquals(exists(`${dir}/${old}.input.json`), false);
+      assertEquals(purging.get(recent, OWNER)?.status, "completed");
+      // Only finished jobs expire
+      assertEquals(purging.get(pending, OWNER) !== null, true);
+    } finally {
+      await purging.close();
+    }
+  }),
+);
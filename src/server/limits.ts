@@ -0,0 +1,207 @@
+/**
+ * API keys and per-client rate limits.
+ *
+ * Each client (an API key, or the remote address when keys aren't in use)
+ * gets two token buckets: one for requests and one for rows returned.
+ * A request is refused while either bucket is empty. Rows are charged after
+ * the response is built, so one large page can push the row bucket into
+ * debt and hold off the client until it refills. Clients whose buckets
+ * have refilled are forgotten, since fresh buckets would be the same.
+ */
+
+export interface ApiKey {
+  /** Name used in logs */
+  name: string;
+  key: string;
+  /** Overrides the server's default request limit for this key */
+  requestsPerMinute?: number;
+  /** Overrides the server's default row limit for this key */
+  rowsPerMinute?: number;
+}
+
+export interface RateLimits {
+  /** Requests per minute, 0 for unlimited */
+  requestsPerMinute: number;
+  /** Rows returned per minute, 0 for unlimited */
+  rowsPerMinute: number;
+}
+
+/**
+ * Load API keys from a JSON file holding an array of
+ * `{ name, key, requestsPerMinute?, rowsPerMinute? }`
+ */
+export async function loadApiKeys(path: string): Promise<ApiKey[]> {
+  const parsed = JSON.parse(await Deno.readTextFile(path));
+
+  if (!Array.isArray(parsed)) {
+    throw new Error(`API key file ${path} must contain a JSON array`);
+  }
+
+  return parsed.map((entry, index) => {
+    if (typeof entry?.key !== "string" || entry.key.length === 0) {
+      throw new Error(`API key ${index} in ${path} has no "key"`);
+    }
+
+    for (const field of ["requestsPerMinute", "rowsPerMinute"]) {
+      if (entry[field] !== undefined && typeof entry[field] !== "number") {
+        throw new Error(
+          `API key ${index} in ${path}: ${field} must be a number`,
+        );
+      }
+    }
+
+    return {
+      name: typeof entry.name === "string" ? entry.name : `key-${index}`,
+      key: entry.key,
+      requestsPerMinute: entry.requestsPerMinute,
+      rowsPerMinute: entry.rowsPerMinute,
+    };
+  });
+}
+
+class TokenBucket {
+  private perMinute: number;
+  private tokens: number;
+  private updatedAt = Date.now();
+
+  constructor(perMinute: number) {
+    this.perMinute = perMinute;
+    this.tokens = perMinute;
+  }
+
+  private refill(now: number) {
+    const elapsed = (now - this.updatedAt) / 60000;
+    this.tokens = Math.min(
+      this.perMinute,
+      this.tokens + elapsed * this.perMinute,
+    );
+    this.updatedAt = now;
+  }
+
+  /**
+   * Seconds until at least one token is available, 0 if one is now
+   */
+  wait(now = Date.now()): number {
+    if (this.perMinute <= 0) {
+      return 0;
+    }
+    this.refill(now);
+    return this.tokens >= 1
+      ? 0
+      : Math.ceil(((1 - this.tokens) / this.perMinute) * 60);
+  }
+
+  take(amount: number, now = Date.now()) {
+    if (this.perMinute <= 0) {
+      return;
+    }
+    this.refill(now);
+    this.tokens -= amount;
+  }
+
+  remaining(): number {
+    return this.perMinute <= 0
+      ? Infinity
+      : Math.max(0, Math.floor(this.tokens));
+  }
+
+  /**
+   * Whether the bucket has refilled, as a new one would be
+   */
+  full(now = Date.now()): boolean {
+    if (this.perMinute <= 0) {
+      return true;
+    }
+    this.refill(now);
+    return this.tokens >= this.perMinute;
+  }
+}
+
+interface ClientBuckets {
+  requests: TokenBucket;
+  rows: TokenBucket;
+}
+
+/** How often idle clients are swept out */
+const SWEEP_INTERVAL_MS = 60_000;
+
+export class RateLimiter {
+  private clients = new Map<string, ClientBuckets>();
+  private defaults: RateLimits;
+  private sweptAt = Date.now();
+
+  constructor(defaults: RateLimits) {
+    this.defaults = defaults;
+  }
+
+  private buckets(client: string, limits: Partial<RateLimits>): ClientBuckets {
+    let buckets = this.clients.get(client);
+    if (!buckets) {
+      buckets = {
+        requests: new TokenBucket(
+          limits.requestsPerMinute ?? this.defaults.requestsPerMinute,
+        ),
+        rows: new TokenBucket(
+          limits.rowsPerMinute ?? this.defaults.rowsPerMinute,
+        ),
+      };
+      this.clients.set(client, buckets);
+    }
+    return buckets;
+  }
+
+  /**
+   * Admit a request, returning the seconds to wait if it must be refused
+   */
+  admit(
+    client: string,
+    limits: Partial<RateLimits> = {},
+    now = Date.now(),
+  ): number {
+    if (now - this.sweptAt >= SWEEP_INTERVAL_MS) {
+      this.sweep(now);
+    }
+
+    const buckets = this.buckets(client, limits);
+    const wait = Math.max(buckets.requests.wait(now), buckets.rows.wait(now));
+    if (wait > 0) {
+      return wait;
+    }
+
+    buckets.requests.take(1, now);
+    return 0;
+  }
+
+  /**
+   * Forget clients whose buckets have both refilled
+   */
+  sweep(now = Date.now()) {
+    for (const [client, buckets] of this.clients) {
+      if (buckets.requests.full(now) && buckets.rows.full(now)) {
+        this.clients.delete(client);
+      }
+    }
+    this.sweptAt = now;
+  }
+
+  /**
+   * Clients with buckets in memory
+   */
+  get size(): number {
+    return this.clients.size;
+  }
+
+  /**
+   * Charge rows returned to a client
+   */
+  chargeRows(client: string, rows: number) {
+    this.clients.get(client)?.rows.take(rows);
+  }
+
+  /**
+   * Requests left in the client's current window
+   */
+  remaining(client: string): number {
+    return this.clients.get(client)?.requests.remaining() ?? Infinity;
+  }
+}
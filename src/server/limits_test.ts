@@ -0,0 +1,111 @@
+import { assertEquals, assertRejects } from "@std/assert";
+import { loadApiKeys, RateLimiter } from "./limits.ts";
+
+Deno.test("requests are refused once the bucket is empty", () => {
+  const limiter = new RateLimiter({ requestsPerMinute: 2, rowsPerMinute: 0 });
+  const now = Date.now();
+  assertEquals(limiter.admit("a", {}, now), 0);
+  assertEquals(limiter.admit("a", {}, now), 0);
+  assertEquals(limiter.admit("a", {}, now), 30);
+  // Each client has its own buckets
+  assertEquals(limiter.admit("b", {}, now), 0);
+  // Half a minute refills one of two tokens
+  assertEquals(limiter.admit("a", {}, now + 30_000), 0);
+  assertEquals(limiter.remaining("a"), 0);
+});
+
+Deno.test("rows are charged after the response and can go into debt", () => {
+  const limiter = new RateLimiter({
+    requestsPerMinute: 0,
+    rowsPerMinute: 60,
+  });
+  const now = Date.now();
+  assertEquals(limiter.admit("a", {}, now), 0);
+  limiter.chargeRows("a", 120);
+  // 61 rows short: a row a second
+  assertEquals(limiter.admit("a", {}, now), 61);
+  assertEquals(limiter.remaining("a"), Infinity);
+});
+
+Deno.test("per-key limits override the defaults", () => {
+  const limiter = new RateLimiter({ requestsPerMinute: 1, rowsPerMinute: 0 });
+  const now = Date.now();
+  for (let i = 0; i < 5; i++) {
+    assertEquals(
+      limiter.admit("key:pipeline", { requestsPerMinute: 0 }, now),
+      0,
+    );
+  }
+  assertEquals(limiter.admit("key:alice", {}, now), 0);
+  assertEquals(limiter.admit("key:alice", {}, now) > 0, true);
+});
+
+Deno.test("clients are forgotten once their buckets refill", () => {
+  const limiter = new RateLimiter({
+    requestsPerMinute: 60,
+    rowsPerMinute: 600,
+  });
+  const now = Date.now();
+  for (let i = 0; i < 100; i++) {
+    limiter.admit(`ip:10.0.0.${i}`, {}, now);
+  }
+  limiter.chargeRows("ip:10.0.0.0", 6000);
+  assertEquals(limiter.size, 100);
+
+  // A minute on every request bucket has refilled, but client 0 still owes
+  // rows; the sweep runs on the next request
+  limiter.admit("ip:10.0.1.1", {}, now + 60_000);
+  assertEquals(limiter.size, 2);
+  assertEquals(limiter.admit("ip:10.0.0.0", {}, now + 60_000) > 0, true);
+
+  limiter.sweep(now + 60 * 60_000);
+  assertEquals(limiter.size, 0);
+});
+
+Deno.test("API key files are validated", async () => {
+  const dir = Deno.makeTempDirSync();
+  const write = (value: unknown) => {
+    const path = `${dir}/keys-${crypto.randomUUID()}.json`;
+    Deno.writeTextFileSync(path, JSON.stringify(value));
+    return path;
+  };
+  try {
+    assertEquals(
+      await loadApiKeys(write([
+        { name: "alice", key: "k1", requestsPerMinute: 120 },
+        { key: "k2" },
+      ])),
+      [
+        {
+          name: "alice",
+          key: "k1",
+          requestsPerMinute: 120,
+          rowsPerMinute: undefined,
+        },
+        {
+          name: "key-1",
+          key: "k2",
+          requestsPerMinute: undefined,
+          rowsPerMinute: undefined,
+        },
+      ],
+    );
+    await assertRejects(
+      () => loadApiKeys(write({ key: "k" })),
+      Error,
+      "must contain a JSON array",
+    );
+    await assertRejects(
+      () => loadApiKeys(write([{ name: "x" }])),
+      Error,
+      "API key 0 in",
+    );
+    await assertRejects(
+      () => loadApiKeys(write([{ key: "k", rowsPerMinute: "10" }])),
+      Error,
+      "rowsPerMinute must be a number",
+    );
+  } finally {
+    Deno.removeSync(dir, { recursive: true });
+  }
+});
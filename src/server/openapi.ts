@@ -0,0 +1,170 @@
+import { type ParamSpec, paginationParams, type Route } from "./routes.ts";
+
+/**
+ * Build the OpenAPI 3 document for a set of routes from their parameter
+ * specs, so the document can't drift from what the handlers accept
+ */
+export function buildOpenApi(
+  routes: Route[],
+  options: { version: string; apiKeys: boolean },
+): Record<string, unknown> {
+  const paths: Record<string, Record<string, unknown>> = {};
+
+  for (const route of routes) {
+    const params = route.paginated
+      ? [...route.params, ...paginationParams]
+      : route.params;
+
+    const responses: Record<string, unknown> = {
+      [String(route.successStatus ?? 200)]: {
+        description: "OK",
+        content: route.contentType
+          ? { [route.contentType]: { schema: { type: "string" } } }
+          : route.raw
+          ? {
+            "application/octet-stream": {
+              schema: { type: "string", format: "binary" },
+            },
+          }
+          : route.streaming
+          ? {
+            "application/x-ndjson": {
+              schema: { $ref: "#/components/schemas/StreamMessage" },
+            },
+          }
+          : {
+            "application/json": {
+              schema: route.paginated
+                ? { $ref: "#/components/schemas/Page" }
+                : { type: "object" },
+            },
+          },
+      },
+    };
+
+    if (params.length > 0 || route.body) {
+      responses["400"] = errorResponse("Invalid parameters");
+    }
+    if (!route.public) {
+      if (options.apiKeys) {
+        responses["401"] = errorResponse("Missing or unknown API key");
+      }
+      responses["429"] = errorResponse(
+        "Rate limit exceeded; see the Retry-After header",
+      );
+    }
+
+    const operation: Record<string, unknown> = {
+      summary: route.summary,
+      parameters: params.map(toParameter),
+      responses,
+    };
+
+    if (route.body) {
+      operation.requestBody = {
+        required: true,
+        content: {
+          "application/json": { schema: route.body },
+          ...(route.upload
+            ? { [route.upload]: { schema: { type: "string" } } }
+            : {}),
+        },
+      };
+    }
+
+    if (options.apiKeys && !route.public) {
+      operation.security = [{ ApiKeyHeader: [] }, { BearerKey: [] }];
+    }
+
+    paths[route.path] = {
+      ...paths[route.path],
+      [route.method.toLowerCase()]: operation,
+    };
+  }
+
+  return {
+    openapi: "3.0.3",
+    info: {
+      title: "Gaia Offline",
+      description: "Query a local copy of the Gaia DR3 catalogue",
+      version: options.version,
+    },
+    paths,
+    components: {
+      schemas: {
+        Page: {
+          type: "object",
+          required: ["data", "count", "next_cursor"],
+          properties: {
+            data: { type: "array", items: { type: "object" } },
+            count: { type: "integer", description: "Rows in this page" },
+            next_cursor: {
+              type: "string",
+              nullable: true,
+              description: "Pass as `cursor` to fetch the next page; null on the last page",
+            },
+          },
+        },
+        StreamMessage: {
+          type: "object",
+          description:
+            "One line of a streamed response, or one WebSocket message. Send `{\"type\": \"cancel\"}` on a WebSocket to stop the scan.",
+          required: ["type"],
+          properties: {
+            type: {
+              type: "string",
+              enum: ["rows", "progress", "done", "cancelled", "error"],
+            },
+            data: { type: "array", items: { type: "object" } },
+            rows: { type: "integer", description: "Rows sent so far" },
+            complete: {
+              type: "number",
+              description: "Fraction of the region scanned",
+            },
+            error: { type: "string" },
+          },
+        },
+        Error: {
+          type: "object",
+          required: ["error"],
+          properties: { error: { type: "string" } },
+        },
+      },
+      ...(options.apiKeys
+        ? {
+          securitySchemes: {
+            ApiKeyHeader: { type: "apiKey", in: "header", name: "X-API-Key" },
+            BearerKey: { type: "http", scheme: "bearer" },
+          },
+        }
+        : {}),
+    },
+  };
+}
+
+function toParameter(spec: ParamSpec): Record<string, unknown> {
+  const schema: Record<string, unknown> = { type: spec.type };
+  if (spec.enum) schema.enum = spec.enum;
+  if (spec.default !== undefined) schema.default = spec.default;
+  if (spec.minimum !== undefined) schema.minimum = spec.minimum;
+  if (spec.maximum !== undefined) schema.maximum = spec.maximum;
+
+  return {
+    name: spec.name,
+    in: spec.in ?? "query",
+    description: spec.description,
+    required: spec.required ?? false,
+    schema,
+  };
+}
+
+function errorResponse(description: string): Record<string, unknown> {
+  return {
+    description,
+    content: {
+      "application/json": {
+        schema: { $ref: "#/components/schemas/Error" },
+      },
+    },
+  };
+}
@@ -0,0 +1,121 @@
+/**
+ * Opaque cursors for paging through list endpoints.
+ *
+ * A cursor records where the next page starts and a fingerprint of the
+ * query that produced it, so a cursor can't be replayed against a
+ * different query. Where the next page starts is the key of the last row
+ * returned for routes ordered by a unique key, which the query can seek
+ * to, and otherwise an offset into the result.
+ */
+
+export const DEFAULT_PAGE_SIZE = 100;
+export const MAX_PAGE_SIZE = 10000;
+
+export interface Cursor {
+  /** Rows of the result before the next page */
+  offset?: number;
+  /** Key of the last row returned, for keyset-paginated routes */
+  after?: string;
+  fingerprint: string;
+}
+
+export interface Page<T> {
+  data: T[];
+  count: number;
+  next_cursor: string | null;
+}
+
+/**
+ * FNV-1a hash of the canonical form of a query's parameters
+ */
+export function queryFingerprint(params: Record<string, unknown>): string {
+  const canonical = JSON.stringify(
+    Object.keys(params).sort().map((key) => [key, params[key]]),
+  );
+
+  let hash = 0x811c9dc5;
+  for (let i = 0; i < canonical.length; i++) {
+    hash ^= canonical.charCodeAt(i);
+    hash = Math.imul(hash, 0x01000193);
+  }
+
+  return (hash >>> 0).toString(16).padStart(8, "0");
+}
+
+export function encodeCursor(cursor: Cursor): string {
+  return btoa(JSON.stringify(cursor))
+    .replace(/\+/g, "-")
+    .replace(/\//g, "_")
+    .replace(/=+$/, "");
+}
+
+/**
+ * Decode a cursor, checking it belongs to the query with `fingerprint`.
+ * Throws on malformed or mismatched cursors.
+ */
+export function decodeCursor(value: string, fingerprint: string): Cursor {
+  let cursor: Cursor;
+  try {
+    cursor = JSON.parse(atob(value.replace(/-/g, "+").replace(/_/g, "/")));
+  } catch {
+    throw new Error("Malformed cursor");
+  }
+
+  const validOffset = typeof cursor?.offset === "number" &&
+    Number.isInteger(cursor.offset) && cursor.offset >= 0;
+  const validKey = typeof cursor?.after === "string";
+  if (validOffset === validKey) {
+    throw new Error("Malformed cursor");
+  }
+
+  if (cursor.fingerprint !== fingerprint) {
+    throw new Error("Cursor does not belong to this query");
+  }
+
+  return cursor;
+}
+
+/**
+ * Cut one page out of `rows`, which must hold everything from the start of
+ * the result up to at least one row past the page
+ */
+export function paginate<T>(
+  rows: T[],
+  offset: number,
+  pageSize: number,
+  fingerprint: string,
+): Page<T> {
+  const data = rows.slice(offset, offset + pageSize);
+  const hasMore = rows.length > offset + pageSize;
+
+  return {
+    data,
+    count: data.length,
+    next_cursor: hasMore
+      ? encodeCursor({ offset: offset + pageSize, fingerprint })
+      : null,
+  };
+}
+
+/**
+ * Cut one page from the start of `rows`, which must be ordered by `key`
+ * and begin after the previous page's last row. The cursor records the
+ * last row's key.
+ */
+export function paginateAfter<T extends Record<string, unknown>>(
+  rows: T[],
+  key: string,
+  pageSize: number,
+  fingerprint: string,
+): Page<T> {
+  const data = rows.slice(0, pageSize);
+  const hasMore = rows.length > pageSize;
+
+  return {
+    data,
+    count: data.length,
+    next_cursor: hasMore
+      ? encodeCursor({ after: String(data.at(-1)![key]), fingerprint })
+      : null,
+  };
+}
@@ -0,0 +1,107 @@
+import { assertEquals, assertThrows } from "@std/assert";
+import {
+  decodeCursor,
+  encodeCursor,
+  paginate,
+  paginateAfter,
+  queryFingerprint,
+} from "./pagination.ts";
+
+Deno.test("fingerprints ignore parameter order", () => {
+  assertEquals(
+    queryFingerprint({ ra: 1, dec: 2, path: "/cone" }),
+    queryFingerprint({ path: "/cone", dec: 2, ra: 1 }),
+  );
+  assertEquals(
+    queryFingerprint({ ra: 1 }) === queryFingerprint({ ra: 2 }),
+    false,
+  );
+});
+
+Deno.test("cursors round-trip and are URL-safe", () => {
+  for (
+    const cursor of [
+      { offset: 300, fingerprint: "0badf00d" },
+      { after: "4295806720", fingerprint: "0badf00d" },
+      // Encodes to base64 with "+", "/" and padding
+      { after: "?>?~~~", fingerprint: "ff" },
+    ]
+  ) {
+    const encoded = encodeCursor(cursor);
+    assertEquals(/^[A-Za-z0-9_-]+$/.test(encoded), true, encoded);
+    assertEquals(decodeCursor(encoded, cursor.fingerprint), cursor);
+  }
+});
+
+Deno.test("cursors are checked", () => {
+  const fingerprint = "0badf00d";
+  assertThrows(
+    () =>
+      decodeCursor(
+        encodeCursor({ offset: 1, fingerprint: "other" }),
+        fingerprint,
+      ),
+    Error,
+    "does not belong to this query",
+  );
+  for (
+    const value of [
+      "not base64!",
+      btoa("not json"),
+      btoa(JSON.stringify({ fingerprint })),
+      btoa(JSON.stringify({ offset: -1, fingerprint })),
+      btoa(JSON.stringify({ offset: 1.5, fingerprint })),
+      btoa(JSON.stringify({ after: 7, fingerprint })),
+      btoa(JSON.stringify({ offset: 1, after: "7", fingerprint })),
+    ]
+  ) {
+    assertThrows(
+      () => decodeCursor(value, fingerprint),
+      Error,
+      "Malformed cursor",
+    );
+  }
+});
+
+Deno.test("offset pages cover the result once", () => {
+  const rows = Array.from({ length: 7 }, (_, i) => i);
+  const seen: number[] = [];
+  let offset = 0;
+  for (let pages = 0; pages < 10; pages++) {
+    const page = paginate(rows, offset, 3, "f");
+    seen.push(...page.data);
+    assertEquals(page.count, page.data.length);
+    if (!page.next_cursor) {
+      break;
+    }
+    offset = decodeCursor(page.next_cursor, "f").offset!;
+  }
+  assertEquals(seen, rows);
+});
+
+Deno.test("keyset pages resume after the last key", () => {
+  const rows = ["10", "11", "20", "31", "42"].map((source_id) => ({
+    source_id,
+  }));
+  const seen: string[] = [];
+  let after: string | undefined;
+  for (let pages = 0; pages < 10; pages++) {
+    // What a handler returns: rows after the key, one more than a page
+    const start = after === undefined
+      ? 0
+      : rows.findIndex((row) => row.source_id > after!);
+    const page = paginateAfter(
+      rows.slice(start, start + 3),
+      "source_id",
+      2,
+      "f",
+    );
+    seen.push(...page.data.map((row) => row.source_id));
+    if (!page.next_cursor) {
+      break;
+    }
+    after = decodeCursor(page.next_cursor, "f").after;
+    assertEquals(after, seen.at(-1));
+  }
+  assertEquals(seen, rows.map((row) => row.source_id));
+});
@@ -0,0 +1,958 @@
+import type { Gaia, GaiaOptions, XmatchTarget } from "../gaia.ts";
+import {
+  getExtinctionOptions,
+  getLuminosityClasses,
+  getMagnitudeLimit,
+  getPhotometryOutput,
+  getSpectralTypes,
+} from "../commands/query.ts";
+import { metrics } from "../metrics.ts";
+import { parse as parseCSV } from "@std/csv";
+import {
+  type ConeFormValues,
+  renderConeError,
+  renderConeResults,
+  renderDocs,
+} from "./docs.ts";
+import {
+  type JobFormat,
+  jobFormats,
+  type JobInfo,
+  type JobOperation,
+  jobOperations,
+  type JobQueue,
+  type JobRequest,
+  MAX_JOB_INPUT,
+} from "./jobs.ts";
+
+/**
+ * An error with an HTTP status, reported to the client as `{ error }`
+ */
+export class HttpError extends Error {
+  status: number;
+
+  constructor(status: number, message: string) {
+    super(message);
+    this.status = status;
+  }
+}
+
+export type ParamType = "number" | "integer" | "string" | "boolean";
+
+/**
+ * A query-string parameter. The same spec drives parsing and the OpenAPI
+ * document.
+ */
+export interface ParamSpec {
+  name: string;
+  /**
+   * Where the value comes from; path parameters appear in the route's path
+   * as `{name}`
+   * @default "query"
+   */
+  in?: "query" | "path";
+  type: ParamType;
+  description: string;
+  required?: boolean;
+  enum?: string[];
+  default?: string | number | boolean;
+  minimum?: number;
+  maximum?: number;
+}
+
+export type Params = Record<string, string | number | boolean | undefined>;
+
+export interface RouteContext {
+  /** Catalogue with the server's default options */
+  gaia: Gaia;
+  params: Params;
+  body: unknown;
+  /** Rows the handler must return at least (offset + page size + 1) */
+  rowsNeeded: number;
+  /**
+   * For keyset-paginated routes, the key of the previous page's last row;
+   * the handler returns only rows after it
+   */
+  after?: string;
+  /** The generated OpenAPI document */
+  openapi: Record<string, unknown>;
+  /** Identifies the caller: their API key, or address without keys */
+  client: string;
+  /** Whether the server requires API keys */
+  apiKeys: boolean;
+  /** Async job queue, when the server runs one */
+  jobs: JobQueue | null;
+}
+
+export interface Route {
+  method: "GET" | "POST" | "DELETE";
+  path: string;
+  summary: string;
+  params: ParamSpec[];
+  /** JSON schema of the request body, for POST routes */
+  body?: Record<string, unknown>;
+  /**
+   * Also accept a body of this content type, passed to the handler as text
+   */
+  upload?: string;
+  /** List endpoints return rows and take `page_size` and `cursor` */
+  paginated: boolean;
+  /**
+   * Page by this unique column rather than by offset: the handler returns
+   * rows ordered by it, starting after `after`
+   */
+  keyset?: string;
+  /**
+   * The handler returns a generator of `ScanBatch`es, streamed as NDJSON or
+   * over a WebSocket when the request asks to upgrade
+   */
+  streaming?: boolean;
+  /** Reachable without an API key */
+  public?: boolean;
+  /** The handler returns the body as a string of this type, not JSON */
+  contentType?: string;
+  /** The handler returns a `Response`, e.g. a file download */
+  raw?: boolean;
+  /**
+   * Status of a successful response
+   * @default 200
+   */
+  successStatus?: number;
+  handler(context: RouteContext): unknown;
+}
+
+/**
+ * Parameters added to every paginated route
+ */
+export const paginationParams: ParamSpec[] = [
+  {
+    name: "page_size",
+    type: "integer",
+    description: "Rows per page",
+    default: 100,
+    minimum: 1,
+    maximum: 10000,
+  },
+  {
+    name: "cursor",
+    type: "string",
+    description: "`next_cursor` from the previous page",
+  },
+];
+
+/**
+ * Parameters controlling the output columns of list endpoints
+ */
+const outputParams: ParamSpec[] = [
+  {
+    name: "photometry",
+    type: "string",
+    description: "Photometry output",
+    enum: ["flux", "magnitude"],
+    default: "flux",
+  },
+  {
+    name: "magnitude_limit",
+    type: "string",
+    description: "G magnitude range as `min,max`",
+    default: "-3,20",
+  },
+  {
+    name: "xmatch",
+    type: "boolean",
+    description: "Include 2MASS J, H, K photometry",
+    default: false,
+  },
+  {
+    name: "classify",
+    type: "boolean",
+    description: "Add spectral type, luminosity class and absolute G",
+    default: false,
+  },
+  {
+    name: "spectral_type",
+    type: "string",
+    description: "Comma-separated spectral types to keep (O, B, A, F, G, K, M)",
+  },
+  {
+    name: "luminosity_class",
+    type: "string",
+    description: "Comma-separated luminosity classes to keep (dwarf, subgiant, giant)",
+  },
+  {
+    name: "deredden",
+    type: "boolean",
+    description: "Add extinction-corrected photometry",
+    default: false,
+  },
+  {
+    name: "ag",
+    type: "number",
+    description: "Fallback G-band extinction for dereddening (mag)",
+  },
+  {
+    name: "ebpminrp",
+    type: "number",
+    description: "Fallback E(BP-RP) for dereddening (mag)",
+  },
+];
+
+const positionParams: ParamSpec[] = [
+  {
+    name: "ra",
+    type: "number",
+    description: "Right ascension (degrees)",
+    required: true,
+    minimum: 0,
+    maximum: 360,
+  },
+  {
+    name: "dec",
+    type: "number",
+    description: "Declination (degrees)",
+    required: true,
+    minimum: -90,
+    maximum: 90,
+  },
+];
+
+const radiusParam: ParamSpec = {
+  name: "radius",
+  type: "number",
+  description: "Search radius (degrees)",
+  required: true,
+  minimum: 0,
+  maximum: 180,
+};
+
+/**
+ * Parse query-string values against their specs, throwing 400 on bad input
+ */
+export function parseParams(
+  specs: ParamSpec[],
+  search: URLSearchParams,
+  pathParams: Record<string, string> = {},
+): Params {
+  const params: Params = {};
+
+  for (const spec of specs) {
+    const raw = spec.in === "path"
+      ? pathParams[spec.name] ?? null
+      : search.get(spec.name);
+    if (raw === null || raw === "") {
+      if (spec.required) {
+        throw new HttpError(400, `Missing required parameter: ${spec.name}`);
+      }
+      params[spec.name] = spec.default;
+      continue;
+    }
+
+    let value: string | number | boolean = raw;
+    if (spec.type === "number" || spec.type === "integer") {
+      value = Number(raw);
+      if (
+        isNaN(value) || (spec.type === "integer" && !Number.isInteger(value))
+      ) {
+        throw new HttpError(400, `${spec.name} must be a ${spec.type}`);
+      }
+      if (
+        (spec.minimum !== undefined && value < spec.minimum) ||
+        (spec.maximum !== undefined && value > spec.maximum)
+      ) {
+        throw new HttpError(
+          400,
+          `${spec.name} must be between ${spec.minimum ?? "-∞"} and ${
+            spec.maximum ?? "∞"
+          }`,
+        );
+      }
+    } else if (spec.type === "boolean") {
+      if (raw !== "true" && raw !== "false") {
+        throw new HttpError(400, `${spec.name} must be true or false`);
+      }
+      value = raw === "true";
+    } else if (spec.enum && !spec.enum.includes(raw)) {
+      throw new HttpError(
+        400,
+        `${spec.name} must be one of ${spec.enum.join(", ")}`,
+      );
+    }
+
+    params[spec.name] = value;
+  }
+
+  return params;
+}
+
+/**
+ * Catalogue options from the output parameters
+ */
+function queryOptions(params: Params): GaiaOptions {
+  const str = (name: string) =>
+    params[name] === undefined ? undefined : String(params[name]);
+
+  try {
+    return {
+      photometryOutput: getPhotometryOutput(str("photometry")),
+      magnitudeLimit: getMagnitudeLimit(str("magnitude_limit")),
+      tmassCrossmatch: params.xmatch === true,
+      classify: params.classify === true,
+      spectralTypes: getSpectralTypes(str("spectral_type")),
+      luminosityClasses: getLuminosityClasses(str("luminosity_class")),
+      extinction: getExtinctionOptions(
+        params.deredden === true,
+        str("ag"),
+        str("ebpminrp"),
+      ),
+    };
+  } catch (error) {
+    throw new HttpError(400, (error as Error).message);
+  }
+}
+
+function derive(context: RouteContext, options: GaiaOptions = {}): Gaia {
+  try {
+    return context.gaia.derive({ ...queryOptions(context.params), ...options });
+  } catch (error) {
+    // e.g. xmatch requested without a 2MASS table
+    throw new HttpError(400, (error as Error).message);
+  }
+}
+
+const MAX_XMATCH_TARGETS = 10000;
+
+function parseXmatchBody(body: unknown): {
+  targets: XmatchTarget[];
+  radius: number;
+} {
+  const request = body as { targets?: unknown; radius?: unknown } | null;
+  if (!request || !Array.isArray(request.targets)) {
+    throw new HttpError(400, "Body must be { targets: [{ ra, dec, id? }] }");
+  }
+
+  if (request.targets.length > MAX_XMATCH_TARGETS) {
+    throw new HttpError(
+      400,
+      `At most ${MAX_XMATCH_TARGETS} targets per request`,
+    );
+  }
+
+  const targets = request.targets.map((target, index) => {
+    const { ra, dec, id } = target ?? {};
+    if (typeof ra !== "number" || typeof dec !== "number") {
+      throw new HttpError(400, `Target ${index} needs numeric ra and dec`);
+    }
+    return { ra, dec, id: id === undefined ? undefined : String(id) };
+  });
+
+  const radius = request.radius ?? 1;
+  if (typeof radius !== "number" || radius <= 0) {
+    throw new HttpError(400, "radius must be a positive number (arcsec)");
+  }
+
+  return { targets, radius };
+}
+
+/**
+ * Path parameters if `pathname` matches the route's path, else null
+ */
+export function matchPath(
+  route: Route,
+  pathname: string,
+): Record<string, string> | null {
+  const names: string[] = [];
+  const pattern = route.path.replace(/\{(\w+)\}/g, (_, name) => {
+    names.push(name);
+    return "([^/]+)";
+  });
+
+  const match = pathname.match(new RegExp(`^${pattern}$`));
+  if (!match) {
+    return null;
+  }
+
+  try {
+    return Object.fromEntries(
+      names.map((name, i) => [name, decodeURIComponent(match[i + 1])]),
+    );
+  } catch {
+    throw new HttpError(400, `Malformed percent-encoding in ${pathname}`);
+  }
+}
+
+function requireJobs(context: RouteContext): JobQueue {
+  if (!context.jobs) {
+    throw new HttpError(
+      404,
+      "Jobs are not enabled; start the server with --jobs-dir",
+    );
+  }
+  return context.jobs;
+}
+
+/**
+ * Job input from a JSON body (`targets` or `source_ids`) or an uploaded
+ * CSV with `ra`, `dec` and optional `id` columns, or a `source_id` column
+ */
+function parseJobInput(
+  operation: JobOperation,
+  body: unknown,
+): Pick<JobRequest, "targets" | "sourceIds"> {
+  if (operation === "cone") {
+    return {};
+  }
+
+  let rows: Record<string, unknown>[];
+  if (typeof body === "string") {
+    try {
+      rows = parseCSV(body, { skipFirstRow: true }) as Record<
+        string,
+        string
+      >[];
+    } catch (error) {
+      throw new HttpError(400, `Invalid CSV: ${(error as Error).message}`);
+    }
+  } else {
+    const json = body as { targets?: unknown; source_ids?: unknown } | null;
+    const list = operation === "xmatch" ? json?.targets : json?.source_ids;
+    if (!Array.isArray(list)) {
+      throw new HttpError(
+        400,
+        operation === "xmatch"
+          ? "Upload a CSV with ra, dec and id columns, or { targets: [...] }"
+          : "Upload a CSV with a source_id column, or { source_ids: [...] }",
+      );
+    }
+    rows = operation === "xmatch"
+      ? list
+      : list.map((id) => ({ source_id: id }));
+  }
+
+  if (rows.length === 0) {
+    throw new HttpError(400, "The input is empty");
+  }
+  if (rows.length > MAX_JOB_INPUT) {
+    throw new HttpError(400, `At most ${MAX_JOB_INPUT} input rows per job`);
+  }
+
+  if (operation === "lookup") {
+    const sourceIds = rows.map((row, index) => {
+      const id = String(row.source_id ?? "").trim();
+      if (!/^\d+$/.test(id)) {
+        throw new HttpError(400, `Row ${index} needs a numeric source_id`);
+      }
+      return id;
+    });
+    return { sourceIds };
+  }
+
+  const targets = rows.map((row, index) => {
+    const ra = Number(row.ra);
+    const dec = Number(row.dec);
+    if (
+      row.ra === undefined || row.ra === "" || isNaN(ra) ||
+      row.dec === undefined || row.dec === "" || isNaN(dec)
+    ) {
+      throw new HttpError(400, `Row ${index} needs numeric ra and dec`);
+    }
+    const id = row.id ?? row.name;
+    return {
+      ra,
+      dec,
+      id: id === undefined || id === "" ? undefined : String(id),
+    };
+  });
+  return { targets };
+}
+
+const jobIdParam: ParamSpec = {
+  name: "id",
+  in: "path",
+  type: "string",
+  description: "Job id",
+  required: true,
+};
+
+const jobContentTypes: Record<JobFormat, string> = {
+  csv: "text/csv",
+  ndjson: "application/x-ndjson",
+  json: "application/json",
+};
+
+/**
+ * Job status with links to itself and, once complete, its result
+ */
+function jobResponse(job: JobInfo) {
+  return {
+    ...job,
+    status_url: `/jobs/${job.id}`,
+    result_url: job.status === "completed" ? `/jobs/${job.id}/result` : null,
+  };
+}
+
+const HTML = "text/html; charset=utf-8";
+const MAX_FORM_ROWS = 1000;
+
+export const routes: Route[] = [
+  {
+    method: "GET",
+    path: "/",
+    summary: "Redirect to the documentation",
+    params: [],
+    paginated: false,
+    public: true,
+    raw: true,
+    handler: () =>
+      new Response(null, { status: 302, headers: { Location: "/docs" } }),
+  },
+  {
+    method: "GET",
+    path: "/docs",
+    summary:
+      "HTML documentation: tables, columns with units, coverage and examples",
+    params: [],
+    paginated: false,
+    public: true,
+    contentType: HTML,
+    handler: ({ gaia, openapi, apiKeys }) =>
+      renderDocs(gaia, {
+        version: (openapi.info as { version: string }).version,
+        apiKeys,
+      }),
+  },
+  {
+    method: "GET",
+    path: "/docs/cone",
+    summary: "HTML cone search form and results",
+    params: [
+      { ...positionParams[0], required: false },
+      { ...positionParams[1], required: false },
+      { ...radiusParam, required: false },
+      outputParams[0],
+      outputParams[1],
+      {
+        name: "rows",
+        type: "integer",
+        description: "Rows to show",
+        default: 100,
+        minimum: 1,
+        maximum: MAX_FORM_ROWS,
+      },
+      {
+        name: "api_key",
+        type: "string",
+        description: "API key, for browsers that can't send headers",
+      },
+    ],
+    paginated: false,
+    contentType: HTML,
+    handler: (context) => {
+      const values = context.params as ConeFormValues;
+      const { ra, dec, radius, rows } = values;
+      if (ra === undefined || dec === undefined || radius === undefined) {
+        return renderConeError(
+          values,
+          "Enter a position and radius",
+          context.apiKeys,
+        );
+      }
+
+      let records;
+      try {
+        records = derive(context, { limit: rows! + 1 })
+          .coneSearch(ra, dec, radius);
+      } catch (error) {
+        return renderConeError(
+          values,
+          (error as Error).message,
+          context.apiKeys,
+        );
+      }
+
+      return renderConeResults(values, records.slice(0, rows), {
+        apiKeys: context.apiKeys,
+        truncated: records.length > rows!,
+      });
+    },
+  },
+  {
+    method: "GET",
+    path: "/cone",
+    summary: "Stars within a radius of a position, by source_id",
+    params: [...positionParams, radiusParam, ...outputParams],
+    paginated: true,
+    keyset: "source_id",
+    handler: (context) => {
+      const { ra, dec, radius } = context.params as Record<string, number>;
+      return derive(context, { limit: context.rowsNeeded })
+        .coneSearch(ra, dec, radius, { after: context.after });
+    },
+  },
+  {
+    method: "GET",
+    path: "/stream/cone",
+    summary:
+      "Stream a cone search with progress as NDJSON, or over a WebSocket when the request asks to upgrade",
+    params: [
+      ...positionParams,
+      radiusParam,
+      {
+        name: "batch_size",
+        type: "integer",
+        description: "Rows scanned between messages",
+        default: 1000,
+        minimum: 1,
+        maximum: 100000,
+      },
+      ...outputParams,
+    ],
+    paginated: false,
+    streaming: true,
+    handler: (context) => {
+      const { ra, dec, radius, batch_size } = context.params as Record<
+        string,
+        number
+      >;
+      return derive(context).streamConeSearch(ra, dec, radius, batch_size);
+    },
+  },
+  {
+    method: "GET",
+    path: "/nearest",
+    summary: "The stars nearest a position, closest first",
+    params: [
+      ...positionParams,
+      {
+        name: "n",
+        type: "integer",
+        description: "Number of stars",
+        default: 10,
+        minimum: 1,
+        maximum: 10000,
+      },
+      ...outputParams,
+    ],
+    paginated: true,
+    handler: (context) => {
+      const { ra, dec, n } = context.params as Record<string, number>;
+      return derive(context).nearest(ra, dec, n);
+    },
+  },
+  {
+    method: "GET",
+    path: "/lookup",
+    summary: "Stars by Gaia DR3 source_id",
+    params: [
+      {
+        name: "source_id",
+        type: "string",
+        description: "Comma-separated Gaia DR3 source_ids",
+        required: true,
+      },
+      ...outputParams,
+    ],
+    paginated: true,
+    handler: (context) => {
+      const ids = String(context.params.source_id)
+        .split(",")
+        .map((id) => id.trim())
+        .filter(Boolean);
+      return derive(context).lookup(ids);
+    },
+  },
+  {
+    method: "GET",
+    path: "/high-pm",
+    summary: "High proper-motion stars, fastest first",
+    params: [
+      {
+        name: "min_pm",
+        type: "number",
+        description: "Minimum total proper motion (mas/yr)",
+        required: true,
+        minimum: 0,
+      },
+      {
+        name: "ra",
+        type: "number",
+        description: "Cone centre right ascension (degrees)",
+      },
+      {
+        name: "dec",
+        type: "number",
+        description: "Cone centre declination (degrees)",
+      },
+      {
+        name: "radius",
+        type: "number",
+        description: "Cone radius (degrees); omit ra, dec and radius for all-sky",
+      },
+      {
+        name: "epoch",
+        type: "number",
+        description: "Propagate positions to this epoch (Julian year)",
+      },
+      ...outputParams,
+    ],
+    paginated: true,
+    handler: (context) => {
+      const { min_pm, ra, dec, radius, epoch } = context.params as Record<
+        string,
+        number | undefined
+      >;
+      const cone = [ra, dec, radius];
+      if (
+        cone.some((v) => v !== undefined) && cone.some((v) => v === undefined)
+      ) {
+        throw new HttpError(400, "ra, dec and radius must be given together");
+      }
+
+      const region = radius !== undefined
+        ? { ra: ra!, dec: dec!, radius }
+        : undefined;
+
+      return derive(context, { limit: context.rowsNeeded })
+        .highProperMotionSearch(min_pm!, { region, epoch });
+    },
+  },
+  {
+    method: "POST",
+    path: "/xmatch",
+    summary: "Closest star to each of a list of positions",
+    params: outputParams,
+    body: {
+      type: "object",
+      required: ["targets"],
+      properties: {
+        targets: {
+          type: "array",
+          maxItems: MAX_XMATCH_TARGETS,
+          items: {
+            type: "object",
+            required: ["ra", "dec"],
+            properties: {
+              id: { type: "string" },
+              ra: { type: "number" },
+              dec: { type: "number" },
+            },
+          },
+        },
+        radius: {
+          type: "number",
+          description: "Match radius (arcsec)",
+          default: 1,
+        },
+      },
+    },
+    paginated: true,
+    handler: (context) => {
+      const { targets, radius } = parseXmatchBody(context.body);
+      return derive(context).xmatch(targets, radius);
+    },
+  },
+  {
+    method: "POST",
+    path: "/jobs",
+    summary:
+      "Submit a crossmatch, lookup or cone export to run in the background",
+    params: [
+      {
+        name: "operation",
+        type: "string",
+        description: "What to run",
+        required: true,
+        enum: jobOperations,
+      },
+      {
+        name: "format",
+        type: "string",
+        description: "Result file format",
+        enum: jobFormats,
+        default: "csv",
+      },
+      {
+        name: "ra",
+        type: "number",
+        description: "Cone centre right ascension (degrees), for cone",
+        minimum: 0,
+        maximum: 360,
+      },
+      {
+        name: "dec",
+        type: "number",
+        description: "Cone centre declination (degrees), for cone",
+        minimum: -90,
+        maximum: 90,
+      },
+      {
+        name: "radius",
+        type: "number",
+        description: "Cone radius (degrees), for cone",
+        minimum: 0,
+        maximum: 180,
+      },
+      {
+        name: "match_radius",
+        type: "number",
+        description: "Match radius (arcsec), for xmatch",
+        default: 1,
+        minimum: 0,
+      },
+      ...outputParams,
+    ],
+    body: {
+      description:
+        "For xmatch, a CSV (text/csv) with ra, dec and optional id columns or { targets: [{ ra, dec, id? }] }; for lookup, a CSV with a source_id column or { source_ids: [...] }; nothing for cone",
+      type: "object",
+      properties: {
+        targets: {
+          type: "array",
+          items: {
+            type: "object",
+            required: ["ra", "dec"],
+            properties: {
+              id: { type: "string" },
+              ra: { type: "number" },
+              dec: { type: "number" },
+            },
+          },
+        },
+        source_ids: { type: "array", items: { type: "string" } },
+      },
+    },
+    upload: "text/csv",
+    paginated: false,
+    successStatus: 202,
+    handler: (context) => {
+      const jobs = requireJobs(context);
+      const operation = context.params.operation as JobOperation;
+      const { ra, dec, radius, match_radius } = context.params as Record<
+        string,
+        number | undefined
+      >;
+
+      let cone: JobRequest["cone"];
+      if (operation === "cone") {
+        if (ra === undefined || dec === undefined || radius === undefined) {
+          throw new HttpError(400, "cone needs ra, dec and radius");
+        }
+        cone = { ra, dec, radius };
+      }
+
+      // Fail now on options the catalogue can't satisfy
+      derive(context);
+
+      return jobResponse(jobs.submit(context.client, {
+        operation,
+        format: context.params.format as JobFormat,
+        options: queryOptions(context.params),
+        matchRadius: match_radius,
+        cone,
+        ...parseJobInput(operation, context.body),
+      }));
+    },
+  },
+  {
+    method: "GET",
+    path: "/jobs",
+    summary: "Your jobs, newest first",
+    params: [],
+    paginated: true,
+    handler: (context) =>
+      requireJobs(context).list(context.client).map(jobResponse),
+  },
+  {
+    method: "GET",
+    path: "/jobs/{id}",
+    summary: "A job's status and progress",
+    params: [jobIdParam],
+    paginated: false,
+    handler: (context) => {
+      const job = requireJobs(context).get(
+        String(context.params.id),
+        context.client,
+      );
+      if (!job) {
+        throw new HttpError(404, "No such job");
+      }
+      return jobResponse(job);
+    },
+  },
+  {
+    method: "GET",
+    path: "/jobs/{id}/result",
+    summary: "Download a completed job's result",
+    params: [jobIdParam],
+    paginated: false,
+    raw: true,
+    handler: async (context) => {
+      const jobs = requireJobs(context);
+      const job = jobs.get(String(context.params.id), context.client);
+      if (!job) {
+        throw new HttpError(404, "No such job");
+      }
+      if (job.status !== "completed") {
+        throw new HttpError(409, `Job is ${job.status}`);
+      }
+
+      const file = await Deno.open(jobs.resultPath(job.id, job.format));
+      return new Response(file.readable, {
+        headers: {
+          "Content-Type": jobContentTypes[job.format],
+          "Content-Disposition":
+            `attachment; filename="gaia-${job.operation}-${job.id}.${job.format}"`,
+        },
+      });
+    },
+  },
+  {
+    method: "DELETE",
+    path: "/jobs/{id}",
+    summary: "Cancel a job and delete it with its result",
+    params: [jobIdParam],
+    paginated: false,
+    handler: (context) => {
+      const id = String(context.params.id);
+      if (!requireJobs(context).delete(id, context.client)) {
+        throw new HttpError(404, "No such job");
+      }
+      return { deleted: id };
+    },
+  },
+  {
+    method: "GET",
+    path: "/stats",
+    summary: "Row counts and population progress",
+    params: [],
+    paginated: false,
+    handler: ({ gaia }) => gaia.getStats(),
+  },
+  {
+    method: "GET",
+    path: "/health",
+    summary: "Liveness check",
+    params: [],
+    paginated: false,
+    public: true,
+    handler: () => ({ status: "ok" }),
+  },
+  {
+    method: "GET",
+    path: "/metrics",
+    summary: "Counters in the Prometheus text format",
+    params: [],
+    paginated: false,
+    public: true,
+    contentType: "text/plain; version=0.0.4",
+    handler: () => metrics.render(),
+  },
+  {
+    method: "GET",
+    path: "/openapi.json",
+    summary: "This API's OpenAPI document",
+    params: [],
+    paginated: false,
+    public: true,
+    handler: ({ openapi }) => openapi,
+  },
+];
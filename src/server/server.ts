@@ -0,0 +1,478 @@
+import { Gaia, type GaiaOptions, type ScanBatch } from "../gaia.ts";
+import { createLogger, formatDuration } from "../utils.ts";
+import type { LogLevel } from "../types.ts";
+import { metrics } from "../metrics.ts";
+import { QueryCache } from "../cache.ts";
+import { type ApiKey, type RateLimits, RateLimiter } from "./limits.ts";
+import { JobQueue } from "./jobs.ts";
+import { buildOpenApi } from "./openapi.ts";
+import {
+  DEFAULT_PAGE_SIZE,
+  decodeCursor,
+  paginate,
+  paginateAfter,
+  queryFingerprint,
+} from "./pagination.ts";
+import {
+  HttpError,
+  matchPath,
+  paginationParams,
+  parseParams,
+  type Route,
+  routes,
+} from "./routes.ts";
+import { ndjsonResponse, webSocketResponse } from "./stream.ts";
+
+const API_VERSION = "1.0.0";
+
+export interface ServerOptions {
+  port: number;
+  hostname: string;
+  /** Catalogue options; requests may override the query options */
+  gaia: GaiaOptions;
+  /** When given, every non-public endpoint requires one of these keys */
+  apiKeys?: ApiKey[];
+  /** Default per-client limits; 0 disables a limit */
+  rateLimits: RateLimits;
+  /** Allowed CORS origins, `*` for any. Empty disables CORS. */
+  corsOrigins: string[];
+  /** In-memory cache size in results; 0 disables the memory layer */
+  cacheEntries?: number;
+  /** Directory for the on-disk cache layer */
+  cacheDirectory?: string;
+  /**
+   * Bytes the on-disk cache layer may hold, 0 for no limit
+   * @default 1 GiB
+   */
+  cacheDiskBytes?: number;
+  /** Directory for async jobs; jobs are disabled without one */
+  jobsDirectory?: string;
+  /**
+   * Jobs run at once
+   * @default 2
+   */
+  jobWorkers?: number;
+  /**
+   * Days to keep finished jobs and their results
+   * @default 7
+   */
+  jobRetentionDays?: number;
+  /**
+   * Largest request body in bytes, refused with 413; 0 disables the limit.
+   * The default fits a job of MAX_JOB_INPUT rows.
+   * @default 128 MiB
+   */
+  maxBodyBytes?: number;
+  logLevel: LogLevel;
+}
+
+export const DEFAULT_MAX_BODY_BYTES = 128 * 1024 * 1024;
+
+interface Client {
+  id: string;
+  name: string;
+  limits: Partial<RateLimits>;
+}
+
+/**
+ * Build the request handler for the catalogue API. Kept separate from
+ * `serve` so it can be mounted behind another server.
+ */
+export function createHandler(
+  gaia: Gaia,
+  options: Omit<ServerOptions, "port" | "hostname" | "gaia"> & {
+    /** Queue for the `/jobs` endpoints */
+    jobs?: JobQueue;
+  },
+): (request: Request, remoteAddress: string) => Promise<Response> {
+  const logger = createLogger(options.logLevel, "Server");
+  const limiter = new RateLimiter(options.rateLimits);
+  const requests = metrics.counter(
+    "gaiaoffline_http_requests_total",
+    "HTTP requests by endpoint and status",
+  );
+  const rowsServed = metrics.counter(
+    "gaiaoffline_http_rows_total",
+    "Rows returned by endpoint",
+  );
+  const keys = new Map(options.apiKeys?.map((key) => [key.key, key]));
+  const openapi = buildOpenApi(routes, {
+    version: API_VERSION,
+    apiKeys: options.apiKeys !== undefined,
+  });
+
+  const corsHeaders = (request: Request): Record<string, string> => {
+    const origin = request.headers.get("Origin");
+    if (!origin || options.corsOrigins.length === 0) {
+      return {};
+    }
+
+    const allowAll = options.corsOrigins.includes("*");
+    if (!allowAll && !options.corsOrigins.includes(origin)) {
+      return {};
+    }
+
+    return {
+      "Access-Control-Allow-Origin": allowAll ? "*" : origin,
+      "Access-Control-Expose-Headers": "Retry-After, X-RateLimit-Remaining",
+      ...(allowAll ? {} : { "Vary": "Origin" }),
+    };
+  };
+
+  const identify = (request: Request, remoteAddress: string): Client => {
+    if (!options.apiKeys) {
+      return { id: `ip:${remoteAddress}`, name: remoteAddress, limits: {} };
+    }
+
+    const authorization = request.headers.get("Authorization");
+    const presented = request.headers.get("X-API-Key") ??
+      (authorization?.startsWith("Bearer ")
+        ? authorization.slice("Bearer ".length)
+        : null) ??
+      // For links and the HTML form, which can't set headers
+      new URL(request.url).searchParams.get("api_key");
+
+    const key = presented ? keys.get(presented) : undefined;
+    if (!key) {
+      throw new HttpError(401, "Missing or unknown API key");
+    }
+
+    return {
+      id: `key:${key.name}`,
+      name: key.name,
+      limits: {
+        requestsPerMinute: key.requestsPerMinute,
+        rowsPerMinute: key.rowsPerMinute,
+      },
+    };
+  };
+
+  const json = (
+    status: number,
+    body: unknown,
+    headers: Record<string, string> = {},
+  ) =>
+    new Response(JSON.stringify(body), {
+      status,
+      headers: { "Content-Type": "application/json", ...headers },
+    });
+
+  const maxBody = options.maxBodyBytes ?? DEFAULT_MAX_BODY_BYTES;
+  const tooLarge = () =>
+    new HttpError(413, `Request body is larger than ${maxBody} bytes`);
+
+  /**
+   * The body as text, refused once it passes the size limit rather than
+   * after it has all been buffered
+   */
+  const readText = async (request: Request): Promise<string> => {
+    if (!maxBody || !request.body) {
+      return await request.text();
+    }
+    if (Number(request.headers.get("Content-Length")) > maxBody) {
+      await request.body.cancel();
+      throw tooLarge();
+    }
+
+    const chunks: Uint8Array[] = [];
+    let size = 0;
+    for await (const chunk of request.body) {
+      size += chunk.length;
+      if (size > maxBody) {
+        throw tooLarge();
+      }
+      chunks.push(chunk);
+    }
+    const bytes = new Uint8Array(size);
+    let offset = 0;
+    for (const chunk of chunks) {
+      bytes.set(chunk, offset);
+      offset += chunk.length;
+    }
+    return new TextDecoder().decode(bytes);
+  };
+
+  /**
+   * A POST body: uploads the route accepts as text, anything else as JSON
+   */
+  const readBody = async (
+    route: Route,
+    request: Request,
+  ): Promise<unknown> => {
+    const text = await readText(request);
+    if (text === "") {
+      return undefined;
+    }
+
+    const type = request.headers.get("Content-Type");
+    if (route.upload && type?.startsWith(route.upload)) {
+      return text;
+    }
+
+    try {
+      return JSON.parse(text);
+    } catch {
+      throw new HttpError(400, "Body must be valid JSON");
+    }
+  };
+
+  const run = async (
+    route: Route,
+    request: Request,
+    url: URL,
+    pathParams: Record<string, string>,
+    client: string,
+  ): Promise<{ body: unknown; rows: number }> => {
+    const specs = route.paginated
+      ? [...route.params, ...paginationParams]
+      : route.params;
+    const params = parseParams(specs, url.searchParams, pathParams);
+    const body = route.method === "POST"
+      ? await readBody(route, request)
+      : undefined;
+    const context = {
+      gaia,
+      params,
+      body,
+      rowsNeeded: 0,
+      openapi,
+      client,
+      apiKeys: options.apiKeys !== undefined,
+      jobs: options.jobs ?? null,
+    };
+
+    if (!route.paginated) {
+      return { body: await route.handler(context), rows: 0 };
+    }
+
+    const { cursor, page_size, ...query } = params;
+    const fingerprint = queryFingerprint({ path: route.path, query, body });
+    let offset = 0;
+    let after: string | undefined;
+    if (cursor !== undefined) {
+      try {
+        ({ offset = 0, after } = decodeCursor(String(cursor), fingerprint));
+      } catch (error) {
+        throw new HttpError(400, (error as Error).message);
+      }
+      if ((after !== undefined) !== (route.keyset !== undefined)) {
+        throw new HttpError(400, "Malformed cursor");
+      }
+    }
+
+    const pageSize = Number(page_size ?? DEFAULT_PAGE_SIZE);
+    const rows = route.handler({
+      ...context,
+      rowsNeeded: offset + pageSize + 1,
+      after,
+    }) as Record<string, unknown>[];
+
+    const page = route.keyset
+      ? paginateAfter(rows, route.keyset, pageSize, fingerprint)
+      : paginate(rows, offset, pageSize, fingerprint);
+    return { body: page, rows: page.count };
+  };
+
+  return async (request, remoteAddress) => {
+    const start = Date.now();
+    const url = new URL(request.url);
+    const cors = corsHeaders(request);
+    let status = 500;
+    let rows = 0;
+    let clientName = remoteAddress;
+    let endpoint = "unknown";
+
+    try {
+      if (request.method === "OPTIONS") {
+        status = 204;
+        return new Response(null, {
+          status,
+          headers: {
+            ...cors,
+            "Access-Control-Allow-Methods": "GET, POST, DELETE, OPTIONS",
+            "Access-Control-Allow-Headers":
+              "Content-Type, Authorization, X-API-Key",
+            "Access-Control-Max-Age": "86400",
+          },
+        });
+      }
+
+      const matches = routes
+        .map((r) => ({ route: r, pathParams: matchPath(r, url.pathname) }))
+        .filter((match) => match.pathParams !== null);
+      if (matches.length === 0) {
+        throw new HttpError(404, `No such endpoint: ${url.pathname}`);
+      }
+
+      const match = matches.find((m) => m.route.method === request.method);
+      if (!match) {
+        throw new HttpError(
+          405,
+          `${url.pathname} only accepts ${
+            matches.map((m) => m.route.method).join(", ")
+          }`,
+        );
+      }
+      const route = match.route;
+      endpoint = route.path;
+
+      const headers: Record<string, string> = { ...cors };
+
+      let client: Client | null = null;
+      if (!route.public) {
+        client = identify(request, remoteAddress);
+        clientName = client.name;
+
+        const wait = limiter.admit(client.id, client.limits);
+        if (wait > 0) {
+          status = 429;
+          return json(status, { error: "Rate limit exceeded" }, {
+            ...headers,
+            "Retry-After": String(wait),
+          });
+        }
+      }
+
+      if (route.streaming) {
+        const batches = route.handler({
+          gaia,
+          params: parseParams(route.params, url.searchParams),
+          body: undefined,
+          rowsNeeded: 0,
+          openapi,
+          client: client?.id ?? `ip:${remoteAddress}`,
+          apiKeys: options.apiKeys !== undefined,
+          jobs: options.jobs ?? null,
+        }) as Generator<ScanBatch>;
+
+        const streamOptions = {
+          headers,
+          logger,
+          onRows: (count: number) => {
+            rowsServed.inc({ path: endpoint }, count);
+            if (client) limiter.chargeRows(client.id, count);
+          },
+          onEnd: (outcome: string, count: number) => {
+            const duration = formatDuration(Date.now() - start);
+            logger.info(
+              `${request.method} ${url.pathname} stream ${outcome} ` +
+                `${count} rows ${duration} ${clientName}`,
+            );
+          },
+        };
+
+        const upgrade = request.headers.get("Upgrade")?.toLowerCase();
+        status = upgrade === "websocket" ? 101 : 200;
+        return upgrade === "websocket"
+          ? webSocketResponse(request, batches, streamOptions)
+          : ndjsonResponse(batches, streamOptions);
+      }
+
+      const result = await run(
+        route,
+        request,
+        url,
+        match.pathParams!,
+        client?.id ?? `ip:${remoteAddress}`,
+      );
+      rows = result.rows;
+
+      if (client) {
+        limiter.chargeRows(client.id, rows);
+        const remaining = limiter.remaining(client.id);
+        if (isFinite(remaining)) {
+          headers["X-RateLimit-Remaining"] = String(remaining);
+        }
+      }
+
+      if (route.raw) {
+        const response = result.body as Response;
+        for (const [name, value] of Object.entries(headers)) {
+          response.headers.set(name, value);
+        }
+        status = response.status;
+        return response;
+      }
+
+      status = route.successStatus ?? 200;
+      if (route.contentType) {
+        return new Response(String(result.body), {
+          status,
+          headers: { ...headers, "Content-Type": route.contentType },
+        });
+      }
+      return json(status, result.body, headers);
+    } catch (error) {
+      if (error instanceof HttpError) {
+        status = error.status;
+        return json(status, { error: error.message }, cors);
+      }
+
+      status = 500;
+      logger.error(`${request.method} ${url.pathname} failed:`, error);
+      return json(status, { error: "Internal server error" }, cors);
+    } finally {
+      requests.inc({ path: endpoint, status: String(status) });
+      if (rows > 0) {
+        rowsServed.inc({ path: endpoint }, rows);
+      }
+
+      const duration = formatDuration(Date.now() - start);
+      if (url.searchParams.has("api_key")) {
+        url.searchParams.set("api_key", "redacted");
+      }
+      logger.info(
+        `${request.method} ${url.pathname}${url.search} ${status} ` +
+          `${rows} rows ${duration} ${clientName}`,
+      );
+    }
+  };
+}
+
+/**
+ * Serve the catalogue API until the returned server is shut down
+ */
+export function serve(options: ServerOptions): Deno.HttpServer<Deno.NetAddr> {
+  const logger = createLogger(options.logLevel, "Server");
+  const cacheEntries = options.cacheEntries ?? 0;
+  const cache = cacheEntries > 0 || options.cacheDirectory
+    ? new QueryCache({
+      maxEntries: cacheEntries,
+      directory: options.cacheDirectory,
+      maxDiskBytes: options.cacheDiskBytes,
+      logLevel: options.logLevel,
+    })
+    : false;
+  const gaia = new Gaia({
+    ...options.gaia,
+    cache,
+    logLevel: options.logLevel,
+  });
+  const jobs = options.jobsDirectory
+    ? new JobQueue(gaia, {
+      directory: options.jobsDirectory,
+      workers: options.jobWorkers,
+      retentionDays: options.jobRetentionDays,
+      logLevel: options.logLevel,
+    })
+    : undefined;
+  jobs?.start();
+  const handler = createHandler(gaia, { ...options, jobs });
+
+  const server = Deno.serve({
+    port: options.port,
+    hostname: options.hostname,
+    onListen: ({ hostname, port }) => {
+      logger.info(`Listening on http://${hostname}:${port}`);
+      if (options.apiKeys) {
+        logger.info(`${options.apiKeys.length} API key(s) loaded`);
+      }
+    },
+  }, (request, info) => handler(request, info.remoteAddr.hostname));
+
+  server.finished.then(async () => {
+    await jobs?.close();
+    gaia.close();
+  });
+  return server;
+}
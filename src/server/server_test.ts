@@ -0,0 +1,287 @@
+import { assertEquals } from "@std/assert";
+import { DEFAULT_CONFIG } from "../config.ts";
+import { GaiaDatabase } from "../database.ts";
+import { Gaia } from "../gaia.ts";
+import { JobQueue } from "./jobs.ts";
+import type { RateLimits } from "./limits.ts";
+import { createHandler } from "./server.ts";
+
+type Handler = ReturnType<typeof createHandler>;
+
+interface Options {
+  apiKeys?: { name: string; key: string; requestsPerMinute?: number }[];
+  rateLimits?: RateLimits;
+  corsOrigins?: string[];
+  jobs?: boolean;
+}
+
+/**
+ * A handler over a database of 25 stars within 0.1° of (45, 6), inserted
+ * out of source_id order
+ */
+function withHandler(
+  options: Options,
+  test: (handler: Handler) => Promise<void>,
+) {
+  return async () => {
+    const dir = Deno.makeTempDirSync();
+    const config = {
+      ...DEFAULT_CONFIG,
+      logLevel: "ERROR" as const,
+      databasePath: `${dir}/gaia.db`,
+    };
+    const db = new GaiaDatabase(config);
+    db.initialize();
+    const insert = db.prepare(
+      "INSERT INTO gaiadr3 (source_id, ra, dec, phot_g_mean_flux) VALUES (?, ?, ?, 1e5)",
+    );
+    for (let i = 0; i < 25; i++) {
+      const n = (i * 7) % 25;
+      insert.run(String(1000 + n), 45 + n * 0.002, 6 + n * 0.002);
+    }
+
+    const gaia = new Gaia(
+      { databasePath: config.databasePath, logLevel: "ERROR" },
+      db,
+    );
+    const jobs = options.jobs
+      ? new JobQueue(gaia, { directory: `${dir}/jobs`, logLevel: "ERROR" })
+      : undefined;
+    const handler = createHandler(gaia, {
+      apiKeys: options.apiKeys,
+      rateLimits: options.rateLimits ??
+        { requestsPerMinute: 0, rowsPerMinute: 0 },
+      corsOrigins: options.corsOrigins ?? [],
+      logLevel: "ERROR",
+      jobs,
+    });
+    try {
+      await test(handler);
+    } finally {
+      await jobs?.close();
+      gaia.close();
+      db.close();
+      Deno.removeSync(dir, { recursive: true });
+    }
+  };
+}
+
+function get(
+  handler: Handler,
+  path: string,
+  init: RequestInit = {},
+  address = "127.0.0.1",
+) {
+  return handler(new Request(`http://localhost${path}`, init), address);
+}
+
+Deno.test(
+  "cone pages follow source_id without gaps or repeats",
+  withHandler({}, async (handler) => {
+    const query = "/cone?ra=45&dec=6&radius=0.1&page_size=10";
+    const ids: string[] = [];
+    const counts: number[] = [];
+    let cursor: string | null = null;
+    do {
+      const response: Response = await get(
+        handler,
+        cursor ? `${query}&cursor=${cursor}` : query,
+      );
+      assertEquals(response.status, 200);
+      const page = await response.json();
+      ids.push(...page.data.map((row: { source_id: string }) => row.source_id));
+      counts.push(page.count);
+      cursor = page.next_cursor;
+    } while (cursor);
+
+    assertEquals(counts, [10, 10, 5]);
+    assertEquals(ids, Array.from({ length: 25 }, (_, i) => String(1000 + i)));
+  }),
+);
+
+Deno.test(
+  "cursors are refused on another query",
+  withHandler({}, async (handler) => {
+    const first = await (await get(
+      handler,
+      "/cone?ra=45&dec=6&radius=0.1&page_size=5",
+    )).json();
+
+    const other = await get(
+      handler,
+      `/cone?ra=45&dec=6&radius=0.2&page_size=5&cursor=${first.next_cursor}`,
+    );
+    assertEquals(other.status, 400);
+    assertEquals(
+      (await other.json()).error,
+      "Cursor does not belong to this query",
+    );
+
+    const garbage = await get(handler, "/cone?ra=45&dec=6&radius=0.1&cursor=x");
+    assertEquals(garbage.status, 400);
+  }),
+);
+
+Deno.test(
+  "the job list is paginated",
+  withHandler({ jobs: true }, async (handler) => {
+    for (let i = 0; i < 3; i++) {
+      const response = await get(
+        handler,
+        "/jobs?operation=cone&ra=45&dec=6&radius=0.1",
+        { method: "POST" },
+      );
+      assertEquals(response.status, 202);
+    }
+
+    const first = await (await get(handler, "/jobs?page_size=2")).json();
+    assertEquals(first.count, 2);
+    const second = await (await get(
+      handler,
+      `/jobs?page_size=2&cursor=${first.next_cursor}`,
+    )).json();
+    assertEquals(second.count, 1);
+    assertEquals(second.next_cursor, null);
+
+    const ids = [...first.data, ...second.data].map((job) => job.id);
+    assertEquals(new Set(ids).size, 3);
+
+    // Another client sees none of them
+    const other = await (await get(handler, "/jobs", {}, "10.0.0.2")).json();
+    assertEquals(other.count, 0);
+  }),
+);
+
+Deno.test(
+  "API keys are required except on public routes",
+  withHandler(
+    { apiKeys: [{ name: "alice", key: "secret" }] },
+    async (handler) => {
+      const cone = "/cone?ra=45&dec=6&radius=0.1";
+      assertEquals((await get(handler, cone)).status, 401);
+      assertEquals(
+        (await get(handler, cone, { headers: { "X-API-Key": "wrong" } }))
+          .status,
+        401,
+      );
+      for (
+        const [path, init] of [
+          [cone, { headers: { "X-API-Key": "secret" } }],
+          [cone, { headers: { Authorization: "Bearer secret" } }],
+          [`${cone}&api_key=secret`, {}],
+        ] as const
+      ) {
+        const response = await get(handler, path, init);
+        assertEquals(response.status, 200, path);
+        await response.body?.cancel();
+      }
+      for (const path of ["/health", "/openapi.json"]) {
+        const response = await get(handler, path);
+        assertEquals(response.status, 200, path);
+        await response.body?.cancel();
+      }
+    },
+  ),
+);
+
+Deno.test(
+  "clients over their limit get 429 with Retry-After",
+  withHandler(
+    {
+      apiKeys: [
+        { name: "alice", key: "a" },
+        { name: "pipeline", key: "p", requestsPerMinute: 0 },
+      ],
+      rateLimits: { requestsPerMinute: 2, rowsPerMinute: 0 },
+    },
+    async (handler) => {
+      const as = (key: string) => ({ headers: { "X-API-Key": key } });
+      const first = await get(handler, "/stats", as("a"));
+      assertEquals(first.headers.get("X-RateLimit-Remaining"), "1");
+      await first.body?.cancel();
+      await (await get(handler, "/stats", as("a"))).body?.cancel();
+
+      const refused = await get(handler, "/stats", as("a"));
+      assertEquals(refused.status, 429);
+      assertEquals(refused.headers.get("Retry-After"), "30");
+      await refused.body?.cancel();
+
+      // The key's own limit overrides the default
+      for (let i = 0; i < 5; i++) {
+        const response = await get(handler, "/stats", as("p"));
+        assertEquals(response.status, 200);
+        await response.body?.cancel();
+      }
+    },
+  ),
+);
+
+Deno.test(
+  "rows returned count against the row limit",
+  withHandler(
+    { rateLimits: { requestsPerMinute: 0, rowsPerMinute: 20 } },
+    async (handler) => {
+      const cone = "/cone?ra=45&dec=6&radius=0.1";
+      const page = await (await get(handler, cone)).json();
+      assertEquals(page.count, 25);
+      assertEquals((await get(handler, cone)).status, 429);
+      // Other addresses have their own buckets
+      const other = await get(handler, "/stats", {}, "10.0.0.2");
+      assertEquals(other.status, 200);
+      await other.body?.cancel();
+    },
+  ),
+);
+
+Deno.test(
+  "CORS headers go only to allowed origins",
+  withHandler(
+    { corsOrigins: ["https://a.example"] },
+    async (handler) => {
+      const from = (origin: string, method = "GET") =>
+        get(handler, "/health", { method, headers: { Origin: origin } });
+
+      const allowed = await from("https://a.example");
+      assertEquals(
+        allowed.headers.get("Access-Control-Allow-Origin"),
+        "https://a.example",
+      );
+      assertEquals(allowed.headers.get("Vary"), "Origin");
+      await allowed.body?.cancel();
+
+      const refused = await from("https://b.example");
+      assertEquals(refused.headers.get("Access-Control-Allow-Origin"), null);
+      await refused.body?.cancel();
+
+      const preflight = await from("https://a.example", "OPTIONS");
+      assertEquals(preflight.status, 204);
+      assertEquals(
+        preflight.headers.get("Access-Control-Allow-Methods"),
+        "GET, POST, DELETE, OPTIONS",
+      );
+
+      // Errors carry the headers too, so the browser can read them
+      const missing = await get(handler, "/nowhere", {
+        headers: { Origin: "https://a.example" },
+      });
+      assertEquals(missing.status, 404);
+      assertEquals(
+        missing.headers.get("Access-Control-Allow-Origin"),
+        "https://a.example",
+      );
+      await missing.body?.cancel();
+    },
+  ),
+);
+
+Deno.test(
+  "a wildcard origin allows any site",
+  withHandler({ corsOrigins: ["*"] }, async (handler) => {
+    const response = await get(handler, "/health", {
+      headers: { Origin: "https://anywhere.example" },
+    });
+    assertEquals(response.headers.get("Access-Control-Allow-Origin"), "*");
+    assertEquals(response.headers.get("Vary"), null);
+    await response.body?.cancel();
+  }),
+);
@@ -0,0 +1,165 @@
+/**
+ * Streaming responses for long-running region queries.
+ *
+ * Results go out as they are scanned, as newline-delimited JSON over a
+ * chunked response or as messages on a WebSocket. Both carry the same
+ * messages:
+ *
+ * - `{ "type": "rows", "data": [...] }`
+ * - `{ "type": "progress", "rows": n, "complete": 0.42 }`
+ * - `{ "type": "done", "rows": n }`
+ * - `{ "type": "cancelled", "rows": n }` (WebSocket only)
+ * - `{ "type": "error", "error": "..." }`
+ *
+ * Closing the connection, or sending `{ "type": "cancel" }` on a WebSocket,
+ * stops the underlying database scan.
+ */
+
+import type { ScanBatch } from "../gaia.ts";
+import type { Logger } from "../types.ts";
+
+/** Pause sending while this many bytes are queued on a WebSocket */
+const MAX_BUFFERED_BYTES = 4 * 1024 * 1024;
+
+export type StreamMessage =
+  | { type: "rows"; data: unknown[] }
+  | { type: "progress"; rows: number; complete: number }
+  | { type: "done"; rows: number }
+  | { type: "cancelled"; rows: number }
+  | { type: "error"; error: string };
+
+export interface StreamOptions {
+  /** Called with the size of each batch sent, for row rate limits */
+  onRows: (rows: number) => void;
+  /** Called once when the stream ends */
+  onEnd: (outcome: "done" | "cancelled" | "failed", rows: number) => void;
+  headers: Record<string, string>;
+  logger: Logger;
+}
+
+function batchMessages({ records, progress }: ScanBatch): StreamMessage[] {
+  const messages: StreamMessage[] = [];
+  if (records.length > 0) {
+    messages.push({ type: "rows", data: records });
+  }
+  messages.push({ type: "progress", ...progress });
+  return messages;
+}
+
+/**
+ * Stream batches as a chunked NDJSON response. Each batch is only scanned
+ * when the client is ready for more.
+ */
+export function ndjsonResponse(
+  batches: Generator<ScanBatch>,
+  options: StreamOptions,
+): Response {
+  const encoder = new TextEncoder();
+  let rows = 0;
+
+  const body = new ReadableStream<Uint8Array>({
+    pull(controller) {
+      const send = (message: StreamMessage) =>
+        controller.enqueue(encoder.encode(JSON.stringify(message) + "\n"));
+
+      try {
+        const next = batches.next();
+        if (next.done) {
+          send({ type: "done", rows });
+          controller.close();
+          options.onEnd("done", rows);
+          return;
+        }
+
+        rows = next.value.progress.rows;
+        options.onRows(next.value.records.length);
+        batchMessages(next.value).forEach(send);
+      } catch (error) {
+        options.logger.error("Stream failed:", error);
+        send({ type: "error", error: "Internal server error" });
+        controller.close();
+        options.onEnd("failed", rows);
+      }
+    },
+    cancel() {
+      batches.return(undefined);
+      options.onEnd("cancelled", rows);
+    },
+  });
+
+  return new Response(body, {
+    headers: { ...options.headers, "Content-Type": "application/x-ndjson" },
+  });
+}
+
+/**
+ * Upgrade the request and stream batches over the WebSocket
+ */
+export function webSocketResponse(
+  request: Request,
+  batches: Generator<ScanBatch>,
+  options: StreamOptions,
+): Response {
+  const { socket, response } = Deno.upgradeWebSocket(request);
+  let cancelled = false;
+  let rows = 0;
+
+  const send = (message: StreamMessage) => {
+    if (socket.readyState === WebSocket.OPEN) {
+      socket.send(JSON.stringify(message));
+    }
+  };
+
+  socket.onmessage = (event) => {
+    try {
+      if (JSON.parse(event.data).type === "cancel") {
+        cancelled = true;
+      }
+    } catch {
+      // Ignore anything that isn't a control message
+    }
+  };
+  socket.onclose = () => {
+    cancelled = true;
+  };
+
+  socket.onopen = async () => {
+    try {
+      while (!cancelled) {
+        const next = batches.next();
+        if (next.done) {
+          send({ type: "done", rows });
+          socket.close(1000);
+          options.onEnd("done", rows);
+          return;
+        }
+
+        rows = next.value.progress.rows;
+        options.onRows(next.value.records.length);
+        batchMessages(next.value).forEach(send);
+
+        // Let cancel messages arrive, and wait for slow clients to catch up
+        do {
+          await new Promise((resolve) => setTimeout(resolve, 0));
+        } while (!cancelled && socket.bufferedAmount > MAX_BUFFERED_BYTES);
+      }
+
+      batches.return(undefined);
+      send({ type: "cancelled", rows });
+      if (socket.readyState === WebSocket.OPEN) {
+        socket.close(1000);
+      }
+      options.onEnd("cancelled", rows);
+    } catch (error) {
+      batches.return(undefined);
+      options.logger.error("Stream failed:", error);
+      send({ type: "error", error: "Internal server error" });
+      if (socket.readyState === WebSocket.OPEN) {
+        socket.close(1011);
+      }
+      options.onEnd("failed", rows);
+    }
+  };
+
+  return response;
+}
@@ -0,0 +1,182 @@
+/**
+ * Declination bands of the 2MASS Point Source Catalog files.
+ *
+ * IRSA splits the PSC into files (psc_aaa.gz, psc_aab.gz, …) that each hold
+ * one band of declination, in name order. A band's start is read from the
+ * first row of its file, fetched with a small ranged request, and it ends
+ * where the next file's band starts. Bands are kept in the `tmass_bands`
+ * table so each file is probed once.
+ *
+ * When the Gaia database covers only part of the sky, only the files whose
+ * bands overlap the crossmatched sources need downloading.
+ */
+
+import type { GaiaDatabase } from "./database.ts";
+import type { HttpClient } from "./http.ts";
+import type { Logger } from "./types.ts";
+
+const PSC_FILE = /psc_[a-z]{3}\.gz$/;
+
+/** Bytes fetched to read a file's first row */
+const PROBE_BYTES = 64 * 1024;
+
+/**
+ * Degrees added around each crossmatched source, for proper motion between
+ * the 2MASS and Gaia epochs
+ */
+const DEC_MARGIN = 0.1;
+
+export interface DecBand {
+  url: string;
+  /** Declination of the first row, degrees */
+  decStart: number;
+  /** Where the next band starts, or 90 for the last */
+  decEnd: number;
+}
+
+/**
+ * The declination of the first row of a gzipped PSC file, read from its
+ * first few kilobytes
+ */
+export async function probeBandStart(
+  client: HttpClient,
+  url: string,
+): Promise<number> {
+  const response = await client.fetch(url, {
+    headers: { Range: `bytes=0-${PROBE_BYTES - 1}` },
+  });
+  if (!response.ok || !response.body) {
+    await response.body?.cancel();
+    throw new Error(`Failed to fetch ${url}: ${response.statusText}`);
+  }
+
+  // The server may ignore the range; only the start is read either way
+  const reader = response.body
+    .pipeThrough(
+      new DecompressionStream("gzip") as unknown as ReadableWritablePair<
+        Uint8Array,
+        Uint8Array
+      >,
+    )
+    .pipeThrough(new TextDecoderStream())
+    .getReader();
+
+  let text = "";
+  try {
+    while (!text.includes("\n")) {
+      const { done, value } = await reader.read();
+      if (done) {
+        break;
+      }
+      text += value;
+    }
+  } finally {
+    reader.cancel().catch(() => {});
+  }
+
+  // ra|decl|…
+  const dec = parseFloat(text.split("\n")[0].split("|")[1]);
+  if (!(dec >= -90 && dec <= 90)) {
+    throw new Error(`No declination in the first row of ${url}`);
+  }
+  return dec;
+}
+
+/**
+ * Bands of the PSC files among `urls`, probing the ones not yet known, or
+ * null if they cannot be worked out (no PSC files, a failed probe, or
+ * files out of declination order)
+ */
+export async function getTmassBands(
+  db: GaiaDatabase,
+  client: HttpClient,
+  urls: string[],
+  logger: Logger,
+): Promise<DecBand[] | null> {
+  const files = urls.filter((url) => PSC_FILE.test(url)).sort();
+  if (files.length === 0) {
+    return null;
+  }
+
+  const starts = db.getTmassBandStarts();
+  const unknown = files.filter((url) => !starts.has(url));
+  if (unknown.length > 0) {
+    logger.info(
+      `🔭 Reading the declination bands of ${unknown.length} 2MASS files…`,
+    );
+  }
+  for (const url of unknown) {
+    try {
+      const dec = await probeBandStart(client, url);
+      db.setTmassBandStart(url, dec);
+      starts.set(url, dec);
+    } catch (error) {
+      logger.warn(
+        `Could not read the band of ${url}, downloading every file: ${
+          error instanceof Error ? error.message : error
+        }`,
+      );
+      return null;
+    }
+  }
+
+  const bands = files.map((url, i) => ({
+    url,
+    decStart: starts.get(url)!,
+    decEnd: i + 1 < files.length ? starts.get(files[i + 1])! : 90,
+  }));
+  if (bands.some((band) => band.decEnd < band.decStart)) {
+    logger.warn(
+      "2MASS files are not in declination order, downloading every file",
+    );
+    return null;
+  }
+  return bands;
+}
+
+/**
+ * Whole-degree declination cells holding crossmatched Gaia sources, or
+ * null when every band is needed: every Gaia file has been populated, or
+ * the cells cannot be trusted because no Gaia files are tracked, the
+ * crossmatch is incomplete or it matched no stored source
+ */
+export function getCoveredDecCells(
+  db: GaiaDatabase,
+  logger: Logger,
+): Set<number> | null {
+  const gaia = db.getTrackingProgress("file_tracking_gaiadr3");
+  if (gaia.total > 0 && gaia.completed === gaia.total) {
+    return null;
+  }
+
+  const skip = (reason: string) => {
+    logger.info(`${reason}, so every 2MASS declination band is downloaded`);
+    return null;
+  };
+  if (gaia.total === 0) {
+    return skip("No Gaia files are tracked");
+  }
+  const xmatch = db.hasTable("file_tracking_tmass_xmatch")
+    ? db.getTrackingProgress("file_tracking_tmass_xmatch")
+    : undefined;
+  if (!xmatch || xmatch.total === 0 || xmatch.completed < xmatch.total) {
+    return skip("The 2MASS crossmatch has not finished");
+  }
+  const cells = db.getMatchedDecCells(DEC_MARGIN);
+  if (cells.size === 0) {
+    return skip("No stored Gaia source has a 2MASS match");
+  }
+  return cells;
+}
+
+/**
+ * Whether a band overlaps any of the cells
+ */
+export function bandOverlaps(band: DecBand, cells: Set<number>): boolean {
+  for (const cell of cells) {
+    if (band.decStart <= cell + 1 && band.decEnd >= cell) {
+      return true;
+    }
+  }
+  return false;
+}
@@ -0,0 +1,121 @@
+import { assertEquals, assertStringIncludes } from "@std/assert";
+import { DEFAULT_CONFIG } from "./config.ts";
+import { GaiaDatabase } from "./database.ts";
+import { bandOverlaps, getCoveredDecCells } from "./tmass.ts";
+import type { Logger } from "./types.ts";
+
+function recordingLogger(): Logger & { infos: string[] } {
+  const infos: string[] = [];
+  return {
+    infos,
+    error: () => {},
+    warn: () => {},
+    info: (...args) => infos.push(args.join(" ")),
+    debug: () => {},
+  };
+}
+
+/**
+ * A database with two of three Gaia files populated, one source at
+ * declination 20.5 and one at -40.05
+ */
+function withPartialDatabase(test: (db: GaiaDatabase) => void) {
+  return () => {
+    const dir = Deno.makeTempDirSync();
+    const db = new GaiaDatabase({
+      ...DEFAULT_CONFIG,
+      logLevel: "ERROR",
+      databasePath: `${dir}/gaia.db`,
+    });
+    try {
+      db.initialize();
+      db.initializeTracking("file_tracking_gaiadr3", ["a", "b", "c"]);
+      db.markFileCompleted("file_tracking_gaiadr3", "a");
+      db.markFileCompleted("file_tracking_gaiadr3", "b");
+      db.prepare(
+        "INSERT INTO gaiadr3 (source_id, ra, dec) VALUES ('1', 10, 20.5), ('2', 200, -40.05)",
+      ).run();
+      test(db);
+    } finally {
+      db.close();
+      Deno.removeSync(dir, { recursive: true });
+    }
+  };
+}
+
+function completeXmatch(db: GaiaDatabase): void {
+  db.initializeTracking("file_tracking_tmass_xmatch", ["x"]);
+  db.markFileCompleted("file_tracking_tmass_xmatch", "x");
+}
+
+Deno.test(
+  "covered cells come from the crossmatched sources, with a margin",
+  withPartialDatabase((db) => {
+    completeXmatch(db);
+    db.prepare(
+      "INSERT INTO tmass_xmatch (gaiadr3_source_id, tmass_source_id) VALUES ('1', 'a'), ('2', 'b')",
+    ).run();
+    const cells = getCoveredDecCells(db, recordingLogger());
+    assertEquals([...cells!].sort((a, b) => a - b), [-41, -40, 20]);
+    assertEquals(
+      bandOverlaps({ url: "u", decStart: 21.5, decEnd: 25 }, cells!),
+      false,
+    );
+    assertEquals(
+      bandOverlaps({ url: "u", decStart: 19, decEnd: 20.2 }, cells!),
+      true,
+    );
+  }),
+);
+
+Deno.test(
+  "every band is needed when nothing stored has a match",
+  withPartialDatabase((db) => {
+    completeXmatch(db);
+    const logger = recordingLogger();
+    assertEquals(getCoveredDecCells(db, logger), null);
+    assertStringIncludes(logger.infos[0], "No stored Gaia source");
+  }),
+);
+
+Deno.test(
+  "every band is needed until the crossmatch has finished",
+  withPartialDatabase((db) => {
+    db.prepare(
+      "INSERT INTO tmass_xmatch (gaiadr3_source_id, tmass_source_id) VALUES ('1', 'a')",
+    ).run();
+    const logger = recordingLogger();
+    // Not run
+    assertEquals(getCoveredDecCells(db, logger), null);
+    // Partly run
+    db.initializeTracking("file_tracking_tmass_xmatch", ["x", "y"]);
+    db.markFileCompleted("file_tracking_tmass_xmatch", "x");
+    assertEquals(getCoveredDecCells(db, logger), null);
+    assertEquals(logger.infos.length, 2);
+    assertStringIncludes(logger.infos[1], "crossmatch has not finished");
+  }),
+);
+
+Deno.test(
+  "every band is needed when no Gaia files are tracked",
+  withPartialDatabase((db) => {
+    completeXmatch(db);
+    db.prepare(
+      "INSERT INTO tmass_xmatch (gaiadr3_source_id, tmass_source_id) VALUES ('1', 'a')",
+    ).run();
+    db.prepare("DELETE FROM file_tracking_gaiadr3").run();
+    const logger = recordingLogger();
+    assertEquals(getCoveredDecCells(db, logger), null);
+    assertStringIncludes(logger.infos[0], "No Gaia files are tracked");
+  }),
+);
+
+Deno.test(
+  "a complete Gaia build needs every band, without a message",
+  withPartialDatabase((db) => {
+    db.markFileCompleted("file_tracking_gaiadr3", "c");
+    const logger = recordingLogger();
+    assertEquals(getCoveredDecCells(db, logger), null);
+    assertEquals(logger.infos, []);
+  }),
+);
@@ -5,7 +5,7 @@
 import { parseGzippedCsvC } from "./ffi/c.ts";
 import type { CLIConfig } from "./config.ts";
 import type { GaiaRecord, TmassXmatchRecord } from "./database.ts";
-import { filterByMagnitude } from "./utils.ts";
+import { filterByMagnitude, parseNumber } from "./utils.ts";
 
 /**
  * Stream and filter CSV from a file path using C parser
@@ -44,7 +44,13 @@ export async function parseTmassXmatchC(
   filePath: string,
 ): Promise<TmassXmatchRecord[]> {
   try {
-    const columns = ["source_id", "original_ext_source_id"];
+    const columns = [
+      "source_id",
+      "original_ext_source_id",
+      "angular_distance",
+      "number_of_neighbours",
+      "number_of_mates",
+    ];
     const records = await parseGzippedCsvC(
       filePath,
       columns,
@@ -55,6 +61,9 @@ export async function parseTmassXmatchC(
     return records.map((r: any) => ({
       gaiadr3_source_id: r.source_id,
       tmass_source_id: r.original_ext_source_id,
+      angular_distance: parseNumber(r.angular_distance),
+      number_of_neighbours: parseNumber(r.number_of_neighbours),
+      number_of_mates: parseNumber(r.number_of_mates),
     }));
   } catch (error) {
     const errorMessage = error instanceof Error ? error.message : String(error);
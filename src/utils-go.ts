@@ -0,0 +1,111 @@
+/**
+ * Go-accelerated ingest and CSV processing utilities
+ */
+
+import {
+  GoBatchReader,
+  type GoIngestSummary,
+  ingestFileGo,
+  ingestXmatchFileGo,
+  isNull,
+} from "./ffi/go.ts";
+import type { CLIConfig } from "./config.ts";
+import type { GaiaRecord } from "./database.ts";
+
+/**
+ * Parse, filter and insert a downloaded Gaia file using the Go ingester.
+ * Rows go straight into the database rather than back through Deno.
+ */
+export async function ingestGaiaFileGo(
+  filePath: string,
+  config: CLIConfig,
+): Promise<GoIngestSummary> {
+  const columns = config.storedColumns;
+
+  try {
+    return await ingestFileGo(config.databasePath, filePath, {
+      columns,
+      // Same rule as GaiaDatabase: derive pm whenever both components are stored
+      derive_pm: columns.includes("pmra") && columns.includes("pmdec") &&
+        !columns.includes("pm"),
+      magnitude_limit: config.magnitudeLimit,
+      zeropoint: config.zeropoints[0],
+      batch_size: config.csvChunkSize,
+    });
+  } catch (error) {
+    const errorMessage = error instanceof Error ? error.message : String(error);
+    throw new Error(`Go ingest failed: ${errorMessage}`);
+  }
+}
+
+/**
+ * Insert a downloaded 2MASS crossmatch file's links using the Go ingester,
+ * with the match distance and neighbour counts
+ */
+export async function ingestTmassXmatchFileGo(
+  filePath: string,
+  config: CLIConfig,
+): Promise<GoIngestSummary> {
+  try {
+    return await ingestXmatchFileGo(
+      config.databasePath,
+      filePath,
+      config.csvChunkSize,
+    );
+  } catch (error) {
+    const errorMessage = error instanceof Error ? error.message : String(error);
+    throw new Error(`Go crossmatch ingest failed: ${errorMessage}`);
+  }
+}
+
+/**
+ * Parse and filter a downloaded Gaia file using the Go batch reader. Go
+ * fills typed column buffers in place and the magnitude filter runs on
+ * them, so records are only built for the rows kept.
+ */
+export async function streamAndFilterCSVGo(
+  filePath: string,
+  config: CLIConfig,
+): Promise<GaiaRecord[]> {
+  const columns = config.storedColumns;
+  const records: GaiaRecord[] = [];
+  const minFlux = 10 ** ((config.zeropoints[0] - config.magnitudeLimit) / 2.5);
+
+  let reader: GoBatchReader | null = null;
+  try {
+    reader = GoBatchReader.open(filePath, columns, config.csvChunkSize);
+
+    for (let batch = await reader.next(); batch; batch = await reader.next()) {
+      const flux = batch.columns.phot_g_mean_flux;
+      const fluxNulls = batch.nulls.phot_g_mean_flux;
+      if (!flux) {
+        continue;
+      }
+
+      for (let row = 0; row < batch.rows; row++) {
+        if (isNull(fluxNulls, row) || !(flux[row] > minFlux)) {
+          continue;
+        }
+
+        const record: Record<string, unknown> = {};
+        for (const column of columns) {
+          const value = batch.columns[column][row];
+          record[column] = isNull(batch.nulls[column], row)
+            ? null
+            // source_id is stored as text
+            : typeof value === "bigint"
+            ? value.toString()
+            : value;
+        }
+        records.push(record as GaiaRecord);
+      }
+    }
+  } catch (error) {
+    const errorMessage = error instanceof Error ? error.message : String(error);
+    throw new Error(`Go CSV parsing failed: ${errorMessage}`);
+  } finally {
+    reader?.close();
+  }
+
+  return records;
+}
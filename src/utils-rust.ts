@@ -5,7 +5,7 @@
 import { parseGzippedCsvRust } from "./ffi/rust.ts";
 import type { CLIConfig } from "./config.ts";
 import type { GaiaRecord, TmassXmatchRecord } from "./database.ts";
-import { filterByMagnitude } from "./utils.ts";
+import { filterByMagnitude, parseNumber } from "./utils.ts";
 
 /**
  * Stream and filter CSV from a file path using Rust parser
@@ -44,7 +44,13 @@ export async function parseTmassXmatchRust(
   filePath: string,
 ): Promise<TmassXmatchRecord[]> {
   try {
-    const columns = ["source_id", "original_ext_source_id"];
+    const columns = [
+      "source_id",
+      "original_ext_source_id",
+      "angular_distance",
+      "number_of_neighbours",
+      "number_of_mates",
+    ];
     const records = await parseGzippedCsvRust(
       filePath,
       columns,
@@ -55,6 +61,9 @@ export async function parseTmassXmatchRust(
     return records.map((r: any) => ({
       gaiadr3_source_id: r.source_id,
       tmass_source_id: r.original_ext_source_id,
+      angular_distance: parseNumber(r.angular_distance),
+      number_of_neighbours: parseNumber(r.number_of_neighbours),
+      number_of_mates: parseNumber(r.number_of_mates),
     }));
   } catch (error) {
     const errorMessage = error instanceof Error ? error.message : String(error);
@@ -8,6 +8,7 @@ import {
 import type { CLIConfig } from "./config.ts";
 import { Logger, LogLevel } from "./types.ts";
 import { parse as parsePSV } from "@std/csv";
+import type { TypedBatch } from "./ffi/wasm.ts";
 
 /**
  * Stream a gzipped CSV from a ReadableStream or file path
@@ -18,7 +19,14 @@ async function* streamGzippedCSV(
   chunkSize: number,
 ): AsyncGenerator<GaiaRecord[]> {
   const columnsToKeepSet = new Set(columnsToKeep);
-  const stringColumns = new Set(["source_id", "solution_id", "designation"]);
+  // The text columns of ffi/go/reader.go
+  const stringColumns = new Set([
+    "source_id",
+    "solution_id",
+    "designation",
+    "phot_variable_flag",
+    "libname_gspphot",
+  ]);
   let fileHandle: Deno.FsFile | null = null;
 
   try {
@@ -69,24 +77,25 @@ async function* streamGzippedCSV(
         const col = headers[i];
         const value = values[i];
 
-        // Fast path: keep strings as-is
-        if (stringColumns.has(col) || value === "") {
+        if (typeof value !== "string") {
           recordObj[col] = value;
-        } else if (typeof value === "string") {
-          // Inline number conversion without function call overhead
-          const lower = value.toLowerCase();
-          if (lower === "null") {
-            recordObj[col] = null;
-          } else if (lower === "false") {
-            recordObj[col] = false;
-          } else if (lower === "true") {
-            recordObj[col] = true;
-          } else {
-            const num = Number(value);
-            recordObj[col] = isNaN(num) ? value : num;
-          }
-        } else {
+          continue;
+        }
+        // Empty and "null" fields are missing in every column, as in the
+        // Go reader and ingester
+        const lower = value.toLowerCase();
+        if (lower === "" || lower === "null") {
+          recordObj[col] = null;
+        } else if (stringColumns.has(col)) {
           recordObj[col] = value;
+        } else if (lower === "false") {
+          recordObj[col] = false;
+        } else if (lower === "true") {
+          recordObj[col] = true;
+        } else {
+          // Inline number conversion without function call overhead
+          const num = Number(value);
+          recordObj[col] = isNaN(num) ? value : num;
         }
       }
 
@@ -114,6 +123,52 @@ async function* streamGzippedCSV(
   }
 }
 
+/**
+ * Stream a gzipped CSV through the WebAssembly reader, yielding typed
+ * batches of the columns to keep
+ */
+async function* streamGzippedCSVWasm(
+  source: string | ReadableStream<Uint8Array>,
+  columnsToKeep: string[],
+  chunkSize: number,
+): AsyncGenerator<TypedBatch> {
+  // Dynamically import the WebAssembly reader only when needed
+  const { WasmCsvReader } = await import("./ffi/wasm.ts");
+  const reader = await WasmCsvReader.create(columnsToKeep, chunkSize);
+
+  try {
+    const readable = typeof source === "string"
+      ? (await Deno.open(source, { read: true })).readable
+      : source;
+
+    for await (const bytes of readable) {
+      yield* reader.write(bytes);
+    }
+    yield* reader.close();
+  } finally {
+    reader.free();
+  }
+}
+
+/**
+ * Rows of a typed batch as records, optionally only those at `rows`
+ */
+export function typedBatchToRecords(
+  batch: TypedBatch,
+  rows?: number[],
+): GaiaRecord[] {
+  const columns = Object.entries(batch.columns);
+  const indices = rows ?? Array.from({ length: batch.rows }, (_, i) => i);
+
+  return indices.map((row) => {
+    const record: Record<string, unknown> = {};
+    for (const [name, values] of columns) {
+      record[name] = batch.nulls[name][row] ? null : values[row];
+    }
+    return record as GaiaRecord;
+  });
+}
+
 /**
  * Stream and filter CSV from a file path or download stream
  */
@@ -123,6 +178,33 @@ export async function streamAndFilterCSV(
 ): Promise<GaiaRecord[]> {
   const allRecords: GaiaRecord[] = [];
 
+  if (config.useWasmParser) {
+    for await (
+      const batch of streamGzippedCSVWasm(
+        source,
+        config.storedColumns,
+        config.csvChunkSize,
+      )
+    ) {
+      // Filter on the typed column before building any records
+      const flux = batch.columns.phot_g_mean_flux as Float64Array | undefined;
+      const nulls = batch.nulls.phot_g_mean_flux;
+      if (!flux) {
+        continue;
+      }
+      const minFlux = 10 **
+        ((config.zeropoints[0] - config.magnitudeLimit) / 2.5);
+      const kept: number[] = [];
+      for (let row = 0; row < batch.rows; row++) {
+        if (!nulls[row] && flux[row] > minFlux) {
+          kept.push(row);
+        }
+      }
+      allRecords.push(...typedBatchToRecords(batch, kept));
+    }
+    return allRecords;
+  }
+
   for await (
     const chunk of streamGzippedCSV(
       source,
@@ -271,6 +353,19 @@ export function formatDuration(ms: number): string {
   return `${seconds}s`;
 }
 
+/**
+ * A numeric CSV field, or null when it is empty or "null"
+ */
+export function parseNumber(value: unknown): number | null {
+  if (
+    value === null || value === undefined || value === "" || value === "null"
+  ) {
+    return null;
+  }
+  const number = Number(value);
+  return Number.isNaN(number) ? null : number;
+}
+
 /**
  * Process a 2MASS crossmatch CSV file
  * Matches Gaia source_id with 2MASS source_id
@@ -323,6 +418,9 @@ export async function processTmassXmatchFile(
           potentialRecords.push({
             gaiadr3_source_id: sourceId,
             tmass_source_id: tmassSourceId,
+            angular_distance: parseNumber(row.angular_distance),
+            number_of_neighbours: parseNumber(row.number_of_neighbours),
+            number_of_mates: parseNumber(row.number_of_mates),
           });
         }
       }
@@ -489,14 +587,22 @@ export async function processTmassFile(
         )
         .all() as { gaiadr3_source_id: string; tmass_source_id: string }[];
 
-      const xmatchMap = new Map(
-        xmatchResults.map((r) => [r.tmass_source_id, r.gaiadr3_source_id]),
-      );
+      // One 2MASS source can be the best neighbour of several Gaia sources
+      const xmatchMap = new Map<string, string[]>();
+      for (const r of xmatchResults) {
+        const gaiaSourceIds = xmatchMap.get(r.tmass_source_id);
+        if (gaiaSourceIds) {
+          gaiaSourceIds.push(r.gaiadr3_source_id);
+        } else {
+          xmatchMap.set(r.tmass_source_id, [r.gaiadr3_source_id]);
+        }
+      }
 
-      // Only keep records that have a crossmatch
+      // Only keep records that have a crossmatch, once per Gaia source
       for (const record of batch) {
-        const gaiaSourceId = xmatchMap.get(record.tmass_source_id);
-        if (gaiaSourceId) {
+        for (
+          const gaiaSourceId of xmatchMap.get(record.tmass_source_id) ?? []
+        ) {
           tmassRecords.push({
             gaiadr3_source_id: gaiaSourceId,
             tmass_source_id: record.tmass_source_id,